@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spreadshirt/f3/server"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// secretFileSuffix marks keys of config files whose value is the path of a file containing the actual value.
+const secretFileSuffix = "-file"
+
+// fileConfig describes config files, its keys match the names of the command line flags.
+type fileConfig struct {
+	FtpAddr              string        `yaml:"ftp-addr" json:"ftp-addr"`
+	FtpPassivePortRange  string        `yaml:"ftp-passive-port-range" json:"ftp-passive-port-range"`
+	FtpPublicIP          string        `yaml:"ftp-public-ip" json:"ftp-public-ip"`
+	WelcomeMessage       string        `yaml:"welcome-message" json:"welcome-message"`
+	ServerName           string        `yaml:"server-name" json:"server-name"`
+	TLSCert              string        `yaml:"tls-cert" json:"tls-cert"`
+	TLSKey               string        `yaml:"tls-key" json:"tls-key"`
+	TLSRequired          bool          `yaml:"tls-required" json:"tls-required"`
+	TLSMinVersion        string        `yaml:"tls-min-version" json:"tls-min-version"`
+	TLSCiphers           []string      `yaml:"tls-ciphers" json:"tls-ciphers"`
+	TLSClientCA          string        `yaml:"tls-client-ca" json:"tls-client-ca"`
+	ShutdownTimeout      time.Duration `yaml:"shutdown-timeout" json:"shutdown-timeout"`
+	Auth                 string        `yaml:"auth" json:"auth"`
+	LDAPURL              string        `yaml:"ldap-url" json:"ldap-url"`
+	LDAPBaseDN           string        `yaml:"ldap-base-dn" json:"ldap-base-dn"`
+	LDAPBindDNTemplate   string        `yaml:"ldap-bind-dn-template" json:"ldap-bind-dn-template"`
+	VaultAddr            string        `yaml:"vault-addr" json:"vault-addr"`
+	VaultToken           string        `yaml:"vault-token" json:"vault-token"`
+	VaultK8sRole         string        `yaml:"vault-k8s-role" json:"vault-k8s-role"`
+	VaultK8sMount        string        `yaml:"vault-k8s-mount" json:"vault-k8s-mount"`
+	VaultK8sTokenPath    string        `yaml:"vault-k8s-token-path" json:"vault-k8s-token-path"`
+	VaultCacheTTL        time.Duration `yaml:"vault-cache-ttl" json:"vault-cache-ttl"`
+	MaxLoginFailures     int           `yaml:"max-login-failures" json:"max-login-failures"`
+	LockoutDuration      time.Duration `yaml:"lockout-duration" json:"lockout-duration"`
+	Verbose              bool          `yaml:"verbose" json:"verbose"`
+	Trace                bool          `yaml:"trace" json:"trace"`
+	OtelEndpoint         string        `yaml:"otel-endpoint" json:"otel-endpoint"`
+	LogFormat            string        `yaml:"log-format" json:"log-format"`
+	MetricsAddr          string        `yaml:"metrics-addr" json:"metrics-addr"`
+	HealthAddr           string        `yaml:"health-addr" json:"health-addr"`
+	CleanupMultipart     bool          `yaml:"cleanup-multipart" json:"cleanup-multipart"`
+	CleanupMultipartAge  time.Duration `yaml:"cleanup-multipart-age" json:"cleanup-multipart-age"`
+	server.FactoryConfig `yaml:",inline"`
+}
+
+// applyConfigFile sets the flags of `flagSet` which were not given on the command line to the values of config file `path`.
+// Config files are either YAML or JSON, which is a subset of YAML.
+// Secrets can be read from other files by appending `-file` to a key, e.g. `s3-credentials-file: /run/secrets/s3`.
+func applyConfigFile(flagSet *pflag.FlagSet, path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read config file %q", path)
+	}
+	values := map[string]interface{}{}
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		return errors.Wrapf(err, "Failed to parse config file %q", path)
+	}
+
+	for key, value := range values {
+		if !strings.HasSuffix(key, secretFileSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(key, secretFileSuffix)
+		if _, ok := values[name]; ok {
+			return fmt.Errorf("Config file %q contains both %q and %q", path, name, key)
+		}
+		secret, err := ioutil.ReadFile(fmt.Sprint(value))
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read %q of config file %q", key, path)
+		}
+		values[name] = strings.TrimSpace(string(secret))
+		delete(values, key)
+	}
+
+	// validate keys and types of values
+	normalized, err := yaml.Marshal(values)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to validate config file %q", path)
+	}
+	if err := yaml.UnmarshalStrict(normalized, &fileConfig{}); err != nil {
+		return errors.Wrapf(err, "Invalid config file %q", path)
+	}
+
+	for key, value := range values {
+		if flagSet.Changed(key) {
+			continue
+		}
+		if err := flagSet.Set(key, flagValue(value)); err != nil {
+			return errors.Wrapf(err, "Invalid value of %q in config file %q", key, path)
+		}
+	}
+	return nil
+}
+
+// flagValue returns `value` formatted as value of a command line flag.
+// Maps are formatted as `key=value` pairs, lists and maps are separated by commas.
+func flagValue(value interface{}) string {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		pairs := make([]string, 0, len(value))
+		for k, v := range value {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", k, v))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	case []interface{}:
+		elements := make([]string, 0, len(value))
+		for _, v := range value {
+			elements = append(elements, fmt.Sprint(v))
+		}
+		return strings.Join(elements, ",")
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestApplyConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-config")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	secretFile := filepath.Join(dir, "s3-credentials")
+	if err := ioutil.WriteFile(secretFile, []byte("access:secret\n"), 0600); err != nil {
+		t.Fatalf("Failed to write secret file: %s", err)
+	}
+	configFile := filepath.Join(dir, "f3.yaml")
+	config := `
+ftp-addr: 0.0.0.0:2121
+features: ls,get
+no-overwrite: true
+s3-bucket: https://some-bucket.somewhere.com
+s3-region: eu-central-1
+s3-credentials-file: ` + secretFile + `
+s3-part-size: 16777216
+max-upload-size: 500M
+otel-endpoint: http://localhost:4318
+s3-content-types:
+  .log: text/plain
+  .yml: application/x-yaml
+`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatalf("Failed to write config file: %s", err)
+	}
+
+	flags := cliFlags{}
+	flagSet := pflag.NewFlagSet("f3", pflag.ContinueOnError)
+	addFlags(flagSet, &flags)
+	if err := flagSet.Parse([]string{"--s3-region=us-east-1"}); err != nil {
+		t.Fatalf("Failed to parse flags: %s", err)
+	}
+	if err := applyConfigFile(flagSet, configFile); err != nil {
+		t.Fatalf("Failed to apply config file: %s", err)
+	}
+
+	if flags.ftpAddr != "0.0.0.0:2121" || flags.features != "ls,get" || !flags.noOverwrite {
+		t.Errorf("FTP settings were not applied: %q, %q, %v", flags.ftpAddr, flags.features, flags.noOverwrite)
+	}
+	if flags.s3Bucket != "https://some-bucket.somewhere.com" {
+		t.Errorf("Expected bucket %q but was %q", "https://some-bucket.somewhere.com", flags.s3Bucket)
+	}
+	if flags.s3Region != "us-east-1" {
+		t.Errorf("Command line flag was overridden by the config file, region is %q", flags.s3Region)
+	}
+	if flags.s3Credentials != "access:secret" {
+		t.Errorf("Credentials were not read from the secret file: %q", flags.s3Credentials)
+	}
+	if flags.s3PartSize != 16777216 {
+		t.Errorf("Expected part size %d but was %d", 16777216, flags.s3PartSize)
+	}
+	if flags.maxUploadSize != 500<<20 {
+		t.Errorf("Expected maximum upload size %d but was %d", 500<<20, flags.maxUploadSize)
+	}
+	if flags.otelEndpoint != "http://localhost:4318" {
+		t.Errorf("Expected OpenTelemetry endpoint %q but was %q", "http://localhost:4318", flags.otelEndpoint)
+	}
+	if len(flags.s3ContentTypes) != 2 || flags.s3ContentTypes[".yml"] != "application/x-yaml" {
+		t.Errorf("Content types were not applied: %v", flags.s3ContentTypes)
+	}
+}
+
+func TestApplyInvalidConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-config")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tCases := []struct {
+		name   string
+		config string
+	}{
+		{"unknown-key", `{"s3-buckets": "https://some-bucket.somewhere.com"}`},
+		{"wrong-type", `{"s3-part-size": "large"}`},
+		{"missing-secret-file", `{"s3-credentials-file": "` + filepath.Join(dir, "missing") + `"}`},
+	}
+	for _, tCase := range tCases {
+		configFile := filepath.Join(dir, tCase.name+".json")
+		if err := ioutil.WriteFile(configFile, []byte(tCase.config), 0600); err != nil {
+			t.Fatalf("Failed to write config file: %s", err)
+		}
+		flagSet := pflag.NewFlagSet("f3", pflag.ContinueOnError)
+		addFlags(flagSet, &cliFlags{})
+		if err := applyConfigFile(flagSet, configFile); err == nil {
+			t.Errorf("Test %s: applying the config file succeeded", tCase.name)
+		}
+	}
+}
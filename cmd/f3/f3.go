@@ -1,80 +1,194 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spreadshirt/f3/meta"
 	"github.com/spreadshirt/f3/server"
 
-	ftp "github.com/goftp/server"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
 )
 
 // AppName is the name of the program.
 const AppName string = "f3"
 
+const (
+	authFile = "file"
+	authLDAP = "ldap"
+	authCert = "cert"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
 type cliFlags struct {
+	configFile          string
 	ftpAddr             string
 	ftpPassivePortRange string
+	ftpPublicIP         string
+	welcomeMessage      string
+	serverName          string
+	tlsCert             string
+	tlsKey              string
+	tlsRequired         bool
+	tlsMinVersion       string
+	tlsCiphers          []string
+	tlsClientCA         string
+	shutdownTimeout     time.Duration
+	idleTimeout         time.Duration
+	listModTimes        bool
+	maxUploadSize       server.ByteSize
+	maxConnections      int
+	statCacheTTL        time.Duration
+	statCacheSize       int
+	allowCIDRs          []string
+	denyCIDRs           []string
+	auth                string
+	ldapURL             string
+	ldapBaseDN          string
+	ldapBindDNTemplate  string
+	vaultAddr           string
+	vaultToken          string
+	vaultK8sRole        string
+	vaultK8sMount       string
+	vaultK8sTokenPath   string
+	vaultCacheTTL       time.Duration
+	maxLoginFailures    int
+	lockoutDuration     time.Duration
 	features            string
 	noOverwrite         bool
+	strictDelete        bool
+	dryRun              bool
+	allowAnonymous      bool
+	anonymousFeatures   string
+	anonymousWrite      bool
+	s3AnonymousPublic   bool
 	s3Credentials       string
+	s3Profile           string
+	s3AssumeRoleARN     string
+	s3ExternalID        string
+	s3UserCredentials   string
+	s3SessionPolicy     string
 	s3Bucket            string
+	s3KeyPrefix         string
+	s3ReadBucket        string
+	s3WriteBucket       string
 	s3Region            string
 	s3Endpoint          string
 	s3pathStyle         bool
+	s3AddressingStyle   string
+	s3Accelerate        bool
+	s3DualStack         bool
+	s3Timeout           time.Duration
+	s3MaxRetries        int
+	s3Proxy             string
+	s3CACert            string
 	disableCloudwatch   bool
+	metrics             string
+	metricsAddr         string
+	healthAddr          string
+	statsdAddr          string
+	statsdPrefix        string
 	verbose             bool
+	trace               bool
+	otelEndpoint        string
+	logFormat           string
+	auditLog            string
+	uploadWebhook       string
 	s3SignatureV2       bool
 	s3DisableSSL        bool
+	s3ContentTypes      map[string]string
+	allowContentTypes   []string
+	s3StorageClass      string
+	s3ObjectLockMode    string
+	s3ObjectLockRetain  string
+	s3ObjectLockHold    string
+	s3SSE               string
+	s3SSEKMSKeyID       string
+	s3ACL               string
+	s3Metadata          map[string]string
+	s3Tags              string
+	s3VerifyMD5         bool
+	compress            bool
+	compressExtensions  []string
+	s3PartSize          int64
+	s3UploadConcurrency int
+	downloadConcurrency int
+	downloadPartSize    server.ByteSize
+	s3LeavePartsOnError bool
+	cleanupMultipart    bool
+	cleanupMultipartAge time.Duration
+	presignThreshold    int64
+	presignTTL          time.Duration
 }
 
 func main() {
 	flags := cliFlags{}
 
 	cmd := &cobra.Command{
-		Use:   fmt.Sprintf("%s /path/to/ftp-credentials.txt", os.Args[0]),
+		Use:   fmt.Sprintf("%s [/path/to/ftp-credentials.txt]", os.Args[0]),
 		Short: "f3 acts like a bridge between FTP and an s3 bucket",
 		Long: `f3 is a bridge between FTP and an s3 bucket.
 It maps FTP commands to s3 equivalents and stores uploaded files as objects in an s3 bucket.
 The feature set of the FTP server can be set very fine grained, e.g. you can only allow 'ls' and 'get' operations.
 Additionally, you can prevent objects from getting overwritten.
+The credentials file can also be a secret of AWS Secrets Manager like secretsmanager://secret-name
+whose JSON keys are the users and whose values are the rest of the lines of credentials files,
+or the field of a secret of HashiCorp Vault like vault://secret/data/f3/users formatted like credentials files.
+Credentials are reloaded on SIGHUP.
 
 See https://github.com/spreadshirt/f3 for details.`,
+		// a credentials file named like a subcommand, e.g. `version`, is given as path, e.g. `./version`
+		Args: cobra.MaximumNArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			if len(args) < 1 {
-				cmd.Usage()
-				return
+			if flags.configFile != "" {
+				if err := applyConfigFile(cmd.Flags(), flags.configFile); err != nil {
+					logrus.WithFields(logrus.Fields{"msg": err}).Fatal(err)
+				}
+			}
+			credentialsFilename := ""
+			if len(args) > 0 {
+				credentialsFilename = args[0]
 			}
-			if args[0] == "version" {
-				fmt.Printf("%s %s built on %s\n", AppName, meta.Version, meta.BuildTime)
+			if credentialsFilename == "" && flags.auth == authFile {
+				cmd.Usage()
 				return
 			}
-			err := run(args[0], flags)
+			err := run(credentialsFilename, flags)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{"msg": err}).Fatal(err)
 			}
 		},
 	}
 
-	cmd.PersistentFlags().StringVar(&flags.ftpAddr, "ftp-addr", "127.0.0.1:21", "Address of the FTP server interface, default: 127.0.0.1:21, overrides $FTP_ADDR")
-	cmd.PersistentFlags().StringVar(&flags.ftpPassivePortRange, "ftp-passive-port-range", "", "Port range to use in FTP passive mode, e.g. 1000-1002 for ports [1000, 1001, 1002], default uses a random port, overrides $FTP_PASSIVE_PORT_RANGE")
-	cmd.PersistentFlags().StringVar(&flags.features, "features", server.DefaultFeatureSet, fmt.Sprintf("Feature set, default is empty. Default: --features=%q, overrides $FTP_FEATURES", server.DefaultFeatureSet))
-	cmd.PersistentFlags().BoolVar(&flags.noOverwrite, "no-overwrite", false, "Prevent files from being overwritten")
-	cmd.PersistentFlags().StringVar(&flags.s3Credentials, "s3-credentials", "", "AccessKey:SecretKey, overrides $S3_CREDENTIALS")
-	cmd.PersistentFlags().StringVar(&flags.s3Bucket, "s3-bucket", "", "URL of the s3 bucket, e.g. https://some-bucket.s3.amazonaws.com, overrides $S3_BUCKET")
-	cmd.PersistentFlags().StringVar(&flags.s3Region, "s3-region", server.DefaultRegion, "Region where the s3 bucket is located in, overrides $S3_REGION")
-	cmd.PersistentFlags().BoolVar(&flags.disableCloudwatch, "disable-cloudwatch", true, "Disable CloudWatch metrics")
-	cmd.PersistentFlags().BoolVarP(&flags.verbose, "verbose", "v", false, "Print what is being done")
-	cmd.PersistentFlags().StringVar(&flags.s3Endpoint, "s3-endpoint", "", "S3 endpoint")
-	cmd.PersistentFlags().BoolVar(&flags.s3SignatureV2, "s3-signatureV2", false, "S3SignatureV2")
-	cmd.PersistentFlags().BoolVar(&flags.s3pathStyle, "s3-pathStyle", false, "S3 PathStyle")
-	cmd.PersistentFlags().BoolVar(&flags.s3DisableSSL, "s3-disableSSL", false, "S3 DisableSSL")
+	addFlags(cmd.PersistentFlags(), &flags)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "version",
+		Short: "Print the version, build time, git commit and Go version of f3",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("%s %s\n", AppName, meta.Current())
+		},
+	})
 
 	err := cmd.Execute()
 	if err != nil {
@@ -82,15 +196,187 @@ See https://github.com/spreadshirt/f3 for details.`,
 	}
 }
 
+// addFlags adds the command line flags to `flagSet` which are parsed into `flags`.
+func addFlags(flagSet *pflag.FlagSet, flags *cliFlags) {
+	flagSet.StringVar(&flags.configFile, "config", "", "Path of a YAML or JSON config file whose keys are the names of these flags, flags given on the command line take precedence")
+	flagSet.StringVar(&flags.ftpAddr, "ftp-addr", "127.0.0.1:21", "Address of the FTP server interface, default: 127.0.0.1:21, overrides $FTP_ADDR")
+	flagSet.StringVar(&flags.ftpPublicIP, "ftp-public-ip", "", "IPv4 address announced to clients in passive mode, e.g. the public address of a NAT gateway or container host, default is the address clients connected to, overrides $FTP_PUBLIC_IP")
+	flagSet.StringVar(&flags.welcomeMessage, "welcome-message", fmt.Sprintf("%s says hello!", AppName), "Message greeting clients when they connect, %h is replaced by the hostname")
+	flagSet.StringVar(&flags.serverName, "server-name", AppName, "Name of the FTP server shown in logs")
+	flagSet.StringVar(&flags.ftpPassivePortRange, "ftp-passive-port-range", "", "Port range to use in FTP passive mode between 1024 and 65535, e.g. 30000-30002 for ports [30000, 30001, 30002], default uses a random port, overrides $FTP_PASSIVE_PORT_RANGE")
+	flagSet.StringVar(&flags.tlsCert, "tls-cert", "", "Path of the PEM encoded TLS certificate, enables explicit FTPS (AUTH TLS), overrides $TLS_CERT")
+	flagSet.StringVar(&flags.tlsKey, "tls-key", "", "Path of the PEM encoded private key of the TLS certificate, overrides $TLS_KEY")
+	flagSet.BoolVar(&flags.tlsRequired, "tls-required", false, "Refuse logins before the connection was upgraded with AUTH TLS")
+	flagSet.StringVar(&flags.tlsMinVersion, "tls-min-version", "1.2", "Minimum TLS version of control and data connections, either 1.2 or 1.3")
+	flagSet.StringSliceVar(&flags.tlsCiphers, "tls-ciphers", nil, "Cipher suites of TLS 1.2 connections, can be repeated, e.g. --tls-ciphers=TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, default are the secure suites of Go")
+	flagSet.StringVar(&flags.tlsClientCA, "tls-client-ca", "", "Path of PEM encoded CA certificates, clients must present a certificate signed by them on control and data connections, overrides $TLS_CLIENT_CA")
+	flagSet.DurationVar(&flags.shutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for active transfers to finish after receiving SIGINT or SIGTERM")
+	flagSet.Var(&flags.maxUploadSize, "max-upload-size", "Maximum size of a single upload in bytes or with a unit like K, M or G, e.g. 500M, unlimited if 0")
+	flagSet.DurationVar(&flags.statCacheTTL, "stat-cache-ttl", 0, "Time the metadata of files is cached, e.g. 10s to reduce s3 requests of clients browsing directories, modifications by other s3 clients are visible after this time, disabled if 0")
+	flagSet.IntVar(&flags.statCacheSize, "stat-cache-size", server.DefaultStatCacheSize, "Maximum number of files whose metadata is cached with --stat-cache-ttl")
+	flagSet.StringSliceVar(&flags.allowCIDRs, "allow-cidr", nil, "Networks clients may connect from, can be repeated, e.g. --allow-cidr=10.0.0.0/8, connections of other clients are closed immediately, all clients if empty")
+	flagSet.StringSliceVar(&flags.denyCIDRs, "deny-cidr", nil, "Networks clients may not connect from, can be repeated, takes precedence over --allow-cidr")
+	flagSet.BoolVar(&flags.listModTimes, "list-mtime", false, "Report the modification times set by clients (x-amz-meta-mtime) in listings, costs a HEAD request per listed file")
+	flagSet.DurationVar(&flags.idleTimeout, "idle-timeout", 0, "Close connections without any file operation and abort uploads without data for this duration, e.g. 10m, disabled if 0")
+	flagSet.IntVar(&flags.maxConnections, "max-connections", 0, "Maximum number of simultaneous connections, further clients get the reply 421 and are disconnected, unlimited if 0")
+	flagSet.StringVar(&flags.auth, "auth", authFile, fmt.Sprintf("Authentication backend, either %q (credentials file), %q or %q (common name of the client certificate of --tls-client-ca is the username, no password)", authFile, authLDAP, authCert))
+	flagSet.StringVar(&flags.ldapURL, "ldap-url", "", "URL of the LDAP server used with --auth=ldap, e.g. ldaps://ldap.example.com, overrides $LDAP_URL")
+	flagSet.StringVar(&flags.ldapBaseDN, "ldap-base-dn", "", "Base DN appended to the bind DN of users, e.g. ou=people,dc=example,dc=com, overrides $LDAP_BASE_DN")
+	flagSet.StringVar(&flags.ldapBindDNTemplate, "ldap-bind-dn-template", "uid=%s", "Bind DN of users where %s is replaced by the username, overrides $LDAP_BIND_DN_TEMPLATE")
+	flagSet.StringVar(&flags.vaultAddr, "vault-addr", "", "URL of HashiCorp Vault to read credentials given as vault://secret/path/field from, overrides $VAULT_ADDR")
+	flagSet.StringVar(&flags.vaultToken, "vault-token", "", "Token to authenticate at Vault, overrides $VAULT_TOKEN")
+	flagSet.StringVar(&flags.vaultK8sRole, "vault-k8s-role", "", "Role to authenticate at Vault with the Kubernetes auth method instead of a token, overrides $VAULT_K8S_ROLE")
+	flagSet.StringVar(&flags.vaultK8sMount, "vault-k8s-mount", server.DefaultVaultKubernetesMount, "Path of the Kubernetes auth method of Vault")
+	flagSet.StringVar(&flags.vaultK8sTokenPath, "vault-k8s-token-path", server.DefaultVaultKubernetesTokenFile, "Path of the Kubernetes service account token used to authenticate at Vault")
+	flagSet.DurationVar(&flags.vaultCacheTTL, "vault-cache-ttl", server.DefaultVaultCacheTTL, "Time credentials read from Vault are cached, they are read again before their lease expires")
+	flagSet.IntVar(&flags.maxLoginFailures, "max-login-failures", 0, "Lock accounts after this number of failed logins within --lockout-duration, disabled if 0")
+	flagSet.DurationVar(&flags.lockoutDuration, "lockout-duration", server.DefaultLockoutDuration, "Time accounts are locked after --max-login-failures failed logins")
+	flagSet.StringVar(&flags.features, "features", server.DefaultFeatureSet, fmt.Sprintf("Feature set, default is empty. Default: --features=%q, all and none enable or disable all features, a leading - disables a feature, e.g. all,-rm,-rmdir, overrides $FTP_FEATURES", server.DefaultFeatureSet))
+	flagSet.BoolVar(&flags.noOverwrite, "no-overwrite", false, "Prevent files from being overwritten")
+	flagSet.BoolVar(&flags.strictDelete, "strict-delete", false, "Fail the deletion of missing files instead of reporting success like s3")
+	flagSet.BoolVar(&flags.dryRun, "dry-run", false, "Log the s3 requests of uploads, deletions, renames and new directories instead of sending them and report success to clients, downloads and listings are not affected")
+	flagSet.BoolVar(&flags.allowAnonymous, "allow-anonymous", false, "Allow anonymous logins with the usernames anonymous and ftp")
+	flagSet.StringVar(&flags.anonymousFeatures, "anonymous-features", server.DefaultAnonymousFeatureSet, "Feature set of anonymous users")
+	flagSet.BoolVar(&flags.anonymousWrite, "anonymous-write", false, "Allow modifying features like put or rm for anonymous users")
+	flagSet.BoolVar(&flags.s3AnonymousPublic, "s3-anonymous-public", false, "Send the s3 requests of anonymous users without credentials, e.g. for public buckets")
+	flagSet.StringVar(&flags.s3Credentials, "s3-credentials", "", "AccessKey:SecretKey[:SessionToken] or secretsmanager://secret-name of a JSON secret with the keys access_key, secret_key and session_token or vault://secret/path/field, the default AWS credential chain (environment, shared credentials file, instance role) is used if empty, overrides $S3_CREDENTIALS")
+	flagSet.StringVar(&flags.s3Profile, "s3-profile", "", "Profile in the shared credentials file (~/.aws/credentials) to use instead of --s3-credentials, overrides $S3_PROFILE")
+	flagSet.StringVar(&flags.s3AssumeRoleARN, "s3-assume-role-arn", "", "ARN of a role which is assumed to access the s3 bucket, overrides $S3_ASSUME_ROLE_ARN")
+	flagSet.StringVar(&flags.s3ExternalID, "s3-external-id", "", "External id passed when assuming the role given by --s3-assume-role-arn, overrides $S3_EXTERNAL_ID")
+	flagSet.StringVar(&flags.s3UserCredentials, "s3-user-credentials", "", "Path of a file with own s3 credentials of FTP users, one user:AccessKey:SecretKey[:SessionToken] or user:RoleARN per line, other users use the global credentials, overrides $S3_USER_CREDENTIALS")
+	flagSet.StringVar(&flags.s3SessionPolicy, "s3-session-policy", "", "Path of a JSON session policy template restricting the role of --s3-assume-role-arn per user, {{.Bucket}}, {{.Prefix}} (key prefix of the user's home) and {{.User}} are expanded at login, overrides $S3_SESSION_POLICY")
+	flagSet.StringVar(&flags.s3Bucket, "s3-bucket", "", "URL of the s3 bucket, e.g. https://some-bucket.s3.amazonaws.com, overrides $S3_BUCKET")
+	flagSet.StringVar(&flags.s3KeyPrefix, "s3-prefix", "", "Prefix of all keys, e.g. ftp-uploads/ to share the bucket with other applications, hidden from FTP clients, overrides $S3_PREFIX")
+	flagSet.StringVar(&flags.s3ReadBucket, "s3-read-bucket", "", "Name of the bucket files are listed and downloaded from, e.g. a bucket replicated for distribution, at the endpoint of --s3-bucket, default is --s3-bucket, overrides $S3_READ_BUCKET")
+	flagSet.StringVar(&flags.s3WriteBucket, "s3-write-bucket", "", "Name of the bucket files are uploaded to, renamed and deleted in, at the endpoint of --s3-bucket, default is --s3-bucket, overrides $S3_WRITE_BUCKET")
+	flagSet.StringVar(&flags.s3Region, "s3-region", server.DefaultRegion, "Region where the s3 bucket is located in, detected for AWS endpoints if not set, overrides $S3_REGION")
+	flagSet.BoolVar(&flags.disableCloudwatch, "disable-cloudwatch", true, "Disable CloudWatch metrics")
+	flagSet.StringVar(&flags.metrics, "metrics", "", fmt.Sprintf("Metrics backend, either %q, %q, %q or %q, default depends on --disable-cloudwatch", server.MetricsCloudWatch, server.MetricsPrometheus, server.MetricsStatsd, server.MetricsNone))
+	flagSet.StringVar(&flags.statsdAddr, "statsd-addr", "127.0.0.1:8125", "Address of the StatsD collector used with --metrics=statsd, metrics are dropped if it is unreachable")
+	flagSet.StringVar(&flags.statsdPrefix, "statsd-prefix", AppName, "Prefix of the names of the metrics sent to StatsD")
+	flagSet.StringVar(&flags.metricsAddr, "metrics-addr", "127.0.0.1:2112", "Address of the HTTP server which serves the Prometheus metrics at /metrics")
+	flagSet.StringVar(&flags.healthAddr, "health-addr", "", "Address of the HTTP server which serves the liveness probe at /healthz and the readiness probe at /readyz, may equal --metrics-addr, disabled if empty")
+	flagSet.BoolVarP(&flags.verbose, "verbose", "v", false, "Print what is being done")
+	flagSet.BoolVar(&flags.trace, "trace", false, "Log each operation and s3 request with its duration, request id and bytes, implies --verbose")
+	flagSet.StringVar(&flags.otelEndpoint, "otel-endpoint", "", "URL of the OTLP/HTTP collector the operations and s3 requests are exported to as OpenTelemetry spans instead of logging them with --trace, e.g. --otel-endpoint=http://localhost:4318, disabled if empty, overrides $OTEL_ENDPOINT")
+	flagSet.StringVar(&flags.logFormat, "log-format", logFormatText, fmt.Sprintf("Format of log entries, either %q or %q, e.g. for log pipelines ingesting JSON", logFormatText, logFormatJSON))
+	flagSet.StringVar(&flags.auditLog, "audit-log", "", "File or s3 URL like s3://audit-bucket/f3 the audit events of logins and file operations are written to as JSON lines, regardless of the log level, disabled if empty, overrides $AUDIT_LOG")
+	flagSet.StringVar(&flags.uploadWebhook, "upload-webhook", "", "URL which is notified about each successful upload by POSTing its bucket, key, size, content type, user and time as JSON, disabled if empty, overrides $UPLOAD_WEBHOOK")
+	flagSet.StringVar(&flags.s3Endpoint, "s3-endpoint", "", "S3 endpoint")
+	flagSet.BoolVar(&flags.s3SignatureV2, "s3-signatureV2", false, "S3SignatureV2")
+	flagSet.BoolVar(&flags.s3pathStyle, "s3-pathStyle", false, "Force path-style requests like --s3-addressing-style=path")
+	flagSet.StringVar(&flags.s3AddressingStyle, "s3-addressing-style", server.AddressingStyleAuto, fmt.Sprintf("Addressing style of s3 requests, either %q, %q (https://endpoint/bucket/key) or %q (https://bucket.endpoint/key), %q uses virtual hosted-style requests for AWS endpoints and path-style requests for others, e.g. IP addresses or MinIO", server.AddressingStyleAuto, server.AddressingStylePath, server.AddressingStyleVirtual, server.AddressingStyleAuto))
+	flagSet.BoolVar(&flags.s3Accelerate, "s3-accelerate", false, "Use S3 Transfer Acceleration, incompatible with --s3-pathStyle and --s3-endpoint")
+	flagSet.BoolVar(&flags.s3DualStack, "s3-dualstack", false, "Use the IPv4 and IPv6 dualstack endpoint of the bucket's region")
+	flagSet.DurationVar(&flags.s3Timeout, "s3-timeout", 0, "Timeout of connecting to s3 and waiting for responses, e.g. 30s, transfers of object data are not limited, disabled if 0")
+	flagSet.IntVar(&flags.s3MaxRetries, "s3-max-retries", 0, "Maximum number of retries of failed s3 requests with exponential backoff, default: 3, -1 disables retries")
+	flagSet.StringVar(&flags.s3Proxy, "s3-proxy", "", "URL of the proxy for s3 and other AWS requests, e.g. http://proxy.example.com:3128, default uses $HTTPS_PROXY and $NO_PROXY")
+	flagSet.StringVar(&flags.s3CACert, "s3-ca-cert", "", "Path of PEM encoded CA certificates trusted in addition to the system's ones, e.g. of an s3 endpoint with a self-signed certificate, overrides $S3_CA_CERT")
+	flagSet.BoolVar(&flags.s3DisableSSL, "s3-disableSSL", false, "S3 DisableSSL")
+	flagSet.StringVar(&flags.s3ObjectLockMode, "s3-object-lock-mode", "", "Object lock mode of uploaded objects, either GOVERNANCE or COMPLIANCE, requires --s3-object-lock-retain-until, overrides $S3_OBJECT_LOCK_MODE")
+	flagSet.StringVar(&flags.s3ObjectLockRetain, "s3-object-lock-retain-until", "", "Date like 2030-12-31T00:00:00Z until which uploaded objects are retained, or the period after their upload like 720h, overrides $S3_OBJECT_LOCK_RETAIN_UNTIL")
+	flagSet.StringVar(&flags.s3ObjectLockHold, "s3-object-lock-legal-hold", "", "Legal hold status of uploaded objects, either ON or OFF, overrides $S3_OBJECT_LOCK_LEGAL_HOLD")
+	flagSet.StringVar(&flags.s3StorageClass, "s3-storage-class", "", "Storage class of uploaded objects, e.g. STANDARD_IA, default is the bucket's default storage class, overrides $S3_STORAGE_CLASS")
+	flagSet.StringVar(&flags.s3SSE, "s3-sse", "", "Server-side encryption of uploaded objects, either AES256 or aws:kms, overrides $S3_SSE")
+	flagSet.StringVar(&flags.s3SSEKMSKeyID, "s3-sse-kms-key-id", "", "Id of the KMS key used for aws:kms server-side encryption, overrides $S3_SSE_KMS_KEY_ID")
+	flagSet.StringVar(&flags.s3ACL, "s3-acl", "", "Canned ACL of uploaded objects, e.g. public-read, default is the bucket's default ACL, overrides $S3_ACL")
+	flagSet.Int64Var(&flags.s3PartSize, "s3-part-size", 0, "Size in bytes of the parts of multipart uploads, at least 5MB, default: 5MB")
+	flagSet.IntVar(&flags.s3UploadConcurrency, "s3-upload-concurrency", 0, "Number of parts of an upload which are uploaded in parallel, default: 5")
+	flagSet.IntVar(&flags.downloadConcurrency, "download-concurrency", 0, "Number of parts of a download which are got in parallel, e.g. to speed up downloading large files from high latency endpoints, sequential if 0")
+	flagSet.Var(&flags.downloadPartSize, "download-part-size", "Size of the parts of parallel downloads in bytes or with a unit like K, M or G, each download buffers up to --download-concurrency parts in memory, default: 5M")
+	flagSet.BoolVar(&flags.s3LeavePartsOnError, "s3-leave-parts-on-error", false, "Keep the uploaded parts of failed multipart uploads instead of aborting them")
+	flagSet.BoolVar(&flags.cleanupMultipart, "cleanup-multipart", false, "Abort the multipart uploads of the bucket which are older than --cleanup-multipart-age on startup, e.g. left behind by interrupted uploads")
+	flagSet.DurationVar(&flags.cleanupMultipartAge, "cleanup-multipart-age", 24*time.Hour, "Age of multipart uploads which are aborted by --cleanup-multipart")
+	flagSet.Int64Var(&flags.presignThreshold, "presign-threshold", 0, "Size in bytes from which SITE GETURL <path> returns a presigned s3 URL to download the object directly, disabled if 0")
+	flagSet.DurationVar(&flags.presignTTL, "presign-ttl", server.DefaultPresignTTL, "Time presigned URLs are valid, at most 168h")
+	flagSet.BoolVar(&flags.compress, "compress", false, "Compress uploaded objects with gzip, compressed objects are decompressed when downloading them")
+	flagSet.StringSliceVar(&flags.compressExtensions, "compress-extensions", nil, "Extensions of files to compress, e.g. --compress-extensions=.txt,.csv, all files if empty")
+	flagSet.BoolVar(&flags.s3VerifyMD5, "verify-md5", false, "Send the MD5 digest of uploaded data to s3 to reject corrupted uploads, buffers up to 5MB per upload")
+	flagSet.StringVar(&flags.s3Tags, "s3-tags", "", "URL encoded tags of uploaded objects, e.g. --s3-tags='retention=30d&source=ftp'")
+	flagSet.StringToStringVar(&flags.s3Metadata, "s3-meta", nil, "Metadata of uploaded objects, can be repeated, e.g. --s3-meta=origin=ftp --s3-meta=team=ops")
+	flagSet.StringSliceVar(&flags.allowContentTypes, "allow-content-types", nil, "Content types of files which may be uploaded, detected by extension and content, e.g. --allow-content-types=image/*,application/pdf, all types if empty")
+	flagSet.StringToStringVar(&flags.s3ContentTypes, "s3-content-types", nil, "Content types of uploaded objects by file extension, e.g. --s3-content-types=.log=text/plain,.yml=application/x-yaml")
+}
+
 func run(credentialsFilename string, flags cliFlags) error {
-	if flags.verbose {
+	if flags.verbose || flags.trace {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
-
-	logrus.Debugf("Trying to read credentials file: %q", credentialsFilename)
-	creds, err := server.AuthenticatorFromFile(credentialsFilename)
+	var tracer server.Tracer
+	if otelEndpoint := getEnvOrDefault("OTEL_ENDPOINT", flags.otelEndpoint); otelEndpoint != "" {
+		otelTracer, err := server.NewOTelTracer(otelEndpoint)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := otelTracer.Close(); err != nil {
+				logrus.Errorf("Failed to export the pending spans: %s", err)
+			}
+		}()
+		tracer = otelTracer
+	} else if flags.trace {
+		tracer = server.LogTracer{}
+	}
+	formatter, err := logFormatter(flags.logFormat)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to read credentials file %q", credentialsFilename)
+		return err
+	}
+	logrus.SetFormatter(formatter)
+
+	var vault *server.VaultClient
+	if vaultAddr := getEnvOrDefault("VAULT_ADDR", flags.vaultAddr); vaultAddr != "" {
+		vault, err = server.NewVaultClient(server.VaultConfig{
+			Addr:                vaultAddr,
+			Token:               getEnvOrDefault("VAULT_TOKEN", flags.vaultToken),
+			KubernetesRole:      getEnvOrDefault("VAULT_K8S_ROLE", flags.vaultK8sRole),
+			KubernetesMount:     flags.vaultK8sMount,
+			KubernetesTokenFile: flags.vaultK8sTokenPath,
+			CacheTTL:            flags.vaultCacheTTL,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to setup Vault")
+		}
+	}
+
+	var auth ftp.Auth
+	var users *server.Authenticator
+	switch flags.auth {
+	case authFile:
+		logrus.Debugf("Trying to read credentials file: %q", credentialsFilename)
+		creds, err := loadCredentials(credentialsFilename, getEnvOrDefault("S3_REGION", flags.s3Region), vault)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read credentials file %q", credentialsFilename)
+		}
+		auth, users = creds, &creds
+	case authLDAP:
+		ldapAuth, err := server.NewLDAPAuthenticator(
+			getEnvOrDefault("LDAP_URL", flags.ldapURL),
+			getEnvOrDefault("LDAP_BIND_DN_TEMPLATE", flags.ldapBindDNTemplate),
+			getEnvOrDefault("LDAP_BASE_DN", flags.ldapBaseDN),
+		)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to setup LDAP authentication")
+		}
+		auth = ldapAuth
+	case authCert:
+		if getEnvOrDefault("TLS_CLIENT_CA", flags.tlsClientCA) == "" {
+			return fmt.Errorf("Authentication by client certificates requires the CA certificates of --tls-client-ca")
+		}
+		if flags.maxLoginFailures != 0 || flags.allowAnonymous {
+			return fmt.Errorf("Authentication by client certificates does not support --max-login-failures and --allow-anonymous")
+		}
+		auth = server.NewCertAuthenticator()
+	default:
+		return fmt.Errorf("Unknown authentication backend %q, must be one of: %s, %s, %s", flags.auth, authFile, authLDAP, authCert)
+	}
+	if flags.maxLoginFailures != 0 {
+		auth, err = server.NewLockoutAuthenticator(auth, flags.maxLoginFailures, flags.lockoutDuration)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to setup account lockout")
+		}
+	}
+	if flags.allowAnonymous {
+		auth = server.NewAnonymousAuthenticator(auth)
 	}
 
 	ftpAddr := getEnvOrDefault("FTP_ADDR", flags.ftpAddr)
@@ -100,53 +386,448 @@ func run(credentialsFilename string, flags cliFlags) error {
 	}
 
 	factory, err := server.NewDriverFactory(&server.FactoryConfig{
-		FtpFeatures:       getEnvOrDefault("FTP_FEATURES", flags.features),
-		FtpNoOverwrite:    flags.noOverwrite,
-		S3Credentials:     getEnvOrDefault("S3_CREDENTIALS", flags.s3Credentials),
-		S3BucketURL:       getEnvOrDefault("S3_BUCKET", flags.s3Bucket),
-		S3Region:          getEnvOrDefault("S3_REGION", flags.s3Region),
-		S3Endpoint:        getEnvOrDefault("S3_ENDPOINT", flags.s3Endpoint),
-		S3UsePathStyle:    getEnvOrDefaultBool("S3_PATHSTYLE", flags.s3pathStyle),
-		DisableCloudWatch: flags.disableCloudwatch,
-		S3SignatureV2:     flags.s3SignatureV2,
-		S3DisableSSL:      flags.s3DisableSSL,
+		FtpFeatures:             getEnvOrDefault("FTP_FEATURES", flags.features),
+		FtpUsers:                users,
+		FtpAllowAnonymous:       flags.allowAnonymous,
+		FtpAnonymousFeatures:    flags.anonymousFeatures,
+		FtpAnonymousWrite:       flags.anonymousWrite,
+		S3AnonymousPublic:       flags.s3AnonymousPublic,
+		FtpNoOverwrite:          flags.noOverwrite,
+		FtpStrictDelete:         flags.strictDelete,
+		FtpDryRun:               flags.dryRun,
+		FtpIdleTimeout:          flags.idleTimeout,
+		FtpListModTimes:         flags.listModTimes,
+		FtpMaxUploadSize:        flags.maxUploadSize,
+		FtpMaxConnections:       flags.maxConnections,
+		FtpStatCacheTTL:         flags.statCacheTTL,
+		FtpStatCacheSize:        flags.statCacheSize,
+		FtpAllowCIDRs:           flags.allowCIDRs,
+		FtpDenyCIDRs:            flags.denyCIDRs,
+		S3Credentials:           getEnvOrDefault("S3_CREDENTIALS", flags.s3Credentials),
+		S3Profile:               getEnvOrDefault("S3_PROFILE", flags.s3Profile),
+		S3AssumeRoleARN:         getEnvOrDefault("S3_ASSUME_ROLE_ARN", flags.s3AssumeRoleARN),
+		S3ExternalID:            getEnvOrDefault("S3_EXTERNAL_ID", flags.s3ExternalID),
+		Vault:                   vault,
+		S3UserCredentials:       getEnvOrDefault("S3_USER_CREDENTIALS", flags.s3UserCredentials),
+		S3SessionPolicy:         getEnvOrDefault("S3_SESSION_POLICY", flags.s3SessionPolicy),
+		S3BucketURL:             getEnvOrDefault("S3_BUCKET", flags.s3Bucket),
+		S3KeyPrefix:             getEnvOrDefault("S3_PREFIX", flags.s3KeyPrefix),
+		S3ReadBucket:            getEnvOrDefault("S3_READ_BUCKET", flags.s3ReadBucket),
+		S3WriteBucket:           getEnvOrDefault("S3_WRITE_BUCKET", flags.s3WriteBucket),
+		S3Region:                getEnvOrDefault("S3_REGION", flags.s3Region),
+		S3Endpoint:              getEnvOrDefault("S3_ENDPOINT", flags.s3Endpoint),
+		S3UsePathStyle:          getEnvOrDefaultBool("S3_PATHSTYLE", flags.s3pathStyle),
+		S3AddressingStyle:       flags.s3AddressingStyle,
+		S3Accelerate:            flags.s3Accelerate,
+		S3DualStack:             flags.s3DualStack,
+		S3Timeout:               flags.s3Timeout,
+		S3MaxRetries:            flags.s3MaxRetries,
+		S3Proxy:                 flags.s3Proxy,
+		S3CACert:                getEnvOrDefault("S3_CA_CERT", flags.s3CACert),
+		DisableCloudWatch:       flags.disableCloudwatch,
+		Metrics:                 flags.metrics,
+		StatsdAddr:              flags.statsdAddr,
+		StatsdPrefix:            flags.statsdPrefix,
+		S3SignatureV2:           flags.s3SignatureV2,
+		S3DisableSSL:            flags.s3DisableSSL,
+		S3ContentTypes:          flags.s3ContentTypes,
+		FtpAllowContentTypes:    flags.allowContentTypes,
+		S3StorageClass:          getEnvOrDefault("S3_STORAGE_CLASS", flags.s3StorageClass),
+		S3ObjectLockMode:        getEnvOrDefault("S3_OBJECT_LOCK_MODE", flags.s3ObjectLockMode),
+		S3ObjectLockRetainUntil: getEnvOrDefault("S3_OBJECT_LOCK_RETAIN_UNTIL", flags.s3ObjectLockRetain),
+		S3ObjectLockLegalHold:   getEnvOrDefault("S3_OBJECT_LOCK_LEGAL_HOLD", flags.s3ObjectLockHold),
+		S3SSE:                   getEnvOrDefault("S3_SSE", flags.s3SSE),
+		S3SSEKMSKeyID:           getEnvOrDefault("S3_SSE_KMS_KEY_ID", flags.s3SSEKMSKeyID),
+		S3ACL:                   getEnvOrDefault("S3_ACL", flags.s3ACL),
+		S3Metadata:              flags.s3Metadata,
+		S3Tags:                  flags.s3Tags,
+		S3VerifyMD5:             flags.s3VerifyMD5,
+		S3Compress:              flags.compress,
+		S3CompressExtensions:    flags.compressExtensions,
+		S3PartSize:              flags.s3PartSize,
+		S3UploadConcurrency:     flags.s3UploadConcurrency,
+		S3DownloadConcurrency:   flags.downloadConcurrency,
+		S3DownloadPartSize:      flags.downloadPartSize,
+		S3LeavePartsOnError:     flags.s3LeavePartsOnError,
+		S3PresignThreshold:      flags.presignThreshold,
+		S3PresignTTL:            flags.presignTTL,
+		Tracer:                  tracer,
+		AuditLog:                getEnvOrDefault("AUDIT_LOG", flags.auditLog),
+		UploadWebhook:           getEnvOrDefault("UPLOAD_WEBHOOK", flags.uploadWebhook),
 	})
 	if err != nil {
 		return errors.Wrapf(err, "Failed to instantiate new driver factory")
 	}
+	if err := factory.VerifyCredentials(); err != nil {
+		return err
+	}
+	if flags.cleanupMultipart && flags.dryRun {
+		logrus.Warn("DRY RUN: skipping the cleanup of multipart uploads")
+	} else if flags.cleanupMultipart {
+		aborted, err := factory.AbortMultipartUploads(flags.cleanupMultipartAge)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to clean up multipart uploads")
+		}
+		logrus.Infof("Aborted %d multipart uploads older than %s", aborted, flags.cleanupMultipartAge)
+	}
+	// metrics and health checks share the HTTP server if their addresses are equal
+	handlers := map[string]*http.ServeMux{}
+	handler := func(addr string) *http.ServeMux {
+		if _, ok := handlers[addr]; !ok {
+			handlers[addr] = http.NewServeMux()
+		}
+		return handlers[addr]
+	}
+	if flags.metrics == server.MetricsPrometheus {
+		handler(flags.metricsAddr).Handle("/metrics", promhttp.Handler())
+	}
+	if flags.healthAddr != "" {
+		health := factory.HealthHandler()
+		handler(flags.healthAddr).Handle("/healthz", health)
+		handler(flags.healthAddr).Handle("/readyz", health)
+		handler(flags.healthAddr).Handle("/version", health)
+	}
+	for addr, mux := range handlers {
+		if err := serveHTTP(addr, mux); err != nil {
+			return err
+		}
+	}
 
+	publicIP, err := parsePublicIP(getEnvOrDefault("FTP_PUBLIC_IP", flags.ftpPublicIP))
+	if err != nil {
+		return err
+	}
+	passivePorts, passivePortCount, err := parsePassivePortRange(getEnvOrDefault("FTP_PASSIVE_PORT_RANGE", flags.ftpPassivePortRange))
+	if err != nil {
+		return err
+	}
+	if passivePortCount > 0 {
+		if flags.maxConnections == 0 || flags.maxConnections > passivePortCount {
+			logrus.Warnf("Passive mode has %d ports but the number of connections is not limited to them, see --max-connections, transfers fail if all ports are in use", passivePortCount)
+		} else {
+			logrus.Infof("Passive mode has %d ports for at most %d connections", passivePortCount, flags.maxConnections)
+		}
+	}
+	welcomeMessage, err := expandWelcomeMessage(flags.welcomeMessage, os.Hostname)
+	if err != nil {
+		return err
+	}
 	serverOpts := ftp.ServerOpts{
 		Factory:        factory,
-		Auth:           creds,
-		Name:           AppName,
+		Auth:           factory.Auth(auth),
+		Name:           flags.serverName,
 		Hostname:       ftpHost,
 		Port:           ftpPort,
-		PassivePorts:   getEnvOrDefault("FTP_PASSIVE_PORT_RANGE", flags.ftpPassivePortRange),
-		WelcomeMessage: fmt.Sprintf("%s says hello!", AppName),
-		Logger:         &server.FTPLogger{},
+		PassivePorts:   passivePorts,
+		PublicIp:       publicIP,
+		WelcomeMessage: welcomeMessage,
+		Logger:         factory.Logger(),
+	}
+	err = configureTLS(&serverOpts, getEnvOrDefault("TLS_CERT", flags.tlsCert), getEnvOrDefault("TLS_KEY", flags.tlsKey), flags.tlsRequired)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to configure TLS")
+	}
+	tlsConfig, err := newTLSConfig(flags.tlsMinVersion, flags.tlsCiphers, getEnvOrDefault("TLS_CLIENT_CA", flags.tlsClientCA))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to configure TLS")
+	}
+	if tlsConfig.ClientCAs != nil && !serverOpts.TLS {
+		return fmt.Errorf("Failed to configure TLS: client certificates require the certificate of the server, see --tls-cert")
 	}
 	logrus.Debugf("Server options: %#v\n", serverOpts)
 
 	ftpServer := ftp.NewServer(&serverOpts)
-	logrus.Infof("FTP server starts listening on \"%s:%d\"", ftpHost, ftpPort)
-	return ftpServer.ListenAndServe()
+	logrus.Infof("FTP server starts listening on %q", net.JoinHostPort(ftpHost, strconv.Itoa(ftpPort)))
+	reloadUsers := func() {
+		if users == nil {
+			return
+		}
+		creds, err := loadCredentials(credentialsFilename, getEnvOrDefault("S3_REGION", flags.s3Region), vault)
+		if err != nil {
+			logrus.Errorf("Failed to reload credentials %q, keeping the current ones: %s", credentialsFilename, err)
+			return
+		}
+		users.Reload(creds)
+		logrus.Infof("Reloaded credentials %q", credentialsFilename)
+	}
+	if users != nil && server.IsVaultURI(credentialsFilename) {
+		// the credentials are read from Vault again when they are not cached anymore
+		go func() {
+			for range time.Tick(vault.CacheTTL()) {
+				reloadUsers()
+			}
+		}()
+	}
+	reload := func() {
+		reloadUsers()
+		if err := factory.ReloadCredentials(); err != nil {
+			logrus.Errorf("%s, keeping the current ones", err)
+		}
+	}
+	return serve(ftpServer, tlsConfig, factory, flags.shutdownTimeout, reload)
 }
 
+// loadCredentials reads the FTP credentials from the file, the secret of AWS Secrets Manager or the field of a secret of `vault` `source`,
+// secrets of AWS Secrets Manager given by name are read in `region`.
+func loadCredentials(source, region string, vault *server.VaultClient) (server.Authenticator, error) {
+	if server.IsSecretsManagerURI(source) {
+		return server.AuthenticatorFromSecretsManager(source, region)
+	}
+	if server.IsVaultURI(source) {
+		if vault == nil {
+			return server.Authenticator{}, fmt.Errorf("Credentials %q require the address of Vault, see --vault-addr", source)
+		}
+		return server.AuthenticatorFromVault(vault, source)
+	}
+	return server.AuthenticatorFromFile(source)
+}
+
+// serve runs `ftpServer` on the listener of `factory` with the TLS settings `tlsConfig` until it fails or SIGINT or SIGTERM is received.
+// On a signal, the server stops accepting connections and waits up to `timeout` for active transfers to finish.
+// On SIGHUP, `reload` reloads the credentials.
+func serve(ftpServer *ftp.Server, tlsConfig *tls.Config, factory server.DriverFactory, timeout time.Duration, reload func()) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	defer func() {
+		if err := factory.Close(); err != nil {
+			logrus.Errorf("Failed to close the driver factory: %s", err)
+		}
+	}()
+
+	errs := make(chan error, 1)
+	listener, err := net.Listen("tcp", net.JoinHostPort(ftpServer.Hostname, strconv.Itoa(ftpServer.Port)))
+	if err != nil {
+		return err
+	}
+	go func() {
+		errs <- server.Serve(ftpServer, factory.Listener(listener), tlsConfig)
+	}()
+
+wait:
+	for {
+		select {
+		case err := <-errs:
+			return err
+		case <-hangups:
+			logrus.Info("Received SIGHUP, reloading credentials")
+			reload()
+		case sig := <-signals:
+			logrus.Infof("Received %s, shutting down", sig)
+			break wait
+		}
+	}
+
+	if err := ftpServer.Shutdown(); err != nil {
+		logrus.Errorf("Failed to stop listening: %s", err)
+	}
+	drained, aborted := factory.Drain(timeout)
+	logrus.Infof("Drained %d active transfers, aborting %d transfers", drained, aborted)
+	return nil
+}
+
+// serveHTTP serves `mux` on `addr` in the background, e.g. the Prometheus metrics at /metrics.
+func serveHTTP(addr string, mux *http.ServeMux) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen for HTTP requests on %q", addr)
+	}
+	logrus.Infof("Serving HTTP requests on \"http://%s\"", listener.Addr())
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logrus.Errorf("Failed to serve HTTP requests on %q: %s", addr, err)
+		}
+	}()
+	return nil
+}
+
+// configureTLS enables explicit FTPS (AUTH TLS) with the certificate `certFile` and its private key `keyFile`.
+// Data connections are encrypted if the client requests it with `PROT P`.
+func configureTLS(opts *ftp.ServerOpts, certFile, keyFile string, required bool) error {
+	if certFile == "" && keyFile == "" {
+		if required {
+			return fmt.Errorf("TLS is required but no certificate was given")
+		}
+		return nil
+	}
+	if certFile == "" || keyFile == "" {
+		return fmt.Errorf("TLS requires both a certificate and its private key")
+	}
+	if _, err := tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+		return errors.Wrapf(err, "Failed to load TLS certificate %q with key %q", certFile, keyFile)
+	}
+	if !required {
+		// the FTP server refuses any login before AUTH TLS as soon as TLS is configured
+		logrus.Warn("Logins without TLS are refused because TLS is configured")
+	}
+
+	opts.TLS = true
+	opts.ExplicitFTPS = true
+	opts.CertFile = certFile
+	opts.KeyFile = keyFile
+	return nil
+}
+
+// tlsVersions are the TLS versions which can be required at least, older versions are insecure.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsCipherSuites are the cipher suites of TLS 1.2 which can be configured, suites without forward secrecy or with
+// CBC mode, RC4 or 3DES are insecure. The suites of TLS 1.3 are not configurable.
+var tlsCipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+}
+
+// newTLSConfig returns the TLS settings of control and data connections with the minimum version `minVersion` like `1.2`
+// and the cipher suites `ciphers` like `TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256`, the defaults of Go if empty.
+// Versions before TLS 1.2 and insecure cipher suites are refused.
+// Clients must present a certificate signed by the PEM encoded CA certificates of file `clientCA` if it is not empty.
+func newTLSConfig(minVersion string, ciphers []string, clientCA string) (*tls.Config, error) {
+	version, ok := tlsVersions[strings.TrimPrefix(strings.ToLower(strings.TrimSpace(minVersion)), "tls")]
+	if !ok {
+		return nil, fmt.Errorf("Invalid minimum TLS version %q, must be 1.2 or 1.3, older versions are insecure", minVersion)
+	}
+	config := &tls.Config{MinVersion: version}
+	for _, name := range ciphers {
+		suite, ok := tlsCipherSuites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("Invalid TLS cipher suite %q, must be one of the secure suites %s", name, strings.Join(tlsCipherSuiteNames(), ", "))
+		}
+		config.CipherSuites = append(config.CipherSuites, suite)
+	}
+	if len(config.CipherSuites) > 0 {
+		config.PreferServerCipherSuites = true
+	}
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read client CA certificates")
+		}
+		// only the given CAs are trusted, not the system's ones
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No PEM encoded certificates found in %q", clientCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// tlsCipherSuiteNames returns the sorted names of the cipher suites which can be configured.
+func tlsCipherSuiteNames() []string {
+	names := make([]string, 0, len(tlsCipherSuites))
+	for name := range tlsCipherSuites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// logFormatter returns the logrus formatter of log format `format`.
+// JSON entries contain the fields of log calls, e.g. `key`, `action` and `bytes`, as keys.
+func logFormatter(format string) (logrus.Formatter, error) {
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case logFormatText, "":
+		return &logrus.TextFormatter{}, nil
+	case logFormatJSON:
+		return &logrus.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown log format %q, must be one of: %s, %s", format, logFormatText, logFormatJSON)
+	}
+}
+
+// expandWelcomeMessage replaces the token %h in `message` by the hostname returned by `hostname`.
+// The message is sent as a single FTP reply, thus it must not contain line breaks.
+func expandWelcomeMessage(message string, hostname func() (string, error)) (string, error) {
+	if strings.ContainsAny(message, "\r\n") {
+		return "", fmt.Errorf("Invalid welcome message %q, must not contain line breaks", message)
+	}
+	if !strings.Contains(message, "%h") {
+		return message, nil
+	}
+	host, err := hostname()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get the hostname of the welcome message")
+	}
+	return strings.Replace(message, "%h", host, -1), nil
+}
+
+// parsePublicIP validates the address `value` announced to clients in passive mode, an empty value is kept.
+// PASV replies only support IPv4 addresses, which clients must be able to connect to.
+func parsePublicIP(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	ip := net.ParseIP(value).To4()
+	if ip == nil {
+		return "", fmt.Errorf("Invalid public IP %q, must be an IPv4 address", value)
+	}
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsMulticast() || ip.IsLinkLocalUnicast() || ip.Equal(net.IPv4bcast) {
+		return "", fmt.Errorf("Invalid public IP %q, must be routable", value)
+	}
+	return ip.String(), nil
+}
+
+// parsePassivePortRange validates the port range `value` of passive mode like `30000-30009`, which includes both ports,
+// and returns it in the format of goftp and the number of its ports. An empty value is kept, a random port is used then.
+// goftp never uses the end of its ranges, thus it is increased by one.
+func parsePassivePortRange(value string) (string, int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", 0, nil
+	}
+	bounds := strings.Split(value, "-")
+	if len(bounds) != 2 {
+		return "", 0, fmt.Errorf("Invalid passive port range %q, must be like 30000-30009", value)
+	}
+	var ports [2]int
+	for idx, bound := range bounds {
+		port, err := strconv.Atoi(strings.TrimSpace(bound))
+		if err != nil || port < 1024 || port > 65535 {
+			return "", 0, fmt.Errorf("Invalid passive port range %q, %q must be a port between 1024 and 65535", value, strings.TrimSpace(bound))
+		}
+		ports[idx] = port
+	}
+	if ports[0] > ports[1] {
+		return "", 0, fmt.Errorf("Invalid passive port range %q, the start must not be after the end", value)
+	}
+	return fmt.Sprintf("%d-%d", ports[0], ports[1]+1), ports[1] - ports[0] + 1, nil
+}
+
+// splitFtpAddr splits `addr` into host and port, the port is 21 if none is given.
+// IPv6 addresses with a port are enclosed in brackets, e.g. `[::1]:2121`.
 func splitFtpAddr(addr string) (string, int, error) {
 	addr = strings.TrimSpace(addr)
 	if addr == "" {
 		return "", -1, fmt.Errorf("Empty FTP address")
 	}
-	parts := strings.SplitN(addr, ":", 2)
-	host := parts[0]
-	port := uint64(21)
-	if len(parts) < 2 { // no port given
-		return host, int(port), nil
+	host, portValue, err := net.SplitHostPort(addr)
+	if err != nil { // no port given
+		switch {
+		case strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]"):
+			host = addr[1 : len(addr)-1]
+		case !strings.Contains(addr, ":") || net.ParseIP(strings.SplitN(addr, "%", 2)[0]) != nil: // with an optional IPv6 zone
+			host = addr
+		default:
+			return "", -1, fmt.Errorf("Invalid FTP address %q: %s", addr, err)
+		}
+		return host, 21, nil
 	}
 
-	port, err := strconv.ParseUint(parts[1], 10, 16)
+	port, err := strconv.ParseUint(portValue, 10, 16)
 	if err != nil {
-		return host, -1, fmt.Errorf("Invalid FTP port %q: %s", parts[1], err)
+		return host, -1, fmt.Errorf("Invalid FTP port %q: %s", portValue, err)
 	}
 
 	return host, int(port), nil
@@ -1,10 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/spreadshirt/f3/server"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
 )
 
 func TestGetEnvOrDefault(t *testing.T) {
@@ -51,6 +71,445 @@ func TestGetEnvOrDefault(t *testing.T) {
 	}
 }
 
+func TestSplitFtpAddr(t *testing.T) {
+	tCases := []struct {
+		addr       string
+		host       string
+		port       int
+		shouldFail bool
+	}{
+		{"0.0.0.0:21", "0.0.0.0", 21, false},
+		{"127.0.0.1:2121", "127.0.0.1", 2121, false},
+		{"localhost", "localhost", 21, false},
+		{"ftp.example.com:2121", "ftp.example.com", 2121, false},
+		{":2121", "", 2121, false},
+		{"[::1]:2121", "::1", 2121, false},
+		{"[::]:21", "::", 21, false},
+		{"[::1]", "::1", 21, false},
+		{"::1", "::1", 21, false},
+		{"fe80::1%eth0", "fe80::1%eth0", 21, false},
+		{" localhost:21 ", "localhost", 21, false},
+		{"", "", -1, true},
+		{"localhost:ftp", "", -1, true},
+		{"localhost:65536", "", -1, true},
+		{"[::1]:2121:21", "", -1, true},
+	}
+
+	for _, tCase := range tCases {
+		t.Run(tCase.addr, func(t *testing.T) {
+			host, port, err := splitFtpAddr(tCase.addr)
+			if tCase.shouldFail {
+				if err == nil {
+					t.Fatalf("Expected splitting %q to fail but was %q and %d", tCase.addr, host, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Splitting %q failed: %s", tCase.addr, err)
+			}
+			if host != tCase.host || port != tCase.port {
+				t.Errorf("Expected host %q and port %d but were %q and %d", tCase.host, tCase.port, host, port)
+			}
+		})
+	}
+}
+
+func TestParsePublicIP(t *testing.T) {
+	tCases := []struct {
+		value      string
+		expected   string
+		shouldFail bool
+	}{
+		{"", "", false},
+		{"203.0.113.10", "203.0.113.10", false},
+		{" 10.0.0.1 ", "10.0.0.1", false},
+		{"::ffff:203.0.113.10", "203.0.113.10", false},
+		{"0.0.0.0", "", true},
+		{"127.0.0.1", "", true},
+		{"169.254.1.1", "", true},
+		{"224.0.0.1", "", true},
+		{"255.255.255.255", "", true},
+		{"2001:db8::1", "", true},
+		{"ftp.example.com", "", true},
+	}
+
+	for _, tCase := range tCases {
+		t.Run(tCase.value, func(t *testing.T) {
+			ip, err := parsePublicIP(tCase.value)
+			if tCase.shouldFail {
+				if err == nil {
+					t.Fatalf("Expected %q to be invalid but was %q", tCase.value, ip)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parsing %q failed: %s", tCase.value, err)
+			}
+			if ip != tCase.expected {
+				t.Errorf("Expected %q but was %q", tCase.expected, ip)
+			}
+		})
+	}
+}
+
+func TestParsePassivePortRange(t *testing.T) {
+	tCases := []struct {
+		value      string
+		expected   string
+		count      int
+		shouldFail bool
+	}{
+		{"", "", 0, false},
+		{"30000-30009", "30000-30010", 10, false},
+		{" 30000 - 30000 ", "30000-30001", 1, false},
+		{"1024-65535", "1024-65536", 64512, false},
+		{"1000-500", "", 0, true},
+		{"30009-30000", "", 0, true},
+		{"abc", "", 0, true},
+		{"30000", "", 0, true},
+		{"30000-", "", 0, true},
+		{"1000-1002", "", 0, true},
+		{"65000-65536", "", 0, true},
+		{"30000-30001-30002", "", 0, true},
+	}
+
+	for _, tCase := range tCases {
+		t.Run(tCase.value, func(t *testing.T) {
+			ports, count, err := parsePassivePortRange(tCase.value)
+			if tCase.shouldFail {
+				if err == nil {
+					t.Fatalf("Expected %q to be invalid but was %q", tCase.value, ports)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parsing %q failed: %s", tCase.value, err)
+			}
+			if ports != tCase.expected || count != tCase.count {
+				t.Errorf("Expected %q with %d ports but was %q with %d", tCase.expected, tCase.count, ports, count)
+			}
+		})
+	}
+}
+
+func TestExpandWelcomeMessage(t *testing.T) {
+	hostname := func() (string, error) { return "ftp01", nil }
+	tCases := []struct {
+		message    string
+		expected   string
+		shouldFail bool
+	}{
+		{"f3 says hello!", "f3 says hello!", false},
+		{"Welcome to %h", "Welcome to ftp01", false},
+		{"%h: %h", "ftp01: ftp01", false},
+		{"100% uptime", "100% uptime", false},
+		{"Welcome\r\n230 Logged in", "", true},
+	}
+
+	for _, tCase := range tCases {
+		t.Run(tCase.message, func(t *testing.T) {
+			message, err := expandWelcomeMessage(tCase.message, hostname)
+			if tCase.shouldFail {
+				if err == nil {
+					t.Fatalf("Expected %q to be invalid but was %q", tCase.message, message)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expanding %q failed: %s", tCase.message, err)
+			}
+			if message != tCase.expected {
+				t.Errorf("Expected %q but was %q", tCase.expected, message)
+			}
+		})
+	}
+
+	failing := func() (string, error) { return "", fmt.Errorf("no hostname") }
+	if _, err := expandWelcomeMessage("Welcome to %h", failing); err == nil {
+		t.Errorf("Expected expanding the hostname to fail")
+	}
+}
+
+func TestLogFormatter(t *testing.T) {
+	tCases := []struct {
+		format     string
+		expected   logrus.Formatter
+		shouldFail bool
+	}{
+		{"", &logrus.TextFormatter{}, false},
+		{"text", &logrus.TextFormatter{}, false},
+		{"json", &logrus.JSONFormatter{}, false},
+		{" JSON ", &logrus.JSONFormatter{}, false},
+		{"logfmt", nil, true},
+	}
+
+	for _, tCase := range tCases {
+		t.Run(tCase.format, func(t *testing.T) {
+			formatter, err := logFormatter(tCase.format)
+			if tCase.shouldFail {
+				if err == nil {
+					t.Fatalf("Expected %q to be invalid but was %T", tCase.format, formatter)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parsing %q failed: %s", tCase.format, err)
+			}
+			if reflect.TypeOf(formatter) != reflect.TypeOf(tCase.expected) {
+				t.Errorf("Expected %T but was %T", tCase.expected, formatter)
+			}
+		})
+	}
+}
+
 func pseudoRandomString() string {
 	return strconv.FormatInt(time.Now().UnixNano(), 16)
 }
+
+// writeSelfSignedCert writes a self-signed certificate and its private key to `dir`.
+func writeSelfSignedCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %s", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %s", err)
+	}
+	return certFile, keyFile
+}
+
+// freePort returns a TCP port which is currently not in use.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %s", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestConfigureTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+
+	tCases := []struct {
+		name       string
+		certFile   string
+		keyFile    string
+		required   bool
+		tls        bool
+		shouldFail bool
+	}{
+		{"no-tls", "", "", false, false, false},
+		{"tls", certFile, keyFile, true, true, false},
+		{"required-without-cert", "", "", true, false, true},
+		{"cert-without-key", certFile, "", true, false, true},
+		{"missing-cert", filepath.Join(dir, "missing.pem"), keyFile, true, false, true},
+	}
+	for _, tCase := range tCases {
+		opts := ftp.ServerOpts{}
+		err := configureTLS(&opts, tCase.certFile, tCase.keyFile, tCase.required)
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Test %s: unexpected error: %v", tCase.name, err)
+			continue
+		}
+		if opts.TLS != tCase.tls || opts.ExplicitFTPS != tCase.tls {
+			t.Errorf("Test %s: expected TLS: %v but was %v (explicit: %v)", tCase.name, tCase.tls, opts.TLS, opts.ExplicitFTPS)
+		}
+	}
+}
+
+func TestFeatAdvertisesAuthTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+
+	factory, err := server.NewDriverFactory(&server.FactoryConfig{
+		FtpFeatures:       server.DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          server.DefaultRegion,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	port := freePort(t)
+	opts := ftp.ServerOpts{
+		Factory:  factory,
+		Hostname: "127.0.0.1",
+		Port:     port,
+		Logger:   &server.FTPLogger{},
+	}
+	if err := configureTLS(&opts, certFile, keyFile, true); err != nil {
+		t.Fatalf("Failed to configure TLS: %s", err)
+	}
+	ftpServer := ftp.NewServer(&opts)
+	go ftpServer.ListenAndServe()
+	defer ftpServer.Shutdown()
+
+	var conn net.Conn
+	for attempt := 0; attempt < 50; attempt++ {
+		conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Failed to connect to FTP server: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	reader := bufio.NewReader(conn)
+	if welcome, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(welcome, "220") {
+		t.Fatalf("Unexpected welcome message %q: %v", welcome, err)
+	}
+	fmt.Fprint(conn, "FEAT\r\n")
+	feats := []string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read FEAT response: %s", err)
+		}
+		feats = append(feats, strings.TrimSpace(line))
+		if strings.HasPrefix(line, "211 ") {
+			break
+		}
+	}
+	if !strings.Contains(strings.Join(feats, "\n"), "AUTH TLS") {
+		t.Errorf("AUTH TLS is not advertised: %v", feats)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tCases := []struct {
+		name       string
+		minVersion string
+		ciphers    []string
+		expected   *tls.Config
+		shouldFail bool
+	}{
+		{"default", "1.2", nil, &tls.Config{MinVersion: tls.VersionTLS12}, false},
+		{"tls-1.3", "TLS1.3", nil, &tls.Config{MinVersion: tls.VersionTLS13}, false},
+		{"ciphers", "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "tls_ecdhe_ecdsa_with_chacha20_poly1305_sha256"}, &tls.Config{
+			MinVersion:               tls.VersionTLS12,
+			CipherSuites:             []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+			PreferServerCipherSuites: true,
+		}, false},
+		{"tls-1.1", "1.1", nil, nil, true},
+		{"tls-1.0", "1.0", nil, nil, true},
+		{"empty-version", "", nil, nil, true},
+		{"cbc-cipher", "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"}, nil, true},
+		{"rsa-key-exchange", "1.2", []string{"TLS_RSA_WITH_AES_128_GCM_SHA256"}, nil, true},
+		{"unknown-cipher", "1.2", []string{"ROT13"}, nil, true},
+	}
+	for _, tCase := range tCases {
+		config, err := newTLSConfig(tCase.minVersion, tCase.ciphers, "")
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Test %s: unexpected error: %v", tCase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, tCase.expected) {
+			t.Errorf("Test %s: expected %#v but was %#v", tCase.name, tCase.expected, config)
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-tls")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+
+	factory, err := server.NewDriverFactory(&server.FactoryConfig{
+		FtpFeatures:       server.DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          server.DefaultRegion,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	opts := ftp.ServerOpts{
+		Factory:  factory,
+		Hostname: "127.0.0.1",
+		Port:     listener.Addr().(*net.TCPAddr).Port,
+		Logger:   &server.FTPLogger{},
+	}
+	if err := configureTLS(&opts, certFile, keyFile, true); err != nil {
+		t.Fatalf("Failed to configure TLS: %s", err)
+	}
+	tlsConfig, err := newTLSConfig("1.2", nil, "")
+	if err != nil {
+		t.Fatalf("Failed to create TLS config: %s", err)
+	}
+	ftpServer := ftp.NewServer(&opts)
+	go server.Serve(ftpServer, listener, tlsConfig)
+	defer ftpServer.Shutdown()
+
+	tCases := []struct {
+		name       string
+		maxVersion uint16
+		shouldFail bool
+	}{
+		{"tls-1.1", tls.VersionTLS11, true},
+		{"tls-1.2", tls.VersionTLS12, false},
+		{"tls-1.3", tls.VersionTLS13, false},
+	}
+	for _, tCase := range tCases {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Failed to connect to FTP server: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		if welcome, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(welcome, "220") {
+			t.Fatalf("Test %s: unexpected welcome message %q: %v", tCase.name, welcome, err)
+		}
+		fmt.Fprint(conn, "AUTH TLS\r\n")
+		if reply, err := reader.ReadString('\n'); err != nil || !strings.HasPrefix(reply, "234") {
+			t.Fatalf("Test %s: unexpected reply to AUTH TLS %q: %v", tCase.name, reply, err)
+		}
+		client := tls.Client(conn, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tCase.maxVersion})
+		err = client.Handshake()
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Test %s: unexpected handshake error: %v", tCase.name, err)
+		}
+		conn.Close()
+	}
+}
@@ -1,5 +1,10 @@
 package meta
 
+import (
+	"fmt"
+	"runtime"
+)
+
 // All variables in this package are set at compile time.
 // Refer to the Makefile for details.
 
@@ -8,3 +13,33 @@ var Version string
 
 // BuildTime contains the projects build timestamp
 var BuildTime string
+
+// GitCommit contains the commit the program was built from
+var GitCommit string
+
+// Info describes the build of the program, e.g. to verify rollouts.
+type Info struct {
+	Version   string `json:"version"`
+	BuildTime string `json:"build_time"`
+	GitCommit string `json:"git_commit,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// Current returns the build information of the running program.
+func Current() Info {
+	return Info{
+		Version:   Version,
+		BuildTime: BuildTime,
+		GitCommit: GitCommit,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// String returns the build information in a single line, e.g. `1.2.3 (commit abc1234) built on 2019-12-31T23:59:59Z with go1.13`.
+func (i Info) String() string {
+	commit := ""
+	if i.GitCommit != "" {
+		commit = fmt.Sprintf(" (commit %s)", i.GitCommit)
+	}
+	return fmt.Sprintf("%s%s built on %s with %s", i.Version, commit, i.BuildTime, i.GoVersion)
+}
@@ -4,7 +4,6 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/base64"
-	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -13,15 +12,12 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/private/protocol/rest"
 )
 
-var (
-	errInvalidMethod = errors.New("v2 signer does not handle HTTP POST")
-)
-
 const (
 	signatureVersion = "2"
 	signatureMethod  = "HmacSHA1"
@@ -38,6 +34,10 @@ var subresources = []string{
 	"partNumber",
 	"policy",
 	"requestPayment",
+	"restore",
+	"select",
+	"select-type",
+	"tagging",
 	"torrent",
 	"uploadId",
 	"uploads",
@@ -64,6 +64,9 @@ type signer struct {
 
 // Sign requests with signature version 2.
 //
+// Unlike the query string signature of other services, the s3 signature covers the HTTP method,
+// thus POST requests like CompleteMultipartUpload or DeleteObjects are signed like any other request.
+//
 // Will sign the requests with the service config's Credentials object
 // Signing is skipped if the credentials is the credentials.AnonymousCredentials
 // object.
@@ -81,6 +84,7 @@ func SignV2(req *request.Request) {
 		Debug:       req.Config.LogLevel.Value(),
 		Logger:      req.Config.Logger,
 		pathStyle:   aws.BoolValue(req.Config.S3ForcePathStyle),
+		bucket:      bucketName(req.Params),
 	}
 
 	req.Error = v2.Sign()
@@ -118,9 +122,8 @@ func (v2 *signer) Sign() error {
 		uri = v2.Request.URL.Path
 	}
 	path := rest.EscapePath(uri, false)
-	if !v2.pathStyle {
-		host := strings.SplitN(v2.Request.URL.Host, ".", 2)[0]
-		path = "/" + host + uri
+	if v2.virtualHosted() {
+		path = "/" + v2.bucket + path
 	}
 	if path == "" {
 		path = "/"
@@ -185,6 +188,27 @@ func (v2 *signer) Sign() error {
 	return nil
 }
 
+// virtualHosted returns true if the bucket is addressed by the host instead of the path of the request.
+// The SDK falls back to path-style requests for bucket names which are not valid host names, e.g. dotted names with TLS.
+func (v2 *signer) virtualHosted() bool {
+	if v2.pathStyle || v2.bucket == "" {
+		return false
+	}
+	return strings.HasPrefix(v2.Request.URL.Host, v2.bucket+".")
+}
+
+// bucketName returns the bucket of the request parameters `params`, empty if there is none, e.g. for ListBuckets.
+func bucketName(params interface{}) string {
+	values, err := awsutil.ValuesAtPath(params, "Bucket")
+	if err != nil || len(values) == 0 {
+		return ""
+	}
+	if bucket, ok := values[0].(*string); ok {
+		return aws.StringValue(bucket)
+	}
+	return ""
+}
+
 const logSignInfoMsg = `DEBUG: Request Signature:
 ---[ STRING TO SIGN ]--------------------------------
 %s
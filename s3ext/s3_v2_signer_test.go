@@ -0,0 +1,151 @@
+package s3ext
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func newTestClient(endpoint string, pathStyle bool) *s3.S3 {
+	return s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("custom"),
+		Endpoint:         aws.String(endpoint),
+		S3ForcePathStyle: aws.Bool(pathStyle),
+		Credentials:      credentials.NewStaticCredentials("access", "secret", ""),
+	})))
+}
+
+func signRequest(t *testing.T, req *request.Request, pathStyle bool) *signer {
+	if err := req.Build(); err != nil {
+		t.Fatalf("Failed to build request: %s", err)
+	}
+	v2 := &signer{
+		Request:     req.HTTPRequest,
+		Time:        time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC),
+		Credentials: req.Config.Credentials,
+		pathStyle:   pathStyle,
+		bucket:      bucketName(req.Params),
+	}
+	if err := v2.Sign(); err != nil {
+		t.Fatalf("Failed to sign request: %s", err)
+	}
+	return v2
+}
+
+func TestSignPost(t *testing.T) {
+	client := newTestClient("https://s3.example.com", true)
+	req, _ := client.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String("some-bucket"),
+		Key:      aws.String("some/key"),
+		UploadId: aws.String("some-upload"),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{{
+			ETag:       aws.String("etag"),
+			PartNumber: aws.Int64(1),
+		}}},
+	})
+	v2 := signRequest(t, req, true)
+
+	lines := strings.Split(v2.stringToSign, "\n")
+	if lines[0] != "POST" {
+		t.Errorf("Expected method POST in string to sign but was %q", lines[0])
+	}
+	if resource := lines[len(lines)-1]; resource != "/some-bucket/some/key?uploadId=some-upload" {
+		t.Errorf("Unexpected canonical resource %q", resource)
+	}
+
+	hash := hmac.New(sha1.New, []byte("secret"))
+	hash.Write([]byte(v2.stringToSign))
+	expected := "AWS access:" + base64.StdEncoding.EncodeToString(hash.Sum(nil))
+	if auth := req.HTTPRequest.Header.Get("Authorization"); auth != expected {
+		t.Errorf("Expected authorization %q but was %q", expected, auth)
+	}
+}
+
+func TestSignPostSubresources(t *testing.T) {
+	client := newTestClient("https://s3.example.com", true)
+	testDataSet := []struct {
+		req      *request.Request
+		resource string
+	}{
+		{
+			func() *request.Request {
+				req, _ := client.DeleteObjectsRequest(&s3.DeleteObjectsInput{
+					Bucket: aws.String("some-bucket"),
+					Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String("some-key")}}},
+				})
+				return req
+			}(),
+			"/some-bucket?delete",
+		},
+		{
+			func() *request.Request {
+				req, _ := client.RestoreObjectRequest(&s3.RestoreObjectInput{
+					Bucket:         aws.String("some-bucket"),
+					Key:            aws.String("some-key"),
+					RestoreRequest: &s3.RestoreRequest{Days: aws.Int64(1)},
+				})
+				return req
+			}(),
+			"/some-bucket/some-key?restore",
+		},
+	}
+	for _, testData := range testDataSet {
+		v2 := signRequest(t, testData.req, true)
+		lines := strings.Split(v2.stringToSign, "\n")
+		if lines[0] != "POST" {
+			t.Errorf("Expected method POST in string to sign but was %q", lines[0])
+		}
+		if resource := lines[len(lines)-1]; resource != testData.resource {
+			t.Errorf("Expected canonical resource %q but was %q", testData.resource, resource)
+		}
+	}
+}
+
+func TestSignCanonicalResource(t *testing.T) {
+	testDataSet := []struct {
+		endpoint  string
+		pathStyle bool
+		bucket    string
+		host      string
+		resource  string
+	}{
+		{"http://s3.example.com", false, "some-bucket", "some-bucket.s3.example.com", "/some-bucket/some%20key"},
+		{"http://s3.example.com", false, "my.dotted.bucket", "my.dotted.bucket.s3.example.com", "/my.dotted.bucket/some%20key"},
+		// the SDK falls back to path-style for dotted bucket names with TLS
+		{"https://s3.example.com", false, "my.dotted.bucket", "s3.example.com", "/my.dotted.bucket/some%20key"},
+		{"https://storage.internal:9000", true, "some-bucket", "storage.internal:9000", "/some-bucket/some%20key"},
+		{"https://storage.internal:9000", true, "my.dotted.bucket", "storage.internal:9000", "/my.dotted.bucket/some%20key"},
+	}
+	for _, testData := range testDataSet {
+		client := newTestClient(testData.endpoint, testData.pathStyle)
+		req, _ := client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(testData.bucket),
+			Key:    aws.String("some key"),
+		})
+		v2 := signRequest(t, req, testData.pathStyle)
+		if host := req.HTTPRequest.URL.Host; host != testData.host {
+			t.Errorf("Test %q/%q: expected host %q but was %q", testData.endpoint, testData.bucket, testData.host, host)
+		}
+		lines := strings.Split(v2.stringToSign, "\n")
+		if resource := lines[len(lines)-1]; resource != testData.resource {
+			t.Errorf("Test %q/%q: expected canonical resource %q but was %q", testData.endpoint, testData.bucket, testData.resource, resource)
+		}
+	}
+
+	client := newTestClient("http://s3.example.com", false)
+	req, _ := client.ListBucketsRequest(&s3.ListBucketsInput{})
+	v2 := signRequest(t, req, false)
+	lines := strings.Split(v2.stringToSign, "\n")
+	if resource := lines[len(lines)-1]; resource != "/" {
+		t.Errorf("Expected canonical resource \"/\" without a bucket but was %q", resource)
+	}
+}
@@ -0,0 +1,447 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// Results of audit events.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// auditFlushInterval is the interval in which the audit events are uploaded to an s3 audit bucket.
+const auditFlushInterval = time.Minute
+
+// AuditEvent is an entry of the audit log, who did what from where with which result.
+type AuditEvent struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session,omitempty"`
+	User     string    `json:"user"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	// Action is the FTP operation, e.g. `LOGIN`, `GET` or `PUT`, like the `action` field of log entries.
+	Action string `json:"action"`
+	Key    string `json:"key,omitempty"`
+	Source string `json:"source,omitempty"`
+	Bytes  int64  `json:"bytes,omitempty"`
+	Result string `json:"result"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AuditLogger writes audit events to a sink, e.g. a file or an s3 bucket.
+// Audit events are written regardless of the log level.
+type AuditLogger interface {
+	Log(event AuditEvent) error
+	// Close writes pending events and releases the sink.
+	Close() error
+}
+
+// fileAuditLogger appends audit events as JSON lines to a file.
+type fileAuditLogger struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+// NewFileAuditLogger returns an AuditLogger which appends events as JSON lines to the file `path`.
+func NewFileAuditLogger(path string) (AuditLogger, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to open audit log %q", path)
+	}
+	return &fileAuditLogger{file: file}, nil
+}
+
+func (l *fileAuditLogger) Log(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// a single write per event, so that lines of concurrent events are not interleaved
+	_, err = l.file.Write(append(line, '\n'))
+	return err
+}
+
+func (l *fileAuditLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
+
+// s3AuditLogger buffers audit events and uploads them as objects of JSON lines,
+// s3 objects are immutable, thus every upload creates a new object.
+type s3AuditLogger struct {
+	lock   sync.Mutex
+	client s3iface.S3API
+	bucket string
+	prefix string
+	buffer bytes.Buffer
+	stop   chan struct{}
+	done   chan struct{}
+	logger logrus.FieldLogger
+}
+
+// NewS3AuditLogger returns an AuditLogger which uploads the events of every `interval` to bucket `bucket`,
+// as objects named like `prefix/20191231T235959Z-0123456789abcdef.jsonl`.
+func NewS3AuditLogger(client s3iface.S3API, bucket, prefix string, interval time.Duration) AuditLogger {
+	return newS3AuditLogger(client, bucket, prefix, interval, nil)
+}
+
+// newS3AuditLogger returns the AuditLogger of NewS3AuditLogger which logs failed uploads to `logger`, the global logger of logrus if nil.
+func newS3AuditLogger(client s3iface.S3API, bucket, prefix string, interval time.Duration, logger logrus.FieldLogger) AuditLogger {
+	l := &s3AuditLogger{
+		client: client,
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: orStandardLogger(logger),
+	}
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := l.flush(); err != nil {
+					l.logger.Errorf("Failed to upload audit events: %s", err)
+				}
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+func (l *s3AuditLogger) Log(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.buffer.Write(append(line, '\n'))
+	return nil
+}
+
+// flush uploads the buffered events, they are kept to be uploaded again if the upload fails.
+func (l *s3AuditLogger) flush() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.buffer.Len() == 0 {
+		return nil
+	}
+	name, err := uniqueName(time.Now())
+	if err != nil {
+		return err
+	}
+	key := path.Join(l.prefix, name+".jsonl")
+	_, err = l.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(l.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(l.buffer.Bytes()),
+		ContentType: aws.String("application/x-ndjson"),
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to upload audit log %q to bucket %q", key, l.bucket)
+	}
+	l.buffer.Reset()
+	return nil
+}
+
+func (l *s3AuditLogger) Close() error {
+	close(l.stop)
+	<-l.done
+	return l.flush()
+}
+
+// newAuditLogger returns the AuditLogger of `target`, either a file path or an s3 URL like `s3://bucket/prefix`.
+// The events of s3 URLs are uploaded with the client created by `newClient`, failed uploads are logged to `logger`.
+func newAuditLogger(target string, newClient func() (s3iface.S3API, error), logger logrus.FieldLogger) (AuditLogger, error) {
+	if !strings.HasPrefix(target, "s3://") {
+		return NewFileAuditLogger(target)
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("Invalid audit bucket URL %q, must be like s3://bucket/prefix", target)
+	}
+	client, err := newClient()
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create s3 client of the audit log")
+	}
+	return newS3AuditLogger(client, u.Host, u.Path, auditFlushInterval, logger), nil
+}
+
+// auditSession is the state of an FTP connection needed for audit events.
+type auditSession struct {
+	clientIP string
+	// user is the requested user before the login and the logged in user afterwards
+	user string
+}
+
+// auditor records the audit events of all FTP connections.
+// Logins are only visible to FTPLogger and file operations to drivers, thus connections are tracked by their session id.
+type auditor struct {
+	logger AuditLogger
+	// log logs failures to write events, logger is the sink of the events
+	log      logrus.FieldLogger
+	lock     sync.Mutex
+	sessions map[string]*auditSession
+}
+
+func newAuditor(logger AuditLogger, log logrus.FieldLogger) *auditor {
+	return &auditor{logger: logger, log: log, sessions: map[string]*auditSession{}}
+}
+
+// record writes `event`, failures are logged because they must not fail the operation itself.
+func (a *auditor) record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if err := a.logger.Log(event); err != nil {
+		a.log.WithFields(logrus.Fields{"action": event.Action, "key": event.Key, "error": err}).Errorf("Failed to write audit event: %s", err)
+	}
+}
+
+// connect registers the connection with session id `sessionID` from client `clientIP`.
+func (a *auditor) connect(sessionID, clientIP string) {
+	if a == nil || sessionID == "" {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.sessions[sessionID] = &auditSession{clientIP: clientIP}
+}
+
+// command records the login attempts of session `sessionID`, the user is given by USER and the result by the reply to PASS.
+func (a *auditor) command(sessionID, command, params string) {
+	if a == nil || strings.ToUpper(command) != "USER" {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if session, ok := a.sessions[sessionID]; ok {
+		session.user = params
+	}
+}
+
+// response records the result of a login of session `sessionID` by the reply code `code`.
+func (a *auditor) response(sessionID string, code int) {
+	if a == nil || (code != 230 && code != 530) {
+		return
+	}
+	a.lock.Lock()
+	session, ok := a.sessions[sessionID]
+	a.lock.Unlock()
+	if !ok {
+		return
+	}
+	event := AuditEvent{Session: sessionID, User: session.user, ClientIP: session.clientIP, Action: "LOGIN", Result: AuditSuccess}
+	if code == 530 {
+		event.Result, event.Error = AuditFailure, "incorrect password"
+	}
+	a.record(event)
+}
+
+// disconnect records the end of session `sessionID` and unregisters it.
+func (a *auditor) disconnect(sessionID string) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	session, ok := a.sessions[sessionID]
+	delete(a.sessions, sessionID)
+	a.lock.Unlock()
+	if ok {
+		a.record(AuditEvent{Session: sessionID, User: session.user, ClientIP: session.clientIP, Action: "LOGOUT", Result: AuditSuccess})
+	}
+}
+
+// ftpConnInfo returns the session id and the client's IP address of `conn`.
+func ftpConnInfo(conn *ftp.Conn) (string, string) {
+	if conn == nil {
+		return "", ""
+	}
+	clientIP := ""
+	if addr := conn.RemoteAddr(); addr != nil {
+		clientIP, _, _ = net.SplitHostPort(addr.String())
+	}
+	return conn.SessionID(), clientIP
+}
+
+// auditDriver records the file operations of a driver as audit events.
+type auditDriver struct {
+	ftp.Driver
+	// s3Driver resolves the keys of operations
+	s3Driver  *S3Driver
+	auditor   *auditor
+	sessionID string
+	clientIP  string
+}
+
+func newAuditDriver(driver ftp.Driver, s3Driver *S3Driver, auditor *auditor) *auditDriver {
+	return &auditDriver{Driver: driver, s3Driver: s3Driver, auditor: auditor}
+}
+
+// record records operation `action` of the file with path `key` which failed if `err` is not nil.
+func (d *auditDriver) record(action, key string, bytes int64, err error) AuditEvent {
+	event := AuditEvent{
+		Session:  d.sessionID,
+		ClientIP: d.clientIP,
+		Action:   action,
+		Key:      d.s3Driver.fqdn(d.s3Driver.objectKey(key)),
+		Bytes:    bytes,
+		Result:   AuditSuccess,
+	}
+	if d.s3Driver.conn != nil {
+		event.User = d.s3Driver.conn.LoginUser()
+	}
+	if err != nil {
+		event.Result, event.Error = AuditFailure, err.Error()
+	}
+	return event
+}
+
+func (d *auditDriver) Init(conn *ftp.Conn) {
+	d.sessionID, d.clientIP = ftpConnInfo(conn)
+	d.auditor.connect(d.sessionID, d.clientIP)
+	d.Driver.Init(conn)
+}
+
+func (d *auditDriver) ListDir(key string, cb func(ftp.FileInfo) error) error {
+	err := d.Driver.ListDir(key, cb)
+	d.auditor.record(d.record("LS", key, 0, err))
+	return err
+}
+
+func (d *auditDriver) DeleteDir(key string) error {
+	err := d.Driver.DeleteDir(key)
+	d.auditor.record(d.record("RMDIR", key, 0, err))
+	return err
+}
+
+func (d *auditDriver) DeleteFile(key string) error {
+	err := d.Driver.DeleteFile(key)
+	d.auditor.record(d.record("DELETE", key, 0, err))
+	return err
+}
+
+func (d *auditDriver) Rename(oldKey string, newKey string) error {
+	err := d.Driver.Rename(oldKey, newKey)
+	event := d.record("MV", newKey, 0, err)
+	event.Source = d.s3Driver.fqdn(d.s3Driver.objectKey(oldKey))
+	d.auditor.record(event)
+	return err
+}
+
+func (d *auditDriver) MakeDir(key string) error {
+	err := d.Driver.MakeDir(key)
+	d.auditor.record(d.record("MKDIR", key, 0, err))
+	return err
+}
+
+// GetFile records the download once the FTP server closed it, with the number of bytes sent to the client.
+func (d *auditDriver) GetFile(key string, offset int64) (int64, io.ReadCloser, error) {
+	size, reader, err := d.Driver.GetFile(key, offset)
+	if err != nil {
+		d.auditor.record(d.record("GET", key, 0, err))
+		return size, reader, err
+	}
+	return size, &auditReader{ReadCloser: reader, event: d.record("GET", key, 0, nil), auditor: d.auditor}, nil
+}
+
+func (d *auditDriver) PutFile(key string, data io.Reader, appendMode bool) (int64, error) {
+	size, err := d.Driver.PutFile(key, data, appendMode)
+	action := "PUT"
+	if appendMode {
+		action = "APPE"
+	}
+	bytes := size
+	if bytes < 0 {
+		bytes = 0
+	}
+	d.auditor.record(d.record(action, key, bytes, err))
+	return size, err
+}
+
+func (d *auditDriver) PresignedURL(key string) (string, error) {
+	url, err := d.s3Driver.PresignedURL(key)
+	d.auditor.record(d.record("GETURL", key, 0, err))
+	return url, err
+}
+
+func (d *auditDriver) ListVersions(key string) ([]ObjectVersion, error) {
+	versions, err := d.s3Driver.ListVersions(key)
+	d.auditor.record(d.record("VERSIONS", key, 0, err))
+	return versions, err
+}
+
+func (d *auditDriver) SelectVersion(versionID string) error {
+	return d.s3Driver.SelectVersion(versionID)
+}
+
+func (d *auditDriver) RestoreObject(key string, days int64) (string, error) {
+	state, err := d.s3Driver.RestoreObject(key, days)
+	d.auditor.record(d.record("RESTORE", key, 0, err))
+	return state, err
+}
+
+func (d *auditDriver) ObjectTags(key string) ([]string, error) {
+	tags, err := d.s3Driver.ObjectTags(key)
+	d.auditor.record(d.record("TAGS", key, 0, err))
+	return tags, err
+}
+
+func (d *auditDriver) SetModTime(key string, mtime time.Time) error {
+	err := d.s3Driver.SetModTime(key, mtime)
+	d.auditor.record(d.record("MFMT", key, 0, err))
+	return err
+}
+
+// auditReader counts the bytes of a download and records its audit event when it is closed.
+type auditReader struct {
+	io.ReadCloser
+	event   AuditEvent
+	auditor *auditor
+	err     error
+}
+
+func (r *auditReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.event.Bytes += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *auditReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.err != nil {
+		r.event.Result, r.event.Error = AuditFailure, r.err.Error()
+	}
+	r.auditor.record(r.event)
+	return err
+}
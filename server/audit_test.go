@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// auditLoggerMock records all audit events.
+type auditLoggerMock struct {
+	lock   sync.Mutex
+	events []AuditEvent
+}
+
+func (l *auditLoggerMock) Log(event AuditEvent) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.events = append(l.events, event)
+	return nil
+}
+
+func (l *auditLoggerMock) Close() error {
+	return nil
+}
+
+func (l *auditLoggerMock) recorded() []AuditEvent {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]AuditEvent{}, l.events...)
+}
+
+func TestAuditDriver(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	s3Driver := &S3Driver{
+		featureFlags: featureList | featureGet | featurePut,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	logger := &auditLoggerMock{}
+	var driver ftp.Driver = newAuditDriver(s3Driver, s3Driver, newAuditor(logger, logrus.StandardLogger()))
+	driver.Init(&ftp.Conn{})
+	s3Driver.conn = loginUserMock("alice")
+
+	if _, err := driver.PutFile("/file", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	_, reader, err := driver.GetFile("/file", 1)
+	if err != nil {
+		t.Fatalf("GetFile failed: %s", err)
+	}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatalf("Reading the download failed: %s", err)
+	}
+	if events := logger.recorded(); len(events) != 1 {
+		t.Errorf("Expected the download to be recorded when it is closed but were %+v", events)
+	}
+	reader.Close()
+	if err := driver.DeleteFile("/file"); err == nil {
+		t.Fatalf("Expected DeleteFile to fail because it is not enabled")
+	}
+
+	key := fmt.Sprintf("https://%s.my.s3.host.com/file", bucketName)
+	expected := []AuditEvent{
+		{User: "alice", Action: "PUT", Key: key, Bytes: 4, Result: AuditSuccess},
+		{User: "alice", Action: "GET", Key: key, Bytes: 3, Result: AuditSuccess},
+		{User: "alice", Action: "DELETE", Key: key, Result: AuditFailure},
+	}
+	events := logger.recorded()
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events but were %+v", len(expected), events)
+	}
+	for i, event := range events {
+		if event.Time.IsZero() {
+			t.Errorf("Expected the time of event %d to be set", i)
+		}
+		if event.Result == AuditFailure && event.Error == "" {
+			t.Errorf("Expected the error of failed event %d", i)
+		}
+		event.Time, event.Error = time.Time{}, ""
+		if event != expected[i] {
+			t.Errorf("Expected event %d to be %+v but was %+v", i, expected[i], event)
+		}
+	}
+}
+
+func TestAuditLogin(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	logger := &auditLoggerMock{}
+	auditor := newAuditor(logger, logrus.StandardLogger())
+	bucketName := "test-bucket"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			s3Driver := &S3Driver{
+				s3:         &s3Mock{bucket: newBucketMock(bucketName)},
+				metrics:    metricsSenderMock{},
+				bucketName: bucketName,
+				bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}
+			return newAuditDriver(s3Driver, s3Driver, auditor), nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{auditor: auditor},
+	})
+	go ftpServer.Serve(listener)
+	defer ftpServer.Shutdown()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connecting failed: %s", err)
+	}
+	replies := bufio.NewReader(conn)
+	send := func(command string) {
+		fmt.Fprintf(conn, "%s\r\n", command)
+		if _, err := replies.ReadString('\n'); err != nil {
+			t.Fatalf("Reading the reply to %q failed: %s", command, err)
+		}
+	}
+	replies.ReadString('\n') // welcome message
+	send("USER alice")
+	send("PASS wrong")
+	send("USER alice")
+	send("PASS secret")
+	send("QUIT")
+	conn.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(logger.recorded()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	events := logger.recorded()
+	expected := []struct{ action, result string }{{"LOGIN", AuditFailure}, {"LOGIN", AuditSuccess}, {"LOGOUT", AuditSuccess}}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events but were %+v", len(expected), events)
+	}
+	for i, event := range events {
+		if event.Action != expected[i].action || event.Result != expected[i].result {
+			t.Errorf("Expected event %d to be %s with %s but was %+v", i, expected[i].action, expected[i].result, event)
+		}
+		if event.User != "alice" || event.ClientIP != "127.0.0.1" || event.Session == "" {
+			t.Errorf("Expected the user, client IP and session of event %d but was %+v", i, event)
+		}
+	}
+}
+
+func TestFileAuditLogger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-audit")
+	if err != nil {
+		t.Fatalf("Creating temporary directory failed: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.jsonl")
+
+	// events are appended to existing logs
+	for _, user := range []string{"alice", "bob"} {
+		logger, err := NewFileAuditLogger(path)
+		if err != nil {
+			t.Fatalf("Opening the audit log failed: %s", err)
+		}
+		if err := logger.Log(AuditEvent{User: user, Action: "LOGIN", Result: AuditSuccess}); err != nil {
+			t.Fatalf("Writing the event failed: %s", err)
+		}
+		logger.Close()
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Reading the audit log failed: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines but were %q", raw)
+	}
+	event := AuditEvent{}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.User != "bob" {
+		t.Errorf("Expected the event of bob but was %q: %v", lines[1], err)
+	}
+}
+
+func TestS3AuditLogger(t *testing.T) {
+	bucketMock := newBucketMock("audit-bucket")
+	logger := NewS3AuditLogger(&s3Mock{bucket: bucketMock}, "audit-bucket", "/f3/", time.Hour)
+	logger.Log(AuditEvent{User: "alice", Action: "PUT", Key: "file", Bytes: 4, Result: AuditSuccess})
+	logger.Log(AuditEvent{User: "alice", Action: "GET", Key: "file", Bytes: 4, Result: AuditSuccess})
+	if len(bucketMock.objects) != 0 {
+		t.Errorf("Expected the events to be buffered until the next upload")
+	}
+	if err := logger.Close(); err != nil {
+		t.Fatalf("Closing the audit log failed: %s", err)
+	}
+
+	if len(bucketMock.objects) != 1 {
+		t.Fatalf("Expected a single object of all events but were %d", len(bucketMock.objects))
+	}
+	for key, object := range bucketMock.objects {
+		if !strings.HasPrefix(key, "f3/") || !strings.HasSuffix(key, ".jsonl") {
+			t.Errorf("Expected an object below the prefix but was %q", key)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(object.data)), "\n"); len(lines) != 2 {
+			t.Errorf("Expected 2 lines but were %q", object.data)
+		}
+	}
+}
@@ -1,21 +1,43 @@
 package server
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"io/ioutil"
+	"path"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
 )
 
 // Authenticator contains credentials.
 // Implements https://godoc.org/github.com/goftp/server#Auth
 type Authenticator struct {
 	credentials map[string]string
+	features    map[string]int
+	homes       map[string]string
+	totpSecrets map[string][]byte
+	schedules   map[string]accessSchedule
+	// totpSteps are the time steps of the last accepted TOTP codes of users, codes may not be used twice
+	totpSteps map[string]int64
+	// lock guards the maps which are shared by all copies of the Authenticator and replaced by Reload
+	lock   *sync.RWMutex
+	logger logrus.FieldLogger
 }
 
 // AuthenticatorFromFile returns an Authenticator with credentials parsed from the given file path.
-// The file must contain one credential pair per line where username and password is separated by a `:`.
+// The file must contain one credential pair per line where username and password is separated by a `:`,
+// optionally followed by a `:` and the feature set of the user, another `:` and the home prefix of the user
+// another `:` and the base32 encoded TOTP secret of the user and another `:` and the access schedule of the user,
+// e.g. `user:password:ls,get:user/:JBSWY3DPEHPK3PXP:Mon-Fri 08:00-18:00 Europe/Berlin`.
+// The global feature set applies to users with an empty feature set.
+// Users with a TOTP secret log in with their password followed by the current code of their authenticator app, e.g. `password123456`.
+// Users with an access schedule may only log in during its windows, which are separated by `;`.
+// A `\` escapes the following character in all fields but the access schedule, e.g. `user:pass\:word` is the password `pass:word`.
 func AuthenticatorFromFile(path string) (Authenticator, error) {
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -25,18 +47,52 @@ func AuthenticatorFromFile(path string) (Authenticator, error) {
 }
 
 // AuthenticatorFromString returns an Authenticator whose credentials where parsed from the given string.
-// The contents must contain one credential pair per line where username and password is separated by a `:`.
+// The contents must contain one credential pair per line where username and password is separated by a `:`,
+// optionally followed by a `:` and the feature set of the user, another `:` and the home prefix of the user
+// another `:` and the TOTP secret of the user and another `:` and the access schedule of the user.
+// A `\` escapes the following character in all fields but the access schedule.
 func AuthenticatorFromString(contents string) (Authenticator, error) {
-	auth := Authenticator{make(map[string]string)}
+	auth := Authenticator{make(map[string]string), make(map[string]int), make(map[string]string), make(map[string][]byte), make(map[string]accessSchedule), make(map[string]int64), &sync.RWMutex{}, nil}
 
 	lines := strings.Split(contents, "\n")
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if len(line) > 0 {
-			parts := strings.SplitN(line, ":", 2)
-			if len(parts) == 2 {
+			// the access schedule is last because its times contain colons
+			parts := splitCredentials(line, 6)
+			if len(parts) >= 2 {
 				auth.credentials[parts[0]] = parts[1]
 			}
+			if len(parts) >= 3 && parts[2] != "" {
+				featureFlags, err := parseFeatureSet(parts[2])
+				if err != nil {
+					return auth, errors.Wrapf(err, "Invalid feature set of user %q", parts[0])
+				}
+				auth.features[parts[0]] = featureFlags
+			}
+			// the home and the TOTP secret may be empty if further fields follow
+			if len(parts) == 4 || (len(parts) > 4 && parts[3] != "") {
+				// `..` elements are resolved, the home is always located inside the bucket
+				home := strings.Trim(path.Clean("/"+parts[3]), "/")
+				if home == "" {
+					return auth, fmt.Errorf("Invalid home prefix %q of user %q", parts[3], parts[0])
+				}
+				auth.homes[parts[0]] = home
+			}
+			if len(parts) == 5 || (len(parts) == 6 && parts[4] != "") {
+				secret, err := parseTOTPSecret(parts[4])
+				if err != nil {
+					return auth, errors.Wrapf(err, "Invalid TOTP secret of user %q", parts[0])
+				}
+				auth.totpSecrets[parts[0]] = secret
+			}
+			if len(parts) == 6 {
+				schedule, err := parseAccessSchedule(parts[5])
+				if err != nil {
+					return auth, errors.Wrapf(err, "Invalid access schedule of user %q", parts[0])
+				}
+				auth.schedules[parts[0]] = schedule
+			}
 		}
 	}
 	if len(auth.credentials) == 0 {
@@ -45,12 +101,151 @@ func AuthenticatorFromString(contents string) (Authenticator, error) {
 	return auth, nil
 }
 
+// splitCredentials splits a line of credentials into at most `n` fields separated by `:`.
+// A `\` escapes the following character, e.g. a `:` of a password, except in the last field which contains the rest of the line.
+func splitCredentials(line string, n int) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		if len(fields) == n-1 {
+			return append(fields, line[i:])
+		}
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
 // CheckPasswd returns `true` if username and password was found in the credentials store.
+// The password of users with a TOTP secret must be followed by the current TOTP code, which is only accepted once,
+// users with an access schedule are rejected outside of its windows.
+// Wrong passwords and TOTP codes fail with the same error.
 func (c Authenticator) CheckPasswd(username, password string) (bool, error) {
-	for user, pass := range c.credentials {
-		if username == user && password == pass {
-			return true, nil
+	// accepted TOTP codes are recorded
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	secret, hasTOTP := c.totpSecrets[username]
+	code := ""
+	if hasTOTP && len(password) >= totpDigits {
+		password, code = password[:len(password)-totpDigits], password[len(password)-totpDigits:]
+	}
+	if pass, ok := c.credentials[username]; !ok || subtle.ConstantTimeCompare([]byte(password), []byte(pass)) != 1 {
+		return false, fmt.Errorf("Invalid credentials of user %q", username)
+	}
+	if hasTOTP {
+		step, valid := verifyTOTP(secret, code, now)
+		if last, used := c.totpSteps[username]; !valid || (used && step <= last) {
+			return false, fmt.Errorf("Invalid credentials of user %q", username)
 		}
+		c.totpSteps[username] = step
+	}
+	return c.checkSchedule(username, now)
+}
+
+// log returns the logger of the authenticator, the global logger of logrus if none is configured.
+func (c Authenticator) log() logrus.FieldLogger {
+	return orStandardLogger(c.logger)
+}
+
+// checkSchedule returns `true` if user `username` has no access schedule or may log in at `now`.
+func (c Authenticator) checkSchedule(username string, now time.Time) (bool, error) {
+	schedule, ok := c.schedules[username]
+	if !ok || schedule.allows(now) {
+		return true, nil
+	}
+	c.log().WithFields(logrus.Fields{"user": username, "action": "LOGIN"}).Warnf("Rejecting login of %q outside of its access schedule", username)
+	return false, fmt.Errorf("User %q may not log in at %s", username, now.Format(time.RFC3339))
+}
+
+// Features returns the feature flags of user `username` and true, or false if the user has no own feature set.
+func (c Authenticator) Features(username string) (int, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	featureFlags, ok := c.features[username]
+	return featureFlags, ok
+}
+
+// anyFeatures returns the features which are enabled for any user with an own feature set.
+func (c Authenticator) anyFeatures() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	featureFlags := 0
+	for _, flags := range c.features {
+		featureFlags |= flags
+	}
+	return featureFlags
+}
+
+// Home returns the prefix under which the objects of user `username` are located,
+// or an empty string if the user has access to the whole bucket.
+func (c Authenticator) Home(username string) string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.homes[username]
+}
+
+// Reload replaces the credentials and settings of all users by the ones of `other`, e.g. after the credentials file changed.
+// All copies of the Authenticator use the new credentials.
+func (c Authenticator) Reload(other Authenticator) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	other.lock.RLock()
+	defer other.lock.RUnlock()
+	// all settings belong to users with credentials
+	for user := range c.credentials {
+		delete(c.credentials, user)
+		delete(c.features, user)
+		delete(c.homes, user)
+		delete(c.totpSecrets, user)
+		delete(c.schedules, user)
+	}
+	for user, password := range other.credentials {
+		c.credentials[user] = password
+		if featureFlags, ok := other.features[user]; ok {
+			c.features[user] = featureFlags
+		}
+		if home, ok := other.homes[user]; ok {
+			c.homes[user] = home
+		}
+		if secret, ok := other.totpSecrets[user]; ok {
+			c.totpSecrets[user] = secret
+		}
+		if schedule, ok := other.schedules[user]; ok {
+			c.schedules[user] = schedule
+		}
+	}
+}
+
+// IsAnonymous returns true if `username` is one of the usernames of anonymous FTP, `anonymous` and `ftp`.
+func IsAnonymous(username string) bool {
+	username = strings.ToLower(username)
+	return username == "anonymous" || username == "ftp"
+}
+
+// AnonymousAuthenticator accepts anonymous logins with any password and delegates all other logins.
+// Implements https://godoc.org/github.com/goftp/server#Auth
+type AnonymousAuthenticator struct {
+	auth ftp.Auth
+}
+
+// NewAnonymousAuthenticator returns an AnonymousAuthenticator which checks non-anonymous logins with `auth`.
+func NewAnonymousAuthenticator(auth ftp.Auth) AnonymousAuthenticator {
+	return AnonymousAuthenticator{auth}
+}
+
+// CheckPasswd returns `true` for anonymous users or if `auth` accepts username and password.
+func (c AnonymousAuthenticator) CheckPasswd(username, password string) (bool, error) {
+	if IsAnonymous(username) {
+		return true, nil
 	}
-	return false, fmt.Errorf("Unknown credentials: %q:%q", username, password)
+	return c.auth.CheckPasswd(username, password)
 }
@@ -2,6 +2,10 @@ package server
 
 import (
 	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
 )
 
 func TestAuthenticatorFromString(t *testing.T) {
@@ -40,6 +44,14 @@ func TestAuthenticatorFromString(t *testing.T) {
 				"Aaron": "Funk",
 			}, false,
 		},
+		{
+			"escaped-colons",
+			"alice:pass\\:word\\\\:ls,get\nbob:trailing\\:",
+			map[string]string{
+				"alice": "pass:word\\",
+				"bob":   "trailing:",
+			}, false,
+		},
 	}
 	for _, testData := range testDataSet {
 		auth, err := AuthenticatorFromString(testData.raw)
@@ -55,3 +67,200 @@ func TestAuthenticatorFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestAuthenticatorFeatures(t *testing.T) {
+	auth, err := AuthenticatorFromString("reader:secret:ls,get\nwriter:secret:put\nadmin:secret")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+
+	testDataSet := []struct {
+		user         string
+		featureFlags int
+		ok           bool
+	}{
+		{"reader", featureList | featureGet, true},
+		{"writer", featurePut, true},
+		{"admin", 0, false},
+		{"unknown", 0, false},
+	}
+	for _, testData := range testDataSet {
+		featureFlags, ok := auth.Features(testData.user)
+		if ok != testData.ok || featureFlags != testData.featureFlags {
+			t.Errorf("Test %s: expected features %d (%v) but were %d (%v)", testData.user, testData.featureFlags, testData.ok, featureFlags, ok)
+		}
+	}
+	if valid, _ := auth.CheckPasswd("reader", "secret"); !valid {
+		t.Error("Password of a user with a feature set could not be validated")
+	}
+
+	if _, err := AuthenticatorFromString("reader:secret:ls,fly"); err == nil {
+		t.Error("Parsing an unknown feature of a user succeeded")
+	}
+}
+
+func TestAuthenticatorHome(t *testing.T) {
+	auth, err := AuthenticatorFromString("alice:secret::alice/\nbob:secret:ls:/../team/bob\ncarol:secret")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	for user, home := range map[string]string{"alice": "alice", "bob": "team/bob", "carol": ""} {
+		if actual := auth.Home(user); actual != home {
+			t.Errorf("Test %s: expected home %q but was %q", user, home, actual)
+		}
+	}
+	if _, ok := auth.Features("alice"); ok {
+		t.Error("An empty feature set of a user does not fall back to the global one")
+	}
+
+	if _, err := AuthenticatorFromString("alice:secret::/"); err == nil {
+		t.Error("Parsing the bucket root as home succeeded")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	// test vectors of RFC 6238 truncated to 6 digits
+	key := []byte("12345678901234567890")
+	tCases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tCase := range tCases {
+		if code := totpCode(key, uint64(tCase.unix/totpPeriod)); code != tCase.code {
+			t.Errorf("Expected code %s at %d but was %s", tCase.code, tCase.unix, code)
+		}
+		if step, ok := verifyTOTP(key, tCase.code, time.Unix(tCase.unix+totpPeriod, 0)); !ok || step != tCase.unix/totpPeriod {
+			t.Errorf("Expected code %s of the previous period to be accepted at %d", tCase.code, tCase.unix+totpPeriod)
+		}
+		if _, ok := verifyTOTP(key, tCase.code, time.Unix(tCase.unix+3*totpPeriod, 0)); ok {
+			t.Errorf("Expected expired code %s to be rejected at %d", tCase.code, tCase.unix+3*totpPeriod)
+		}
+	}
+
+	auth, err := AuthenticatorFromString("alice:secret:::gezd gnbv gy3t qojq gezd gnbv gy3t qojq\nbob:secret")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	code := totpCode(key, uint64(time.Now().Unix()/totpPeriod))
+	testDataSet := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{"alice", "secret" + code, true},
+		// codes may not be replayed
+		{"alice", "secret" + code, false},
+		{"alice", "secret", false},
+		{"alice", "wrong" + code, false},
+		{"alice", code, false},
+		{"bob", "secret", true},
+	}
+	for _, testData := range testDataSet {
+		valid, _ := auth.CheckPasswd(testData.user, testData.password)
+		if valid != testData.valid {
+			t.Errorf("Test %s:%s: expected %v but was %v", testData.user, testData.password, testData.valid, valid)
+		}
+	}
+	// failures do not tell whether the password or the code was wrong
+	_, wrongPassword := auth.CheckPasswd("alice", "wrong"+code)
+	_, wrongCode := auth.CheckPasswd("alice", "secret000000")
+	if wrongPassword == nil || wrongCode == nil || wrongPassword.Error() != wrongCode.Error() {
+		t.Errorf("Expected the same error for wrong passwords and codes but were %v and %v", wrongPassword, wrongCode)
+	}
+	if auth.Home("alice") != "" {
+		t.Errorf("Expected no home of alice but was %q", auth.Home("alice"))
+	}
+
+	if _, err := AuthenticatorFromString("alice:secret:::not-base32!"); err == nil {
+		t.Error("Parsing an invalid TOTP secret succeeded")
+	}
+}
+
+func TestAuthenticatorSchedule(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	now := time.Now().UTC()
+	other := [...]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}[(now.Weekday()+2)%7]
+	auth, err := AuthenticatorFromString("alice:secret::::Mon-Sun 00:00-24:00 UTC\nbob:secret:ls:bob::" + other + " 00:00-24:00; " + other + " 08:00-10:00")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	if valid, _ := auth.CheckPasswd("alice", "secret"); !valid {
+		t.Error("Login of alice within the access schedule failed")
+	}
+	if valid, _ := auth.CheckPasswd("bob", "secret"); valid {
+		t.Error("Login of bob outside of the access schedule succeeded")
+	}
+	if auth.Home("bob") != "bob" {
+		t.Errorf("Expected home bob but was %q", auth.Home("bob"))
+	}
+	if _, err := AuthenticatorFromString("alice:secret::::Mon-Fri 08:00"); err == nil {
+		t.Error("Parsing an invalid access schedule succeeded")
+	}
+}
+
+func TestAuthenticatorReload(t *testing.T) {
+	auth, err := AuthenticatorFromString("alice:secret:ls:alice\nbob:secret")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	// copies like the one passed to the FTP server use the reloaded credentials
+	var copied ftp.Auth = auth
+	other, err := AuthenticatorFromString("alice:changed\ncarol:secret:get:carol")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	auth.Reload(other)
+
+	testDataSet := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{"alice", "secret", false},
+		{"alice", "changed", true},
+		{"bob", "secret", false},
+		{"carol", "secret", true},
+	}
+	for _, testData := range testDataSet {
+		if valid, _ := copied.CheckPasswd(testData.user, testData.password); valid != testData.valid {
+			t.Errorf("Test %s:%s: expected %v but was %v", testData.user, testData.password, testData.valid, valid)
+		}
+	}
+	if _, ok := auth.Features("alice"); ok || auth.Home("alice") != "" {
+		t.Error("The settings of alice were not removed")
+	}
+	if featureFlags, _ := auth.Features("carol"); featureFlags != featureGet || auth.Home("carol") != "carol" {
+		t.Errorf("The settings of carol were not added: %d, %q", featureFlags, auth.Home("carol"))
+	}
+}
+
+func TestAnonymousAuthenticator(t *testing.T) {
+	creds, err := AuthenticatorFromString("foo:bar")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	auth := NewAnonymousAuthenticator(creds)
+
+	testDataSet := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{"anonymous", "guest@example.com", true},
+		{"FTP", "", true},
+		{"foo", "bar", true},
+		{"foo", "wrong", false},
+		{"bar", "", false},
+	}
+	for _, testData := range testDataSet {
+		valid, _ := auth.CheckPasswd(testData.user, testData.password)
+		if valid != testData.valid {
+			t.Errorf("Test %s:%s: expected %v but was %v", testData.user, testData.password, testData.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a size in bytes which is parsed from numbers with an optional binary unit suffix, e.g. `500M` or `2GiB`.
+// It implements pflag.Value to be used as command line flag and yaml.Unmarshaler to be used in config files.
+type ByteSize int64
+
+// byteUnits are the multipliers of the unit suffixes, matched case-insensitively.
+var byteUnits = []struct {
+	suffix     string
+	multiplier int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30}, {"tib", 1 << 40},
+	{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"tb", 1 << 40},
+	{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30}, {"t", 1 << 40},
+	{"b", 1},
+}
+
+// ParseByteSize parses a size in bytes like `1024`, `500M` or `2GiB`, units are powers of 1024.
+func ParseByteSize(value string) (ByteSize, error) {
+	number := strings.ToLower(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q, must be a positive number of bytes with an optional unit like K, M or G", value)
+	}
+	if n > (1<<63-1)/multiplier {
+		return 0, fmt.Errorf("Size %q is too large", value)
+	}
+	return ByteSize(n * multiplier), nil
+}
+
+// String returns the size in bytes.
+func (s *ByteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+// Set parses `value` as size, see ParseByteSize.
+func (s *ByteSize) Set(value string) error {
+	size, err := ParseByteSize(value)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// Type returns the name of the type in the usage of command line flags.
+func (s *ByteSize) Type() string {
+	return "size"
+}
+
+// UnmarshalYAML parses sizes given as number of bytes or as string with a unit.
+func (s *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	return s.Set(value)
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// CertAuthenticator authenticates users by the common name of their verified TLS client certificate instead of passwords,
+// e.g. for machine-to-machine transfers without shared secrets. The username must equal the common name.
+// Servers with a CertAuthenticator must be run with Serve and a TLS config which requires and verifies client certificates.
+// Implements https://godoc.org/github.com/goftp/server#Auth and ConnAuth of the goftp fork.
+type CertAuthenticator struct {
+	logger logrus.FieldLogger
+}
+
+// NewCertAuthenticator returns a CertAuthenticator.
+func NewCertAuthenticator() *CertAuthenticator {
+	return &CertAuthenticator{}
+}
+
+// log returns the logger of the authenticator, the global logger of logrus if none is configured.
+func (a *CertAuthenticator) log() logrus.FieldLogger {
+	return orStandardLogger(a.logger)
+}
+
+// CheckPasswd always returns `false` since passwords sent by clients are never accepted.
+func (a *CertAuthenticator) CheckPasswd(username, password string) (bool, error) {
+	return false, fmt.Errorf("User %q presented no verified TLS client certificate", username)
+}
+
+// CheckConnPasswd returns `true` if the client of `conn` presented a verified certificate with the common name `username`.
+func (a *CertAuthenticator) CheckConnPasswd(conn *ftp.Conn, username, password string) (bool, error) {
+	commonName := verifiedCommonName(conn)
+	if commonName == "" {
+		return a.CheckPasswd(username, password)
+	}
+	if commonName != username {
+		a.log().WithFields(logrus.Fields{"user": username, "action": "LOGIN"}).Warnf("Rejecting login of %q with the TLS client certificate of %q", username, commonName)
+		return false, nil
+	}
+	return true, nil
+}
+
+// verifiedCommonName returns the common name of the verified client certificate of the control connection of `conn`,
+// empty if it is no TLS connection or the client presented no verified certificate.
+func verifiedCommonName(conn *ftp.Conn) string {
+	state, ok := conn.TLSConnectionState()
+	if !ok || !state.HandshakeComplete || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
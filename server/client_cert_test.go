@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// newTestCert returns a certificate of `commonName` signed by `parent`, self-signed if nil.
+func newTestCert(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	issuer, issuerKey := template, interface{}(key)
+	if parent != nil {
+		issuer, issuerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %s", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeTestCert writes a self-signed certificate of a server and its key to `dir` and returns their paths.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	certificate := newTestCert(t, "localhost", nil)
+	keyDER, err := x509.MarshalECPrivateKey(certificate.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %s", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %s", err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "f3-client-cert")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "f3 test CA", nil)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	bucketName := "test-bucket"
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				s3:         &s3Mock{bucket: newBucketMock(bucketName)},
+				metrics:    metricsSenderMock{},
+				bucketName: bucketName,
+				bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}, nil
+		}),
+		Auth:         NewCertAuthenticator(),
+		TLS:          true,
+		ExplicitFTPS: true,
+		CertFile:     certFile,
+		KeyFile:      keyFile,
+		Logger:       &FTPLogger{},
+	})
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	go Serve(ftpServer, listener, &tls.Config{ClientCAs: clientCAs, ClientAuth: tls.RequireAndVerifyClientCert})
+	defer ftpServer.Shutdown()
+
+	alice := newTestCert(t, "alice", &ca)
+	untrusted := newTestCert(t, "alice", nil)
+	tCases := []struct {
+		name        string
+		certificate *tls.Certificate
+		user        string
+		reply       string
+	}{
+		{"verified-certificate", &alice, "alice", "230"},
+		{"other-user", &alice, "bob", "530"},
+		{"no-certificate", nil, "alice", ""},
+		{"untrusted-certificate", &untrusted, "alice", ""},
+	}
+	for _, tCase := range tCases {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Connecting failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		replies := bufio.NewReader(conn)
+		if welcome, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(welcome, "220") {
+			t.Fatalf("Test %s: expected the welcome message but was %q: %v", tCase.name, welcome, err)
+		}
+		fmt.Fprint(conn, "AUTH TLS\r\n")
+		if reply, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(reply, "234") {
+			t.Fatalf("Test %s: unexpected reply to AUTH TLS %q: %v", tCase.name, reply, err)
+		}
+		clientConfig := &tls.Config{InsecureSkipVerify: true}
+		if tCase.certificate != nil {
+			clientConfig.Certificates = []tls.Certificate{*tCase.certificate}
+		}
+		tlsConn := tls.Client(conn, clientConfig)
+		replies = bufio.NewReader(tlsConn)
+		fmt.Fprintf(tlsConn, "USER %s\r\n", tCase.user)
+		reply, err := replies.ReadString('\n')
+		if tCase.reply == "" {
+			// TLS 1.3 clients only notice the rejected certificate when reading
+			if err == nil {
+				t.Errorf("Test %s: expected the TLS handshake to fail but got %q", tCase.name, reply)
+			}
+			conn.Close()
+			continue
+		}
+		if err != nil || !strings.HasPrefix(reply, "331") {
+			t.Fatalf("Test %s: unexpected reply to USER %q: %v", tCase.name, reply, err)
+		}
+		fmt.Fprint(tlsConn, "PASS ignored\r\n")
+		if reply, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(reply, tCase.reply) {
+			t.Errorf("Test %s: expected reply %s to PASS but was %q: %v", tCase.name, tCase.reply, reply, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestCertAuthenticatorRejectsPasswords(t *testing.T) {
+	auth := NewCertAuthenticator()
+	if ok, err := auth.CheckPasswd("alice", "password"); ok || err == nil {
+		t.Errorf("Expected passwords to be rejected")
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"sync"
+)
+
+// connectionTerminated is the message goftp logs when a connection was closed.
+// goftp has no hook for closed connections, so FTPLogger watches for this message to record logouts.
+const connectionTerminated = "Connection Terminated"
+
+// connections counts the open FTP connections and limits their number, see filterListener.
+type connections struct {
+	lock sync.Mutex
+	open int
+	max  int
+}
+
+// acquire registers a new connection.
+// It returns false if the maximum number of connections is reached, unlimited if max is 0.
+func (c *connections) acquire() bool {
+	if c == nil {
+		return true
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.max > 0 && c.open >= c.max {
+		return false
+	}
+	c.open++
+	return true
+}
+
+// release unregisters a closed connection.
+func (c *connections) release() {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.open > 0 {
+		c.open--
+	}
+}
+
+// count returns the number of open connections.
+func (c *connections) count() int {
+	if c == nil {
+		return 0
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.open
+}
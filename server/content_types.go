@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// sniffLength is the number of bytes http.DetectContentType considers.
+const sniffLength = 512
+
+// parseContentTypePatterns validates the allowed content types `patterns`, e.g. `image/*` or `application/pdf`.
+// The patterns are returned in lower case without parameters, e.g. `; charset=utf-8`.
+func parseContentTypePatterns(patterns []string) ([]string, error) {
+	parsed := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		parts := strings.Split(pattern, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" || (parts[0] == "*" && parts[1] != "*") {
+			return nil, fmt.Errorf("Invalid content type %q, must be like type/subtype, type/* or */*", pattern)
+		}
+		parsed = append(parsed, pattern)
+	}
+	return parsed, nil
+}
+
+// matchContentType returns true if the content type `contentType` matches any of the patterns `patterns`.
+func matchContentType(patterns []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkContentType rejects the upload of `data` as object with key `key` if its content type is not allowed.
+// Both the content type of the extension and the one detected from the first 512 bytes of `data` must be allowed,
+// so that e.g. executables can not be uploaded with the extension of an image.
+// The detected type of appended data says nothing about the object, thus appends are only checked by their extension.
+// It returns a reader of all data including the bytes read for detecting its type.
+func (d *S3Driver) checkContentType(key string, data io.Reader, appendMode bool) (io.Reader, error) {
+	if len(d.allowContentTypes) == 0 {
+		return data, nil
+	}
+	if contentType := d.contentType(key); !matchContentType(d.allowContentTypes, contentType) {
+		return data, fmt.Errorf("content type %q of %q %w", contentType, d.fqdn(key), ErrContentTypeForbidden)
+	}
+	if appendMode {
+		return data, nil
+	}
+
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(data, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return data, fmt.Errorf("Failed to read data to upload to %q: %w", d.fqdn(key), err)
+	}
+	head = head[:n]
+	if detected := http.DetectContentType(head); !matchContentType(d.allowContentTypes, detected) {
+		return data, fmt.Errorf("detected content type %q of %q %w", detected, d.fqdn(key), ErrContentTypeForbidden)
+	}
+	return io.MultiReader(bytes.NewReader(head), data), nil
+}
@@ -1,80 +1,228 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/request"
 	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
 	"github.com/spreadshirt/f3/s3ext"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	ftp "github.com/goftp/server"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/aws/aws-sdk-go/service/sts"
 	goErrors "github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
 )
 
 const (
 	// DefaultFeatureSet is the driver default (set of) features
 	DefaultFeatureSet = "ls"
+	// DefaultAnonymousFeatureSet is the default (set of) features of anonymous users
+	DefaultAnonymousFeatureSet = "ls,get"
 	// DefaultRegion is the default bucket region
 	DefaultRegion = "custom"
+	// DefaultPresignTTL is the default time presigned URLs are valid
+	DefaultPresignTTL = 15 * time.Minute
+	// AddressingStyleAuto uses virtual hosted-style requests for AWS endpoints and path-style requests for others, e.g. IP addresses or MinIO
+	AddressingStyleAuto = "auto"
+	// AddressingStylePath uses path-style requests (`https://endpoint/bucket/key`)
+	AddressingStylePath = "path"
+	// AddressingStyleVirtual uses virtual hosted-style requests (`https://bucket.endpoint/key`)
+	AddressingStyleVirtual = "virtual"
+	// MetricsCloudWatch sends metrics to CloudWatch
+	MetricsCloudWatch = "cloudwatch"
+	// MetricsPrometheus serves metrics to be scraped by Prometheus
+	MetricsPrometheus = "prometheus"
+	// MetricsStatsd sends metrics to a StatsD collector
+	MetricsStatsd = "statsd"
+	// MetricsNone disables metrics
+	MetricsNone = "none"
 )
 
 // DriverFactory builds FTP drivers.
 // Implements https://godoc.org/github.com/goftp/server#DriverFactory
 type DriverFactory struct {
-	featureFlags      int
-	noOverwrite       bool
-	awsCredentials    *credentials.Credentials
-	s3PathStyle       bool
-	s3SignatureV2     bool
-	s3Region          string
-	s3Endpoint        string
-	hostname          string
-	bucketName        string
-	bucketURL         *url.URL
-	DisableCloudWatch bool
-	DisableSSL        bool
+	featureFlags        int
+	anonymousFeatures   int
+	anonymousPublic     bool
+	users               *Authenticator
+	transfers           *transfers
+	connections         *connections
+	ipFilter            *ipFilter
+	readiness           *readiness
+	auditor             *auditor
+	webhook             *webhook
+	statCache           *statCache
+	tracer              Tracer
+	logger              logrus.FieldLogger
+	idleTimeout         time.Duration
+	maxUploadSize       int64
+	noOverwrite         bool
+	strictDelete        bool
+	dryRun              bool
+	awsCredentials      *credentials.Credentials
+	secretCredentials   *credentials.Credentials
+	secretProvider      *secretsManagerProvider
+	userCredentials     map[string]*credentials.Credentials
+	userS3              map[string]userS3API
+	sessionPolicy       *sessionPolicy
+	s3Client            s3iface.S3API
+	s3Uploader          s3manageriface.UploaderAPI
+	s3PathStyle         bool
+	s3Accelerate        bool
+	s3DualStack         bool
+	s3Timeout           time.Duration
+	s3Proxy             *url.URL
+	s3RootCAs           *x509.CertPool
+	s3MaxRetries        int
+	s3SignatureV2       bool
+	s3Region            string
+	s3Endpoint          string
+	hostname            string
+	bucketName          string
+	readBucketName      string
+	writeBucketName     string
+	bucketURL           *url.URL
+	keyPrefix           string
+	contentTypes        map[string]string
+	allowContentTypes   []string
+	storageClass        string
+	objectLock          *objectLock
+	sse                 string
+	sseKMSKeyID         string
+	acl                 string
+	metadata            map[string]string
+	verifyMD5           bool
+	tags                string
+	compress            bool
+	listModTimes        bool
+	compressExtensions  map[string]bool
+	partSize            int64
+	downloadPartSize    int64
+	downloadConcurrency int
+	presignThreshold    int64
+	presignTTL          time.Duration
+	concurrency         int
+	leavePartsOnError   bool
+	metrics             MetricsSender
+	DisableCloudWatch   bool
+	DisableSSL          bool
 }
 
 // NewDriver returns a new FTP driver.
 func (d DriverFactory) NewDriver() (ftp.Driver, error) {
-	logrus.Debugf("Trying to create an aws session with: Region: %q, PathStyle: %v, Endpoint: %q", d.s3Region, d.s3PathStyle, d.s3Endpoint)
-	s3Session, err := session.NewSession(&aws.Config{
-		Region:           aws.String(d.s3Region),
-		S3ForcePathStyle: aws.Bool(d.s3PathStyle),
-		Endpoint:         aws.String(d.s3Endpoint),
-		Credentials:      d.awsCredentials,
-		DisableSSL:       aws.Bool(d.DisableSSL),
-	})
+	driver, err := d.newDriver()
+	if err != nil {
+		return nil, err
+	}
+	var ftpDriver ftp.Driver = driver
+	if d.tracer != nil {
+		// requests of given clients are not traced, they are shared by all drivers
+		client, _ := driver.s3.(*s3.S3)
+		if d.s3Client != nil {
+			client = nil
+		}
+		ftpDriver = newTracingDriver(driver, d.tracer, client)
+	}
+	if d.auditor != nil {
+		ftpDriver = newAuditDriver(ftpDriver, driver, d.auditor)
+	}
+	return ftpDriver, nil
+}
+
+// newDriver returns a new FTP driver which uses the configured s3 client and settings.
+func (d DriverFactory) newDriver() (*S3Driver, error) {
+	s3Client, uploader, err := d.newS3API()
 	if err != nil {
 		return nil, goErrors.Wrapf(err, "Failed to instantiate driver")
 	}
-	s3Client := s3.New(s3Session)
 
-	if d.s3SignatureV2 {
-		logrus.Debug("Using Signature V2 Format")
-		s3Client.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
-			Name: "v2Signer",
-			Fn: func(req *request.Request) {
-				s3ext.SignV2(req)
-			},
-		})
+	driver := &S3Driver{
+		featureFlags:        d.featureFlags,
+		anonymousFeatures:   d.anonymousFeatures,
+		users:               d.users,
+		transfers:           d.transfers,
+		idleTimeout:         d.idleTimeout,
+		maxUploadSize:       d.maxUploadSize,
+		noOverwrite:         d.noOverwrite,
+		strictDelete:        d.strictDelete,
+		dryRun:              d.dryRun,
+		logger:              d.logger,
+		leavePartsOnError:   d.leavePartsOnError,
+		s3:                  s3Client,
+		uploader:            uploader,
+		userS3:              d.userS3,
+		sessionPolicy:       d.sessionPolicy,
+		bucketName:          d.bucketName,
+		readBucketName:      d.readBucketName,
+		writeBucketName:     d.writeBucketName,
+		bucketURL:           d.bucketURL,
+		keyPrefix:           d.keyPrefix,
+		contentTypes:        d.contentTypes,
+		allowContentTypes:   d.allowContentTypes,
+		webhook:             d.webhook,
+		statCache:           d.statCache,
+		storageClass:        d.storageClass,
+		objectLock:          d.objectLock,
+		sse:                 d.sse,
+		sseKMSKeyID:         d.sseKMSKeyID,
+		acl:                 d.acl,
+		metadata:            d.metadata,
+		verifyMD5:           d.verifyMD5,
+		tags:                d.tags,
+		compress:            d.compress,
+		listModTimes:        d.listModTimes,
+		compressExtensions:  d.compressExtensions,
+		partSize:            d.partSize,
+		downloadPartSize:    d.downloadPartSize,
+		downloadConcurrency: d.downloadConcurrency,
+		presignThreshold:    d.presignThreshold,
+		presignTTL:          d.presignTTL,
+	}
+
+	if d.anonymousPublic {
+		anonymousS3Client, err := d.newS3Client(credentials.AnonymousCredentials)
+		if err != nil {
+			return nil, goErrors.Wrapf(err, "Failed to instantiate driver for anonymous users")
+		}
+		driver.anonymousS3 = anonymousS3Client
+		driver.anonymousUploader = d.newUploader(anonymousS3Client)
 	}
 
 	var metricsSender MetricsSender
-	if d.DisableCloudWatch {
+	switch {
+	case d.metrics != nil:
+		// shared by all drivers, e.g. the Prometheus collectors
+		metricsSender = d.metrics
+	case d.DisableCloudWatch:
 		metricsSender = NopSender{}
-	} else {
+	default:
 		cloudwatchSession, err := session.NewSession(&aws.Config{
 			Region:      aws.String(d.s3Region),
 			Credentials: d.awsCredentials,
+			HTTPClient:  d.httpClient(),
 		})
 		if err != nil {
 			return nil, goErrors.Wrapf(err, "Failed to create cloudwatch session")
@@ -85,50 +233,512 @@ func (d DriverFactory) NewDriver() (ftp.Driver, error) {
 			return nil, goErrors.Wrapf(err, "Failed to instantiate cloudwatch sender")
 		}
 	}
-	return S3Driver{
-		featureFlags: d.featureFlags,
-		noOverwrite:  d.noOverwrite,
-		s3:           s3Client,
-		uploader:     s3manager.NewUploaderWithClient(s3Client),
-		metrics:      metricsSender,
-		bucketName:   d.bucketName,
-		bucketURL:    d.bucketURL,
-	}, nil
+	driver.metrics = metricsSender
+	return driver, nil
+}
+
+// newS3Client returns an s3 client which uses the credentials `creds`.
+func (d DriverFactory) newS3Client(creds *credentials.Credentials) (*s3.S3, error) {
+	s3Session, err := d.newS3Session(creds)
+	if err != nil {
+		return nil, err
+	}
+	return d.s3ClientOf(s3Session), nil
+}
+
+// newS3Session returns a session for s3 clients which uses the credentials `creds`.
+func (d DriverFactory) newS3Session(creds *credentials.Credentials) (*session.Session, error) {
+	d.log().Debugf("Trying to create an aws session with: Region: %q, PathStyle: %v, Endpoint: %q, Accelerate: %v, DualStack: %v", d.s3Region, d.s3PathStyle, d.s3Endpoint, d.s3Accelerate, d.s3DualStack)
+	endpoint := d.s3Endpoint
+	if d.s3DualStack {
+		// the dualstack endpoint of the region is resolved by the SDK
+		endpoint = ""
+	}
+	return session.NewSession(&aws.Config{
+		Region:           aws.String(d.s3Region),
+		S3ForcePathStyle: aws.Bool(d.s3PathStyle),
+		S3UseAccelerate:  aws.Bool(d.s3Accelerate),
+		UseDualStack:     aws.Bool(d.s3DualStack),
+		Endpoint:         aws.String(endpoint),
+		HTTPClient:       d.httpClient(),
+		MaxRetries:       aws.Int(d.s3MaxRetries),
+		Credentials:      creds,
+		DisableSSL:       aws.Bool(d.DisableSSL),
+	})
+}
+
+// s3ClientOf returns an s3 client of the session `s3Session`, `configs` override the settings of the session.
+func (d DriverFactory) s3ClientOf(s3Session *session.Session, configs ...*aws.Config) *s3.S3 {
+	s3Client := s3.New(s3Session, configs...)
+
+	if d.s3SignatureV2 {
+		d.log().Debug("Using Signature V2 Format")
+		s3Client.Handlers.Sign.Swap(v4.SignRequestHandler.Name, request.NamedHandler{
+			Name: "v2Signer",
+			Fn: func(req *request.Request) {
+				s3ext.SignV2(req)
+			},
+		})
+	}
+	return s3Client
+}
+
+// httpClient returns the HTTP client for AWS requests.
+// Requests are sent through the configured proxy, otherwise the proxy environment variables (HTTPS_PROXY, NO_PROXY) apply.
+// The timeout limits connecting and waiting for the response headers but not transferring bodies,
+// thus large uploads and downloads are not aborted.
+func (d DriverFactory) httpClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if d.s3Proxy != nil {
+		transport.Proxy = http.ProxyURL(d.s3Proxy)
+	}
+	if d.s3RootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: d.s3RootCAs}
+	}
+	if d.s3Timeout > 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   d.s3Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = d.s3Timeout
+		transport.ResponseHeaderTimeout = d.s3Timeout
+	}
+	return &http.Client{Transport: transport}
+}
+
+// newS3API returns the s3 client and uploader of a driver, either the given ones or new ones.
+func (d DriverFactory) newS3API() (s3iface.S3API, s3manageriface.UploaderAPI, error) {
+	if d.s3Client != nil {
+		if d.s3Uploader != nil {
+			return d.s3Client, d.s3Uploader, nil
+		}
+		return d.s3Client, d.newUploader(d.s3Client), nil
+	}
+	s3Client, err := d.newS3Client(d.awsCredentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s3Client, d.newUploader(s3Client), nil
+}
+
+// newUploader returns an uploader for `s3Client` which uses the configured upload options.
+func (d DriverFactory) newUploader(s3Client s3iface.S3API) *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(s3Client, func(u *s3manager.Uploader) {
+		u.PartSize = d.partSize
+		u.Concurrency = d.concurrency
+		u.LeavePartsOnError = d.leavePartsOnError
+	})
 }
 
 // FactoryConfig wraps config values required to setup an FTP driver and for the s3 backend.
+// The keys of config files match the names of the command line flags.
 type FactoryConfig struct {
-	FtpFeatures       string
-	FtpNoOverwrite    bool
-	S3Credentials     string
-	S3BucketURL       string
-	S3Region          string
-	S3Endpoint        string
-	S3UsePathStyle    bool
-	S3SignatureV2     bool
-	DisableCloudWatch bool
-	S3DisableSSL      bool
+	FtpFeatures string `yaml:"features" json:"features"`
+	// FtpUsers provides per-user settings like feature sets which take precedence over the global ones, optional.
+	FtpUsers       *Authenticator `yaml:"-" json:"-"`
+	FtpNoOverwrite bool           `yaml:"no-overwrite" json:"no-overwrite"`
+	// FtpStrictDelete fails the deletion of missing files instead of reporting success like s3, costs a HEAD request per deletion.
+	FtpStrictDelete bool `yaml:"strict-delete" json:"strict-delete"`
+	// FtpDryRun logs the s3 requests of uploads, deletions, renames and new directories instead of sending them and reports success,
+	// e.g. to validate feature sets and prefixes against production clients. Reads are sent as usual.
+	FtpDryRun bool `yaml:"dry-run" json:"dry-run"`
+	// FtpMaxUploadSize is the maximum size in bytes of a single upload, e.g. `500M`, unlimited if 0.
+	FtpMaxUploadSize ByteSize `yaml:"max-upload-size" json:"max-upload-size"`
+	// FtpListModTimes reports the modification times set by clients (`x-amz-meta-mtime`) in listings, costs a HEAD request per listed file.
+	// Stat, e.g. of MDTM, reports them regardless.
+	FtpListModTimes bool `yaml:"list-mtime" json:"list-mtime"`
+	// FtpStatCacheTTL is the time the metadata of objects returned by Stat is cached, e.g. for GUI clients browsing directories, disabled if 0.
+	// Modifications of other clients than f3 are only visible after the TTL.
+	FtpStatCacheTTL time.Duration `yaml:"stat-cache-ttl" json:"stat-cache-ttl"`
+	// FtpStatCacheSize is the maximum number of objects whose metadata is cached, DefaultStatCacheSize if 0.
+	FtpStatCacheSize int `yaml:"stat-cache-size" json:"stat-cache-size"`
+	// FtpIdleTimeout closes connections without any file operation for this duration, disabled if 0.
+	// Uploads which receive no data for this duration are aborted.
+	FtpIdleTimeout time.Duration `yaml:"idle-timeout" json:"idle-timeout"`
+	// FtpMaxConnections is the maximum number of simultaneous connections, unlimited if 0.
+	FtpMaxConnections int `yaml:"max-connections" json:"max-connections"`
+	// FtpAllowCIDRs are the networks, e.g. `10.0.0.0/8`, clients may connect from, all if empty.
+	FtpAllowCIDRs []string `yaml:"allow-cidr" json:"allow-cidr"`
+	// FtpDenyCIDRs are the networks clients may not connect from, they take precedence over FtpAllowCIDRs.
+	FtpDenyCIDRs []string `yaml:"deny-cidr" json:"deny-cidr"`
+	// FtpAllowAnonymous allows anonymous logins (`anonymous` or `ftp` with any password).
+	FtpAllowAnonymous bool `yaml:"allow-anonymous" json:"allow-anonymous"`
+	// FtpAnonymousFeatures is the feature set of anonymous users, `ls,get` if empty.
+	FtpAnonymousFeatures string `yaml:"anonymous-features" json:"anonymous-features"`
+	// FtpAnonymousWrite allows modifying features like `put` or `rm` in FtpAnonymousFeatures.
+	FtpAnonymousWrite bool `yaml:"anonymous-write" json:"anonymous-write"`
+	// S3AnonymousPublic sends the requests of anonymous users without credentials, e.g. to a bucket which permits public reads.
+	S3AnonymousPublic bool `yaml:"s3-anonymous-public" json:"s3-anonymous-public"`
+	// S3Credentials are static credentials `access_key:secret_key[:session_token]`, the secret of AWS Secrets Manager
+	// containing them like `secretsmanager://name` or the field of a secret of Vault containing them like `vault://secret/data/f3/s3/credentials`,
+	// the default credential chain is used if empty.
+	S3Credentials string `yaml:"s3-credentials" json:"s3-credentials"`
+	// S3Profile is the profile in the shared credentials file (~/.aws/credentials) used instead of S3Credentials.
+	S3Profile string `yaml:"s3-profile" json:"s3-profile"`
+	// S3AssumeRoleARN is the ARN of a role which is assumed with the given credentials to access the bucket.
+	S3AssumeRoleARN string `yaml:"s3-assume-role-arn" json:"s3-assume-role-arn"`
+	// S3ExternalID is the external id passed when assuming the role S3AssumeRoleARN.
+	S3ExternalID string `yaml:"s3-external-id" json:"s3-external-id"`
+	// Vault reads S3Credentials given as field of a secret of Vault, required for `vault://` references.
+	Vault *VaultClient `yaml:"-" json:"-"`
+	// S3UserCredentials is the path of a file which assigns FTP users their own s3 credentials, one `user:access_key:secret_key[:session_token]`
+	// or `user:role_arn` per line, roles are assumed with the global credentials. Users without own credentials use the global ones.
+	S3UserCredentials string `yaml:"s3-user-credentials" json:"s3-user-credentials"`
+	// S3SessionPolicy is the path of a JSON IAM policy template which restricts the credentials of the role S3AssumeRoleARN
+	// for each user, e.g. to the home prefix. The placeholders `{{.Bucket}}`, `{{.Prefix}}` (the key prefix of the user's objects
+	// with trailing slash) and `{{.User}}` are expanded when a user logs in. Users with own s3 credentials are not affected.
+	S3SessionPolicy string `yaml:"s3-session-policy" json:"s3-session-policy"`
+	S3BucketURL     string `yaml:"s3-bucket" json:"s3-bucket"`
+	// S3KeyPrefix is prepended to all keys, e.g. to share a bucket with other applications, FTP clients do not see it.
+	S3KeyPrefix string `yaml:"s3-prefix" json:"s3-prefix"`
+	// S3ReadBucket is the name of the bucket files are listed and downloaded from, e.g. a bucket replicated for distribution, S3BucketURL's bucket if empty.
+	// It is accessed with the same client as S3BucketURL's bucket, thus it must be located at the same endpoint and in the same region.
+	S3ReadBucket string `yaml:"s3-read-bucket" json:"s3-read-bucket"`
+	// S3WriteBucket is the name of the bucket files are uploaded to, e.g. for ingestion, S3BucketURL's bucket if empty.
+	// Files are also created, renamed and deleted in this bucket.
+	S3WriteBucket string `yaml:"s3-write-bucket" json:"s3-write-bucket"`
+	S3Region      string `yaml:"s3-region" json:"s3-region"`
+	S3Endpoint    string `yaml:"s3-endpoint" json:"s3-endpoint"`
+	// S3UsePathStyle forces path-style requests like S3AddressingStyle `path`.
+	S3UsePathStyle bool `yaml:"s3-pathStyle" json:"s3-pathStyle"`
+	// S3AddressingStyle is the addressing style of s3 requests, either AddressingStyleAuto, AddressingStylePath or AddressingStyleVirtual, auto if empty.
+	S3AddressingStyle string `yaml:"s3-addressing-style" json:"s3-addressing-style"`
+	S3SignatureV2     bool   `yaml:"s3-signatureV2" json:"s3-signatureV2"`
+	DisableCloudWatch bool   `yaml:"disable-cloudwatch" json:"disable-cloudwatch"`
+	S3DisableSSL      bool   `yaml:"s3-disableSSL" json:"s3-disableSSL"`
+	// S3Accelerate uses S3 Transfer Acceleration, which is incompatible with path-style requests and custom endpoints.
+	S3Accelerate bool `yaml:"s3-accelerate" json:"s3-accelerate"`
+	// S3DualStack uses the IPv4 and IPv6 dualstack endpoint of the bucket's region.
+	S3DualStack bool `yaml:"s3-dualstack" json:"s3-dualstack"`
+	// S3Timeout limits connecting to s3 and waiting for responses, disabled if 0.
+	S3Timeout time.Duration `yaml:"s3-timeout" json:"s3-timeout"`
+	// S3MaxRetries is the maximum number of retries of failed s3 requests, the SDK's default (3) if 0 and none if negative.
+	S3MaxRetries int `yaml:"s3-max-retries" json:"s3-max-retries"`
+	// S3Proxy is the URL of the proxy for all AWS requests, the proxy environment variables (HTTPS_PROXY) apply if empty.
+	S3Proxy string `yaml:"s3-proxy" json:"s3-proxy"`
+	// S3CACert is the path of PEM encoded CA certificates trusted in addition to the system's ones, e.g. of self-signed endpoints.
+	S3CACert string `yaml:"s3-ca-cert" json:"s3-ca-cert"`
+	// S3Client is used by all drivers instead of creating a client, e.g. to embed f3 with a client with tracing handlers.
+	// S3BucketURL is still required, the settings of the AWS session like credentials or the endpoint are not used.
+	S3Client s3iface.S3API `yaml:"-" json:"-"`
+	// S3Uploader uploads the files of all drivers if S3Client is given, an s3manager.Uploader of S3Client if nil.
+	S3Uploader s3manageriface.UploaderAPI `yaml:"-" json:"-"`
+	// UploadWebhook is the URL which is notified about each successful upload by POSTing an UploadNotification as JSON, disabled if empty.
+	// Notifications are sent in the background with retries, failures are logged.
+	UploadWebhook string `yaml:"upload-webhook" json:"upload-webhook"`
+	// AuditLog is the path of a file or an s3 URL like `s3://bucket/prefix` the audit events of logins and file operations are written to as JSON lines,
+	// the events of s3 URLs are uploaded every minute with the credentials and endpoint of S3BucketURL. Auditing is disabled if empty.
+	AuditLog string `yaml:"audit-log" json:"audit-log"`
+	// AuditLogger writes the audit events instead of AuditLog, e.g. to send them to another sink.
+	AuditLogger AuditLogger `yaml:"-" json:"-"`
+	// Tracer traces the operations of drivers and their s3 requests, e.g. OTelTracer, tracing is disabled if nil.
+	Tracer Tracer `yaml:"-" json:"-"`
+	// Logger receives the logs of the server and its drivers instead of the global logger of logrus if not nil,
+	// e.g. a *logrus.Logger with its own level and output or a *logrus.Entry with fields of the embedding application.
+	Logger logrus.FieldLogger `yaml:"-" json:"-"`
+	// S3ContentTypes maps file extensions to content types, overriding the detected type of uploaded objects.
+	S3ContentTypes map[string]string `yaml:"s3-content-types" json:"s3-content-types"`
+	// FtpAllowContentTypes restricts uploads to these content types, e.g. `image/*` or `application/pdf`, all types are allowed if empty.
+	// Both the type of a file's extension and the type detected from its first 512 bytes must be allowed.
+	FtpAllowContentTypes []string `yaml:"allow-content-types" json:"allow-content-types"`
+	// S3StorageClass is the storage class of uploaded objects, the bucket's default is used if empty.
+	S3StorageClass string `yaml:"s3-storage-class" json:"s3-storage-class"`
+	// S3ObjectLockMode is the object lock mode of uploaded objects, either GOVERNANCE or COMPLIANCE, which requires S3ObjectLockRetainUntil.
+	// Object lock settings require the MD5 digest of uploaded data, thus they enable S3VerifyMD5.
+	S3ObjectLockMode string `yaml:"s3-object-lock-mode" json:"s3-object-lock-mode"`
+	// S3ObjectLockRetainUntil is the date like `2030-12-31T00:00:00Z` until which uploaded objects are retained, or the period after their upload like `720h`.
+	S3ObjectLockRetainUntil string `yaml:"s3-object-lock-retain-until" json:"s3-object-lock-retain-until"`
+	// S3ObjectLockLegalHold is the legal hold status of uploaded objects, either ON or OFF.
+	S3ObjectLockLegalHold string `yaml:"s3-object-lock-legal-hold" json:"s3-object-lock-legal-hold"`
+	// S3SSE is the server-side encryption of uploaded objects, either `AES256` or `aws:kms`.
+	S3SSE string `yaml:"s3-sse" json:"s3-sse"`
+	// S3SSEKMSKeyID is the id of the KMS key used if S3SSE is `aws:kms`.
+	S3SSEKMSKeyID string `yaml:"s3-sse-kms-key-id" json:"s3-sse-kms-key-id"`
+	// S3ACL is the canned ACL of uploaded objects, the bucket's default is used if empty.
+	S3ACL string `yaml:"s3-acl" json:"s3-acl"`
+	// S3Metadata is stored as user-defined metadata (`x-amz-meta-*`) on uploaded objects.
+	S3Metadata map[string]string `yaml:"s3-meta" json:"s3-meta"`
+	// S3Tags are the tags of uploaded objects URL encoded, e.g. `retention=30d&source=ftp`.
+	S3Tags string `yaml:"s3-tags" json:"s3-tags"`
+	// S3VerifyMD5 sends the MD5 digest of uploaded data to let s3 reject corrupted uploads.
+	S3VerifyMD5 bool `yaml:"verify-md5" json:"verify-md5"`
+	// S3Compress gzip compresses uploaded objects and sets their content encoding, compressed objects are decompressed when downloading them.
+	// The uncompressed size is stored as metadata `x-amz-meta-uncompressed-size` by copying the object after the upload,
+	// listings request it for each file which is compressed. Compressed objects can not be appended to.
+	S3Compress bool `yaml:"compress" json:"compress"`
+	// S3CompressExtensions limits compression to files with these extensions, e.g. `.txt`, all files are compressed if empty.
+	S3CompressExtensions []string `yaml:"compress-extensions" json:"compress-extensions"`
+	// S3PartSize is the size in bytes of the parts of multipart uploads, at least 5MB.
+	S3PartSize int64 `yaml:"s3-part-size" json:"s3-part-size"`
+	// S3UploadConcurrency is the number of parts of a single upload which are uploaded in parallel.
+	S3UploadConcurrency int `yaml:"s3-upload-concurrency" json:"s3-upload-concurrency"`
+	// S3DownloadConcurrency is the number of parts of a single download which are got in parallel, e.g. for large objects at high latency endpoints.
+	// Objects are got sequentially if it is 0 or 1.
+	S3DownloadConcurrency int `yaml:"download-concurrency" json:"download-concurrency"`
+	// S3DownloadPartSize is the size of the parts of parallel downloads, e.g. `16M`, 5MB if 0.
+	// Each download buffers up to S3DownloadConcurrency parts in memory.
+	S3DownloadPartSize ByteSize `yaml:"download-part-size" json:"download-part-size"`
+	// S3LeavePartsOnError keeps the uploaded parts of failed multipart uploads instead of aborting them.
+	S3LeavePartsOnError bool `yaml:"s3-leave-parts-on-error" json:"s3-leave-parts-on-error"`
+	// S3PresignThreshold is the size in bytes from which SITE GETURL serves a presigned URL of an object, disabled if 0.
+	S3PresignThreshold int64 `yaml:"presign-threshold" json:"presign-threshold"`
+	// S3PresignTTL is the time presigned URLs are valid, at most 7 days.
+	S3PresignTTL time.Duration `yaml:"presign-ttl" json:"presign-ttl"`
+	// Metrics selects the metrics backend, either `cloudwatch`, `prometheus`, `statsd` or `none`.
+	// CloudWatch is used unless DisableCloudWatch is set if empty.
+	Metrics string `yaml:"metrics" json:"metrics"`
+	// MetricsRegisterer registers the Prometheus metrics, prometheus.DefaultRegisterer if nil.
+	MetricsRegisterer prometheus.Registerer `yaml:"-" json:"-"`
+	// StatsdAddr is the address of the StatsD collector, e.g. `127.0.0.1:8125`.
+	StatsdAddr string `yaml:"statsd-addr" json:"statsd-addr"`
+	// StatsdPrefix is prepended to the names of the metrics sent to StatsD.
+	StatsdPrefix string `yaml:"statsd-prefix" json:"statsd-prefix"`
 }
 
 // NewDriverFactory returns a DriverFactory.
 func NewDriverFactory(config *FactoryConfig) (DriverFactory, error) {
-	_, factory, err := setupS3(setupFtp(config, &DriverFactory{}, nil))
-	factory.DisableCloudWatch = config.DisableCloudWatch
+	_, factory, err := setupMetrics(setupS3(setupFtp(config, &DriverFactory{transfers: newTransfers(), connections: &connections{}, readiness: &readiness{}}, nil)))
+	factory.readiness.newClient = func() (s3iface.S3API, error) {
+		client, _, err := factory.newS3API()
+		return client, err
+	}
+	if err != nil {
+		return *factory, err
+	}
+	// the clients of users with own credentials are shared by their connections
+	if len(factory.userCredentials) > 0 {
+		factory.userS3 = make(map[string]userS3API, len(factory.userCredentials))
+		for user, creds := range factory.userCredentials {
+			s3Client, err := factory.newS3Client(creds)
+			if err != nil {
+				return *factory, goErrors.Wrapf(err, "Failed to instantiate s3 client of user %q", user)
+			}
+			factory.userS3[user] = userS3API{s3Client, factory.newUploader(s3Client)}
+		}
+	}
+	if factory.sessionPolicy != nil {
+		if config.S3Client != nil {
+			return *factory, fmt.Errorf("A session policy requires session based s3 clients")
+		}
+		// the clients of users are created when they log in, thus they share a session which can not fail to be created
+		s3Session, err := factory.newS3Session(nil)
+		if err != nil {
+			return *factory, goErrors.Wrap(err, "Failed to create s3 session of users with session policy")
+		}
+		factory.sessionPolicy.bucketName = factory.bucketName
+		factory.sessionPolicy.keyPrefix = factory.keyPrefix
+		factory.sessionPolicy.newS3API = func(creds *credentials.Credentials) userS3API {
+			s3Client := factory.s3ClientOf(s3Session, &aws.Config{Credentials: creds})
+			return userS3API{s3Client, factory.newUploader(s3Client)}
+		}
+	}
+	auditLogger := config.AuditLogger
+	if auditLogger == nil && config.AuditLog != "" {
+		auditLogger, err = newAuditLogger(config.AuditLog, factory.readiness.newClient, factory.logger)
+		if err != nil {
+			return *factory, err
+		}
+	}
+	if auditLogger != nil {
+		factory.auditor = newAuditor(auditLogger, factory.log())
+	}
+	factory.webhook, err = newWebhook(config.UploadWebhook, http.DefaultClient, factory.log())
 	return *factory, err
 }
 
+// Logger returns the logger for the FTP server.
+// It has to be used to record logouts in the audit log since goftp only logs when a connection is closed.
+func (d DriverFactory) Logger() *FTPLogger {
+	return &FTPLogger{auditor: d.auditor, logger: d.logger}
+}
+
+// Auth returns `auth` for the FTP server, authenticators of this package log to the logger of the factory.
+// The authenticators delegated to by AnonymousAuthenticator and LockoutAuthenticator log to it as well.
+func (d DriverFactory) Auth(auth ftp.Auth) ftp.Auth {
+	switch a := auth.(type) {
+	case *CertAuthenticator:
+		copied := *a
+		copied.logger = d.logger
+		return &copied
+	case Authenticator:
+		// copies share the credentials, thus reloading them still applies to the returned authenticator
+		a.logger = d.logger
+		return a
+	case LDAPAuthenticator:
+		a.logger = d.logger
+		return a
+	case AnonymousAuthenticator:
+		return AnonymousAuthenticator{d.Auth(a.auth)}
+	case *LockoutAuthenticator:
+		// the failed logins are kept by the authenticator, thus it is not copied
+		a.lock.Lock()
+		defer a.lock.Unlock()
+		a.auth = d.Auth(a.auth)
+		a.logger = d.logger
+		return a
+	}
+	return auth
+}
+
+// log returns the logger of the server, the global logger of logrus if none is configured.
+func (d DriverFactory) log() logrus.FieldLogger {
+	return orStandardLogger(d.logger)
+}
+
+// Listener wraps `listener` of the FTP server to close the connections of clients
+// which are not allowed to connect by their IP address before the FTP handshake.
+// Clients beyond the maximum number of connections get the reply 421 and are disconnected.
+// Use Serve to serve the connections it accepts.
+func (d DriverFactory) Listener(listener net.Listener) net.Listener {
+	return &filterListener{Listener: listener, filter: d.ipFilter, connections: d.connections, auditor: d.auditor, logger: d.log()}
+}
+
+// Close waits for pending webhook notifications, writes the pending audit events and closes the audit log,
+// e.g. after draining the connections on shutdown.
+func (d DriverFactory) Close() error {
+	webhookErr := d.webhook.close(webhookCloseTimeout)
+	if d.auditor != nil {
+		if err := d.auditor.logger.Close(); err != nil {
+			return goErrors.Wrapf(err, "Failed to close the audit log")
+		}
+	}
+	return webhookErr
+}
+
+// Connections returns the number of open FTP connections accepted by Listener.
+func (d DriverFactory) Connections() int {
+	return d.connections.count()
+}
+
+// abortTimeout is the time aborted uploads get to clean up, e.g. to abort their multipart uploads.
+const abortTimeout = 5 * time.Second
+
+// Drain waits up to `timeout` for the active transfers of all connections to finish,
+// e.g. to shut down the server after it stopped accepting connections.
+// Uploads which are still active afterwards are aborted, so that no parts of multipart uploads are left behind.
+// It returns the number of transfers which finished and which were still active.
+func (d DriverFactory) Drain(timeout time.Duration) (int, int) {
+	drained, active := d.transfers.wait(timeout)
+	if active > 0 {
+		d.transfers.abort()
+		d.transfers.wait(abortTimeout)
+	}
+	return drained, active
+}
+
+// AbortMultipartUploads aborts the multipart uploads of the bucket uploads are written to (below the key prefix) which were initiated more than `age` ago,
+// e.g. to delete the parts of interrupted uploads on startup.
+// It returns the number of aborted uploads.
+func (d DriverFactory) AbortMultipartUploads(age time.Duration) (int, error) {
+	s3Client, _, err := d.newS3API()
+	if err != nil {
+		return 0, goErrors.Wrapf(err, "Failed to create s3 client")
+	}
+	bucketName := d.bucketName
+	if d.writeBucketName != "" {
+		bucketName = d.writeBucketName
+	}
+	return abortMultipartUploads(s3Client, bucketName, d.keyPrefix, time.Now().Add(-age), d.log())
+}
+
+// ReloadCredentials reads the s3 credentials given as secret of AWS Secrets Manager again, e.g. after they were rotated.
+// The current credentials are kept if the secret can not be read.
+func (d DriverFactory) ReloadCredentials() error {
+	if d.secretProvider == nil {
+		return nil
+	}
+	if _, err := d.secretProvider.read(); err != nil {
+		return goErrors.Wrap(err, "Failed to reload s3 credentials")
+	}
+	d.secretCredentials.Expire()
+	d.log().Infof("Reloaded s3 credentials of secret %q", d.secretProvider.uri)
+	return nil
+}
+
+// anyFeatures returns the features which are enabled for any user, e.g. to advertise their FTP extensions before the login.
+func (d DriverFactory) anyFeatures() int {
+	featureFlags := d.featureFlags | d.anonymousFeatures
+	if d.users != nil {
+		featureFlags |= d.users.anyFeatures()
+	}
+	return featureFlags
+}
+
+// VerifyCredentials retrieves the configured AWS credentials, e.g. to fail early if assuming a role is rejected.
+func (d DriverFactory) VerifyCredentials() error {
+	if d.awsCredentials == nil {
+		// the default credential chain is resolved by the session
+		return nil
+	}
+	if _, err := d.awsCredentials.Get(); err != nil {
+		return goErrors.Wrapf(err, "Failed to retrieve AWS credentials")
+	}
+	return nil
+}
+
 func setupFtp(config *FactoryConfig, factory *DriverFactory, err error) (*FactoryConfig, *DriverFactory, error) {
 	if err != nil { // fallthrough
 		return config, factory, err
 	}
+	factory.logger = config.Logger
 	factory.noOverwrite = config.FtpNoOverwrite
+	factory.strictDelete = config.FtpStrictDelete
+	factory.dryRun = config.FtpDryRun
+	if factory.dryRun {
+		factory.log().Warn("DRY RUN: uploads, deletions, renames and new directories are logged but not sent to s3, the bucket is not modified")
+	}
+	if config.FtpIdleTimeout < 0 {
+		return config, factory, fmt.Errorf("idle timeout must not be negative but was %s", config.FtpIdleTimeout)
+	}
+	factory.idleTimeout = config.FtpIdleTimeout
+	factory.listModTimes = config.FtpListModTimes
+	factory.tracer = config.Tracer
+	if config.FtpMaxUploadSize < 0 {
+		return config, factory, fmt.Errorf("maximum upload size must not be negative but was %d", config.FtpMaxUploadSize)
+	}
+	factory.maxUploadSize = int64(config.FtpMaxUploadSize)
+	if config.FtpMaxConnections < 0 {
+		return config, factory, fmt.Errorf("maximum number of connections must not be negative but was %d", config.FtpMaxConnections)
+	}
+	if factory.connections != nil {
+		factory.connections.max = config.FtpMaxConnections
+	}
+	if config.FtpStatCacheTTL < 0 || config.FtpStatCacheSize < 0 {
+		return config, factory, fmt.Errorf("stat cache TTL and size must not be negative but were %s and %d", config.FtpStatCacheTTL, config.FtpStatCacheSize)
+	}
+	factory.statCache = newStatCache(config.FtpStatCacheSize, config.FtpStatCacheTTL)
+	factory.ipFilter, err = parseIPFilter(config.FtpAllowCIDRs, config.FtpDenyCIDRs)
+	if err != nil {
+		return config, factory, err
+	}
 
-	logrus.Debugf("Trying to parse feature set: %q", config.FtpFeatures)
+	factory.log().Debugf("Trying to parse feature set: %q", config.FtpFeatures)
 	featureFlags, err := parseFeatureSet(config.FtpFeatures)
 	if err != nil {
 		return config, factory, goErrors.Wrapf(err, "Failed to parse FTP feature set: %q", config.FtpFeatures)
 	}
 	factory.featureFlags = featureFlags
+	factory.users = config.FtpUsers
+
+	if config.FtpAllowAnonymous {
+		anonymousFeatures := config.FtpAnonymousFeatures
+		if anonymousFeatures == "" {
+			anonymousFeatures = DefaultAnonymousFeatureSet
+		}
+		anonymousFlags, err := parseFeatureSet(anonymousFeatures)
+		if err != nil {
+			return config, factory, goErrors.Wrapf(err, "Failed to parse FTP feature set of anonymous users: %q", anonymousFeatures)
+		}
+		if anonymousFlags == 0 {
+			// anonymous users without features would get the features of all users
+			return config, factory, fmt.Errorf("Feature set of anonymous users %q is empty, disallow anonymous logins instead", anonymousFeatures)
+		}
+		if anonymousFlags&writeFeatures != 0 && !config.FtpAnonymousWrite {
+			return config, factory, fmt.Errorf("Feature set of anonymous users %q contains modifying features, but anonymous writes are not allowed", anonymousFeatures)
+		}
+		factory.anonymousFeatures = anonymousFlags
+		factory.anonymousPublic = config.S3AnonymousPublic
+	}
 
 	return config, factory, nil
 }
@@ -142,8 +752,20 @@ const (
 	featureMakeDir   = 1 << iota
 	featureGet       = 1 << iota
 	featurePut       = 1 << iota
+	featureAppend    = 1 << iota
+	featureVersions  = 1 << iota
+	featureRestore   = 1 << iota
+	featureTags      = 1 << iota
 )
 
+// writeFeatures are the features which modify the bucket.
+const writeFeatures = featureRemoveDir | featureRemove | featureMove | featureMakeDir | featurePut | featureAppend
+
+// allFeatures are all features, enabled by the `all` feature set.
+const allFeatures = featureChangeDir | featureList | writeFeatures | featureGet | featureVersions | featureRestore | featureTags
+
+// parseFeatureSet parses a comma separated list of features, e.g. `ls,get`.
+// `all` enables and `none` disables all features, features prefixed by `-` are disabled again, e.g. `all,-rm,-rmdir`.
 func parseFeatureSet(featureSet string) (int, error) {
 	featureFlags := 0
 	featureSet = strings.TrimSpace(featureSet)
@@ -152,43 +774,241 @@ func parseFeatureSet(featureSet string) (int, error) {
 	}
 	features := strings.Split(featureSet, ",")
 	for _, feature := range features {
-		switch strings.ToLower(feature) {
+		name := strings.ToLower(feature)
+		disable := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+
+		var flag int
+		switch name {
+		case "all":
+			flag = allFeatures
+		case "none":
+			if disable {
+				return 0, fmt.Errorf("Invalid feature flag: %q, use %q instead", feature, "all")
+			}
+			featureFlags = 0
+			continue
 		case "cd":
-			featureFlags |= featureChangeDir
+			flag = featureChangeDir
 		case "ls":
-			featureFlags |= featureList
+			flag = featureList
 		case "rmdir":
-			featureFlags |= featureRemoveDir
+			flag = featureRemoveDir
 		case "rm":
-			featureFlags |= featureRemove
+			flag = featureRemove
 		case "mv":
-			featureFlags |= featureMove
+			flag = featureMove
 		case "mkdir":
-			featureFlags |= featureMakeDir
+			flag = featureMakeDir
 		case "get":
-			featureFlags |= featureGet
+			flag = featureGet
 		case "put":
-			featureFlags |= featurePut
+			flag = featurePut
+		case "append":
+			flag = featureAppend
+		case "versions":
+			flag = featureVersions
+		case "restore":
+			flag = featureRestore
+		case "tags":
+			flag = featureTags
 		default:
 			return 0, fmt.Errorf("Unknown feature flag: %q", feature)
 		}
+		if disable {
+			featureFlags &^= flag
+		} else {
+			featureFlags |= flag
+		}
 	}
 	return featureFlags, nil
 }
 
+func setupMetrics(config *FactoryConfig, factory *DriverFactory, err error) (*FactoryConfig, *DriverFactory, error) {
+	if err != nil { // fallthrough
+		return config, factory, err
+	}
+
+	switch config.Metrics {
+	case "":
+		factory.DisableCloudWatch = config.DisableCloudWatch
+	case MetricsCloudWatch:
+		factory.DisableCloudWatch = false
+	case MetricsNone:
+		factory.DisableCloudWatch = true
+	case MetricsPrometheus:
+		registerer := config.MetricsRegisterer
+		if registerer == nil {
+			registerer = prometheus.DefaultRegisterer
+		}
+		factory.metrics, err = NewPrometheusSender(registerer)
+		if err != nil {
+			return config, factory, err
+		}
+	case MetricsStatsd:
+		if config.StatsdAddr == "" {
+			return config, factory, fmt.Errorf("the address of the StatsD collector is missing")
+		}
+		// the UDP socket is shared by all drivers since goftp does not close drivers
+		sender, err := NewStatsdSender(config.StatsdAddr, config.StatsdPrefix)
+		if err != nil {
+			return config, factory, err
+		}
+		sender.logger = factory.logger
+		factory.metrics = sender
+	default:
+		return config, factory, fmt.Errorf("unknown metrics backend %q, expected one of %q, %q, %q or %q", config.Metrics, MetricsCloudWatch, MetricsPrometheus, MetricsStatsd, MetricsNone)
+	}
+	return config, factory, nil
+}
+
 func setupS3(config *FactoryConfig, factory *DriverFactory, err error) (*FactoryConfig, *DriverFactory, error) {
 	if err != nil { // fallthrough
 		return config, factory, err
 	}
 
-	// credentials
-	pair := strings.SplitN(config.S3Credentials, ":", 2)
-	if len(pair) != 2 {
-		return config, factory, fmt.Errorf("Malformed credentials, not in format: 'access_key:secret_key'")
+	// HTTP client of all AWS sessions
+	if config.S3Timeout < 0 {
+		return config, factory, fmt.Errorf("Invalid s3 timeout %s, must not be negative", config.S3Timeout)
+	}
+	factory.s3Timeout = config.S3Timeout
+	if config.S3Proxy != "" {
+		proxyURL, err := url.Parse(config.S3Proxy)
+		if err != nil {
+			return config, factory, goErrors.Wrapf(err, "Failed to parse proxy URL %q", config.S3Proxy)
+		}
+		if !contains([]string{"http", "https", "socks5"}, proxyURL.Scheme) || proxyURL.Host == "" {
+			return config, factory, fmt.Errorf("Invalid proxy URL %q, expected e.g. http://proxy.example.com:3128", config.S3Proxy)
+		}
+		factory.s3Proxy = proxyURL
+	}
+	if config.S3CACert != "" {
+		factory.s3RootCAs, err = loadCertPool(config.S3CACert, factory.log())
+		if err != nil {
+			return config, factory, err
+		}
+	}
+
+	// clients of embedding applications are used instead of session based ones
+	if config.S3Uploader != nil && config.S3Client == nil {
+		return config, factory, fmt.Errorf("An s3 uploader requires an s3 client")
+	}
+	factory.s3Client = config.S3Client
+	factory.s3Uploader = config.S3Uploader
+
+	// credentials, the default credential chain of the AWS SDK is used if none are given
+	switch {
+	case config.S3Credentials != "" && config.S3Profile != "":
+		return config, factory, fmt.Errorf("Either s3 credentials or a profile can be given, but not both")
+	case config.S3Profile != "":
+		factory.log().Infof("Using s3 credentials of profile %q from the shared credentials file", config.S3Profile)
+		factory.awsCredentials = credentials.NewSharedCredentials("", config.S3Profile)
+	case config.S3Credentials == "" && os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE") != "" && os.Getenv("AWS_ROLE_ARN") != "":
+		roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		factory.log().Infof("Using s3 credentials of role %q assumed with the web identity token %q", roleARN, tokenFile)
+		stsSession, err := session.NewSession(&aws.Config{
+			Region:      aws.String(config.S3Region),
+			Credentials: credentials.AnonymousCredentials,
+			HTTPClient:  factory.httpClient(),
+		})
+		if err != nil {
+			return config, factory, goErrors.Wrapf(err, "Failed to create sts session to assume role %q", roleARN)
+		}
+		factory.awsCredentials = newWebIdentityCredentials(sts.New(stsSession), roleARN, os.Getenv("AWS_ROLE_SESSION_NAME"), tokenFile)
+	case IsSecretsManagerURI(config.S3Credentials):
+		factory.log().Infof("Using s3 credentials of secret %q", config.S3Credentials)
+		client, err := newSecretsManagerClient(config.S3Credentials, config.S3Region, factory.httpClient())
+		if err != nil {
+			return config, factory, err
+		}
+		factory.secretProvider = &secretsManagerProvider{client: client, uri: config.S3Credentials}
+		factory.secretCredentials = credentials.NewCredentials(factory.secretProvider)
+		// fail fast instead of on the first request
+		if _, err := factory.secretCredentials.Get(); err != nil {
+			return config, factory, goErrors.Wrap(err, "Failed to read s3 credentials")
+		}
+		factory.awsCredentials = factory.secretCredentials
+	case IsVaultURI(config.S3Credentials):
+		if config.Vault == nil {
+			return config, factory, fmt.Errorf("s3 credentials %q require the address of Vault", config.S3Credentials)
+		}
+		factory.log().Infof("Using s3 credentials of Vault secret %q", config.S3Credentials)
+		factory.awsCredentials = credentials.NewCredentials(&vaultProvider{client: config.Vault, uri: config.S3Credentials})
+		// fail fast instead of on the first request
+		if _, err := factory.awsCredentials.Get(); err != nil {
+			return config, factory, goErrors.Wrap(err, "Failed to read s3 credentials")
+		}
+	case config.S3Credentials == "":
+		factory.log().Info("No s3 credentials given, using the default credential chain (environment, shared credentials file, instance role)")
+		factory.awsCredentials = nil
+	default:
+		factory.log().Info("Using the given static s3 credentials")
+		factory.awsCredentials, err = parseStaticCredentials(config.S3Credentials)
+		if err != nil {
+			return config, factory, fmt.Errorf("%s. Leave them empty to use the default credential chain (environment, shared credentials file, instance role)", err)
+		}
+	}
+
+	if config.S3AssumeRoleARN != "" {
+		factory.log().Debugf("Assuming role %q to access s3", config.S3AssumeRoleARN)
+		stsSession, err := session.NewSession(&aws.Config{
+			Region:      aws.String(config.S3Region),
+			Credentials: factory.awsCredentials,
+			HTTPClient:  factory.httpClient(),
+		})
+		if err != nil {
+			return config, factory, goErrors.Wrapf(err, "Failed to create sts session to assume role %q", config.S3AssumeRoleARN)
+		}
+		stsClient := sts.New(stsSession)
+		factory.awsCredentials = assumeRoleCredentials(stsClient, config.S3AssumeRoleARN, config.S3ExternalID)
+		if config.S3SessionPolicy != "" {
+			raw, err := ioutil.ReadFile(config.S3SessionPolicy)
+			if err != nil {
+				return config, factory, goErrors.Wrapf(err, "Failed to read session policy %q", config.S3SessionPolicy)
+			}
+			policy, err := parseSessionPolicy(string(raw))
+			if err != nil {
+				return config, factory, goErrors.Wrapf(err, "Failed to parse session policy %q", config.S3SessionPolicy)
+			}
+			// the role is assumed for each user with the credentials the global role is assumed with
+			factory.sessionPolicy = &sessionPolicy{
+				template:   policy,
+				client:     stsClient,
+				roleARN:    config.S3AssumeRoleARN,
+				externalID: config.S3ExternalID,
+				logger:     factory.log(),
+			}
+		}
+	} else if config.S3ExternalID != "" {
+		return config, factory, fmt.Errorf("An external id requires a role to assume")
+	} else if config.S3SessionPolicy != "" {
+		return config, factory, fmt.Errorf("A session policy requires a role to assume")
+	}
+
+	if config.S3UserCredentials != "" {
+		if config.S3Client != nil {
+			return config, factory, fmt.Errorf("s3 credentials of users require session based s3 clients")
+		}
+		raw, err := ioutil.ReadFile(config.S3UserCredentials)
+		if err != nil {
+			return config, factory, goErrors.Wrapf(err, "Failed to read s3 credentials of users %q", config.S3UserCredentials)
+		}
+		stsSession, err := session.NewSession(&aws.Config{
+			Region:      aws.String(config.S3Region),
+			Credentials: factory.awsCredentials,
+			HTTPClient:  factory.httpClient(),
+		})
+		if err != nil {
+			return config, factory, goErrors.Wrap(err, "Failed to create sts session to assume the roles of users")
+		}
+		factory.userCredentials, err = parseUserCredentials(string(raw), func(roleARN string) *credentials.Credentials {
+			return assumeRoleCredentials(sts.New(stsSession), roleARN, "")
+		})
+		if err != nil {
+			return config, factory, goErrors.Wrapf(err, "Failed to parse s3 credentials of users %q", config.S3UserCredentials)
+		}
+		factory.log().Infof("Using own s3 credentials of %d users", len(factory.userCredentials))
 	}
-	accessKey, secretKey := pair[0], pair[1]
-	sessionToken := ""
-	factory.awsCredentials = credentials.NewStaticCredentials(accessKey, secretKey, sessionToken)
 
 	bucketURL, err := url.Parse(config.S3BucketURL)
 	if err != nil {
@@ -198,7 +1018,7 @@ func setupS3(config *FactoryConfig, factory *DriverFactory, err error) (*Factory
 
 	if config.S3Endpoint == "" {
 		// retrieve bucket name and endpoint from bucket FQDN
-		pair = strings.SplitN(bucketURL.Host, ".", 2)
+		pair := strings.SplitN(bucketURL.Host, ".", 2)
 		if len(pair) != 2 {
 			return config, factory, fmt.Errorf("Not a fully qualified bucket name (e.g. 'bucket.host.domain'): %q", bucketURL.String())
 		}
@@ -209,11 +1029,373 @@ func setupS3(config *FactoryConfig, factory *DriverFactory, err error) (*Factory
 		factory.bucketName = bucketURL.Host
 		factory.s3Endpoint = config.S3Endpoint
 	}
+	// `..` elements are resolved, the prefix is always located inside the bucket
+	factory.keyPrefix = strings.Trim(path.Clean("/"+config.S3KeyPrefix), "/")
+	if factory.readBucketName, err = parseBucketName(config.S3ReadBucket); err != nil {
+		return config, factory, goErrors.Wrapf(err, "Invalid read bucket")
+	}
+	if factory.writeBucketName, err = parseBucketName(config.S3WriteBucket); err != nil {
+		return config, factory, goErrors.Wrapf(err, "Invalid write bucket")
+	}
 
 	factory.s3Region = config.S3Region
-	factory.s3PathStyle = config.S3UsePathStyle
+	if (config.S3Region == "" || config.S3Region == DefaultRegion) && isAWSEndpoint(factory.s3Endpoint) && config.S3Client == nil {
+		factory.s3Region = detectRegion(factory, config.S3Region)
+	}
+	if factory.s3PathStyle, err = usePathStyle(config.S3AddressingStyle, config.S3UsePathStyle, factory.s3Endpoint); err != nil {
+		return config, factory, err
+	}
+	if factory.s3PathStyle {
+		factory.log().Debugf("Using path-style requests for endpoint %q", factory.s3Endpoint)
+	} else {
+		factory.log().Debugf("Using virtual hosted-style requests for endpoint %q", factory.s3Endpoint)
+	}
 	factory.s3SignatureV2 = config.S3SignatureV2
+
+	if config.S3Accelerate {
+		if config.S3Endpoint != "" || !isAWSEndpoint(factory.s3Endpoint) {
+			return config, factory, fmt.Errorf("Transfer acceleration is incompatible with the custom endpoint %q", factory.s3Endpoint)
+		}
+		if factory.s3PathStyle {
+			return config, factory, fmt.Errorf("Transfer acceleration is incompatible with path-style requests")
+		}
+	}
+	factory.s3Accelerate = config.S3Accelerate
+	if config.S3DualStack {
+		if !isAWSEndpoint(factory.s3Endpoint) {
+			return config, factory, fmt.Errorf("Dualstack endpoints are only supported by AWS, not by %q", factory.s3Endpoint)
+		}
+		if factory.s3Region == "" || factory.s3Region == DefaultRegion {
+			return config, factory, fmt.Errorf("Dualstack endpoints require the region of the bucket")
+		}
+	}
+	factory.s3DualStack = config.S3DualStack
+
+	// failed requests are retried with exponential backoff, throttling responses like SlowDown back off longer
+	switch {
+	case config.S3MaxRetries == 0:
+		factory.s3MaxRetries = aws.UseServiceDefaultRetries
+	case config.S3MaxRetries < 0:
+		factory.s3MaxRetries = 0
+	default:
+		factory.s3MaxRetries = config.S3MaxRetries
+	}
 	factory.DisableSSL = config.S3DisableSSL
 
+	factory.contentTypes = make(map[string]string, len(config.S3ContentTypes))
+	for ext, contentType := range config.S3ContentTypes {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return config, factory, goErrors.Wrapf(err, "Invalid content type %q for extension %q", contentType, ext)
+		}
+		factory.contentTypes["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = contentType
+	}
+
+	if factory.allowContentTypes, err = parseContentTypePatterns(config.FtpAllowContentTypes); err != nil {
+		return config, factory, err
+	}
+
+	if config.S3StorageClass != "" && !contains(storageClasses, config.S3StorageClass) {
+		return config, factory, fmt.Errorf("Unknown storage class %q, must be one of: %s", config.S3StorageClass, strings.Join(storageClasses, ", "))
+	}
+	factory.storageClass = config.S3StorageClass
+
+	switch config.S3SSE {
+	case "":
+		if config.S3SSEKMSKeyID != "" {
+			return config, factory, fmt.Errorf("A KMS key id requires %q server-side encryption", s3.ServerSideEncryptionAwsKms)
+		}
+	case s3.ServerSideEncryptionAes256:
+		if config.S3SSEKMSKeyID != "" {
+			return config, factory, fmt.Errorf("A KMS key id can not be used with %q server-side encryption", s3.ServerSideEncryptionAes256)
+		}
+	case s3.ServerSideEncryptionAwsKms:
+		if config.S3SSEKMSKeyID == "" {
+			return config, factory, fmt.Errorf("%q server-side encryption requires a KMS key id", s3.ServerSideEncryptionAwsKms)
+		}
+	default:
+		return config, factory, fmt.Errorf("Unknown server-side encryption %q, must be one of: %s, %s", config.S3SSE, s3.ServerSideEncryptionAes256, s3.ServerSideEncryptionAwsKms)
+	}
+	factory.sse = config.S3SSE
+	factory.sseKMSKeyID = config.S3SSEKMSKeyID
+
+	if config.S3ACL != "" && !contains(cannedACLs, config.S3ACL) {
+		return config, factory, fmt.Errorf("Unknown canned ACL %q, must be one of: %s", config.S3ACL, strings.Join(cannedACLs, ", "))
+	}
+	factory.acl = config.S3ACL
+
+	for key, value := range config.S3Metadata {
+		if !isHeaderToken(key) {
+			return config, factory, fmt.Errorf("Invalid metadata key %q, must be a valid HTTP header name", key)
+		}
+		if !isHeaderValue(value) {
+			return config, factory, fmt.Errorf("Invalid value %q of metadata key %q, must be a valid HTTP header value", value, key)
+		}
+	}
+	factory.metadata = config.S3Metadata
+	tags, err := parseTags(config.S3Tags)
+	if err != nil {
+		return config, factory, err
+	}
+	factory.tags = tags
+	factory.verifyMD5 = config.S3VerifyMD5
+	if factory.objectLock, err = parseObjectLock(config.S3ObjectLockMode, config.S3ObjectLockRetainUntil, config.S3ObjectLockLegalHold, time.Now()); err != nil {
+		return config, factory, err
+	}
+	if factory.objectLock != nil && !factory.verifyMD5 {
+		factory.log().Info("Sending the MD5 digest of uploaded data because s3 requires it with object lock settings")
+		factory.verifyMD5 = true
+	}
+	factory.compress = config.S3Compress
+	factory.compressExtensions = make(map[string]bool, len(config.S3CompressExtensions))
+	for _, ext := range config.S3CompressExtensions {
+		factory.compressExtensions["."+strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+
+	factory.partSize = s3manager.DefaultUploadPartSize
+	if config.S3PartSize != 0 {
+		if config.S3PartSize < s3manager.MinUploadPartSize {
+			return config, factory, fmt.Errorf("Part size of %d bytes is too small, must be at least %d bytes", config.S3PartSize, s3manager.MinUploadPartSize)
+		}
+		factory.partSize = config.S3PartSize
+	}
+	factory.concurrency = s3manager.DefaultUploadConcurrency
+	if config.S3UploadConcurrency != 0 {
+		if config.S3UploadConcurrency < 0 {
+			return config, factory, fmt.Errorf("Invalid upload concurrency %d, must be positive", config.S3UploadConcurrency)
+		}
+		factory.concurrency = config.S3UploadConcurrency
+	}
+	factory.leavePartsOnError = config.S3LeavePartsOnError
+	if config.S3DownloadConcurrency < 0 || config.S3DownloadPartSize < 0 {
+		return config, factory, fmt.Errorf("Download concurrency and part size must not be negative but were %d and %d", config.S3DownloadConcurrency, config.S3DownloadPartSize)
+	}
+	factory.downloadConcurrency = config.S3DownloadConcurrency
+	factory.downloadPartSize = s3manager.DefaultDownloadPartSize
+	if config.S3DownloadPartSize != 0 {
+		factory.downloadPartSize = int64(config.S3DownloadPartSize)
+	}
+
+	if config.S3PresignThreshold < 0 {
+		return config, factory, fmt.Errorf("Invalid presign threshold %d, must not be negative", config.S3PresignThreshold)
+	}
+	if config.S3PresignTTL < 0 || config.S3PresignTTL > maxPresignTTL {
+		return config, factory, fmt.Errorf("Invalid presign TTL %s, must be at most %s", config.S3PresignTTL, maxPresignTTL)
+	}
+	factory.presignThreshold = config.S3PresignThreshold
+	factory.presignTTL = DefaultPresignTTL
+	if config.S3PresignTTL != 0 {
+		factory.presignTTL = config.S3PresignTTL
+	}
+
 	return config, factory, nil
 }
+
+// loadCertPool returns the system's certificate pool extended by the PEM encoded certificates of file `path`.
+func loadCertPool(path string, logger logrus.FieldLogger) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, goErrors.Wrapf(err, "Failed to read CA certificates")
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		logger.Warnf("Failed to load the system's CA certificates, only trusting those of %q: %s", path, err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No PEM encoded certificates found in %q", path)
+	}
+	return pool, nil
+}
+
+// maxPresignTTL is the maximum time presigned URLs of signature version 4 are valid.
+const maxPresignTTL = 7 * 24 * time.Hour
+
+var storageClasses = []string{
+	s3.StorageClassStandard,
+	s3.StorageClassReducedRedundancy,
+	s3.StorageClassStandardIa,
+	s3.StorageClassOnezoneIa,
+	s3.StorageClassIntelligentTiering,
+	s3.StorageClassGlacier,
+	"DEEP_ARCHIVE",
+}
+
+var cannedACLs = []string{
+	s3.ObjectCannedACLPrivate,
+	s3.ObjectCannedACLPublicRead,
+	s3.ObjectCannedACLPublicReadWrite,
+	s3.ObjectCannedACLAuthenticatedRead,
+	s3.ObjectCannedACLAwsExecRead,
+	s3.ObjectCannedACLBucketOwnerRead,
+	s3.ObjectCannedACLBucketOwnerFullControl,
+}
+
+// contains returns true if `value` is an element of `values`.
+func contains(values []string, value string) bool {
+	for _, known := range values {
+		if value == known {
+			return true
+		}
+	}
+	return false
+}
+
+// isHeaderToken returns true if `name` is a valid HTTP header name, see RFC 7230 section 3.2.6.
+func isHeaderToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// maxTags is the maximum number of tags of an s3 object.
+const maxTags = 10
+
+// parseTags validates the URL encoded tags `tags`, e.g. `k1=v1&k2=v2`, and returns them encoded in a canonical form.
+// See https://docs.aws.amazon.com/AmazonS3/latest/userguide/object-tagging.html for the restrictions of tags.
+func parseTags(tags string) (string, error) {
+	if tags == "" {
+		return "", nil
+	}
+	values, err := url.ParseQuery(tags)
+	if err != nil {
+		return "", goErrors.Wrapf(err, "Invalid tags %q, must be URL encoded like k1=v1&k2=v2", tags)
+	}
+	if len(values) > maxTags {
+		return "", fmt.Errorf("Too many tags in %q, at most %d tags are allowed", tags, maxTags)
+	}
+	for key, value := range values {
+		if len(value) > 1 {
+			return "", fmt.Errorf("Tag %q is given %d times in %q", key, len(value), tags)
+		}
+		if key == "" || utf8.RuneCountInString(key) > 128 || !isTagString(key) {
+			return "", fmt.Errorf("Invalid tag key %q, must be 1 to 128 letters, numbers, spaces or one of + - = . _ : / @", key)
+		}
+		if utf8.RuneCountInString(value[0]) > 256 || !isTagString(value[0]) {
+			return "", fmt.Errorf("Invalid value %q of tag %q, must be at most 256 letters, numbers, spaces or one of + - = . _ : / @", value[0], key)
+		}
+	}
+	return values.Encode(), nil
+}
+
+// isTagString returns true if `s` only contains characters allowed in tag keys and values.
+func isTagString(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && !unicode.IsSpace(r) && !strings.ContainsRune("+-=._:/@", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// isHeaderValue returns true if `value` contains only printable ASCII characters, spaces and tabs.
+func isHeaderValue(value string) bool {
+	for _, r := range value {
+		if (r < ' ' && r != '\t') || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// assumeRoleCredentials returns credentials of the role `roleARN` which are renewed before they expire.
+func assumeRoleCredentials(client stscreds.AssumeRoler, roleARN, externalID string) *credentials.Credentials {
+	return stscreds.NewCredentialsWithClient(client, roleARN, func(p *stscreds.AssumeRoleProvider) {
+		if externalID != "" {
+			p.ExternalID = aws.String(externalID)
+		}
+	})
+}
+
+// parseBucketName validates the bucket name `name`, an empty name is kept.
+// Only the characters of bucket names are allowed, URLs are rejected because the bucket is accessed at the endpoint of the main bucket.
+func parseBucketName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", nil
+	}
+	if len(name) < 3 || len(name) > 255 {
+		return "", fmt.Errorf("bucket name %q must be 3 to 255 characters long", name)
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return "", fmt.Errorf("bucket name %q must only contain letters, digits, dots, hyphens and underscores", name)
+		}
+	}
+	return name, nil
+}
+
+// isAWSEndpoint returns true if `endpoint` is an s3 endpoint of AWS.
+func isAWSEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(u.Hostname(), ".amazonaws.com")
+}
+
+// usePathStyle returns true if s3 requests to `endpoint` use path-style addressing with addressing style `style`.
+// The auto style picks path-style requests for all endpoints but AWS ones, e.g. IP addresses or MinIO and Ceph hosts,
+// which often lack the wildcard DNS records and certificates virtual hosted-style requests require.
+func usePathStyle(style string, forcePathStyle bool, endpoint string) (bool, error) {
+	pathStyle := false
+	switch strings.ToLower(style) {
+	case AddressingStyleAuto, "":
+		pathStyle = forcePathStyle || !isAWSEndpoint(endpoint)
+	case AddressingStylePath:
+		pathStyle = true
+	case AddressingStyleVirtual:
+		if forcePathStyle {
+			return false, fmt.Errorf("Forcing path-style requests contradicts the addressing style %q", style)
+		}
+	default:
+		return false, fmt.Errorf("Unknown addressing style %q, must be one of: %s, %s, %s", style, AddressingStyleAuto, AddressingStylePath, AddressingStyleVirtual)
+	}
+	return pathStyle, nil
+}
+
+// detectRegion returns the region of the bucket, or `defaultRegion` if it can not be determined.
+func detectRegion(factory *DriverFactory, defaultRegion string) string {
+	locationSession, err := session.NewSession(&aws.Config{
+		Region:           aws.String(endpoints.UsEast1RegionID),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      factory.awsCredentials,
+		HTTPClient:       factory.httpClient(),
+	})
+	if err != nil {
+		factory.log().Warnf("Failed to create session to detect the region of bucket %q: %s", factory.bucketName, err)
+		return defaultRegion
+	}
+	region, err := bucketRegion(s3.New(locationSession), factory.bucketName)
+	if err != nil {
+		factory.log().Warnf("Failed to detect the region of bucket %q, using region %q: %s", factory.bucketName, defaultRegion, err)
+		return defaultRegion
+	}
+	factory.log().Infof("Detected region %q of bucket %q", region, factory.bucketName)
+	return region
+}
+
+// bucketLocator returns the location of buckets.
+// Implemented by *s3.S3.
+type bucketLocator interface {
+	GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error)
+}
+
+// bucketRegion returns the region of bucket `bucketName`.
+func bucketRegion(client bucketLocator, bucketName string) (string, error) {
+	resp, err := client.GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(bucketName),
+	})
+	if err != nil {
+		return "", err
+	}
+	return s3.NormalizeBucketLocation(aws.StringValue(resp.LocationConstraint)), nil
+}
@@ -1,8 +1,32 @@
 package server
 
 import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/spreadshirt/f3/meta"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
 )
 
 func TestParseFeatureSet(t *testing.T) {
@@ -24,6 +48,24 @@ func TestParseFeatureSet(t *testing.T) {
 			featureChangeDir | featureList | featureRemoveDir | featureRemove | featureMove | featureMakeDir | featureGet | featurePut,
 			false,
 		},
+		{
+			"append",
+			"put,append",
+			featurePut | featureAppend,
+			false,
+		},
+		{
+			"versions",
+			"ls,get,versions",
+			featureList | featureGet | featureVersions,
+			false,
+		},
+		{
+			"restore",
+			"get,restore",
+			featureGet | featureRestore,
+			false,
+		},
 		{
 			"invalid-features",
 			"cd,invalid,put",
@@ -36,12 +78,52 @@ func TestParseFeatureSet(t *testing.T) {
 			0,
 			true,
 		},
+		{
+			"all",
+			"all",
+			featureChangeDir | featureList | featureRemoveDir | featureRemove | featureMove | featureMakeDir | featureGet | featurePut | featureAppend | featureVersions | featureRestore | featureTags,
+			false,
+		},
+		{
+			"all-except",
+			"all,-mv,-rm",
+			featureChangeDir | featureList | featureRemoveDir | featureMakeDir | featureGet | featurePut | featureAppend | featureVersions | featureRestore | featureTags,
+			false,
+		},
+		{
+			"none",
+			"none",
+			0,
+			false,
+		},
+		{
+			"none-and-some",
+			"none,ls,get",
+			featureList | featureGet,
+			false,
+		},
+		{
+			"disable-unknown",
+			"all,-fly",
+			0,
+			true,
+		},
+		{
+			"disable-none",
+			"ls,-none",
+			0,
+			true,
+		},
 	}
 	for _, testData := range testDataSet {
 		flags, err := parseFeatureSet(testData.featureSet)
 		if err != nil && testData.shouldFail {
 			continue
 		}
+		if err == nil && testData.shouldFail {
+			t.Errorf("Test %s: feature set %q was parsed although it is invalid", testData.id, testData.featureSet)
+			continue
+		}
 		if err != nil && !testData.shouldFail {
 			t.Errorf("Test %q failed: %s", testData.id, err)
 			continue
@@ -69,16 +151,16 @@ func TestDriverFactory(t *testing.T) {
 		},
 		{
 			FactoryConfig{
-				DefaultFeatureSet,
-				false,
-				"access:secret",
-				"https://some-bucket.somewhere.com",
-				DefaultRegion,
-				"",
-				true,
-				false,
-				true,
-				true,
+				FtpFeatures:       DefaultFeatureSet,
+				FtpNoOverwrite:    false,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				S3Endpoint:        "",
+				S3UsePathStyle:    true,
+				S3SignatureV2:     false,
+				DisableCloudWatch: true,
+				S3DisableSSL:      true,
 			},
 			"some-bucket",
 			"valid-minimal-config",
@@ -86,36 +168,1616 @@ func TestDriverFactory(t *testing.T) {
 		},
 		{
 			FactoryConfig{
-				"ls,rm,mkdir,get",
-				false,
-				"access:secret",
-				"https://another-bucket.somewhere.in.some.datacenter.domain.com",
-				"us-east-1",
-				"",
-				true,
-				false,
-				false,
-				true,
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"default-credentials",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				FtpIdleTimeout:    -time.Second,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"negative-idle-timeout",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				FtpMaxConnections: -1,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"negative-max-connections",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:             DefaultFeatureSet,
+				S3ObjectLockMode:        "GOVERNANCE",
+				S3ObjectLockRetainUntil: "720h",
+				S3BucketURL:             "https://some-bucket.somewhere.com",
+				S3Region:                DefaultRegion,
+				DisableCloudWatch:       true,
+			},
+			"some-bucket",
+			"object-lock",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3ObjectLockMode:  "GOVERNANCE",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"object-lock-without-retention",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:           DefaultFeatureSet,
+				S3DownloadConcurrency: -1,
+				S3BucketURL:           "https://some-bucket.somewhere.com",
+				S3Region:              DefaultRegion,
+				DisableCloudWatch:     true,
+			},
+			"some-bucket",
+			"negative-download-concurrency",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				FtpStatCacheTTL:   10 * time.Second,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"stat-cache",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				FtpStatCacheTTL:   -time.Second,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"negative-stat-cache-ttl",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				FtpAllowCIDRs:     []string{"10.0.0.0/8", "192.168.1.10"},
+				FtpDenyCIDRs:      []string{"10.0.0.0/24", "fd00::/8"},
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"cidrs",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				FtpDenyCIDRs:      []string{"10.0.0.0/33"},
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"invalid-cidr",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:        DefaultFeatureSet,
+				S3BucketURL:        "https://some-bucket.somewhere.com",
+				S3Region:           DefaultRegion,
+				S3PresignThreshold: 1 << 30,
+				S3PresignTTL:       time.Hour,
+				DisableCloudWatch:  true,
+			},
+			"some-bucket",
+			"presign",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:        DefaultFeatureSet,
+				S3BucketURL:        "https://some-bucket.somewhere.com",
+				S3Region:           DefaultRegion,
+				S3PresignThreshold: 1 << 30,
+				S3PresignTTL:       8 * 24 * time.Hour,
+				DisableCloudWatch:  true,
+			},
+			"some-bucket",
+			"presign-ttl-too-long",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.s3.amazonaws.com",
+				S3Region:          "eu-west-1",
+				S3Accelerate:      true,
+				S3DualStack:       true,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"accelerate-dualstack",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.s3.amazonaws.com",
+				S3Region:          "eu-west-1",
+				S3UsePathStyle:    true,
+				S3Accelerate:      true,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"accelerate-path-style",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket",
+				S3Endpoint:        "https://s3.eu-west-1.amazonaws.com",
+				S3Region:          "eu-west-1",
+				S3Accelerate:      true,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"accelerate-endpoint",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          "eu-west-1",
+				S3Accelerate:      true,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"accelerate-custom-host",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          "eu-west-1",
+				S3DualStack:       true,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"dualstack-custom-host",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				S3Proxy:           "proxy.example.com:3128",
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"proxy-without-scheme",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				S3CACert:          "/path/to/missing/ca.pem",
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"missing-ca-cert",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				Metrics:           MetricsPrometheus,
+				MetricsRegisterer: prometheus.NewRegistry(),
+			},
+			"some-bucket",
+			"prometheus-metrics",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures: DefaultFeatureSet,
+				S3BucketURL: "https://some-bucket.somewhere.com",
+				S3Region:    DefaultRegion,
+				Metrics:     "graphite",
+			},
+			"some-bucket",
+			"unknown-metrics",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures: DefaultFeatureSet,
+				S3BucketURL: "https://some-bucket.somewhere.com",
+				S3Region:    DefaultRegion,
+				Metrics:     MetricsStatsd,
+				StatsdAddr:  "127.0.0.1:8125",
+			},
+			"some-bucket",
+			"statsd-metrics",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures: DefaultFeatureSet,
+				S3BucketURL: "https://some-bucket.somewhere.com",
+				S3Region:    DefaultRegion,
+				Metrics:     MetricsStatsd,
+			},
+			"some-bucket",
+			"statsd-without-address",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access-only",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"malformed-credentials",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret:token",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"session-token",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Profile:         "some-profile",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"profile",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3Profile:         "some-profile",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"credentials-and-profile",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3AssumeRoleARN:   "arn:aws:iam::123456789012:role/some-role",
+				S3ExternalID:      "some-external-id",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          "eu-central-1",
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"assume-role",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3ExternalID:      "some-external-id",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          "eu-central-1",
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"external-id-without-role",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "vault://secret/data/f3/s3",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          "eu-central-1",
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"vault-credentials-without-vault",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3SessionPolicy:   "/does/not/matter.json",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          "eu-central-1",
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"session-policy-without-role",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3AssumeRoleARN:   "arn:aws:iam::123456789012:role/some-role",
+				S3SessionPolicy:   "/does/not/exist.json",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          "eu-central-1",
+				DisableCloudWatch: true,
+			},
+			"some-bucket",
+			"missing-session-policy",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       "ls,rm,mkdir,get",
+				FtpNoOverwrite:    false,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://another-bucket.somewhere.in.some.datacenter.domain.com",
+				S3Region:          "us-east-1",
+				S3Endpoint:        "",
+				S3UsePathStyle:    true,
+				S3SignatureV2:     false,
+				DisableCloudWatch: false,
+				S3DisableSSL:      true,
 			},
 			"another-bucket",
 			"valid-config",
 			false,
 		},
-	}
-	for _, testData := range testDataSet {
-		factory, err := NewDriverFactory(&testData.config)
-		if err != nil && testData.shouldFail {
-			continue
-		}
-		if err != nil && !testData.shouldFail {
-			t.Errorf("Test %q failed: %s", testData.id, err)
-			continue
-		}
-		if factory.bucketName != testData.bucketName {
-			t.Errorf("Test %s: bad bucket name %q, expected %q", testData.id, factory.bucketName, testData.bucketName)
-		}
-		if factory.featureFlags == 0 {
-			t.Errorf("Test %s: Empty feature set", testData.id)
-		}
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3ContentTypes:    map[string]string{".log": "text/plain; charset=utf-8"},
+			},
+			"some-bucket",
+			"content-types",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3ContentTypes:    map[string]string{".log": "not a content type"},
+			},
+			"some-bucket",
+			"invalid-content-types",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3StorageClass:    "STANDARD_IA",
+			},
+			"some-bucket",
+			"storage-class",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3StorageClass:    "STANDARD-IA",
+			},
+			"some-bucket",
+			"invalid-storage-class",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3SSE:             "AES256",
+			},
+			"some-bucket",
+			"sse-s3",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3SSE:             "aws:kms",
+				S3SSEKMSKeyID:     "some-key-id",
+			},
+			"some-bucket",
+			"sse-kms",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3SSE:             "aws:kms",
+			},
+			"some-bucket",
+			"sse-kms-without-key",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3SSE:             "AES256",
+				S3SSEKMSKeyID:     "some-key-id",
+			},
+			"some-bucket",
+			"sse-s3-with-key",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3SSE:             "rot13",
+			},
+			"some-bucket",
+			"invalid-sse",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3ACL:             "public-read",
+			},
+			"some-bucket",
+			"acl",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3ACL:             "public",
+			},
+			"some-bucket",
+			"invalid-acl",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3Metadata:        map[string]string{"origin": "ftp server"},
+			},
+			"some-bucket",
+			"metadata",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3Metadata:        map[string]string{"some origin": "ftp"},
+			},
+			"some-bucket",
+			"invalid-metadata-key",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3Metadata:        map[string]string{"origin": "ftp\nserver"},
+			},
+			"some-bucket",
+			"invalid-metadata-value",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3Tags:            "retention=30d&source=ftp+server",
+			},
+			"some-bucket",
+			"tags",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3Tags:            "retention=30d&retention=1y",
+			},
+			"some-bucket",
+			"duplicate-tags",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3ReadBucket:      "some-replica",
+				S3WriteBucket:     "some-ingest",
+			},
+			"some-bucket",
+			"read-write-buckets",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3ReadBucket:      "https://some-replica.somewhere.com",
+			},
+			"some-bucket",
+			"read-bucket-url",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:          DefaultFeatureSet,
+				S3Credentials:        "access:secret",
+				S3BucketURL:          "https://some-bucket.somewhere.com",
+				S3Region:             DefaultRegion,
+				DisableCloudWatch:    true,
+				FtpAllowContentTypes: []string{"image/*", "application/pdf"},
+			},
+			"some-bucket",
+			"allow-content-types",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:          DefaultFeatureSet,
+				S3Credentials:        "access:secret",
+				S3BucketURL:          "https://some-bucket.somewhere.com",
+				S3Region:             DefaultRegion,
+				DisableCloudWatch:    true,
+				FtpAllowContentTypes: []string{"image"},
+			},
+			"some-bucket",
+			"invalid-content-type",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:         DefaultFeatureSet,
+				S3Credentials:       "access:secret",
+				S3BucketURL:         "https://some-bucket.somewhere.com",
+				S3Region:            DefaultRegion,
+				DisableCloudWatch:   true,
+				S3PartSize:          16 * 1024 * 1024,
+				S3UploadConcurrency: 2,
+			},
+			"some-bucket",
+			"upload-options",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				S3PartSize:        1024,
+			},
+			"some-bucket",
+			"part-size-too-small",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:         DefaultFeatureSet,
+				S3Credentials:       "access:secret",
+				S3BucketURL:         "https://some-bucket.somewhere.com",
+				S3Region:            DefaultRegion,
+				DisableCloudWatch:   true,
+				S3UploadConcurrency: -1,
+			},
+			"some-bucket",
+			"negative-concurrency",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:       DefaultFeatureSet,
+				S3Credentials:     "access:secret",
+				S3BucketURL:       "https://some-bucket.somewhere.com",
+				S3Region:          DefaultRegion,
+				DisableCloudWatch: true,
+				FtpAllowAnonymous: true,
+				S3AnonymousPublic: true,
+			},
+			"some-bucket",
+			"anonymous",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:          DefaultFeatureSet,
+				S3Credentials:        "access:secret",
+				S3BucketURL:          "https://some-bucket.somewhere.com",
+				S3Region:             DefaultRegion,
+				DisableCloudWatch:    true,
+				FtpAllowAnonymous:    true,
+				FtpAnonymousFeatures: "ls,get,put",
+				FtpAnonymousWrite:    true,
+			},
+			"some-bucket",
+			"anonymous-write",
+			false,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:          DefaultFeatureSet,
+				S3Credentials:        "access:secret",
+				S3BucketURL:          "https://some-bucket.somewhere.com",
+				S3Region:             DefaultRegion,
+				DisableCloudWatch:    true,
+				FtpAllowAnonymous:    true,
+				FtpAnonymousFeatures: "ls,get,put",
+			},
+			"some-bucket",
+			"anonymous-write-not-allowed",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:          DefaultFeatureSet,
+				S3Credentials:        "access:secret",
+				S3BucketURL:          "https://some-bucket.somewhere.com",
+				S3Region:             DefaultRegion,
+				DisableCloudWatch:    true,
+				FtpAllowAnonymous:    true,
+				FtpAnonymousFeatures: "ls,fly",
+			},
+			"some-bucket",
+			"invalid-anonymous-features",
+			true,
+		},
+		{
+			FactoryConfig{
+				FtpFeatures:          DefaultFeatureSet,
+				S3Credentials:        "access:secret",
+				S3BucketURL:          "https://some-bucket.somewhere.com",
+				S3Region:             DefaultRegion,
+				DisableCloudWatch:    true,
+				FtpAllowAnonymous:    true,
+				FtpAnonymousFeatures: "none",
+			},
+			"some-bucket",
+			"no-anonymous-features",
+			true,
+		},
+	}
+	for _, testData := range testDataSet {
+		factory, err := NewDriverFactory(&testData.config)
+		if err != nil && testData.shouldFail {
+			continue
+		}
+		if err != nil && !testData.shouldFail {
+			t.Errorf("Test %q failed: %s", testData.id, err)
+			continue
+		}
+		if testData.shouldFail {
+			t.Errorf("Test %q should fail but succeeded", testData.id)
+			continue
+		}
+		if factory.bucketName != testData.bucketName {
+			t.Errorf("Test %s: bad bucket name %q, expected %q", testData.id, factory.bucketName, testData.bucketName)
+		}
+		if factory.featureFlags == 0 {
+			t.Errorf("Test %s: Empty feature set", testData.id)
+		}
+	}
+}
+
+func TestAccelerateDualStack(t *testing.T) {
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket.s3.amazonaws.com",
+		S3Region:          "eu-west-1",
+		S3DualStack:       true,
+		S3Accelerate:      true,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	client, err := factory.newS3Client(factory.awsCredentials)
+	if err != nil {
+		t.Fatalf("Failed to create s3 client: %s", err)
+	}
+	if !aws.BoolValue(client.Config.S3UseAccelerate) || !aws.BoolValue(client.Config.UseDualStack) {
+		t.Errorf("Acceleration and dualstack are not enabled: %v, %v", aws.BoolValue(client.Config.S3UseAccelerate), aws.BoolValue(client.Config.UseDualStack))
+	}
+
+	req, _ := client.GetObjectRequest(&s3.GetObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("some-key")})
+	if err := req.Build(); err != nil {
+		t.Fatalf("Failed to build request: %s", err)
+	}
+	if host := req.HTTPRequest.URL.Host; host != "some-bucket.s3-accelerate.dualstack.amazonaws.com" {
+		t.Errorf("Unexpected host %q", host)
+	}
+
+	factory.s3Accelerate = false
+	client, err = factory.newS3Client(factory.awsCredentials)
+	if err != nil {
+		t.Fatalf("Failed to create s3 client: %s", err)
+	}
+	if endpoint := client.Endpoint; endpoint != "https://s3.dualstack.eu-west-1.amazonaws.com" {
+		t.Errorf("Unexpected dualstack endpoint %q", endpoint)
+	}
+}
+
+func TestS3Timeout(t *testing.T) {
+	done := make(chan struct{})
+	requests := int32(0)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer gateway.Close()
+	// unblock the stuck request before closing the gateway
+	defer close(done)
+
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "http://some-bucket",
+		S3Endpoint:        gateway.URL,
+		S3UsePathStyle:    true,
+		S3Region:          DefaultRegion,
+		S3Timeout:         50 * time.Millisecond,
+		S3MaxRetries:      -1,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	client, err := factory.newS3Client(factory.awsCredentials)
+	if err != nil {
+		t.Fatalf("Failed to create s3 client: %s", err)
+	}
+
+	start := time.Now()
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("some-key")})
+	if err == nil {
+		t.Fatal("Request to a stuck gateway succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Request was not canceled by the timeout but took %s", elapsed)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected a single request without retries but were %d", n)
+	}
+}
+
+func TestS3Retries(t *testing.T) {
+	requests := int32(0)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`<Error><Code>SlowDown</Code><Message>Please reduce your request rate.</Message></Error>`))
+			return
+		}
+	}))
+	defer gateway.Close()
+
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "http://some-bucket",
+		S3Endpoint:        gateway.URL,
+		S3UsePathStyle:    true,
+		S3Region:          DefaultRegion,
+		S3MaxRetries:      1,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	client, err := factory.newS3Client(factory.awsCredentials)
+	if err != nil {
+		t.Fatalf("Failed to create s3 client: %s", err)
+	}
+
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("some-key")})
+	if err != nil {
+		t.Fatalf("Request was not retried after SlowDown: %s", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 requests but were %d", n)
+	}
+}
+
+func TestS3Proxy(t *testing.T) {
+	proxiedHosts := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedHosts <- r.URL.Host
+	}))
+	defer proxy.Close()
+
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "http://some-bucket",
+		S3Endpoint:        "http://s3.example.invalid",
+		S3UsePathStyle:    true,
+		S3Region:          DefaultRegion,
+		S3Proxy:           proxy.URL,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	client, err := factory.newS3Client(factory.awsCredentials)
+	if err != nil {
+		t.Fatalf("Failed to create s3 client: %s", err)
+	}
+
+	_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("some-key")})
+	if err != nil {
+		t.Fatalf("Request through the proxy failed: %s", err)
+	}
+	if host := <-proxiedHosts; host != "s3.example.invalid" {
+		t.Errorf("Expected a request to \"s3.example.invalid\" through the proxy but was %q", host)
+	}
+}
+
+func TestS3CACert(t *testing.T) {
+	endpoint := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer endpoint.Close()
+
+	// the AWS SDK replaces the CA certificates of the transport with those of $AWS_CA_BUNDLE
+	if bundle, ok := os.LookupEnv("AWS_CA_BUNDLE"); ok {
+		os.Unsetenv("AWS_CA_BUNDLE")
+		defer os.Setenv("AWS_CA_BUNDLE", bundle)
+	}
+
+	caFile, err := ioutil.TempFile("", "f3-ca-*.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: endpoint.Certificate().Raw})
+	caFile.Close()
+
+	config := FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket",
+		S3Endpoint:        endpoint.URL,
+		S3UsePathStyle:    true,
+		S3Region:          DefaultRegion,
+		S3MaxRetries:      -1,
+		DisableCloudWatch: true,
+	}
+	headObject := func(config FactoryConfig) error {
+		factory, err := NewDriverFactory(&config)
+		if err != nil {
+			t.Fatalf("Failed to create driver factory: %s", err)
+		}
+		client, err := factory.newS3Client(factory.awsCredentials)
+		if err != nil {
+			t.Fatalf("Failed to create s3 client: %s", err)
+		}
+		if factory.s3RootCAs != nil && client.Config.HTTPClient.Transport.(*http.Transport).TLSClientConfig.RootCAs != factory.s3RootCAs {
+			t.Error("The CA certificates are not used by the s3 client")
+		}
+		_, err = client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("some-key")})
+		return err
+	}
+
+	if err := headObject(config); err == nil {
+		t.Error("Request to an endpoint with an untrusted certificate succeeded")
+	}
+	config.S3CACert = caFile.Name()
+	if err := headObject(config); err != nil {
+		t.Errorf("Request with the CA certificate failed: %s", err)
+	}
+}
+
+func TestCredentialsWithSessionToken(t *testing.T) {
+	testDataSet := []struct {
+		credentials  string
+		secretKey    string
+		sessionToken string
+	}{
+		{"access:secret", "secret", ""},
+		{"access:secret:token", "secret", "token"},
+	}
+	for _, testData := range testDataSet {
+		factory, err := NewDriverFactory(&FactoryConfig{
+			FtpFeatures:       DefaultFeatureSet,
+			S3Credentials:     testData.credentials,
+			S3BucketURL:       "https://some-bucket.somewhere.com",
+			S3Region:          DefaultRegion,
+			DisableCloudWatch: true,
+		})
+		if err != nil {
+			t.Errorf("Test %q failed: %s", testData.credentials, err)
+			continue
+		}
+		value, err := factory.awsCredentials.Get()
+		if err != nil {
+			t.Errorf("Test %q: failed to get credentials: %s", testData.credentials, err)
+			continue
+		}
+		if value.AccessKeyID != "access" || value.SecretAccessKey != testData.secretKey {
+			t.Errorf("Test %q: bad key pair %q:%q", testData.credentials, value.AccessKeyID, value.SecretAccessKey)
+		}
+		if value.SessionToken != testData.sessionToken {
+			t.Errorf("Test %q: expected session token %q but was %q", testData.credentials, testData.sessionToken, value.SessionToken)
+		}
+	}
+}
+
+func TestUserCredentials(t *testing.T) {
+	mock := &assumeRolerMock{}
+	assumeRole := func(roleARN string) *credentials.Credentials {
+		return assumeRoleCredentials(mock, roleARN, "")
+	}
+	userCredentials, err := parseUserCredentials("# comment\nalice:alice-access:alice-secret\n\nbob:arn:aws:iam::123456789012:role/bob", assumeRole)
+	if err != nil {
+		t.Fatalf("Parsing credentials of users failed: %s", err)
+	}
+	if value, err := userCredentials["alice"].Get(); err != nil || value.AccessKeyID != "alice-access" || value.SecretAccessKey != "alice-secret" {
+		t.Errorf("Expected the static credentials of alice but were %#v: %v", value, err)
+	}
+	if value, err := userCredentials["bob"].Get(); err != nil || value.AccessKeyID != "role-access" {
+		t.Errorf("Expected the credentials of the role of bob but were %#v: %v", value, err)
+	}
+	if arn := aws.StringValue(mock.lastInput.RoleArn); arn != "arn:aws:iam::123456789012:role/bob" {
+		t.Errorf("Expected the role of bob to be assumed but was %q", arn)
+	}
+	for _, contents := range []string{"", "alice", "alice:access-only", ":access:secret", "alice:access:secret\nalice:other:secret"} {
+		if _, err := parseUserCredentials(contents, assumeRole); err == nil {
+			t.Errorf("Parsing credentials of users %q succeeded", contents)
+		}
+	}
+
+	credentialsFile, err := ioutil.TempFile("", "f3-user-credentials")
+	if err != nil {
+		t.Fatalf("Failed to create credentials file: %s", err)
+	}
+	defer os.Remove(credentialsFile.Name())
+	credentialsFile.WriteString("alice:alice-access:alice-secret\n")
+	credentialsFile.Close()
+	config := &FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3UserCredentials: credentialsFile.Name(),
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          DefaultRegion,
+		DisableCloudWatch: true,
+	}
+	factory, err := NewDriverFactory(config)
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	driver, err := factory.newDriver()
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	for user, accessKey := range map[string]string{"alice": "alice-access", "carol": "access"} {
+		driver.conn = loginUserMock(user)
+		value, err := driver.s3Client().(*s3.S3).Config.Credentials.Get()
+		if err != nil || value.AccessKeyID != accessKey {
+			t.Errorf("Expected the access key %q to be used for %s but was %q: %v", accessKey, user, value.AccessKeyID, err)
+		}
+		if driver.s3Uploader().(*s3manager.Uploader).S3 != driver.s3Client() {
+			t.Errorf("Expected the uploader of %s to use the same client", user)
+		}
+	}
+
+	config.S3UserCredentials = credentialsFile.Name() + "-missing"
+	if _, err := NewDriverFactory(config); err == nil {
+		t.Error("Creating a driver factory with a missing credentials file succeeded")
+	}
+	config.S3UserCredentials = credentialsFile.Name()
+	config.S3Client = &s3Mock{}
+	if _, err := NewDriverFactory(config); err == nil {
+		t.Error("Creating a driver factory with credentials of users and a given client succeeded")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		FtpMaxConnections: 2,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          DefaultRegion,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	rawListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	listener := factory.Listener(rawListener)
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", rawListener.Addr().String())
+		if err != nil {
+			t.Fatalf("Connecting failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		defer dial().Close()
+		conns = append(conns, <-accepted)
+	}
+	refused := dial()
+	defer refused.Close()
+	if reply, err := ioutil.ReadAll(refused); err != nil || string(reply) != "421 Too many connections\r\n" {
+		t.Errorf("Expected the connection beyond the maximum to be refused with 421 but read %q: %v", reply, err)
+	}
+	if n := factory.Connections(); n != 2 {
+		t.Errorf("Expected 2 open connections but were %d", n)
+	}
+
+	conns[0].Close()
+	conns[0].Close()
+	if n := factory.Connections(); n != 1 {
+		t.Errorf("Expected 1 open connection after closing one but were %d", n)
+	}
+	defer dial().Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Error("Connection was refused after closing another one")
+	}
+	conns[1].Close()
+}
+
+type assumeRolerMock struct {
+	lastInput *sts.AssumeRoleInput
+	err       error
+}
+
+func (m *assumeRolerMock) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	m.lastInput = input
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &sts.AssumeRoleOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("role-access"),
+			SecretAccessKey: aws.String("role-secret"),
+			SessionToken:    aws.String("role-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestAssumeRoleCredentials(t *testing.T) {
+	roleARN := "arn:aws:iam::123456789012:role/some-role"
+	mock := &assumeRolerMock{}
+	value, err := assumeRoleCredentials(mock, roleARN, "some-external-id").Get()
+	if err != nil {
+		t.Fatalf("Failed to assume role: %s", err)
+	}
+	if value.AccessKeyID != "role-access" || value.SecretAccessKey != "role-secret" || value.SessionToken != "role-token" {
+		t.Errorf("Credentials of the assumed role are not used: %#v", value)
+	}
+	if arn := aws.StringValue(mock.lastInput.RoleArn); arn != roleARN {
+		t.Errorf("Expected role %q but was %q", roleARN, arn)
+	}
+	if externalID := aws.StringValue(mock.lastInput.ExternalId); externalID != "some-external-id" {
+		t.Errorf("Expected external id %q but was %q", "some-external-id", externalID)
+	}
+
+	mock = &assumeRolerMock{err: awserr.New("AccessDenied", "not authorized", nil)}
+	factory := DriverFactory{awsCredentials: assumeRoleCredentials(mock, roleARN, "")}
+	if err := factory.VerifyCredentials(); err == nil {
+		t.Error("Verifying credentials succeeded although assuming the role was rejected")
+	}
+	if mock.lastInput.ExternalId != nil {
+		t.Errorf("External id %q was set although none was given", aws.StringValue(mock.lastInput.ExternalId))
+	}
+}
+
+type webIdentityRoleAssumerMock struct {
+	lastInput *sts.AssumeRoleWithWebIdentityInput
+}
+
+func (m *webIdentityRoleAssumerMock) AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	m.lastInput = input
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("pod-access"),
+			SecretAccessKey: aws.String("pod-secret"),
+			SessionToken:    aws.String("pod-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Hour)),
+		},
+	}, nil
+}
+
+func TestWebIdentityCredentials(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "f3-web-identity-token")
+	if err != nil {
+		t.Fatalf("Failed to create token file: %s", err)
+	}
+	defer os.Remove(tokenFile.Name())
+	if _, err := tokenFile.WriteString("some-token\n"); err != nil {
+		t.Fatalf("Failed to write token file: %s", err)
+	}
+	tokenFile.Close()
+
+	roleARN := "arn:aws:iam::123456789012:role/some-role"
+	mock := &webIdentityRoleAssumerMock{}
+	value, err := newWebIdentityCredentials(mock, roleARN, "some-session", tokenFile.Name()).Get()
+	if err != nil {
+		t.Fatalf("Failed to assume role with web identity: %s", err)
+	}
+	if value.AccessKeyID != "pod-access" || value.SecretAccessKey != "pod-secret" || value.SessionToken != "pod-token" {
+		t.Errorf("Credentials of the assumed role are not used: %#v", value)
+	}
+	if token := aws.StringValue(mock.lastInput.WebIdentityToken); token != "some-token" {
+		t.Errorf("Expected token %q but was %q", "some-token", token)
+	}
+	if arn := aws.StringValue(mock.lastInput.RoleArn); arn != roleARN {
+		t.Errorf("Expected role %q but was %q", roleARN, arn)
+	}
+
+	_, err = newWebIdentityCredentials(mock, roleARN, "", tokenFile.Name()+".missing").Get()
+	if err == nil {
+		t.Error("Retrieving credentials succeeded without a token file")
+	}
+
+	os.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile.Name())
+	os.Setenv("AWS_ROLE_ARN", roleARN)
+	defer os.Unsetenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	defer os.Unsetenv("AWS_ROLE_ARN")
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          "eu-central-1",
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	if factory.awsCredentials == nil {
+		t.Error("Web identity credentials are not used")
+	}
+}
+
+type bucketLocatorMock struct {
+	location string
+	err      error
+}
+
+func (m bucketLocatorMock) GetBucketLocation(input *s3.GetBucketLocationInput) (*s3.GetBucketLocationOutput, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &s3.GetBucketLocationOutput{LocationConstraint: aws.String(m.location)}, nil
+}
+
+func TestBucketRegion(t *testing.T) {
+	testDataSet := []struct {
+		location string
+		region   string
+	}{
+		{"", "us-east-1"},
+		{"EU", "eu-west-1"},
+		{"eu-central-1", "eu-central-1"},
+	}
+	for _, testData := range testDataSet {
+		region, err := bucketRegion(bucketLocatorMock{location: testData.location}, "some-bucket")
+		if err != nil {
+			t.Errorf("Test %q failed: %s", testData.location, err)
+			continue
+		}
+		if region != testData.region {
+			t.Errorf("Test %q: expected region %q but was %q", testData.location, testData.region, region)
+		}
+	}
+
+	if _, err := bucketRegion(bucketLocatorMock{err: awserr.New("AccessDenied", "denied", nil)}, "some-bucket"); err == nil {
+		t.Error("Detecting the region succeeded although the location could not be retrieved")
+	}
+
+	for endpoint, isAWS := range map[string]bool{
+		"https://s3.amazonaws.com":              true,
+		"https://s3.eu-central-1.amazonaws.com": true,
+		"https://s3.somewhere.com":              false,
+		"https://amazonaws.com.evil.com":        false,
+	} {
+		if isAWSEndpoint(endpoint) != isAWS {
+			t.Errorf("Test %q: expected AWS endpoint: %v", endpoint, isAWS)
+		}
+	}
+}
+
+func TestInjectedS3Client(t *testing.T) {
+	bucketMock := newBucketMock("some-bucket")
+	mock := &s3Mock{bucket: bucketMock}
+	uploader := &s3UploaderMock{bucket: bucketMock}
+	config := FactoryConfig{
+		FtpFeatures:       "ls,get,put",
+		S3BucketURL:       "https://some-bucket.s3.amazonaws.com",
+		S3Client:          mock,
+		S3Uploader:        uploader,
+		DisableCloudWatch: true,
+	}
+	factory, err := NewDriverFactory(&config)
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	driver, err := factory.NewDriver()
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	if _, err := driver.PutFile("/some-key", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PUT with the given uploader failed: %s", err)
+	}
+	if uploader.lastInput == nil {
+		t.Error("The given uploader was not used")
+	}
+	if _, err := driver.Stat("/some-key"); err != nil {
+		t.Errorf("Stat with the given client failed: %s", err)
+	}
+
+	// an uploader of the given client is created if none is given
+	config.S3Uploader = nil
+	factory, err = NewDriverFactory(&config)
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	driver, err = factory.NewDriver()
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	s3Driver := driver.(*S3Driver)
+	if s3Driver.s3 != mock {
+		t.Error("The given client was not used")
+	}
+	if s3Uploader, ok := s3Driver.uploader.(*s3manager.Uploader); !ok || s3Uploader.S3 != mock {
+		t.Errorf("Expected an uploader of the given client but was %#v", s3Driver.uploader)
+	}
+
+	config.S3Client = nil
+	config.S3Uploader = uploader
+	if _, err := NewDriverFactory(&config); err == nil {
+		t.Error("An uploader without a client was accepted")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	testDataSet := []struct {
+		value      string
+		size       ByteSize
+		shouldFail bool
+	}{
+		{"0", 0, false},
+		{"1024", 1024, false},
+		{"100b", 100, false},
+		{"1k", 1 << 10, false},
+		{"500M", 500 << 20, false},
+		{"2GiB", 2 << 30, false},
+		{"1.5G", 0, true},
+		{" 3 TB ", 3 << 40, false},
+		{"-1M", 0, true},
+		{"M", 0, true},
+		{"10X", 0, true},
+		{"9999999T", 0, true},
+	}
+
+	for _, testData := range testDataSet {
+		size, err := ParseByteSize(testData.value)
+		if testData.shouldFail {
+			if err == nil {
+				t.Errorf("Expected parsing %q to fail but was %d", testData.value, size)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parsing %q failed: %s", testData.value, err)
+		} else if size != testData.size {
+			t.Errorf("Expected %q to be %d bytes but was %d", testData.value, testData.size, size)
+		}
+	}
+}
+
+func TestParseTags(t *testing.T) {
+	testDataSet := []struct {
+		tags       string
+		expected   string
+		shouldFail bool
+	}{
+		{"", "", false},
+		{"source=ftp", "source=ftp", false},
+		{"source=ftp&retention=30d", "retention=30d&source=ftp", false},
+		{"team=data+ops&empty=", "empty=&team=data+ops", false},
+		{"path=a%2Fb%3Ac%40d", "path=a%2Fb%3Ac%40d", false},
+		{"k1=1&k2=2&k3=3&k4=4&k5=5&k6=6&k7=7&k8=8&k9=9&k10=10&k11=11", "", true},
+		{"=value", "", true},
+		{"key=a%3Bb", "", true},
+		{"key=%zz", "", true},
+		{"key=" + strings.Repeat("v", 257), "", true},
+	}
+
+	for _, testData := range testDataSet {
+		tags, err := parseTags(testData.tags)
+		if testData.shouldFail {
+			if err == nil {
+				t.Errorf("Expected tags %q to be invalid but were parsed as %q", testData.tags, tags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parsing tags %q failed: %s", testData.tags, err)
+		} else if tags != testData.expected {
+			t.Errorf("Expected tags %q to be encoded as %q but were %q", testData.tags, testData.expected, tags)
+		}
+	}
+}
+
+// headBucketMock counts HeadBucket requests which fail with `err`.
+type headBucketMock struct {
+	s3iface.S3API
+	err   error
+	calls int
+}
+
+func (mock *headBucketMock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	mock.calls++
+	if mock.err != nil {
+		return nil, mock.err
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func TestHealthHandler(t *testing.T) {
+	mock := &headBucketMock{}
+	factory := DriverFactory{
+		bucketName: "some-bucket",
+		readiness: &readiness{newClient: func() (s3iface.S3API, error) {
+			return mock, nil
+		}},
+	}
+	handler := factory.HealthHandler()
+	probe := func(path string) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+		return recorder.Code
+	}
+
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected the liveness probe to succeed but was %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code := probe("/readyz"); code != http.StatusOK {
+			t.Errorf("Expected the readiness probe to succeed but was %d", code)
+		}
+	}
+	if mock.calls != 1 {
+		t.Errorf("Expected the result of the readiness check to be cached but HeadBucket was called %d times", mock.calls)
+	}
+
+	// readiness flips once the cached result expires
+	mock.err = awserr.New("RequestError", "send request failed", nil)
+	if err := factory.readiness.check(factory.bucketName, time.Now().Add(readinessTTL)); err == nil {
+		t.Errorf("Expected the readiness check to fail if the bucket is unreachable")
+	}
+	if code := probe("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the readiness probe to fail but was %d", code)
+	}
+	if code := probe("/healthz"); code != http.StatusOK {
+		t.Errorf("Expected the liveness probe to succeed regardless of s3 but was %d", code)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	meta.Version, meta.GitCommit = "1.2.3", "abc1234"
+	defer func() { meta.Version, meta.GitCommit = "", "" }()
+	recorder := httptest.NewRecorder()
+	DriverFactory{}.HealthHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	info := meta.Info{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &info); err != nil {
+		t.Fatalf("Expected the build information as JSON but was %q: %s", recorder.Body.String(), err)
+	}
+	if info.Version != "1.2.3" || info.GitCommit != "abc1234" || info.GoVersion != runtime.Version() {
+		t.Errorf("Expected the build information of the program but was %+v", info)
+	}
+}
+
+func TestUsePathStyle(t *testing.T) {
+	tCases := []struct {
+		style      string
+		force      bool
+		endpoint   string
+		pathStyle  bool
+		shouldFail bool
+	}{
+		{"", false, "https://s3.eu-central-1.amazonaws.com", false, false},
+		{AddressingStyleAuto, false, "https://s3.amazonaws.com", false, false},
+		{AddressingStyleAuto, false, "http://127.0.0.1:9000", true, false},
+		{AddressingStyleAuto, false, "https://minio.example.com", true, false},
+		{AddressingStyleAuto, true, "https://s3.amazonaws.com", true, false},
+		{AddressingStylePath, false, "https://s3.amazonaws.com", true, false},
+		{AddressingStyleVirtual, false, "https://minio.example.com", false, false},
+		{AddressingStyleVirtual, true, "https://minio.example.com", false, true},
+		{"dns", false, "https://s3.amazonaws.com", false, true},
+	}
+	for _, tCase := range tCases {
+		pathStyle, err := usePathStyle(tCase.style, tCase.force, tCase.endpoint)
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Expected style %q with %q to fail: %t but error was %v", tCase.style, tCase.endpoint, tCase.shouldFail, err)
+			continue
+		}
+		if pathStyle != tCase.pathStyle {
+			t.Errorf("Expected style %q with %q to use path-style requests: %t but was %t", tCase.style, tCase.endpoint, tCase.pathStyle, pathStyle)
+		}
+	}
+}
+
+func TestInjectedLogger(t *testing.T) {
+	// the global logger would record everything which is not logged by the injected one
+	defer logrus.SetLevel(logrus.GetLevel())
+	logrus.SetLevel(logrus.DebugLevel)
+	global := logrustest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	logger, hook := logrustest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+
+	factory, err := NewDriverFactoryWithOptions(
+		WithBucket("https://some-bucket.s3.amazonaws.com"),
+		WithFeatures("ls"),
+		WithS3Client(&s3Mock{bucket: newBucketMock("some-bucket")}, nil),
+		WithMetrics(MetricsNone),
+		WithLogger(logger),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	driver, err := factory.NewDriver()
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	if err := driver.ChangeDir("/foo"); err == nil {
+		t.Fatalf("Expected changing the directory to be disabled")
+	}
+	if entry := hook.LastEntry(); entry == nil || entry.Data["action"] != "CD" || entry.Level != logrus.WarnLevel {
+		t.Errorf("Expected the disabled CD to be logged by the injected logger but was %+v", entry)
+	}
+	factory.Logger().PrintCommand("some-session", "CWD", "/foo")
+	if entry := hook.LastEntry(); entry == nil || entry.Data["command"] != "CWD" {
+		t.Errorf("Expected the FTP command to be logged by the injected logger but was %+v", entry)
+	}
+	certAuth := NewCertAuthenticator()
+	if auth, ok := factory.Auth(certAuth).(*CertAuthenticator); !ok || auth == certAuth || auth.logger != logger {
+		t.Errorf("Expected a copy of the authenticator logging to the injected logger but was %+v", auth)
+	}
+	if entries := global.AllEntries(); len(entries) != 0 {
+		t.Errorf("Expected nothing to be logged by the global logger but was %+v", entries)
 	}
 }
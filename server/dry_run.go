@@ -0,0 +1,16 @@
+package server
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// dryRunField marks the log entries of s3 requests which are not sent in dry-run mode.
+const dryRunField = "dry_run"
+
+// logDryRun logs the s3 requests `requests`, e.g. `DeleteObject`, which an operation would send without dry-run mode.
+// `fields` are the fields of the operation like `key` and `action`.
+func (d *S3Driver) logDryRun(fields logrus.Fields, requests string, format string, args ...interface{}) {
+	fields[dryRunField] = true
+	fields["requests"] = requests
+	d.log().WithFields(fields).Infof("DRY RUN: "+format, args...)
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"strings"
+
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// ftpCommands returns the commands which are added to goftp or replace its own, see Serve.
+func ftpCommands() map[string]ftp.Command {
+	return map[string]ftp.Command{
+		"MFMT": commandMfmt{},
+		"MLSD": commandMlsd{},
+		"MLST": commandMlst{},
+		"OPTS": commandOpts{},
+		"SITE": commandSite{},
+		"STOU": commandStou{},
+	}
+}
+
+// commandOpts sets options of commands, see RFC 2389. Names are always UTF-8, thus UTF8 can only be turned on.
+// goftp rejects `OPTS UTF8` without value which some clients send.
+type commandOpts struct{}
+
+func (cmd commandOpts) IsExtend() bool     { return false }
+func (cmd commandOpts) RequireParam() bool { return true }
+func (cmd commandOpts) RequireAuth() bool  { return false }
+
+func (cmd commandOpts) Execute(conn *ftp.Conn, param string) {
+	fields := strings.Fields(param)
+	switch {
+	case len(fields) == 0 || !strings.EqualFold(fields[0], "UTF8") || len(fields) > 2:
+		conn.WriteMessage(501, "Option not understood")
+	case len(fields) == 1 || strings.EqualFold(fields[1], "ON"):
+		conn.WriteMessage(200, "UTF8 mode enabled")
+	default:
+		conn.WriteMessage(504, "UTF8 mode can not be turned off")
+	}
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// dialFTP connects to the FTP server of `listener` and logs in as `user` with `password`.
+func dialFTP(t *testing.T, listener net.Listener, user, password string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connecting failed: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := bufio.NewReader(conn)
+	expectReply(t, replies, "220")
+	fmt.Fprintf(conn, "USER %s\r\n", user)
+	expectReply(t, replies, "331")
+	fmt.Fprintf(conn, "PASS %s\r\n", password)
+	expectReply(t, replies, "230")
+	return conn, replies
+}
+
+// expectReply reads the next reply line and fails the test if it does not start with `code`.
+func expectReply(t *testing.T, replies *bufio.Reader, code string) string {
+	reply, err := replies.ReadString('\n')
+	if err != nil || !strings.HasPrefix(reply, code) {
+		t.Fatalf("Expected reply %s but was %q: %v", code, reply, err)
+	}
+	return reply
+}
+
+// transferData opens a passive data connection with EPSV and sends `command`.
+// It uploads `data` if not nil, otherwise it returns the data sent by the server.
+func transferData(t *testing.T, conn net.Conn, replies *bufio.Reader, command string, data []byte) string {
+	fmt.Fprint(conn, "EPSV\r\n")
+	reply := expectReply(t, replies, "229")
+	var port int
+	if _, err := fmt.Sscanf(reply[strings.Index(reply, "(|||"):], "(|||%d|)", &port); err != nil {
+		t.Fatalf("Unexpected reply to EPSV %q: %s", reply, err)
+	}
+	dataConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Opening the data connection failed: %s", err)
+	}
+	defer dataConn.Close()
+	dataConn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, command+"\r\n")
+	expectReply(t, replies, "150")
+	if data != nil {
+		if _, err := dataConn.Write(data); err != nil {
+			t.Fatalf("Writing the data of %s failed: %s", command, err)
+		}
+		dataConn.Close()
+	} else if data, err = ioutil.ReadAll(dataConn); err != nil {
+		t.Fatalf("Reading the data of %s failed: %s", command, err)
+	}
+	expectReply(t, replies, "226")
+	return string(data)
+}
+
+// driverFactoryFunc creates drivers by calling itself.
+type driverFactoryFunc func() (ftp.Driver, error)
+
+func (f driverFactoryFunc) NewDriver() (ftp.Driver, error) {
+	return f()
+}
+
+func TestOptsUTF8(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) { return &S3Driver{}, nil }),
+		Auth:    &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger:  &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connecting failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := bufio.NewReader(conn)
+	expectReply(t, replies, "220")
+
+	tCases := []struct {
+		param string
+		reply string
+	}{
+		{"UTF8 ON", "200"},
+		{"utf8 on", "200"},
+		{"UTF8", "200"},
+		{"UTF8 OFF", "504"},
+		{"MLST type;size;", "501"},
+		{"UTF8 ON now", "501"},
+	}
+	for _, tCase := range tCases {
+		fmt.Fprintf(conn, "OPTS %s\r\n", tCase.param)
+		if reply, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(reply, tCase.reply+" ") {
+			t.Errorf("Test %q: expected reply %s but was %q: %v", tCase.param, tCase.reply, reply, err)
+		}
+	}
+}
+
+func TestUTF8Names(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				featureFlags: allFeatures,
+				s3:           &s3Mock{bucket: bucketMock},
+				uploader:     &s3UploaderMock{bucket: bucketMock},
+				metrics:      metricsSenderMock{},
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}, nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	conn, replies := dialFTP(t, listener, "alice", "secret")
+	defer conn.Close()
+	fmt.Fprint(conn, "OPTS UTF8 ON\r\n")
+	expectReply(t, replies, "200")
+
+	transferData(t, conn, replies, "STOR /café/naïve.txt", []byte("crème brûlée"))
+	if _, ok := bucketMock.objects["café/naïve.txt"]; !ok {
+		t.Fatalf("Expected the object café/naïve.txt to be uploaded but were %v", bucketMock.objects)
+	}
+
+	if listing := transferData(t, conn, replies, "LIST /", nil); !strings.HasSuffix(listing, " café\r\n") {
+		t.Errorf("Expected the directory café to be listed but was %q", listing)
+	}
+	if listing := transferData(t, conn, replies, "MLSD /café", nil); !strings.HasSuffix(listing, "; naïve.txt\r\n") {
+		t.Errorf("Expected the file naïve.txt to be listed but was %q", listing)
+	}
+	fmt.Fprint(conn, "CWD café\r\n")
+	expectReply(t, replies, "250")
+	fmt.Fprint(conn, "SIZE naïve.txt\r\n")
+	if reply := expectReply(t, replies, "213"); reply != fmt.Sprintf("213 %d\r\n", len("crème brûlée")) {
+		t.Errorf("Unexpected size of naïve.txt %q", reply)
+	}
+	if data := transferData(t, conn, replies, "RETR naïve.txt", nil); data != "crème brûlée" {
+		t.Errorf("Expected the content of naïve.txt but was %q", data)
+	}
+}
+
+func TestFqdnUTF8(t *testing.T) {
+	d := S3Driver{bucketURL: intoURL("https://some-bucket.s3.amazonaws.com")}
+	if fqdn := d.fqdn("café/naïve.txt"); fqdn != "https://some-bucket.s3.amazonaws.com/café/naïve.txt" {
+		t.Errorf("Expected the key to be displayed as is but was %q", fqdn)
+	}
+}
+
+func TestStou(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	bucketMock.Put("ftp/drop/", objectMock{[]byte{}, time.Now(), "etag"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				featureFlags: featureChangeDir | featurePut,
+				s3:           &s3Mock{bucket: bucketMock},
+				uploader:     &s3UploaderMock{bucket: bucketMock},
+				metrics:      metricsSenderMock{},
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+				keyPrefix:    "ftp",
+			}, nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	conn, replies := dialFTP(t, listener, "alice", "secret")
+	defer conn.Close()
+	fmt.Fprint(conn, "STOU\r\n")
+	expectReply(t, replies, "425")
+	fmt.Fprint(conn, "CWD /drop\r\n")
+	expectReply(t, replies, "250")
+	for i := 0; i < 3; i++ {
+		transferData(t, conn, replies, "STOU", []byte("data"))
+	}
+
+	names := map[string]bool{}
+	for key, object := range bucketMock.List() {
+		if name := strings.TrimPrefix(key, "ftp/drop/"); name != "" {
+			if strings.Contains(name, "/") || string(object.data) != "data" {
+				t.Errorf("Expected unique names in the working directory below the prefix but was %q with %q", key, object.data)
+			}
+			names[name] = true
+		}
+	}
+	if len(names) != 3 {
+		t.Errorf("Expected 3 objects with unique names but were %v", names)
+	}
+}
+
+func TestMfmt(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	mock := &metadataMock{objects: map[string]*s3.HeadObjectOutput{
+		"ftp/file": {
+			ContentLength: aws.Int64(4),
+			LastModified:  aws.Time(time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC)),
+		},
+	}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				featureFlags: featureList | featurePut,
+				s3:           mock,
+				metrics:      metricsSenderMock{},
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+				keyPrefix:    "ftp",
+			}, nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	conn, replies := dialFTP(t, listener, "alice", "secret")
+	defer conn.Close()
+	tCases := []struct {
+		param string
+		code  string
+	}{
+		{"20010203040506", "501"},
+		{"2001-02-03 file", "501"},
+		{"20010203040506 missing", "550"},
+		{"20010203040506.7 file", "213"},
+	}
+	for _, tCase := range tCases {
+		fmt.Fprintf(conn, "MFMT %s\r\n", tCase.param)
+		expectReply(t, replies, tCase.code)
+	}
+
+	mtime := modTime(mock.objects["ftp/file"].Metadata, time.Time{})
+	if expected := time.Date(2001, 2, 3, 4, 5, 6, 700000000, time.UTC); !mtime.Equal(expected) {
+		t.Errorf("Expected the modification time %s but was %s", expected, mtime)
+	}
+}
+
+func TestReplyCodes(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				featureFlags: featureList | featureRemove | featureGet,
+				s3:           unreachableS3Mock{err: awserr.New("SlowDown", "Please reduce your request rate.", nil)},
+				metrics:      metricsSenderMock{},
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}, nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	// the replies tell clients to try again later instead of the default replies of the commands
+	conn, replies := dialFTP(t, listener, "alice", "secret")
+	defer conn.Close()
+	for _, command := range []string{"DELE file", "MLST file"} {
+		fmt.Fprintf(conn, "%s\r\n", command)
+		if reply := expectReply(t, replies, "450"); !strings.Contains(reply, "Please reduce your request rate.") {
+			t.Errorf("Expected the message of s3 in the reply to %s but was %q", command, reply)
+		}
+	}
+	fmt.Fprint(conn, "SIZE file\r\n")
+	expectReply(t, replies, "450")
+	fmt.Fprint(conn, "RETR file\r\n")
+	expectReply(t, replies, "450")
+}
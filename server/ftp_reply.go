@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ftpError is an error of a driver operation with the FTP reply matching its cause,
+// e.g. to tell clients to try again later if s3 is throttling requests.
+type ftpError struct {
+	code    int
+	message string
+	key     string
+	err     error
+}
+
+// Error returns the message of the reply with the key of the object and the message of s3,
+// e.g. `Permission denied: "https://some-bucket.s3.amazonaws.com/file": Access Denied`.
+func (e ftpError) Error() string {
+	return fmt.Sprintf("%s: %q: %s", e.message, e.key, intoAwsError(e.err).Message())
+}
+
+// Code returns the FTP reply code of the error which goftp sends instead of the default one of the command, see ftp.ReplyCode.
+func (e ftpError) Code() int {
+	return e.code
+}
+
+// Cause returns the original error, see https://godoc.org/github.com/pkg/errors#Cause
+func (e ftpError) Cause() error {
+	return e.err
+}
+
+// Unwrap returns the original error, e.g. to check it with errors.Is.
+func (e ftpError) Unwrap() error {
+	return e.err
+}
+
+// ftpReplies maps s3 error codes to FTP replies, see RFC 959 section 4.2.
+var ftpReplies = map[string]ftpError{
+	"AccessDenied":                 {code: 550, message: "Permission denied"},
+	"AllAccessDisabled":            {code: 550, message: "Permission denied"},
+	"InvalidAccessKeyId":           {code: 530, message: "Not logged in to s3"},
+	"SignatureDoesNotMatch":        {code: 530, message: "Not logged in to s3"},
+	"ExpiredToken":                 {code: 530, message: "Not logged in to s3"},
+	s3.ErrCodeNoSuchKey:            {code: 550, message: "No such file or directory"},
+	s3.ErrCodeNoSuchBucket:         {code: 550, message: "No such file or directory"},
+	"NotFound":                     {code: 550, message: "No such file or directory"},
+	"EntityTooLarge":               {code: 552, message: "Exceeded storage allocation"},
+	"SlowDown":                     {code: 450, message: "Service busy, try again later"},
+	"ServiceUnavailable":           {code: 450, message: "Service busy, try again later"},
+	"InternalError":                {code: 451, message: "Local error in processing, try again later"},
+	"RequestTimeout":               {code: 451, message: "Local error in processing, try again later"},
+	request.CanceledErrorCode:      {code: 426, message: "Connection closed, transfer aborted"},
+	request.ErrCodeResponseTimeout: {code: 451, message: "Local error in processing, try again later"},
+}
+
+// ftpReply returns `err` of the object with key `key` as ftpError if its s3 error code has a matching FTP reply, otherwise `err` as is.
+func ftpReply(err error, key string) error {
+	if err == nil {
+		return nil
+	}
+	reply, ok := ftpReplies[intoAwsError(err).Code()]
+	if !ok {
+		return err
+	}
+	reply.key = key
+	reply.err = err
+	return reply
+}
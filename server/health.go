@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spreadshirt/f3/meta"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// readinessTTL is the time the result of a readiness check is reused,
+// so that frequent probes do not send a request to s3 each.
+const readinessTTL = 10 * time.Second
+
+// readiness caches the result of checking whether the bucket is reachable.
+type readiness struct {
+	lock      sync.Mutex
+	client    s3iface.S3API
+	checked   time.Time
+	err       error
+	newClient func() (s3iface.S3API, error)
+}
+
+// check returns nil if the bucket `bucketName` was reachable within the last readinessTTL.
+func (r *readiness) check(bucketName string, now time.Time) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.checked.IsZero() && now.Sub(r.checked) < readinessTTL {
+		return r.err
+	}
+	if r.client == nil {
+		client, err := r.newClient()
+		if err != nil {
+			return errors.Wrapf(err, "Failed to create s3 client")
+		}
+		r.client = client
+	}
+	_, err := r.client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucketName)})
+	if err != nil {
+		err = errors.Wrapf(intoAwsError(err), "Bucket %q is not reachable", bucketName)
+	}
+	r.checked, r.err = now, err
+	return err
+}
+
+// HealthHandler returns the HTTP handler of liveness and readiness probes, e.g. of Kubernetes.
+// `/healthz` succeeds while the process is running, `/readyz` only while the bucket is reachable.
+// `/version` returns the build information as JSON, e.g. to verify rollouts.
+func (d DriverFactory) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(meta.Current())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := d.Ready(); err != nil {
+			d.log().Warnf("Readiness check failed: %s", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// Ready returns an error if the bucket is not reachable, the result is cached for readinessTTL.
+func (d DriverFactory) Ready() error {
+	if d.readiness == nil {
+		return fmt.Errorf("Driver factory was not created by NewDriverFactory")
+	}
+	return d.readiness.check(d.bucketName, time.Now())
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	ldap "gopkg.in/ldap.v3"
+)
+
+// ldapConn is a connection to an LDAP server.
+// Implemented by *ldap.Conn.
+type ldapConn interface {
+	Bind(username, password string) error
+	Close()
+}
+
+// LDAPAuthenticator verifies credentials by binding to an LDAP server as the user.
+// Implements https://godoc.org/github.com/goftp/server#Auth
+type LDAPAuthenticator struct {
+	url            string
+	bindDNTemplate string
+	baseDN         string
+	dial           func(url string) (ldapConn, error)
+	logger         logrus.FieldLogger
+}
+
+// NewLDAPAuthenticator returns an LDAPAuthenticator for the LDAP server at `url`, e.g. `ldaps://ldap.example.com`.
+// The DN to bind as is built by replacing `%s` in `bindDNTemplate` with the username, e.g. `uid=%s`,
+// followed by `baseDN` if it is not empty, e.g. `ou=people,dc=example,dc=com`.
+func NewLDAPAuthenticator(url, bindDNTemplate, baseDN string) (LDAPAuthenticator, error) {
+	if url == "" {
+		return LDAPAuthenticator{}, fmt.Errorf("Empty LDAP URL")
+	}
+	if strings.Count(bindDNTemplate, "%s") != 1 {
+		return LDAPAuthenticator{}, fmt.Errorf("Bind DN template %q must contain exactly one %%s for the username", bindDNTemplate)
+	}
+	return LDAPAuthenticator{
+		url:            url,
+		bindDNTemplate: bindDNTemplate,
+		baseDN:         baseDN,
+		dial: func(url string) (ldapConn, error) {
+			return ldap.DialURL(url)
+		},
+	}, nil
+}
+
+// CheckPasswd returns `true` if binding to the LDAP server as `username` with `password` succeeds.
+// Failed binds are reported the same way for unknown users and wrong passwords.
+func (a LDAPAuthenticator) CheckPasswd(username, password string) (bool, error) {
+	if username == "" || password == "" {
+		// an empty password results in an unauthenticated bind which always succeeds
+		return false, fmt.Errorf("Invalid credentials for user %q", username)
+	}
+
+	conn, err := a.dial(a.url)
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to connect to LDAP server %q", a.url)
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(a.bindDN(username), password); err != nil {
+		a.log().WithFields(logrus.Fields{"user": username, "error": err}).Debug("LDAP bind failed")
+		return false, fmt.Errorf("Invalid credentials for user %q", username)
+	}
+	return true, nil
+}
+
+// log returns the logger of the authenticator, the global logger of logrus if none is configured.
+func (a LDAPAuthenticator) log() logrus.FieldLogger {
+	return orStandardLogger(a.logger)
+}
+
+// bindDN returns the DN of user `username`.
+func (a LDAPAuthenticator) bindDN(username string) string {
+	dn := fmt.Sprintf(a.bindDNTemplate, escapeDN(username))
+	if a.baseDN != "" {
+		dn += "," + a.baseDN
+	}
+	return dn
+}
+
+// escapeDN escapes special characters of `value` to be used as attribute value in a DN, see RFC 4514 section 2.4.
+func escapeDN(value string) string {
+	escaped := strings.Builder{}
+	for idx, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			idx == 0 && (r == ' ' || r == '#'),
+			idx == len(value)-1 && r == ' ':
+			escaped.WriteRune('\\')
+			escaped.WriteRune(r)
+		case r == 0:
+			escaped.WriteString(`\00`)
+		default:
+			escaped.WriteRune(r)
+		}
+	}
+	return escaped.String()
+}
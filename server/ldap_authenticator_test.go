@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	ldap "gopkg.in/ldap.v3"
+)
+
+type ldapConnMock struct {
+	passwords map[string]string
+	lastDN    string
+	closed    bool
+}
+
+func (c *ldapConnMock) Bind(username, password string) error {
+	c.lastDN = username
+	if pass, ok := c.passwords[username]; ok && pass == password {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("Invalid Credentials"))
+}
+
+func (c *ldapConnMock) Close() {
+	c.closed = true
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	auth, err := NewLDAPAuthenticator("ldaps://ldap.example.com", "uid=%s", "ou=people,dc=example,dc=com")
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %s", err)
+	}
+	conn := &ldapConnMock{passwords: map[string]string{
+		"uid=alice,ou=people,dc=example,dc=com":      "secret",
+		`uid=bob\,admin,ou=people,dc=example,dc=com`: "secret",
+	}}
+	auth.dial = func(url string) (ldapConn, error) {
+		conn.closed = false
+		return conn, nil
+	}
+
+	testDataSet := []struct {
+		user     string
+		password string
+		valid    bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"alice", "", false},
+		{"mallory", "secret", false},
+		{"bob,admin", "secret", true},
+	}
+	for _, testData := range testDataSet {
+		valid, err := auth.CheckPasswd(testData.user, testData.password)
+		if valid != testData.valid {
+			t.Errorf("Test %s:%s: expected %v but was %v (%v)", testData.user, testData.password, testData.valid, valid, err)
+		}
+		if !valid && err.Error() != fmt.Sprintf("Invalid credentials for user %q", testData.user) {
+			t.Errorf("Test %s:%s: unexpected error %q", testData.user, testData.password, err)
+		}
+		if testData.password != "" && !conn.closed {
+			t.Errorf("Test %s:%s: LDAP connection was not closed", testData.user, testData.password)
+		}
+	}
+
+	auth.dial = func(url string) (ldapConn, error) {
+		return nil, fmt.Errorf("connection refused")
+	}
+	if valid, err := auth.CheckPasswd("alice", "secret"); valid || err == nil {
+		t.Error("Authentication succeeded without an LDAP server")
+	}
+
+	if _, err := NewLDAPAuthenticator("ldaps://ldap.example.com", "uid=bob", ""); err == nil {
+		t.Error("Bind DN template without placeholder was accepted")
+	}
+}
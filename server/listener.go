@@ -0,0 +1,190 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// ipFilter decides by their IP address which clients may connect.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// parseIPFilter returns a filter of the networks `allow` and `deny` in CIDR notation, e.g. `10.0.0.0/8`.
+// Single addresses like `10.0.0.1` match only this address. It returns nil if no networks are given.
+func parseIPFilter(allow, deny []string) (*ipFilter, error) {
+	allowed, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	return &ipFilter{allow: allowed, deny: denied}, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid CIDR %q, must be like 10.0.0.0/8 or a single address", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q, must be like 10.0.0.0/8 or a single address", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// allowed returns true if `ip` is in none of the denied networks and, if networks are allowed, in one of them.
+// Denied networks take precedence over allowed ones.
+func (f *ipFilter) allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.deny {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, network := range f.allow {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterListener closes the connections of clients which are not allowed right after accepting them,
+// i.e. before the FTP handshake, and of clients beyond the maximum number of connections.
+type filterListener struct {
+	net.Listener
+	filter      *ipFilter
+	connections *connections
+	auditor     *auditor
+	logger      logrus.FieldLogger
+}
+
+// tooManyConnections is the reply to clients beyond the maximum number of connections, see RFC 959.
+const tooManyConnections = "421 Too many connections\r\n"
+
+// Accept waits for the next connection of an allowed client.
+// The connection counts towards the maximum number of connections until it is closed.
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		clientIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !l.filter.allowed(net.ParseIP(clientIP)) {
+			l.logger.WithFields(logrus.Fields{"client_ip": clientIP, "action": "CONNECT"}).Warnf("Rejected connection from %s", clientIP)
+			l.auditor.record(AuditEvent{ClientIP: clientIP, Action: "CONNECT", Result: AuditFailure, Error: "client IP is not allowed"})
+			conn.Close()
+			continue
+		}
+		if !l.connections.acquire() {
+			l.logger.WithFields(logrus.Fields{"client_ip": clientIP, "action": "CONNECT"}).Warnf("Refused connection from %s, at most %d connections are allowed", clientIP, l.connections.max)
+			l.auditor.record(AuditEvent{ClientIP: clientIP, Action: "CONNECT", Result: AuditFailure, Error: "too many connections"})
+			conn.Write([]byte(tooManyConnections))
+			conn.Close()
+			continue
+		}
+		return &countedConn{Conn: conn, release: l.connections.release}, nil
+	}
+}
+
+// countedConn releases its slot of the maximum number of connections when it is closed.
+type countedConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+// Close closes the connection and releases its slot, only the first call releases it.
+func (c *countedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// Serve serves the FTP connections accepted by `listener` like ftpServer.ListenAndServe, e.g. of DriverFactory.Listener.
+// `tlsConfig` are the TLS settings of control and data connections like the minimum version, the certificate of the server is added.
+// If it is nil, the TLSConfig of the server options is used. The reply to FEAT advertises the enabled features unless the server options set Features.
+// The commands of f3 like SITE are added to the server, the Commands of its options take precedence.
+func Serve(ftpServer *ftp.Server, listener net.Listener, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		tlsConfig = ftpServer.TLSConfig
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	ftpServer.TLSConfig = tlsConfig
+	if len(ftpServer.Features) == 0 {
+		ftpServer.Features = ftpExtensions(ftpServer)
+	}
+	commands := ftpCommands()
+	for name, command := range ftpServer.Commands {
+		commands[name] = command
+	}
+	ftpServer.Commands = commands
+	return ftpServer.Serve(listener)
+}
+
+// ftpExtensions returns the FTP extensions advertised by FEAT, see RFC 2389.
+// Extensions of features are advertised if the feature is enabled for any user because FEAT is sent before the login.
+func ftpExtensions(ftpServer *ftp.Server) []string {
+	features := allFeatures
+	if factory, ok := ftpServer.Factory.(DriverFactory); ok {
+		features = factory.anyFeatures()
+	}
+	extensions := []string{"UTF8", "EPRT", "EPSV", "LPRT", "SIZE", "MDTM"}
+	if features&featureList != 0 {
+		extensions = append(extensions, "MLST "+mlsxFacts)
+	}
+	if features&(featureGet|featureAppend) != 0 {
+		// goftp resumes downloads and uploads at the offset of REST
+		extensions = append(extensions, "REST STREAM")
+	}
+	if features&featurePut != 0 {
+		extensions = append(extensions, "MFMT")
+	}
+	if ftpServer.TLS {
+		if ftpServer.ExplicitFTPS {
+			extensions = append(extensions, "AUTH TLS")
+		}
+		extensions = append(extensions, "PBSZ", "PROT")
+	}
+	return extensions
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+func TestIPFilter(t *testing.T) {
+	filter, err := parseIPFilter([]string{"10.0.0.0/8", "192.168.1.10", "2001:db8::/32"}, []string{"10.1.0.0/16", "2001:db8::1"})
+	if err != nil {
+		t.Fatalf("Parsing the filter failed: %s", err)
+	}
+	tCases := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"192.168.1.10", true},
+		{"192.168.1.11", false},
+		{"::ffff:10.0.0.1", true},
+		{"2001:db8::2", true},
+		{"2001:db8::1", false},
+		{"127.0.0.1", false},
+		{"", false},
+	}
+	for _, tCase := range tCases {
+		if allowed := filter.allowed(net.ParseIP(tCase.ip)); allowed != tCase.allowed {
+			t.Errorf("Expected %q to be allowed: %t but was %t", tCase.ip, tCase.allowed, allowed)
+		}
+	}
+
+	denyOnly, err := parseIPFilter(nil, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("Parsing the filter failed: %s", err)
+	}
+	if !denyOnly.allowed(net.ParseIP("127.0.0.1")) || denyOnly.allowed(net.ParseIP("10.0.0.1")) {
+		t.Errorf("Expected all networks but the denied ones to be allowed")
+	}
+	if filter, err := parseIPFilter(nil, []string{" "}); filter != nil || err != nil {
+		t.Errorf("Expected no filter without networks but was %v: %v", filter, err)
+	}
+	for _, invalid := range []string{"10.0.0.0/33", "10.0.0", "example.com"} {
+		if _, err := parseIPFilter([]string{invalid}, nil); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestServeFilteredListener(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	logger := &auditLoggerMock{}
+	bucketName := "test-bucket"
+	factory := DriverFactory{connections: &connections{}, auditor: newAuditor(logger, logrus.StandardLogger())}
+
+	tCases := []struct {
+		deny     []string
+		accepted bool
+	}{
+		{nil, true},
+		{[]string{"127.0.0.0/8"}, false},
+	}
+	for _, tCase := range tCases {
+		factory.ipFilter, _ = parseIPFilter(nil, tCase.deny)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listening failed: %s", err)
+		}
+		ftpServer := ftp.NewServer(&ftp.ServerOpts{
+			Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+				return &S3Driver{
+					s3:         &s3Mock{bucket: newBucketMock(bucketName)},
+					metrics:    metricsSenderMock{},
+					bucketName: bucketName,
+					bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+				}, nil
+			}),
+			Auth:           &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+			WelcomeMessage: "hello",
+			Logger:         factory.Logger(),
+		})
+		go Serve(ftpServer, factory.Listener(listener), nil)
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Connecting failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if !tCase.accepted {
+			if data, err := ioutil.ReadAll(conn); err != nil || len(data) != 0 {
+				t.Errorf("Expected the connection to be closed without reply but read %q: %v", data, err)
+			}
+			events := logger.recorded()
+			if len(events) != 1 || events[0].Action != "CONNECT" || events[0].ClientIP != "127.0.0.1" || events[0].Result != AuditFailure {
+				t.Errorf("Expected the rejected connection to be recorded but were %+v", events)
+			}
+		} else {
+			replies := bufio.NewReader(conn)
+			if welcome, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(welcome, "220 hello") {
+				t.Errorf("Expected the welcome message but was %q: %v", welcome, err)
+			}
+			fmt.Fprintf(conn, "FEAT\r\n")
+			feats := ""
+			for !strings.HasPrefix(feats, "211 ") {
+				line, err := replies.ReadString('\n')
+				if err != nil {
+					t.Fatalf("Reading the reply to FEAT failed: %s", err)
+				}
+				feats = line + feats
+			}
+			if !strings.Contains(feats, "EPSV") {
+				t.Errorf("Expected EPSV to be advertised by FEAT")
+			}
+		}
+		conn.Close()
+		ftpServer.Shutdown()
+	}
+}
+
+func TestServeFeat(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	dir, err := ioutil.TempDir("", "f3-feat")
+	if err != nil {
+		t.Fatalf("Failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	tCases := []struct {
+		name       string
+		features   string
+		users      string
+		tls        bool
+		explicit   bool
+		extensions []string
+	}{
+		{"list-only", "ls", "", false, false, []string{"UTF8", "EPRT", "EPSV", "LPRT", "SIZE", "MDTM", "MLST type*;size*;modify*;"}},
+		{"downloads", "ls,get", "", false, false, []string{"UTF8", "EPRT", "EPSV", "LPRT", "SIZE", "MDTM", "MLST type*;size*;modify*;", "REST STREAM"}},
+		{"downloads-of-users", "ls", "alice:secret:ls,get", false, false, []string{"UTF8", "EPRT", "EPSV", "LPRT", "SIZE", "MDTM", "MLST type*;size*;modify*;", "REST STREAM"}},
+		{"uploads", "ls,put", "", false, false, []string{"UTF8", "EPRT", "EPSV", "LPRT", "SIZE", "MDTM", "MLST type*;size*;modify*;", "MFMT"}},
+		{"explicit-tls", "ls", "", true, true, []string{"UTF8", "EPRT", "EPSV", "LPRT", "SIZE", "MDTM", "MLST type*;size*;modify*;", "AUTH TLS", "PBSZ", "PROT"}},
+		{"implicit-tls", "ls", "", true, false, []string{"UTF8", "EPRT", "EPSV", "LPRT", "SIZE", "MDTM", "MLST type*;size*;modify*;", "PBSZ", "PROT"}},
+	}
+	for _, tCase := range tCases {
+		config := &FactoryConfig{
+			FtpFeatures:       tCase.features,
+			S3Credentials:     "access:secret",
+			S3BucketURL:       "https://some-bucket.somewhere.com",
+			S3Region:          DefaultRegion,
+			DisableCloudWatch: true,
+		}
+		if tCase.users != "" {
+			users, err := AuthenticatorFromString(tCase.users)
+			if err != nil {
+				t.Fatalf("Test %s: parsing credentials failed: %s", tCase.name, err)
+			}
+			config.FtpUsers = &users
+		}
+		factory, err := NewDriverFactory(config)
+		if err != nil {
+			t.Fatalf("Test %s: creating the driver factory failed: %s", tCase.name, err)
+		}
+		opts := &ftp.ServerOpts{Factory: factory, Logger: factory.Logger()}
+		if tCase.tls {
+			opts.TLS, opts.ExplicitFTPS, opts.CertFile, opts.KeyFile = true, tCase.explicit, certFile, keyFile
+		}
+		ftpServer := ftp.NewServer(opts)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listening failed: %s", err)
+		}
+		go Serve(ftpServer, listener, nil)
+
+		var conn net.Conn
+		if tCase.tls && !tCase.explicit {
+			conn, err = tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		} else {
+			conn, err = net.Dial("tcp", listener.Addr().String())
+		}
+		if err != nil {
+			t.Fatalf("Test %s: connecting failed: %s", tCase.name, err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		replies := bufio.NewReader(conn)
+		if welcome, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(welcome, "220") {
+			t.Fatalf("Test %s: expected the welcome message but was %q: %v", tCase.name, welcome, err)
+		}
+		fmt.Fprint(conn, "FEAT\r\n")
+		lines := []string{}
+		for {
+			line, err := replies.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Test %s: reading the reply to FEAT failed: %s", tCase.name, err)
+			}
+			if !strings.HasSuffix(line, "\r\n") {
+				t.Errorf("Test %s: expected the line %q of the reply to FEAT to end with CRLF", tCase.name, line)
+			}
+			lines = append(lines, strings.TrimRight(line, "\r\n"))
+			if strings.HasPrefix(line, "211 ") {
+				break
+			}
+		}
+		expected := []string{"211-Extensions supported:"}
+		for _, extension := range tCase.extensions {
+			expected = append(expected, " "+extension)
+		}
+		expected = append(expected, "211 END")
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("Test %s: expected the reply to FEAT %q but was %q", tCase.name, expected, lines)
+		}
+		conn.Close()
+		ftpServer.Shutdown()
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// DefaultLockoutDuration is the default time accounts are locked after too many failed logins.
+const DefaultLockoutDuration = 15 * time.Minute
+
+// LockoutAuthenticator locks accounts for a cooldown after repeated failed logins, e.g. against guessing passwords,
+// and delegates all other logins.
+// Implements https://godoc.org/github.com/goftp/server#Auth
+type LockoutAuthenticator struct {
+	auth        ftp.Auth
+	maxFailures int
+	duration    time.Duration
+	now         func() time.Time
+	lock        sync.Mutex
+	accounts    map[string]*lockoutAccount
+	logger      logrus.FieldLogger
+}
+
+// lockoutAccount are the failed logins of an account.
+type lockoutAccount struct {
+	failures int
+	// since is the time of the first failed login which is counted
+	since       time.Time
+	lockedUntil time.Time
+}
+
+// NewLockoutAuthenticator returns a LockoutAuthenticator which checks logins with `auth` and locks accounts for `duration`
+// after `maxFailures` failed logins within `duration`. A successful login resets the failed logins.
+func NewLockoutAuthenticator(auth ftp.Auth, maxFailures int, duration time.Duration) (*LockoutAuthenticator, error) {
+	if maxFailures <= 0 {
+		return nil, fmt.Errorf("Invalid maximum number of failed logins %d, must be positive", maxFailures)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("Invalid lockout duration %s, must be positive", duration)
+	}
+	return &LockoutAuthenticator{
+		auth:        auth,
+		maxFailures: maxFailures,
+		duration:    duration,
+		now:         time.Now,
+		accounts:    make(map[string]*lockoutAccount),
+	}, nil
+}
+
+// CheckPasswd returns `true` if the account of `username` is not locked and `auth` accepts username and password.
+// Passwords of locked accounts are not checked.
+func (a *LockoutAuthenticator) CheckPasswd(username, password string) (bool, error) {
+	a.lock.Lock()
+	account, ok := a.accounts[username]
+	if ok && a.now().Before(account.lockedUntil) {
+		a.lock.Unlock()
+		return false, fmt.Errorf("Account %q is locked until %s", username, account.lockedUntil.Format(time.RFC3339))
+	}
+	a.lock.Unlock()
+
+	// not locked while the password is checked, e.g. by a slow LDAP server
+	valid, err := a.auth.CheckPasswd(username, password)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if valid {
+		delete(a.accounts, username)
+		return valid, err
+	}
+	a.fail(username)
+	return valid, err
+}
+
+// log returns the logger of the authenticator, the global logger of logrus if none is configured.
+func (a *LockoutAuthenticator) log() logrus.FieldLogger {
+	return orStandardLogger(a.logger)
+}
+
+// fail counts a failed login of `username` and locks the account when the maximum is reached, a.lock must be held.
+func (a *LockoutAuthenticator) fail(username string) {
+	now := a.now()
+	// forget expired failures, e.g. of unknown users
+	for name, account := range a.accounts {
+		if now.Sub(account.since) > a.duration && !now.Before(account.lockedUntil) {
+			delete(a.accounts, name)
+		}
+	}
+	account, ok := a.accounts[username]
+	if !ok {
+		account = &lockoutAccount{since: now}
+		a.accounts[username] = account
+	}
+	account.failures++
+	if account.failures >= a.maxFailures {
+		account.lockedUntil = now.Add(a.duration)
+		account.failures, account.since = 0, now
+		a.log().WithFields(logrus.Fields{"user": username, "action": "LOGIN"}).Warnf("Locking account %q for %s after %d failed logins", username, a.duration, a.maxFailures)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLockoutAuthenticator(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	creds, err := AuthenticatorFromString("alice:secret\nbob:secret")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	auth, err := NewLockoutAuthenticator(creds, 3, time.Minute)
+	if err != nil {
+		t.Fatalf("Creating the lockout authenticator failed: %s", err)
+	}
+	now := time.Now()
+	auth.now = func() time.Time { return now }
+
+	checkPasswd := func(user, password string, expected bool) {
+		t.Helper()
+		if valid, _ := auth.CheckPasswd(user, password); valid != expected {
+			t.Errorf("Login of %s:%s: expected %v but was %v", user, password, expected, valid)
+		}
+	}
+	// a successful login resets the failed logins
+	checkPasswd("alice", "wrong", false)
+	checkPasswd("alice", "wrong", false)
+	checkPasswd("alice", "secret", true)
+	checkPasswd("alice", "wrong", false)
+	checkPasswd("alice", "wrong", false)
+	checkPasswd("alice", "secret", true)
+
+	// failed logins outside of the window are forgotten
+	checkPasswd("alice", "wrong", false)
+	checkPasswd("alice", "wrong", false)
+	now = now.Add(time.Minute + time.Second)
+	checkPasswd("alice", "wrong", false)
+	checkPasswd("alice", "secret", true)
+
+	for i := 0; i < 3; i++ {
+		checkPasswd("alice", "wrong", false)
+	}
+	checkPasswd("alice", "secret", false)
+	checkPasswd("bob", "secret", true)
+	now = now.Add(time.Minute)
+	checkPasswd("alice", "secret", true)
+	if len(auth.accounts) != 0 {
+		t.Errorf("Expected no failed logins to be left but were %d", len(auth.accounts))
+	}
+
+	for _, tCase := range []struct {
+		maxFailures int
+		duration    time.Duration
+	}{{0, time.Minute}, {-1, time.Minute}, {3, 0}} {
+		if _, err := NewLockoutAuthenticator(creds, tCase.maxFailures, tCase.duration); err == nil {
+			t.Errorf("Creating a lockout authenticator with %d failures and duration %s succeeded", tCase.maxFailures, tCase.duration)
+		}
+	}
+}
@@ -8,21 +8,42 @@ import (
 )
 
 // FTPLogger is a logger implementation for use in `go-ftp`.
-type FTPLogger struct{}
+type FTPLogger struct {
+	auditor *auditor
+	logger  logrus.FieldLogger
+}
+
+// log returns the logger of the FTP server.
+func (logger *FTPLogger) log() logrus.FieldLogger {
+	return orStandardLogger(logger.logger)
+}
+
+// orStandardLogger returns `logger`, the global logger of logrus if nil.
+func orStandardLogger(logger logrus.FieldLogger) logrus.FieldLogger {
+	if logger == nil {
+		return logrus.StandardLogger()
+	}
+	return logger
+}
 
 // Print logs the given message and session id.
 func (logger *FTPLogger) Print(sessionID string, message interface{}) {
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "session": sessionID, "message": message}).Debug("FTP:", message)
+	if message == connectionTerminated {
+		logger.auditor.disconnect(sessionID)
+	}
+	logger.log().WithFields(logrus.Fields{"time": time.Now(), "session": sessionID, "message": message}).Debug("FTP:", message)
 }
 
 // PrintCommand logs the given command and its parameters as well as the session id.
 func (logger *FTPLogger) PrintCommand(sessionID string, command string, params string) {
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "session": sessionID, "command": command, "parameters": params}).Debugf("FTP: %s(%s)", command, params)
+	logger.auditor.command(sessionID, command, params)
+	logger.log().WithFields(logrus.Fields{"time": time.Now(), "session": sessionID, "command": command, "parameters": params}).Debugf("FTP: %s(%s)", command, params)
 }
 
 // PrintResponse logs the response code and message as well as the session id.
 func (logger *FTPLogger) PrintResponse(sessionID string, code int, message string) {
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "session": sessionID, "code": code, "response": message}).Debugf("Response with %q and code %d", message, code)
+	logger.auditor.response(sessionID, code)
+	logger.log().WithFields(logrus.Fields{"time": time.Now(), "session": sessionID, "code": code, "response": message}).Debugf("Response with %q and code %d", message, code)
 
 }
 
@@ -31,5 +52,5 @@ func (logger *FTPLogger) Printf(sessionID string, format string, v ...interface{
 	if !strings.HasSuffix(format, "\n") {
 		format += "\n"
 	}
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "session": sessionID}).Debugf(format, v...)
+	logger.log().WithFields(logrus.Fields{"time": time.Now(), "session": sessionID}).Debugf(format, v...)
 }
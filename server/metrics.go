@@ -9,6 +9,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 )
 
 // MetricsSender defines methods for sending data to a metrics provider.
@@ -17,6 +18,10 @@ type MetricsSender interface {
 	SendPut(size int64, timestamp time.Time) error
 	// SendGet sends the size of a served (GET) object and the operation's timestamp.
 	SendGet(size int64, timestamp time.Time) error
+	// SendDelete sends the timestamp of a DELETE operation.
+	SendDelete(timestamp time.Time) error
+	// SendList sends the number of listed entries and the operation's timestamp.
+	SendList(count int, timestamp time.Time) error
 }
 
 // NopSender returns immediately.
@@ -28,6 +33,12 @@ func (n NopSender) SendPut(size int64, timestamp time.Time) error { return nil }
 // SendGet returns nil.
 func (n NopSender) SendGet(size int64, timestamp time.Time) error { return nil }
 
+// SendDelete returns nil.
+func (n NopSender) SendDelete(timestamp time.Time) error { return nil }
+
+// SendList returns nil.
+func (n NopSender) SendList(count int, timestamp time.Time) error { return nil }
+
 // CloudwatchSender implements MetricsSender for amazon's cloudwatch service.
 type CloudwatchSender struct {
 	metrics  cloudwatchiface.CloudWatchAPI
@@ -64,7 +75,7 @@ func (c *CloudwatchSender) SendPut(size int64, timestamp time.Time) error {
 		},
 	})
 	if err != nil {
-		logAwsError(intoAwsError(err))
+		logAwsError(logrus.StandardLogger(), intoAwsError(err))
 		return errors.Wrapf(err, "Failed to send cloudwatch PUT metric")
 	}
 	return nil
@@ -88,8 +99,41 @@ func (c *CloudwatchSender) SendGet(size int64, timestamp time.Time) error {
 		},
 	})
 	if err != nil {
-		logAwsError(intoAwsError(err))
+		logAwsError(logrus.StandardLogger(), intoAwsError(err))
 		return errors.Wrapf(err, "Failed to send cloudwatch GET metric")
 	}
 	return nil
 }
+
+// SendDelete stores the metric data for a DELETE operation in cloudwatch.
+func (c *CloudwatchSender) SendDelete(timestamp time.Time) error {
+	return c.putMetric("DELETE", "Count", 1, timestamp)
+}
+
+// SendList stores the metric data for a LIST operation in cloudwatch.
+func (c *CloudwatchSender) SendList(count int, timestamp time.Time) error {
+	return c.putMetric("LIST", "Count", float64(count), timestamp)
+}
+
+func (c *CloudwatchSender) putMetric(name, unit string, value float64, timestamp time.Time) error {
+	_, err := c.metrics.PutMetricData(&cloudwatch.PutMetricDataInput{
+		Namespace: aws.String("f3"),
+		MetricData: []*cloudwatch.MetricDatum{
+			&cloudwatch.MetricDatum{
+				MetricName: aws.String(name),
+				Timestamp:  &timestamp,
+				Unit:       aws.String(unit),
+				Value:      aws.Float64(value),
+				Dimensions: []*cloudwatch.Dimension{&cloudwatch.Dimension{
+					Name:  aws.String("Hostname"),
+					Value: aws.String(c.hostname),
+				}},
+			},
+		},
+	})
+	if err != nil {
+		logAwsError(logrus.StandardLogger(), intoAwsError(err))
+		return errors.Wrapf(err, "Failed to send cloudwatch %s metric", name)
+	}
+	return nil
+}
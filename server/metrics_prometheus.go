@@ -0,0 +1,82 @@
+package server
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// PrometheusSender implements MetricsSender by updating Prometheus collectors.
+// The collectors are served by the HTTP handler of the registry they were registered with.
+type PrometheusSender struct {
+	bytes      *prometheus.CounterVec
+	entries    prometheus.Counter
+	operations *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+}
+
+// NewPrometheusSender returns a new PrometheusSender whose collectors are registered with `registerer`.
+func NewPrometheusSender(registerer prometheus.Registerer) (*PrometheusSender, error) {
+	p := &PrometheusSender{
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "f3",
+			Name:      "transferred_bytes_total",
+			Help:      "Number of bytes of served (GET) and stored (PUT) objects.",
+		}, []string{"operation"}),
+		entries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "f3",
+			Name:      "listed_entries_total",
+			Help:      "Number of entries of directory listings (LIST).",
+		}),
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "f3",
+			Name:      "operations_total",
+			Help:      "Number of FTP operations.",
+		}, []string{"operation"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "f3",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of the s3 requests of FTP operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+	}
+	for _, collector := range []prometheus.Collector{p.bytes, p.entries, p.operations, p.latency} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, errors.Wrapf(err, "Failed to register Prometheus metrics")
+		}
+	}
+	return p, nil
+}
+
+// SendPut counts a PUT operation, its size and the time passed since `timestamp`.
+func (p *PrometheusSender) SendPut(size int64, timestamp time.Time) error {
+	p.bytes.WithLabelValues("PUT").Add(float64(size))
+	p.observe("PUT", timestamp)
+	return nil
+}
+
+// SendGet counts a GET operation, its size and the time passed since `timestamp`.
+func (p *PrometheusSender) SendGet(size int64, timestamp time.Time) error {
+	p.bytes.WithLabelValues("GET").Add(float64(size))
+	p.observe("GET", timestamp)
+	return nil
+}
+
+// SendDelete counts a DELETE operation and the time passed since `timestamp`.
+func (p *PrometheusSender) SendDelete(timestamp time.Time) error {
+	p.observe("DELETE", timestamp)
+	return nil
+}
+
+// SendList counts a LIST operation, its number of entries and the time passed since `timestamp`.
+func (p *PrometheusSender) SendList(count int, timestamp time.Time) error {
+	p.entries.Add(float64(count))
+	p.observe("LIST", timestamp)
+	return nil
+}
+
+func (p *PrometheusSender) observe(operation string, timestamp time.Time) {
+	p.operations.WithLabelValues(operation).Inc()
+	p.latency.WithLabelValues(operation).Observe(time.Since(timestamp).Seconds())
+}
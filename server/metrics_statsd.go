@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// statsdWriteTimeout limits the time to send metrics so that transfers are never blocked by the collector.
+const statsdWriteTimeout = 100 * time.Millisecond
+
+// StatsdSender implements MetricsSender by sending metrics over UDP to a StatsD collector.
+// Metrics are dropped if the collector is unreachable.
+type StatsdSender struct {
+	conn   net.Conn
+	prefix string
+	logger logrus.FieldLogger
+}
+
+// NewStatsdSender returns a new StatsdSender which sends metrics to `addr` and prefixes their names with `prefix`.
+func NewStatsdSender(addr, prefix string) (*StatsdSender, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to StatsD collector %q", addr)
+	}
+	prefix = strings.TrimSuffix(prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+	return &StatsdSender{conn: conn, prefix: prefix}, nil
+}
+
+// log returns the logger of the sender, the global logger of logrus if none is configured.
+func (s *StatsdSender) log() logrus.FieldLogger {
+	return orStandardLogger(s.logger)
+}
+
+// SendPut sends the size of a stored (PUT) object and the time passed since `timestamp`.
+func (s *StatsdSender) SendPut(size int64, timestamp time.Time) error {
+	s.send("put", "bytes", size, timestamp)
+	return nil
+}
+
+// SendGet sends the size of a served (GET) object and the time passed since `timestamp`.
+func (s *StatsdSender) SendGet(size int64, timestamp time.Time) error {
+	s.send("get", "bytes", size, timestamp)
+	return nil
+}
+
+// SendDelete sends a DELETE operation and the time passed since `timestamp`.
+func (s *StatsdSender) SendDelete(timestamp time.Time) error {
+	s.send("delete", "count", 1, timestamp)
+	return nil
+}
+
+// SendList sends the number of listed entries and the time passed since `timestamp`.
+func (s *StatsdSender) SendList(count int, timestamp time.Time) error {
+	s.send("list", "entries", int64(count), timestamp)
+	return nil
+}
+
+// send sends the counter `metric` of `operation` along with the operation's duration.
+func (s *StatsdSender) send(operation, metric string, value int64, timestamp time.Time) {
+	duration := time.Since(timestamp) / time.Millisecond
+	packet := fmt.Sprintf("%[1]s%[2]s.%[3]s:%[4]d|c\n%[1]s%[2]s.duration:%[5]d|ms", s.prefix, operation, metric, value, duration)
+
+	s.conn.SetWriteDeadline(time.Now().Add(statsdWriteTimeout))
+	if _, err := s.conn.Write([]byte(packet)); err != nil {
+		s.log().Debugf("Dropped %s metrics: %s", operation, err)
+	}
+}
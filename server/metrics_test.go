@@ -1,11 +1,15 @@
 package server
 
 import (
+	"net"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type CloudwatchMock struct {
@@ -33,4 +37,120 @@ func TestCloudwatchSender(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = cw.SendDelete(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cw.SendList(7, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrometheusSender(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	p, err := NewPrometheusSender(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPrometheusSender(registry); err == nil {
+		t.Error("Registering the metrics twice succeeded")
+	}
+
+	if err := p.SendGet(int64(21), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendPut(int64(42), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendPut(int64(8), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendDelete(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SendList(7, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	testDataSet := []struct {
+		collector prometheus.Collector
+		expected  float64
+	}{
+		{p.bytes.WithLabelValues("GET"), 21},
+		{p.bytes.WithLabelValues("PUT"), 50},
+		{p.operations.WithLabelValues("GET"), 1},
+		{p.operations.WithLabelValues("PUT"), 2},
+		{p.operations.WithLabelValues("DELETE"), 1},
+		{p.operations.WithLabelValues("LIST"), 1},
+		{p.entries, 7},
+	}
+	for i, testData := range testDataSet {
+		if value := testutil.ToFloat64(testData.collector); value != testData.expected {
+			t.Errorf("Test %d: expected %f but was %f", i, testData.expected, value)
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	observations := uint64(0)
+	for _, family := range families {
+		if family.GetName() != "f3_operation_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			observations += metric.GetHistogram().GetSampleCount()
+		}
+	}
+	if observations != 5 {
+		t.Errorf("Expected 5 observed latencies but were %d", observations)
+	}
+}
+
+func TestStatsdSender(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	s, err := NewStatsdSender(collector.LocalAddr().String(), "f3.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SendGet(int64(21), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 1024)
+	collector.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to receive metrics: %s", err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	if len(lines) != 2 || lines[0] != "f3.test.get.bytes:21|c" || !strings.HasPrefix(lines[1], "f3.test.get.duration:") || !strings.HasSuffix(lines[1], "|ms") {
+		t.Errorf("Unexpected metrics %q", buf[:n])
+	}
+
+	if err := s.SendList(7, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err = collector.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to receive metrics: %s", err)
+	}
+	if lines := strings.Split(string(buf[:n]), "\n"); lines[0] != "f3.test.list.entries:7|c" {
+		t.Errorf("Unexpected metrics %q", buf[:n])
+	}
+
+	// metrics are dropped if the collector is unreachable
+	collector.Close()
+	for i := 0; i < 2; i++ {
+		if err := s.SendPut(int64(42), time.Now()); err != nil {
+			t.Errorf("Sending to an unreachable collector failed: %s", err)
+		}
+	}
 }
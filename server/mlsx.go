@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// mlsxFacts are the facts of MLSD and MLST, they are advertised by FEAT, see RFC 3659.
+const mlsxFacts = "type*;size*;modify*;"
+
+// commandMlsd lists the directory of the parameter, or the working directory, with machine-readable facts on the data connection.
+type commandMlsd struct{}
+
+func (cmd commandMlsd) IsExtend() bool     { return true }
+func (cmd commandMlsd) RequireParam() bool { return false }
+func (cmd commandMlsd) RequireAuth() bool  { return true }
+
+func (cmd commandMlsd) Execute(conn *ftp.Conn, param string) {
+	path := conn.BuildPath(param)
+	info, err := conn.Driver().Stat(path)
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	if !info.IsDir() {
+		conn.WriteMessage(501, fmt.Sprintf("%q is not a directory", path))
+		return
+	}
+	var lines strings.Builder
+	err = conn.Driver().ListDir(path, func(f ftp.FileInfo) error {
+		lines.WriteString(formatFacts(f) + " " + f.Name() + "\r\n")
+		return nil
+	})
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	conn.WriteMessage(150, "Opening ASCII mode data connection for directory listing")
+	if !conn.SendOutofbandData([]byte(lines.String())) {
+		conn.WriteMessage(425, "No data connection, send PASV or PORT first")
+	}
+}
+
+// commandMlst replies the machine-readable facts of the file or directory of the parameter, or the working directory.
+type commandMlst struct{}
+
+func (cmd commandMlst) IsExtend() bool     { return true }
+func (cmd commandMlst) RequireParam() bool { return false }
+func (cmd commandMlst) RequireAuth() bool  { return true }
+
+func (cmd commandMlst) Execute(conn *ftp.Conn, param string) {
+	path := conn.BuildPath(param)
+	info, err := conn.Driver().Stat(path)
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	conn.WriteMessageLines(250, "Listing "+path, " "+formatFacts(info)+" "+path, "End")
+}
+
+// formatFacts returns the facts of `info` like `type=file;size=42;modify=20200102150405;`, prefixes are of type `dir`.
+func formatFacts(info ftp.FileInfo) string {
+	facts := "type=file;size=" + fmt.Sprint(info.Size()) + ";"
+	if info.IsDir() {
+		facts = "type=dir;"
+	}
+	if modTime := info.ModTime(); !modTime.IsZero() {
+		facts += "modify=" + modTime.UTC().Format("20060102150405") + ";"
+	}
+	return facts
+}
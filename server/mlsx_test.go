@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+func TestFormatFacts(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 16, 4, 5, 0, time.FixedZone("CET", 3600))
+	tCases := []struct {
+		name  string
+		info  S3ObjectInfo
+		facts string
+	}{
+		{"file", S3ObjectInfo{name: "a.txt", size: 42, modTime: modTime}, "type=file;size=42;modify=20200102150405;"},
+		{"prefix", S3ObjectInfo{name: "foo", isPrefix: true, modTime: modTime}, "type=dir;modify=20200102150405;"},
+		{"no-mod-time", S3ObjectInfo{name: "a.txt"}, "type=file;size=0;"},
+	}
+	for _, tCase := range tCases {
+		if facts := formatFacts(tCase.info); facts != tCase.facts {
+			t.Errorf("Test %s: expected facts %q but were %q", tCase.name, tCase.facts, facts)
+		}
+	}
+}
+
+func TestMlsx(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	modTime := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	bucketMock.Put("baz", objectMock{[]byte("baz"), modTime, "baz"})
+	bucketMock.Put("foo/a", objectMock{[]byte("a"), modTime, "a"})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				featureFlags: featureList | featureChangeDir,
+				s3:           &s3Mock{bucket: bucketMock},
+				metrics:      metricsSenderMock{},
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}, nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	conn, replies := dialFTP(t, listener, "alice", "secret")
+	defer conn.Close()
+
+	listing := transferData(t, conn, replies, "MLSD /", nil)
+	lines := strings.Split(strings.TrimSuffix(listing, "\r\n"), "\r\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 entries but listed %q", listing)
+	}
+	for _, line := range lines {
+		switch {
+		case strings.HasSuffix(line, " foo"):
+			if !strings.HasPrefix(line, "type=dir;") {
+				t.Errorf("Expected the prefix foo to be a directory but was %q", line)
+			}
+		case strings.HasSuffix(line, " baz"):
+			if line != "type=file;size=3;modify=20200102150405; baz" {
+				t.Errorf("Unexpected facts of baz %q", line)
+			}
+		default:
+			t.Errorf("Unexpected entry %q", line)
+		}
+	}
+
+	fmt.Fprint(conn, "CWD /foo\r\n")
+	expectReply(t, replies, "250")
+	if listing := transferData(t, conn, replies, "MLSD", nil); listing != "type=file;size=1;modify=20200102150405; a\r\n" {
+		t.Errorf("Unexpected listing of the working directory %q", listing)
+	}
+
+	fmt.Fprint(conn, "MLST /baz\r\n")
+	expectReply(t, replies, "250-")
+	if facts := expectReply(t, replies, " "); facts != " type=file;size=3;modify=20200102150405; /baz\r\n" {
+		t.Errorf("Unexpected facts of /baz %q", facts)
+	}
+	expectReply(t, replies, "250 ")
+
+	fmt.Fprint(conn, "MLSD /baz\r\n")
+	expectReply(t, replies, "501")
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+	"github.com/sirupsen/logrus"
+)
+
+// Option changes a setting of the DriverFactory returned by NewDriverFactoryWithOptions.
+// Options are applied in order, later options override earlier ones.
+type Option func(*FactoryConfig)
+
+// NewDriverFactoryWithOptions returns a DriverFactory configured by `opts`, the bucket is set by WithBucket.
+// Unless overridden, only listing is enabled (DefaultFeatureSet), the default AWS credential chain is used
+// and metrics are sent to CloudWatch.
+func NewDriverFactoryWithOptions(opts ...Option) (DriverFactory, error) {
+	config := FactoryConfig{
+		FtpFeatures: DefaultFeatureSet,
+	}
+	for _, opt := range opts {
+		opt(&config)
+	}
+	return NewDriverFactory(&config)
+}
+
+// WithConfig replaces all settings by `config`, e.g. to adjust a config file with further options.
+func WithConfig(config FactoryConfig) Option {
+	return func(c *FactoryConfig) {
+		*c = config
+	}
+}
+
+// WithBucket sets the URL of the bucket, e.g. `https://some-bucket.s3.amazonaws.com`.
+func WithBucket(bucketURL string) Option {
+	return func(c *FactoryConfig) {
+		c.S3BucketURL = bucketURL
+	}
+}
+
+// WithKeyPrefix prepends `prefix` to all keys, keys are not prefixed by default.
+func WithKeyPrefix(prefix string) Option {
+	return func(c *FactoryConfig) {
+		c.S3KeyPrefix = prefix
+	}
+}
+
+// WithReadWriteBuckets downloads files from bucket `read` and uploads them to bucket `write`, both are the bucket's name if empty.
+func WithReadWriteBuckets(read, write string) Option {
+	return func(c *FactoryConfig) {
+		c.S3ReadBucket = read
+		c.S3WriteBucket = write
+	}
+}
+
+// WithAuditLog writes the audit events of logins and file operations to the file `target` or an s3 URL like `s3://bucket/prefix`.
+func WithAuditLog(target string) Option {
+	return func(c *FactoryConfig) {
+		c.AuditLog = target
+	}
+}
+
+// WithAllowedContentTypes restricts uploads to the content types `patterns`, e.g. `image/*`, all types are allowed by default.
+func WithAllowedContentTypes(patterns ...string) Option {
+	return func(c *FactoryConfig) {
+		c.FtpAllowContentTypes = patterns
+	}
+}
+
+// WithUploadWebhook notifies `url` about each successful upload, no webhook is notified by default.
+func WithUploadWebhook(url string) Option {
+	return func(c *FactoryConfig) {
+		c.UploadWebhook = url
+	}
+}
+
+// WithFeatures sets the feature set of all users, e.g. `ls,get` or `all,-rm`, instead of DefaultFeatureSet.
+func WithFeatures(featureSet string) Option {
+	return func(c *FactoryConfig) {
+		c.FtpFeatures = featureSet
+	}
+}
+
+// WithUsers sets per-user settings like feature sets which take precedence over the global ones, none by default.
+func WithUsers(users *Authenticator) Option {
+	return func(c *FactoryConfig) {
+		c.FtpUsers = users
+	}
+}
+
+// WithNoOverwrite forbids overwriting existing objects, which is allowed by default.
+func WithNoOverwrite() Option {
+	return func(c *FactoryConfig) {
+		c.FtpNoOverwrite = true
+	}
+}
+
+// WithMaxUploadSize limits the size in bytes of single uploads, uploads are unlimited by default.
+func WithMaxUploadSize(size int64) Option {
+	return func(c *FactoryConfig) {
+		c.FtpMaxUploadSize = ByteSize(size)
+	}
+}
+
+// WithIdleTimeout closes connections without any file operation for `timeout`, connections are kept open by default.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(c *FactoryConfig) {
+		c.FtpIdleTimeout = timeout
+	}
+}
+
+// WithStatCache caches the metadata of up to `size` objects returned by Stat for `ttl`, metadata is not cached by default.
+func WithStatCache(size int, ttl time.Duration) Option {
+	return func(c *FactoryConfig) {
+		c.FtpStatCacheSize = size
+		c.FtpStatCacheTTL = ttl
+	}
+}
+
+// WithMaxConnections limits the number of simultaneous connections, which is unlimited by default.
+func WithMaxConnections(max int) Option {
+	return func(c *FactoryConfig) {
+		c.FtpMaxConnections = max
+	}
+}
+
+// WithIPFilter only accepts connections of clients in the networks `allow` and not in the networks `deny`, e.g. `10.0.0.0/8`.
+// Denied networks take precedence, all clients are accepted by default.
+func WithIPFilter(allow, deny []string) Option {
+	return func(c *FactoryConfig) {
+		c.FtpAllowCIDRs = allow
+		c.FtpDenyCIDRs = deny
+	}
+}
+
+// WithCredentials sets static credentials in the format `access_key:secret_key[:session_token]`
+// instead of using the default AWS credential chain.
+func WithCredentials(credentials string) Option {
+	return func(c *FactoryConfig) {
+		c.S3Credentials = credentials
+	}
+}
+
+// WithRegion sets the region of the bucket, which is detected for AWS endpoints by default.
+func WithRegion(region string) Option {
+	return func(c *FactoryConfig) {
+		c.S3Region = region
+	}
+}
+
+// WithEndpoint sets the s3 endpoint, e.g. of an s3 compatible storage, which is derived from the bucket URL by default.
+func WithEndpoint(endpoint string) Option {
+	return func(c *FactoryConfig) {
+		c.S3Endpoint = endpoint
+	}
+}
+
+// WithPathStyle uses path-style requests (`https://endpoint/bucket/key`) instead of virtual hosted-style requests.
+func WithPathStyle() Option {
+	return func(c *FactoryConfig) {
+		c.S3UsePathStyle = true
+	}
+}
+
+// WithAddressingStyle sets the addressing style of s3 requests, either AddressingStyleAuto, AddressingStylePath or AddressingStyleVirtual.
+// By default, path-style requests are used for all endpoints but AWS ones.
+func WithAddressingStyle(style string) Option {
+	return func(c *FactoryConfig) {
+		c.S3AddressingStyle = style
+	}
+}
+
+// WithSignatureV2 signs requests with signature version 2 instead of version 4, e.g. for older s3 compatible storages.
+func WithSignatureV2() Option {
+	return func(c *FactoryConfig) {
+		c.S3SignatureV2 = true
+	}
+}
+
+// WithStorageClass sets the storage class of uploaded objects instead of the bucket's default, e.g. STANDARD_IA.
+func WithStorageClass(storageClass string) Option {
+	return func(c *FactoryConfig) {
+		c.S3StorageClass = storageClass
+	}
+}
+
+// WithSSE sets the server-side encryption of uploaded objects, either AES256 or aws:kms with the KMS key `kmsKeyID`.
+// Objects are encrypted according to the bucket's settings by default.
+func WithSSE(sse, kmsKeyID string) Option {
+	return func(c *FactoryConfig) {
+		c.S3SSE = sse
+		c.S3SSEKMSKeyID = kmsKeyID
+	}
+}
+
+// WithACL sets the canned ACL of uploaded objects instead of the bucket's default, e.g. public-read.
+func WithACL(acl string) Option {
+	return func(c *FactoryConfig) {
+		c.S3ACL = acl
+	}
+}
+
+// WithMetadata sets the user-defined metadata of uploaded objects, none by default.
+func WithMetadata(metadata map[string]string) Option {
+	return func(c *FactoryConfig) {
+		c.S3Metadata = metadata
+	}
+}
+
+// WithTags sets the URL encoded tags of uploaded objects, e.g. `retention=30d&source=ftp`, none by default.
+func WithTags(tags string) Option {
+	return func(c *FactoryConfig) {
+		c.S3Tags = tags
+	}
+}
+
+// WithContentTypes sets the content types of uploaded objects by file extension, overriding the detected types.
+func WithContentTypes(contentTypes map[string]string) Option {
+	return func(c *FactoryConfig) {
+		c.S3ContentTypes = contentTypes
+	}
+}
+
+// WithCompression gzip compresses uploaded files with one of `extensions`, or all files if none are given.
+func WithCompression(extensions ...string) Option {
+	return func(c *FactoryConfig) {
+		c.S3Compress = true
+		c.S3CompressExtensions = extensions
+	}
+}
+
+// WithPartSize sets the size in bytes of the parts of multipart uploads, at least and by default 5MB.
+func WithPartSize(partSize int64) Option {
+	return func(c *FactoryConfig) {
+		c.S3PartSize = partSize
+	}
+}
+
+// WithParallelDownloads gets `concurrency` parts of `partSize` bytes of each download in parallel, objects are got sequentially by default.
+func WithParallelDownloads(concurrency int, partSize int64) Option {
+	return func(c *FactoryConfig) {
+		c.S3DownloadConcurrency = concurrency
+		c.S3DownloadPartSize = ByteSize(partSize)
+	}
+}
+
+// WithObjectLock sets the object lock mode, retention and legal hold status of uploaded objects, e.g. for WORM buckets.
+// The retention is either a date like `2030-12-31T00:00:00Z` or a period after the upload like `720h`, empty values are not set.
+func WithObjectLock(mode, retainUntil, legalHold string) Option {
+	return func(c *FactoryConfig) {
+		c.S3ObjectLockMode = mode
+		c.S3ObjectLockRetainUntil = retainUntil
+		c.S3ObjectLockLegalHold = legalHold
+	}
+}
+
+// WithMetrics selects the metrics backend, either MetricsCloudWatch (default), MetricsPrometheus, MetricsStatsd or MetricsNone.
+func WithMetrics(metrics string) Option {
+	return func(c *FactoryConfig) {
+		c.Metrics = metrics
+	}
+}
+
+// WithTracer traces the operations of drivers and their s3 requests with `tracer`, tracing is disabled by default.
+func WithTracer(tracer Tracer) Option {
+	return func(c *FactoryConfig) {
+		c.Tracer = tracer
+	}
+}
+
+// WithLogger logs to `logger` instead of the global logger of logrus, e.g. a *logrus.Logger with its own level and output.
+func WithLogger(logger logrus.FieldLogger) Option {
+	return func(c *FactoryConfig) {
+		c.Logger = logger
+	}
+}
+
+// WithS3Client uses `client` and `uploader` instead of creating them, `uploader` may be nil to use an uploader of `client`.
+// The settings of the AWS session like credentials or the endpoint are not used then.
+func WithS3Client(client s3iface.S3API, uploader s3manageriface.UploaderAPI) Option {
+	return func(c *FactoryConfig) {
+		c.S3Client = client
+		c.S3Uploader = uploader
+	}
+}
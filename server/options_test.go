@@ -0,0 +1,94 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+	config := FactoryConfig{FtpFeatures: DefaultFeatureSet}
+	for _, opt := range []Option{
+		WithBucket("https://some-bucket.somewhere.com"),
+		WithFeatures("all,-rm"),
+		WithNoOverwrite(),
+		WithIdleTimeout(time.Minute),
+		WithMaxConnections(10),
+		WithCredentials("access:secret"),
+		WithRegion("eu-central-1"),
+		WithEndpoint("https://somewhere.com"),
+		WithPathStyle(),
+		WithSignatureV2(),
+		WithStorageClass("STANDARD_IA"),
+		WithSSE("aws:kms", "some-key"),
+		WithACL("private"),
+		WithMetadata(map[string]string{"origin": "ftp"}),
+		WithContentTypes(map[string]string{".log": "text/plain"}),
+		WithPartSize(10 << 20),
+		WithMetrics(MetricsNone),
+	} {
+		opt(&config)
+	}
+
+	expected := FactoryConfig{
+		FtpFeatures:       "all,-rm",
+		FtpNoOverwrite:    true,
+		FtpIdleTimeout:    time.Minute,
+		FtpMaxConnections: 10,
+		S3Credentials:     "access:secret",
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3Region:          "eu-central-1",
+		S3Endpoint:        "https://somewhere.com",
+		S3UsePathStyle:    true,
+		S3SignatureV2:     true,
+		S3StorageClass:    "STANDARD_IA",
+		S3SSE:             "aws:kms",
+		S3SSEKMSKeyID:     "some-key",
+		S3ACL:             "private",
+		S3Metadata:        map[string]string{"origin": "ftp"},
+		S3ContentTypes:    map[string]string{".log": "text/plain"},
+		S3PartSize:        10 << 20,
+		Metrics:           MetricsNone,
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected config\n%+v\nbut was\n%+v", expected, config)
+	}
+}
+
+func TestNewDriverFactoryWithOptions(t *testing.T) {
+	bucketMock := newBucketMock("some-bucket")
+	mock := &s3Mock{bucket: bucketMock}
+	factory, err := NewDriverFactoryWithOptions(
+		WithBucket("https://some-bucket.somewhere.com"),
+		WithS3Client(mock, &s3UploaderMock{bucket: bucketMock}),
+		WithMetrics(MetricsNone),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	if factory.featureFlags != featureList {
+		t.Errorf("Expected the default feature set %q but flags were %b", DefaultFeatureSet, factory.featureFlags)
+	}
+	if factory.bucketName != "some-bucket" {
+		t.Errorf("Expected bucket %q but was %q", "some-bucket", factory.bucketName)
+	}
+	if !factory.DisableCloudWatch || factory.metrics != nil {
+		t.Errorf("Expected no metrics but sender was %T", factory.metrics)
+	}
+
+	// later options override earlier ones
+	factory, err = NewDriverFactoryWithOptions(
+		WithConfig(FactoryConfig{FtpFeatures: "ls", S3BucketURL: "https://other-bucket.somewhere.com", S3Client: mock, Metrics: MetricsNone}),
+		WithFeatures("ls,get"),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	if factory.featureFlags != featureList|featureGet || factory.bucketName != "other-bucket" {
+		t.Errorf("Options were not applied in order: features %b, bucket %q", factory.featureFlags, factory.bucketName)
+	}
+
+	if _, err := NewDriverFactoryWithOptions(WithS3Client(mock, nil)); err == nil {
+		t.Error("Driver factory without bucket was created")
+	}
+}
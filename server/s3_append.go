@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// appendObject appends `data` to the existing object with key `key`.
+//
+// s3 objects are immutable, thus appending is emulated by a multipart upload
+// where the first part is a server-side copy of the existing object and the following parts contain `data`.
+// Parts (except the last one) must be at least 5MB large, so objects smaller than that are downloaded,
+// concatenated with `data` and uploaded again.
+// Either way, the object keeps the metadata, content type and tags of the existing object.
+func (d *S3Driver) appendObject(ctx context.Context, key string, data io.Reader) error {
+	head, err := d.headObject(d.writeBucket(), key)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to check size of object %q", d.fqdn(key))
+	}
+
+	if aws.Int64Value(head.ContentLength) < s3manager.MinUploadPartSize {
+		d.log().Debugf("Appending to %q by re-uploading the object because it is smaller than a single part.", d.fqdn(key))
+		resp, err := d.s3Client().GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(d.writeBucket()),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "Failed to get object %q", d.fqdn(key))
+		}
+		defer resp.Body.Close()
+
+		tags := ""
+		if aws.Int64Value(resp.TagCount) > 0 {
+			tags = d.existingTags(ctx, key)
+		}
+		_, err = d.s3Uploader().UploadWithContext(ctx, d.appendUploadInput(key, io.MultiReader(resp.Body, data), head, tags))
+		return err
+	}
+
+	upload, err := d.s3Client().CreateMultipartUploadWithContext(ctx, multipartUploadInput(d.appendUploadInput(key, nil, head, d.existingTags(ctx, key))))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to start multipart upload for %q", d.fqdn(key))
+	}
+
+	parts, err := d.appendParts(ctx, key, upload.UploadId, data)
+	if err != nil {
+		d.abortMultipartUpload(key, upload.UploadId)
+		return err
+	}
+
+	_, err = d.s3Client().CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(d.writeBucket()),
+		Key:             aws.String(key),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return errors.Wrapf(err, "Failed to complete multipart upload for %q", d.fqdn(key))
+	}
+	return nil
+}
+
+// appendUploadInput returns the parameters to upload the object with key `key` with the appended `body`.
+// The properties of the existing object `head` take precedence over the configured ones, as do its URL encoded tags `tags` unless empty.
+func (d *S3Driver) appendUploadInput(key string, body io.Reader, head *s3.HeadObjectOutput, tags string) *s3manager.UploadInput {
+	input := d.uploadInput(key, body)
+	if len(head.Metadata) > 0 {
+		metadata := make(map[string]*string, len(input.Metadata)+len(head.Metadata))
+		for k, v := range input.Metadata {
+			metadata[k] = v
+		}
+		for k, v := range head.Metadata {
+			metadata[k] = v
+		}
+		input.Metadata = metadata
+	}
+	if head.ContentType != nil {
+		input.ContentType = head.ContentType
+	}
+	input.ContentEncoding = head.ContentEncoding
+	input.ContentDisposition = head.ContentDisposition
+	input.ContentLanguage = head.ContentLanguage
+	input.CacheControl = head.CacheControl
+	if head.StorageClass != nil {
+		input.StorageClass = head.StorageClass
+	}
+	if head.ServerSideEncryption != nil {
+		input.ServerSideEncryption = head.ServerSideEncryption
+		input.SSEKMSKeyId = head.SSEKMSKeyId
+	}
+	if tags != "" {
+		input.Tagging = aws.String(tags)
+	}
+	return input
+}
+
+// existingTags returns the URL encoded tags of the object with key `key` in the write bucket, e.g. `retention=30d&source=ftp`.
+// If they can not be read, e.g. due to missing permissions, the configured tags are used and an empty string is returned.
+func (d *S3Driver) existingTags(ctx context.Context, key string) string {
+	resp, err := d.s3Client().GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(d.writeBucket()),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(key), "action": "APPE", "error": err}).Warnf("Failed to get tags of %q, appending with the configured tags", d.fqdn(key))
+		return ""
+	}
+	tags := url.Values{}
+	for _, tag := range resp.TagSet {
+		tags.Add(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+	}
+	return tags.Encode()
+}
+
+// abortMultipartUpload aborts the multipart upload `uploadID` of the object with key `key` to delete its uploaded parts.
+// The upload is aborted regardless of whether the context of the upload was cancelled.
+func (d *S3Driver) abortMultipartUpload(key string, uploadID *string) {
+	_, err := d.s3Client().AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(d.writeBucket()),
+		Key:      aws.String(key),
+		UploadId: uploadID,
+	})
+	if err != nil {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(key), "upload": aws.StringValue(uploadID), "error": err}).Errorf("Failed to abort multipart upload %q for %q: %s", aws.StringValue(uploadID), d.fqdn(key), err)
+	}
+}
+
+// multipartUploadInput returns the parameters to start a multipart upload matching those of `upload`.
+func multipartUploadInput(upload *s3manager.UploadInput) *s3.CreateMultipartUploadInput {
+	return &s3.CreateMultipartUploadInput{
+		Bucket:                    upload.Bucket,
+		Key:                       upload.Key,
+		ContentType:               upload.ContentType,
+		ContentEncoding:           upload.ContentEncoding,
+		ContentDisposition:        upload.ContentDisposition,
+		ContentLanguage:           upload.ContentLanguage,
+		CacheControl:              upload.CacheControl,
+		StorageClass:              upload.StorageClass,
+		ServerSideEncryption:      upload.ServerSideEncryption,
+		SSEKMSKeyId:               upload.SSEKMSKeyId,
+		ACL:                       upload.ACL,
+		Metadata:                  upload.Metadata,
+		Tagging:                   upload.Tagging,
+		ObjectLockMode:            upload.ObjectLockMode,
+		ObjectLockRetainUntilDate: upload.ObjectLockRetainUntilDate,
+		ObjectLockLegalHoldStatus: upload.ObjectLockLegalHoldStatus,
+	}
+}
+
+// appendParts copies the existing object with key `key` as the first part of the multipart upload `uploadID`
+// and uploads `data` as the following parts.
+func (d *S3Driver) appendParts(ctx context.Context, key string, uploadID *string, data io.Reader) ([]*s3.CompletedPart, error) {
+	copyResp, err := d.s3Client().UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+		Bucket:     aws.String(d.writeBucket()),
+		Key:        aws.String(key),
+		UploadId:   uploadID,
+		PartNumber: aws.Int64(1),
+		CopySource: aws.String(copySource(d.writeBucket(), key)),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to copy %q into multipart upload", d.fqdn(key))
+	}
+	parts := []*s3.CompletedPart{{
+		ETag:       copyResp.CopyPartResult.ETag,
+		PartNumber: aws.Int64(1),
+	}}
+
+	partSize := d.partSize
+	if partSize <= 0 {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+	buf := make([]byte, partSize)
+	for partNumber := int64(2); ; partNumber++ {
+		n, readErr := io.ReadFull(data, buf)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return nil, errors.Wrapf(readErr, "Failed to read data to append to %q", d.fqdn(key))
+		}
+		if n == 0 {
+			break
+		}
+
+		resp, err := d.s3Client().UploadPartWithContext(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(d.writeBucket()),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int64(partNumber),
+			Body:       bytes.NewReader(buf[:n]),
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to upload part %d for %q", partNumber, d.fqdn(key))
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       resp.ETag,
+			PartNumber: aws.Int64(partNumber),
+		})
+
+		if readErr != nil {
+			break
+		}
+	}
+	return parts, nil
+}
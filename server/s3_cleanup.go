@@ -0,0 +1,53 @@
+package server
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// abortMultipartUploads aborts the multipart uploads of bucket `bucket` below `prefix` which were initiated before `before`.
+// Interrupted uploads leave their parts behind, which are invisible over FTP but charged by s3.
+// It returns the number of aborted uploads.
+func abortMultipartUploads(client s3iface.S3API, bucket, prefix string, before time.Time, logger logrus.FieldLogger) (int, error) {
+	if prefix != "" {
+		prefix += "/"
+	}
+	aborted := 0
+	var abortErr error
+	err := client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if !aws.TimeValue(upload.Initiated).Before(before) {
+				continue
+			}
+			_, err := client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil && intoAwsError(err).Code() == s3.ErrCodeNoSuchUpload {
+				// completed or aborted in the meantime
+				continue
+			}
+			if err != nil {
+				abortErr = errors.Wrapf(err, "Failed to abort multipart upload %q of %q", aws.StringValue(upload.UploadId), aws.StringValue(upload.Key))
+				return false
+			}
+			logger.Debugf("Aborted multipart upload %q of %q initiated at %s", aws.StringValue(upload.UploadId), aws.StringValue(upload.Key), aws.TimeValue(upload.Initiated))
+			aborted++
+		}
+		// return if we should continue with the next page
+		return !lastPage
+	})
+	if err != nil {
+		return aborted, errors.Wrapf(err, "Failed to list multipart uploads of bucket %q", bucket)
+	}
+	return aborted, abortErr
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+// gzipEncoding is the content encoding of compressed objects.
+const gzipEncoding = "gzip"
+
+// uncompressedSizeMetadataKey is the user-defined metadata (`x-amz-meta-uncompressed-size`) with the size of the data of compressed objects.
+const uncompressedSizeMetadataKey = "Uncompressed-Size"
+
+// compressed returns true if the object with key `key` is compressed when uploading it.
+func (d *S3Driver) compressed(key string) bool {
+	if !d.compress {
+		return false
+	}
+	if len(d.compressExtensions) == 0 {
+		return true
+	}
+	return d.compressExtensions[strings.ToLower(path.Ext(key))]
+}
+
+// uncompressedSize returns the size of the decompressed data of an object with content encoding `encoding` and `metadata`.
+// It returns false if the object is not compressed or its metadata has no valid size, e.g. if it was compressed by another application.
+func uncompressedSize(encoding *string, metadata map[string]*string) (int64, bool) {
+	value, ok := metadata[uncompressedSizeMetadataKey]
+	if !ok || aws.StringValue(encoding) != gzipEncoding {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(aws.StringValue(value), 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// storeUncompressedSize stores the size `size` of the data of the compressed object with key `objectKey` as its metadata.
+// The size is only known after the upload, thus the object is copied in place. Stat and listings report the stored size if this fails.
+func (d *S3Driver) storeUncompressedSize(objectKey string, size int64) {
+	if err := d.replaceMetadata(objectKey, uncompressedSizeMetadataKey, strconv.FormatInt(size, 10)); err != nil {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(objectKey), "action": "PUT", "error": err}).Warnf("Failed to store the uncompressed size of %q", d.fqdn(objectKey))
+	}
+}
+
+// replaceMetadata sets the user-defined metadata `name` of the object with key `objectKey` in the write bucket to `value`.
+// s3 does not allow modifying objects, thus the object is copied in place, which is limited to objects of up to 5GB.
+// The copy keeps the access control list of the object unless an ACL is configured, as well as its retention and legal hold.
+func (d *S3Driver) replaceMetadata(objectKey, name, value string) error {
+	head, err := d.s3Client().HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(d.writeBucket()),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		return err
+	}
+
+	// replacing the metadata replaces all properties of the object which are not given again
+	metadata := make(map[string]*string, len(head.Metadata)+1)
+	for k, v := range head.Metadata {
+		metadata[k] = v
+	}
+	metadata[name] = aws.String(value)
+	input := &s3.CopyObjectInput{
+		Bucket:               aws.String(d.writeBucket()),
+		Key:                  aws.String(objectKey),
+		CopySource:           aws.String(copySource(d.writeBucket(), objectKey)),
+		MetadataDirective:    aws.String(s3.MetadataDirectiveReplace),
+		Metadata:             metadata,
+		ContentType:          head.ContentType,
+		ContentEncoding:      head.ContentEncoding,
+		ContentDisposition:   head.ContentDisposition,
+		ContentLanguage:      head.ContentLanguage,
+		CacheControl:         head.CacheControl,
+		StorageClass:         head.StorageClass,
+		ServerSideEncryption: head.ServerSideEncryption,
+		SSEKMSKeyId:          head.SSEKMSKeyId,
+	}
+	if d.acl != "" {
+		input.ACL = aws.String(d.acl)
+	} else {
+		acl, err := d.s3Client().GetObjectAcl(&s3.GetObjectAclInput{
+			Bucket: aws.String(d.writeBucket()),
+			Key:    aws.String(objectKey),
+		})
+		if err != nil {
+			err := intoAwsError(err)
+			logAwsError(d.log(), err)
+			return err
+		}
+		copyGrants(input, acl)
+	}
+	// copies are new versions which are only locked like the object if requested
+	if head.ObjectLockRetainUntilDate != nil && head.ObjectLockRetainUntilDate.After(time.Now()) {
+		input.ObjectLockMode = head.ObjectLockMode
+		input.ObjectLockRetainUntilDate = head.ObjectLockRetainUntilDate
+	}
+	input.ObjectLockLegalHoldStatus = head.ObjectLockLegalHoldStatus
+	_, err = d.s3Client().CopyObject(input)
+	d.statCache.invalidate(d.writeBucket(), objectKey)
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		return err
+	}
+	return nil
+}
+
+// copyGrants sets the grants of the access control list `acl` of an object as those of its copy `input`.
+// Objects only accessible by their owner need no grants, which are not supported by buckets with disabled ACLs.
+func copyGrants(input *s3.CopyObjectInput, acl *s3.GetObjectAclOutput) {
+	owner := ""
+	if acl.Owner != nil {
+		owner = aws.StringValue(acl.Owner.ID)
+	}
+	grantees := map[string][]string{}
+	private := true
+	for _, grant := range acl.Grants {
+		if grant.Grantee == nil {
+			continue
+		}
+		var grantee string
+		switch aws.StringValue(grant.Grantee.Type) {
+		case s3.TypeCanonicalUser:
+			grantee = fmt.Sprintf("id=%q", aws.StringValue(grant.Grantee.ID))
+		case s3.TypeGroup:
+			grantee = fmt.Sprintf("uri=%q", aws.StringValue(grant.Grantee.URI))
+		case s3.TypeAmazonCustomerByEmail:
+			grantee = fmt.Sprintf("emailAddress=%q", aws.StringValue(grant.Grantee.EmailAddress))
+		default:
+			continue
+		}
+		permission := aws.StringValue(grant.Permission)
+		if aws.StringValue(grant.Grantee.Type) != s3.TypeCanonicalUser || aws.StringValue(grant.Grantee.ID) != owner || permission != s3.PermissionFullControl {
+			private = false
+		}
+		grantees[permission] = append(grantees[permission], grantee)
+	}
+	if private {
+		return
+	}
+	input.GrantFullControl = joinGrantees(grantees[s3.PermissionFullControl])
+	input.GrantRead = joinGrantees(grantees[s3.PermissionRead])
+	input.GrantReadACP = joinGrantees(grantees[s3.PermissionReadAcp])
+	input.GrantWriteACP = joinGrantees(grantees[s3.PermissionWriteAcp])
+}
+
+// joinGrantees returns the grant header of `grantees`, nil if there are none.
+func joinGrantees(grantees []string) *string {
+	if len(grantees) == 0 {
+		return nil
+	}
+	return aws.String(strings.Join(grantees, ", "))
+}
+
+// countingReader counts the bytes read from the reader, e.g. to get the size of data before it is compressed.
+type countingReader struct {
+	io.Reader
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// gzipReader returns a reader of the gzip compressed data of `r`, compressing while it is read.
+// Closing the reader stops the compression.
+func gzipReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		zw := gzip.NewWriter(pw)
+		_, err := io.Copy(zw, r)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// gunzipReadCloser decompresses the body of a compressed object, closing it closes the body.
+type gunzipReadCloser struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (r gunzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
+
+// gunzip returns a reader of the decompressed `body` starting at byte `offset` of the decompressed data.
+func gunzip(body io.ReadCloser, offset int64) (io.ReadCloser, error) {
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, zr, offset); err != nil {
+		body.Close()
+		return nil, err
+	}
+	return gunzipReadCloser{Reader: zr, body: body}, nil
+}
+
+// acceptIdentityEncoding prevents the HTTP client from requesting and transparently decompressing gzip encoded responses,
+// which drops the content length and encoding of compressed objects.
+func acceptIdentityEncoding(r *request.Request) {
+	r.HTTPRequest.Header.Set("Accept-Encoding", "identity")
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// getObjectParallel gets the object of `input` starting at byte `offset` in ranges of the download part size,
+// `d.downloadConcurrency` of which are got in parallel and buffered until the FTP data connection reads them.
+// The first range is got before returning, so that failures like missing objects are reported like by getObject,
+// and its Content-Range tells the size of the object. Objects not larger than a single part are served by the first range.
+// It returns nil to get the object sequentially if it is compressed.
+func (d *S3Driver) getObjectParallel(input *s3.GetObjectInput, offset int64) (*s3.GetObjectOutput, error) {
+	first, err := d.getRange(aws.BackgroundContext(), input, offset, offset+d.downloadPartSize)
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidRange" {
+		// empty objects have no ranges, getting the object reports offsets beyond the end
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	size, ok := objectSizeOfRange(first.ContentRange)
+	if !ok || aws.StringValue(first.ContentEncoding) == gzipEncoding {
+		// ranges of compressed objects are ranges of the stored data
+		first.Body.Close()
+		return nil, nil
+	}
+	if size-offset <= d.downloadPartSize {
+		return first, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader := &parallelReader{
+		parts:  make(chan chan downloadPart, d.downloadConcurrency),
+		slots:  make(chan struct{}, d.downloadConcurrency),
+		cancel: cancel,
+	}
+	// all parts must belong to the same object, even if it is overwritten during the download
+	partInput := *input
+	partInput.IfMatch = first.ETag
+	reader.slots <- struct{}{}
+	firstPart := make(chan downloadPart, 1)
+	reader.parts <- firstPart
+	go func() {
+		data, err := readPart(first, d.downloadPartSize)
+		firstPart <- downloadPart{data: data, err: err}
+	}()
+	go func() {
+		defer close(reader.parts)
+		for start := offset + d.downloadPartSize; start < size; start += d.downloadPartSize {
+			select {
+			case reader.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			part := make(chan downloadPart, 1)
+			reader.parts <- part
+			end := start + d.downloadPartSize
+			if end > size {
+				end = size
+			}
+			go func(start, end int64) {
+				resp, err := d.getRange(ctx, &partInput, start, end)
+				if err != nil {
+					part <- downloadPart{err: err}
+					return
+				}
+				data, err := readPart(resp, end-start)
+				part <- downloadPart{data: data, err: err}
+			}(start, end)
+		}
+	}()
+
+	return &s3.GetObjectOutput{
+		Body:          reader,
+		ContentLength: aws.Int64(size - offset),
+		ContentType:   first.ContentType,
+		ETag:          first.ETag,
+		LastModified:  first.LastModified,
+		VersionId:     first.VersionId,
+		Metadata:      first.Metadata,
+	}, nil
+}
+
+// objectSizeOfRange returns the size of the object of the Content-Range `contentRange` of a response, e.g. `bytes 0-9/100`,
+// and false if it is unknown.
+func objectSizeOfRange(contentRange *string) (int64, bool) {
+	i := strings.LastIndex(aws.StringValue(contentRange), "/")
+	if i < 0 {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(aws.StringValue(contentRange)[i+1:], 10, 64)
+	return size, err == nil
+}
+
+// getRange gets the bytes from `start` up to `end` (exclusive) of the object of `input`.
+func (d *S3Driver) getRange(ctx context.Context, input *s3.GetObjectInput, start, end int64) (*s3.GetObjectOutput, error) {
+	rangeInput := *input
+	rangeInput.Range = aws.String(fmt.Sprintf("bytes=%d-%d", start, end-1))
+	return d.s3Client().GetObjectWithContext(ctx, &rangeInput, acceptIdentityEncoding)
+}
+
+// readPart reads the body of `resp`, which is a range of at most `maxSize` bytes.
+func readPart(resp *s3.GetObjectOutput, maxSize int64) ([]byte, error) {
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSize))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read range %s", aws.StringValue(resp.ContentRange))
+	}
+	if int64(len(data)) != aws.Int64Value(resp.ContentLength) {
+		return nil, fmt.Errorf("range %s ended after %d of %d bytes", aws.StringValue(resp.ContentRange), len(data), aws.Int64Value(resp.ContentLength))
+	}
+	return data, nil
+}
+
+// downloadPart is a range of an object got by getObjectParallel.
+type downloadPart struct {
+	data []byte
+	err  error
+}
+
+// parallelReader reads the parts of an object in order while the following parts are got in the background.
+type parallelReader struct {
+	// parts are the pending parts in order, each is delivered once it was got
+	parts chan chan downloadPart
+	// slots limits the number of parts which are got or buffered
+	slots  chan struct{}
+	buffer []byte
+	err    error
+	cancel context.CancelFunc
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for len(r.buffer) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		pending, ok := <-r.parts
+		if !ok {
+			return 0, io.EOF
+		}
+		part := <-pending
+		<-r.slots
+		if part.err != nil {
+			r.err = part.err
+			r.cancel()
+			continue
+		}
+		r.buffer = part.data
+	}
+	n := copy(p, r.buffer)
+	r.buffer = r.buffer[n:]
+	return n, nil
+}
+
+// Close aborts getting the remaining parts, parts which wait for free slots are not got anymore.
+func (r *parallelReader) Close() error {
+	r.cancel()
+	if r.err == nil {
+		r.err = io.ErrClosedPipe
+	}
+	return nil
+}
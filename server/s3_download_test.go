@@ -0,0 +1,204 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/sirupsen/logrus"
+)
+
+// rangeMock serves ranges of a single object, each response is delayed by `latency` and streamed at `bytesPerSecond`,
+// like a high latency endpoint which limits the throughput of each connection.
+type rangeMock struct {
+	s3iface.S3API
+	data           []byte
+	etag           string
+	latency        time.Duration
+	bytesPerSecond int
+	lock           sync.Mutex
+	active         int
+	maxActive      int
+	gets           int
+}
+
+func (mock *rangeMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	mock.lock.Lock()
+	etag := mock.etag
+	mock.lock.Unlock()
+	if input.IfMatch != nil && aws.StringValue(input.IfMatch) != etag {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	start, end := 0, len(mock.data)-1
+	if input.Range != nil {
+		if n, _ := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end); n == 0 {
+			return nil, awserr.New("InvalidArgument", fmt.Sprintf("Unsupported range %q", aws.StringValue(input.Range)), nil)
+		}
+	}
+	if start >= len(mock.data) {
+		return nil, awserr.New("InvalidRange", "The requested range is not satisfiable", nil)
+	}
+	if end >= len(mock.data) {
+		end = len(mock.data) - 1
+	}
+	mock.lock.Lock()
+	mock.gets++
+	mock.active++
+	if mock.active > mock.maxActive {
+		mock.maxActive = mock.active
+	}
+	mock.lock.Unlock()
+	time.Sleep(mock.latency)
+	data := mock.data[start : end+1]
+	return &s3.GetObjectOutput{
+		Body:          &throttledBody{Reader: bytes.NewReader(data), bytesPerSecond: mock.bytesPerSecond, done: mock.done},
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentRange:  aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, len(mock.data))),
+		ETag:          aws.String(etag),
+	}, nil
+}
+
+// reset sets the ETag of the object and resets the request counters.
+func (mock *rangeMock) reset(etag string) {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	mock.etag, mock.gets, mock.maxActive = etag, 0, 0
+}
+
+func (mock *rangeMock) done() {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	mock.active--
+}
+
+// throttledBody reads at most `bytesPerSecond`, unlimited if 0.
+type throttledBody struct {
+	io.Reader
+	bytesPerSecond int
+	done           func()
+	once           sync.Once
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if b.bytesPerSecond > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(b.bytesPerSecond))
+	}
+	return n, err
+}
+
+func (b *throttledBody) Close() error {
+	b.once.Do(b.done)
+	return nil
+}
+
+func newDownloadDriver(mock *rangeMock, concurrency int, partSize int64) *S3Driver {
+	return &S3Driver{
+		featureFlags:        featureGet,
+		s3:                  mock,
+		metrics:             metricsSenderMock{},
+		bucketName:          "test-bucket",
+		bucketURL:           intoURL("https://test-bucket.my.s3.host.com"),
+		downloadConcurrency: concurrency,
+		downloadPartSize:    partSize,
+	}
+}
+
+func TestParallelDownload(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	mock := &rangeMock{data: data, etag: "etag", latency: time.Millisecond}
+	driver := newDownloadDriver(mock, 3, 64)
+
+	tCases := []struct {
+		offset int64
+		gets   int
+	}{
+		{0, 16},
+		{100, 15},
+		// the remaining bytes fit into a single part
+		{950, 1},
+	}
+	for _, tCase := range tCases {
+		mock.reset("etag")
+		size, reader, err := driver.GetFile("/file", tCase.offset)
+		if err != nil {
+			t.Fatalf("GetFile with offset %d failed: %s", tCase.offset, err)
+		}
+		got, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("Reading the download with offset %d failed: %s", tCase.offset, err)
+		}
+		if size != int64(len(data))-tCase.offset || !bytes.Equal(got, data[tCase.offset:]) {
+			t.Errorf("Expected %d bytes from offset %d but got %d of reported %d bytes", len(data)-int(tCase.offset), tCase.offset, len(got), size)
+		}
+		if mock.gets != tCase.gets {
+			t.Errorf("Expected %d ranges to be got for offset %d but were %d", tCase.gets, tCase.offset, mock.gets)
+		}
+		if mock.maxActive > 3 {
+			t.Errorf("Expected at most 3 parallel requests but were %d", mock.maxActive)
+		}
+	}
+
+	if _, _, err := driver.GetFile("/file", int64(len(data))); err == nil {
+		t.Errorf("Expected the download from beyond the end of the object to fail")
+	}
+
+	// the object was overwritten after the download started
+	_, reader, err := driver.GetFile("/file", 0)
+	if err != nil {
+		t.Fatalf("GetFile failed: %s", err)
+	}
+	mock.reset("other-etag")
+	if _, err := ioutil.ReadAll(reader); err == nil {
+		t.Errorf("Expected the download of the overwritten object to fail")
+	}
+	reader.Close()
+
+	// a closed download stops getting parts
+	mock.reset("etag")
+	_, reader, err = driver.GetFile("/file", 0)
+	if err != nil {
+		t.Fatalf("GetFile failed: %s", err)
+	}
+	reader.Close()
+	if _, err := reader.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Expected reading the closed download to fail")
+	}
+}
+
+// BenchmarkGetFile compares downloading an object sequentially with getting its parts in parallel
+// from an endpoint with a latency of 20ms and a throughput of 10MB/s per connection.
+func BenchmarkGetFile(b *testing.B) {
+	logrus.SetLevel(logrus.PanicLevel)
+	mock := &rangeMock{data: make([]byte, 4<<20), etag: "etag", latency: 20 * time.Millisecond, bytesPerSecond: 10 << 20}
+	for _, concurrency := range []int{0, 4, 8} {
+		driver := newDownloadDriver(mock, concurrency, 512<<10)
+		b.Run(fmt.Sprintf("concurrency-%d", concurrency), func(b *testing.B) {
+			b.SetBytes(int64(len(mock.data)))
+			for i := 0; i < b.N; i++ {
+				_, reader, err := driver.GetFile("/file", 0)
+				if err != nil {
+					b.Fatalf("GetFile failed: %s", err)
+				}
+				if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+					b.Fatalf("Reading the download failed: %s", err)
+				}
+				reader.Close()
+			}
+		})
+	}
+}
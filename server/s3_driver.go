@@ -1,81 +1,269 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/url"
-	"path/filepath"
+	"path"
 	"reflect"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
-	ftp "github.com/goftp/server"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// maxDeleteBatchSize is the maximum number of keys s3 accepts in a single delete request.
+const maxDeleteBatchSize = 1000
+
+// bucketCheckTTL is the time a successful bucket check is trusted, so that not every operation costs a HeadBucket request.
+const bucketCheckTTL = time.Minute
+
+var (
+	// ErrFeatureNotEnabled is returned by operations whose feature is not enabled.
+	ErrFeatureNotEnabled = errors.New("not enabled")
+	// ErrAppendUnsupported is returned by uploads appending to an object if appending is not enabled.
+	ErrAppendUnsupported = errors.New("appending is not enabled")
+	// ErrOverwriteForbidden is returned by uploads of existing objects if overwriting is forbidden.
+	ErrOverwriteForbidden = errors.New("overwriting is forbidden")
+	// ErrNotFound is returned by operations on missing objects or directories which are not implicitly created.
+	ErrNotFound = errors.New("does not exist")
+	// ErrUploadTooLarge is returned by uploads exceeding the maximum upload size.
+	ErrUploadTooLarge = errors.New("exceeds the maximum upload size")
+	// ErrContentTypeForbidden is returned by uploads whose content type is not allowed.
+	ErrContentTypeForbidden = errors.New("is not allowed")
+	// ErrArchived is returned by downloads of objects which are archived, e.g. in Glacier, and not restored.
+	ErrArchived = errors.New("is archived")
 )
 
 func notEnabled(op string) error {
-	return fmt.Errorf("%q is not enabled", op)
+	return fmt.Errorf("%q is %w", op, ErrFeatureNotEnabled)
 }
 
 // S3Driver is a filesystem FTP driver.
 // Implements https://godoc.org/github.com/goftp/server#Driver
 type S3Driver struct {
-	featureFlags int
-	noOverwrite  bool
-	s3           s3iface.S3API
-	uploader     s3manageriface.UploaderAPI
-	metrics      MetricsSender
-	hostname     string
-	bucketName   string
-	bucketURL    *url.URL
-	cwd          string
+	featureFlags        int
+	anonymousFeatures   int
+	users               *Authenticator
+	transfers           *transfers
+	conn                loginUser
+	idleTimeout         time.Duration
+	maxUploadSize       int64
+	idle                *time.Timer
+	noOverwrite         bool
+	strictDelete        bool
+	dryRun              bool
+	leavePartsOnError   bool
+	s3                  s3iface.S3API
+	uploader            s3manageriface.UploaderAPI
+	anonymousS3         s3iface.S3API
+	anonymousUploader   s3manageriface.UploaderAPI
+	userS3              map[string]userS3API
+	sessionPolicy       *sessionPolicy
+	metrics             MetricsSender
+	hostname            string
+	bucketName          string
+	readBucketName      string
+	writeBucketName     string
+	bucketURL           *url.URL
+	keyPrefix           string
+	bucketChecked       time.Time
+	contentTypes        map[string]string
+	allowContentTypes   []string
+	webhook             *webhook
+	statCache           *statCache
+	storageClass        string
+	objectLock          *objectLock
+	sse                 string
+	sseKMSKeyID         string
+	acl                 string
+	metadata            map[string]string
+	verifyMD5           bool
+	tags                string
+	compress            bool
+	listModTimes        bool
+	compressExtensions  map[string]bool
+	partSize            int64
+	downloadPartSize    int64
+	downloadConcurrency int
+	presignThreshold    int64
+	presignTTL          time.Duration
+	cwd                 string
+	versionID           string
+	logger              logrus.FieldLogger
 }
 
+// loginUser provides the name of the logged in user of an FTP connection.
+// Implemented by *ftp.Conn.
+type loginUser interface {
+	LoginUser() string
+}
+
+// intoAwsError returns `err` as awserr.Error.
+// Errors which were not returned by s3, e.g. network errors, are wrapped into an awserr.Error with code errCodeUnknown.
 func intoAwsError(err error) awserr.Error {
-	return err.(awserr.Error)
+	if awsErr, ok := errors.Cause(err).(awserr.Error); ok {
+		return awsErr
+	}
+	return unknownError{err}
+}
+
+// errCodeUnknown is the code of errors which were not returned by s3.
+const errCodeUnknown = "Unknown"
+
+// unknownError is an awserr.Error of an error which was not returned by s3.
+// The message of the original error is kept.
+type unknownError struct {
+	error
+}
+
+func (e unknownError) Code() string {
+	return errCodeUnknown
+}
+
+func (e unknownError) Message() string {
+	return e.error.Error()
+}
+
+func (e unknownError) OrigErr() error {
+	return e.error
+}
+
+func logAwsError(logger logrus.FieldLogger, err awserr.Error) {
+	logger.WithFields(logrus.Fields{"code": err.Code(), "error": err.Message()}).Error("AWS error")
 }
 
-func logAwsError(err awserr.Error) {
-	logrus.Errorf("AWS Error: Code=%q Message=%q", err.Code(), err.Message())
+// log returns the logger of the driver, the global logger of logrus if none is configured.
+func (d *S3Driver) log() logrus.FieldLogger {
+	return orStandardLogger(d.logger)
 }
 
-// bucketCheck checks if the bucket is accessible
-func (d S3Driver) bucketCheck() error {
-	_, err := d.s3.HeadBucket(&s3.HeadBucketInput{
-		Bucket: aws.String(d.bucketName),
+// bucketCheck checks if the bucket files are listed and downloaded from is accessible, see readBucket.
+// Successful checks are cached for bucketCheckTTL, failed checks are repeated by the next operation.
+func (d *S3Driver) bucketCheck() error {
+	if time.Since(d.bucketChecked) < bucketCheckTTL {
+		return nil
+	}
+	_, err := d.s3Client().HeadBucket(&s3.HeadBucketInput{
+		Bucket: aws.String(d.readBucket()),
 	})
 	if err != nil {
 		err := intoAwsError(err)
-		logAwsError(err)
-		logrus.Errorf("Bucket %q is not accessible.", d.bucketURL)
-		return errors.Wrapf(err, "Bucket %q is not accessible", d.bucketName)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"key": d.bucketURL.String(), "bucket": d.readBucket(), "code": err.Code(), "error": err.Message()}).Errorf("Bucket %q is not accessible.", d.readBucket())
+		return errors.Wrapf(err, "Bucket %q is not accessible", d.readBucket())
 	}
+	d.bucketChecked = time.Now()
 	return nil
 }
 
 // Init initializes the FTP connection.
-func (d S3Driver) Init(conn *ftp.Conn) {
+func (d *S3Driver) Init(conn *ftp.Conn) {
+	d.conn = conn
+	if d.idleTimeout > 0 {
+		d.startIdleTimer(conn.Close)
+	}
+}
+
+// startIdleTimer calls `closeConn` once the connection was inactive for the idle timeout.
+// Every operation of the driver counts as activity, the timer is paused during downloads and reset by the data of uploads.
+func (d *S3Driver) startIdleTimer(closeConn func()) {
+	d.idle = time.AfterFunc(d.idleTimeout, func() {
+		d.log().Debugf("Closing connection after being idle for %s", d.idleTimeout)
+		closeConn()
+	})
+}
+
+// keepAlive restarts the idle timer of the connection.
+func (d *S3Driver) keepAlive() {
+	if d.idle != nil {
+		d.idle.Reset(d.idleTimeout)
+	}
+}
 
+// beginTransfer registers an active transfer and pauses the idle timer until endTransfer is called.
+func (d *S3Driver) beginTransfer() {
+	d.transfers.begin()
+	if d.idle != nil {
+		d.idle.Stop()
+	}
+}
+
+// endTransfer unregisters a finished transfer and restarts the idle timer.
+func (d *S3Driver) endTransfer() {
+	d.transfers.end()
+	d.keepAlive()
+}
+
+// uploadContext returns the context of an upload which is cancelled when the server is shut down before it finished,
+// or when the FTP connection is closed, e.g. because the client disconnected or it was idle, see startIdleTimer.
+func (d *S3Driver) uploadContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(d.transfers.context())
+	conn, ok := d.conn.(interface{ Context() context.Context })
+	if !ok {
+		return ctx, cancel
+	}
+	connCtx := conn.Context()
+	go func() {
+		select {
+		case <-connCtx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// enabled returns true if `feature` is enabled for the logged in user.
+// Features configured for the user in the credentials file take precedence over the global feature set,
+// anonymous users have their own feature set if anonymous logins are allowed.
+func (d *S3Driver) enabled(feature int) bool {
+	featureFlags := d.featureFlags
+	if d.anonymous() {
+		featureFlags = d.anonymousFeatures
+	} else if d.users != nil && d.conn != nil {
+		if userFlags, ok := d.users.Features(d.conn.LoginUser()); ok {
+			featureFlags = userFlags
+		}
+	}
+	return featureFlags&feature != 0
 }
 
 // Stat returns information about the object with key `key`.
-func (d S3Driver) Stat(key string) (ftp.FileInfo, error) {
+func (d *S3Driver) Stat(key string) (ftp.FileInfo, error) {
+	d.keepAlive()
 	if err := d.bucketCheck(); err != nil {
-		return S3ObjectInfo{}, errors.Wrapf(err, "Bucket check failed")
+		return S3ObjectInfo{}, ftpReply(errors.Wrapf(err, "Bucket check failed"), d.fqdn(d.objectKey(key)))
 	}
 
-	fqdn := d.fqdn(key)
-	resp, err := d.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
-	})
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	if d.resolvePath(key) == "" {
+		// the bucket root is always a directory
+		return S3ObjectInfo{
+			name:     key,
+			isPrefix: true,
+			size:     0,
+			modTime:  time.Now(),
+		}, nil
+	}
+
+	resp, err := d.headObject(d.readBucket(), objectKey)
 	if err != nil {
 		err := intoAwsError(err)
 		if err.Code() == "NotFound" {
@@ -89,103 +277,142 @@ func (d S3Driver) Stat(key string) (ftp.FileInfo, error) {
 				modTime:  time.Now(),
 			}, nil
 		}
-		logrus.WithFields(logrus.Fields{"time": time.Now(), "object": fqdn}).Errorf("Stat for %q failed.\nCode: %s", fqdn, err.Code())
-		return S3ObjectInfo{}, err
+		d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "STAT", "code": err.Code(), "error": err.Message()}).Errorf("Stat for %q failed.", fqdn)
+		return S3ObjectInfo{}, ftpReply(err, fqdn)
 	}
 
 	size := int64(0)
 	if resp.ContentLength != nil {
 		size = *resp.ContentLength
 	}
-	modTime := time.Now()
+	if uncompressed, ok := uncompressedSize(resp.ContentEncoding, resp.Metadata); ok {
+		size = uncompressed
+	}
+	lastModified := time.Now()
 	if resp.LastModified != nil {
-		modTime = *resp.LastModified
+		lastModified = *resp.LastModified
 	}
 
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "STAT"}).Infof("File information for %q", fqdn)
+	d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "STAT"}).Infof("File information for %q", fqdn)
 	return S3ObjectInfo{
 		name:     key,
-		isPrefix: true,
+		isPrefix: false,
 		size:     size,
-		modTime:  modTime,
+		modTime:  modTime(resp.Metadata, lastModified),
 	}, nil
 }
 
-// ChangeDir will always return an error because there is no such operation for a cloud object storage.
+// ChangeDir changes the current working directory to `path`.
 //
 // To allow uploading into "subdirectories" of a bucket a path change is simulated by keeping track of `CD` calls.
 // In FTP only a single directory level will be changed at a time, i.e. `CD /foo/bar` will result in two calls, `CD /foo` and `CD /foo/bar`.
 // There is no server side logic to be implement because relative paths are handled by the client, at least is how lftp and Filezilla operated.
-func (d S3Driver) ChangeDir(path string) error {
-	d.cwd = path
-	logrus.Debugf("Changed into path: %q", d.cwd)
+// If `cd` is not enabled, only the bucket root can be changed into, otherwise changing into a prefix which contains no objects fails.
+func (d *S3Driver) ChangeDir(path string) error {
+	d.keepAlive()
+	dir := d.resolvePath(path)
+	if dir != "" && !d.enabled(featureChangeDir) {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(d.objectKey(path)), "action": "CD"}).Warn("ChangeDir (CD) is not enabled.")
+		return notEnabled("CD")
+	}
+	if dir != "" {
+		prefix := d.objectKey(path)
+		resp, err := d.s3Client().ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:    aws.String(d.readBucket()),
+			Prefix:    aws.String(prefix + "/"),
+			Delimiter: aws.String("/"),
+			MaxKeys:   aws.Int64(1),
+		})
+		if err != nil {
+			err := intoAwsError(err)
+			logAwsError(d.log(), err)
+			d.log().WithFields(logrus.Fields{"time": time.Now(), "key": d.fqdn(prefix), "action": "CD", "code": err.Code(), "error": err.Message()}).Errorf("Could not change into %q.", d.fqdn(prefix))
+			return ftpReply(err, d.fqdn(prefix))
+		}
+		if len(resp.Contents) == 0 && len(resp.CommonPrefixes) == 0 {
+			d.log().WithFields(logrus.Fields{"time": time.Now(), "key": d.fqdn(prefix), "action": "CD"}).Warnf("Directory %q does not exist", path)
+			return fmt.Errorf("directory %q %w", path, ErrNotFound)
+		}
+	}
+
+	d.cwd = "/" + dir
+	d.log().WithFields(logrus.Fields{"key": d.fqdn(d.objectKey("")), "action": "CD"}).Debugf("Changed into path: %q", d.cwd)
 	return nil
 }
 
 // ListDir call the callback function with object metadata for each object located under prefix `key`.
-func (d S3Driver) ListDir(key string, cb func(ftp.FileInfo) error) error {
-	if d.featureFlags&featureList == 0 {
+func (d *S3Driver) ListDir(key string, cb func(ftp.FileInfo) error) error {
+	// listings are sent over the data connection like files
+	d.beginTransfer()
+	defer d.endTransfer()
+	if !d.enabled(featureList) {
 		return notEnabled("LS")
 	}
+	timestamp := time.Now()
 
 	if err := d.bucketCheck(); err != nil {
-		return errors.Wrapf(err, "Bucket check failed")
+		return ftpReply(errors.Wrapf(err, "Bucket check failed"), d.fqdn(d.objectKey(key)))
 	}
 
-	listParams := &s3.ListObjectsInput{
-		Bucket: aws.String(d.bucketName),
+	// Only a single "directory" level is requested by using a delimiter,
+	// nested prefixes are returned as common prefixes by s3.
+	prefix := d.objectKey(key)
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	listParams := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(d.readBucket()),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
 	}
 
-	prefixKey := strings.TrimPrefix(key, "/")
-	folders := make(map[string]struct{})
-
-	err := d.s3.ListObjectsPages(listParams, func(page *s3.ListObjectsOutput, lastPage bool) bool {
+	var cbErr error
+	count := 0
+	emit := func(info S3ObjectInfo) bool {
+		count++
+		cbErr = cb(info)
+		if cbErr != nil {
+			d.log().WithFields(logrus.Fields{"time": time.Now(), "key": d.fqdn(prefix + info.name), "action": "LS", "error": cbErr}).Errorf("Could not list %q", d.fqdn(prefix+info.name))
+			return false
+		}
+		return true
+	}
+	err := d.s3Client().ListObjectsV2Pages(listParams, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, commonPrefix := range page.CommonPrefixes {
+			name := strings.TrimPrefix(aws.StringValue(commonPrefix.Prefix), prefix)
+			ok := emit(S3ObjectInfo{
+				name:     strings.TrimSuffix(name, "/"),
+				size:     0,
+				modTime:  time.Now(),
+				isPrefix: true,
+			})
+			if !ok {
+				return false
+			}
+		}
 
 		for _, object := range page.Contents {
-			name := *object.Key
-
-			if prefixKey != "" {
-				if !strings.HasPrefix(name, prefixKey) {
-					continue
-				} else {
-					name = strings.TrimPrefix(name, prefixKey)
-				}
+			name := strings.TrimPrefix(aws.StringValue(object.Key), prefix)
+			if name == "" {
+				// the directory marker of the listed prefix itself
+				continue
 			}
 
 			owner := ""
 			if object.Owner != nil {
-				owner = *object.Owner.ID
-			}
-
-			isPrefix := false
-			if trimName := strings.TrimPrefix(name, "/"); strings.Contains(trimName, "/") {
-				isPrefix = true
-				name = strings.Split(trimName, "/")[0]
+				owner = aws.StringValue(object.Owner.ID)
 			}
 
-			finalName := strings.TrimPrefix(name, "/")
-			//logrus.Infof("LS File: %q, Size: %d, IsPrefix: %v, Owner: %q, Last Modifier: %q", finalName, *object.Size,isPrefix, owner,*object.LastModified)
-			fileSize := *object.Size
-			if isPrefix {
-				//check if already added
-				if _, ok := folders[finalName]; ok {
-					continue
-				} else {
-					folders[finalName] = struct{}{}
-				}
-				fileSize = 0
-			}
-
-			err := cb(S3ObjectInfo{
-				name:     finalName,
-				size:     fileSize,
+			size, lastModified := d.listedObject(aws.StringValue(object.Key), aws.Int64Value(object.Size), aws.TimeValue(object.LastModified))
+			ok := emit(S3ObjectInfo{
+				name:     name,
+				size:     size,
 				owner:    owner,
-				modTime:  *object.LastModified,
-				isPrefix: isPrefix,
+				modTime:  lastModified,
+				isPrefix: false,
 			})
-
-			if err != nil {
-				logrus.WithFields(logrus.Fields{"time": time.Now(), "error": err}).Errorf("Could not list %q", d.fqdn(name))
+			if !ok {
+				return false
 			}
 		}
 		// return if we should continue with the next page
@@ -194,153 +421,795 @@ func (d S3Driver) ListDir(key string, cb func(ftp.FileInfo) error) error {
 
 	if err != nil {
 		err := intoAwsError(err)
-		fqdn := d.fqdn(key)
-		logAwsError(err)
-		logrus.Errorf("Could not list %q.", fqdn)
-		return err
+		fqdn := d.fqdn(prefix)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "LS", "code": err.Code(), "error": err.Message()}).Errorf("Could not list %q.", fqdn)
+		return ftpReply(err, fqdn)
 	}
+	if cbErr != nil {
+		return cbErr
+	}
+
+	d.log().WithFields(logrus.Fields{"time": timestamp, "key": d.fqdn(prefix), "action": "LS", "files": count}).Infof("Directory listing for %q", key)
 
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "key": key, "action": "LS"}).Infof("Directory listing for %q", key)
+	err = d.metrics.SendList(count, timestamp)
+	if err != nil {
+		d.log().WithFields(logrus.Fields{"action": "LS", "error": err}).Errorf("Sending LIST metrics failed: %s", err)
+	}
 	return nil
 }
 
-// DeleteDir will always return an error because there is no such operation for a cloud object storage.
-func (d S3Driver) DeleteDir(key string) error {
-	// NOTE: Bucket removal will not be implemented
-	logrus.Warn("RemoveDir (RMDIR) is not supported.")
-	return notEnabled("RMDIR")
+// listedObject returns the size and modification time of the listed object with key `key` with the stored `size` and `lastModified`.
+// Listings do not contain metadata, thus it is requested for the modification times set by clients and the uncompressed size of compressed objects.
+// The stored size and last modification are returned if the request fails.
+func (d *S3Driver) listedObject(key string, size int64, lastModified time.Time) (int64, time.Time) {
+	if !d.listModTimes && !d.compressed(key) {
+		return size, lastModified
+	}
+	resp, err := d.headObject(d.readBucket(), key)
+	if err != nil {
+		d.log().Debugf("Failed to get the metadata of %q: %s", d.fqdn(key), err)
+		return size, lastModified
+	}
+	if uncompressed, ok := uncompressedSize(resp.ContentEncoding, resp.Metadata); ok {
+		size = uncompressed
+	}
+	if d.listModTimes {
+		lastModified = modTime(resp.Metadata, lastModified)
+	}
+	return size, lastModified
+}
+
+// DeleteDir deletes all objects located under prefix `key`.
+// Objects are deleted in batches, if a batch fails the deletion is aborted and the number of already deleted objects is reported.
+func (d *S3Driver) DeleteDir(key string) error {
+	d.keepAlive()
+	if !d.enabled(featureRemoveDir) {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(d.objectKey(key)), "action": "RMDIR"}).Warn("RemoveDir (RMDIR) is not enabled.")
+		return notEnabled("RMDIR")
+	}
+
+	if d.resolvePath(key) == "" {
+		// NOTE: Bucket removal will not be implemented
+		return fmt.Errorf("can not remove the root directory")
+	}
+	prefix := d.objectKey(key) + "/"
+	fqdn := d.fqdn(prefix)
+	timestamp := time.Now()
+
+	keys := []*s3.ObjectIdentifier{}
+	err := d.s3Client().ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(d.writeBucket()),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		return !lastPage
+	})
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "RMDIR", "code": err.Code(), "error": err.Message()}).Errorf("Could not list %q.", fqdn)
+		return ftpReply(err, fqdn)
+	}
+	if d.dryRun {
+		d.logDryRun(logrus.Fields{"time": timestamp, "bucket": d.writeBucket(), "key": fqdn, "action": "RMDIR", "files": len(keys)}, "DeleteObjects",
+			"Would delete %d objects under %q", len(keys), fqdn)
+		return nil
+	}
+
+	deleted := 0
+	for start := 0; start < len(keys); start += maxDeleteBatchSize {
+		end := start + maxDeleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		resp, err := d.s3Client().DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(d.writeBucket()),
+			Delete: &s3.Delete{
+				Objects: keys[start:end],
+				Quiet:   aws.Bool(false),
+			},
+		})
+		if err == nil && len(resp.Errors) > 0 {
+			err = awserr.New(aws.StringValue(resp.Errors[0].Code), aws.StringValue(resp.Errors[0].Message), nil)
+		}
+		if resp != nil {
+			deleted += len(resp.Deleted)
+		}
+		if err != nil {
+			err := intoAwsError(err)
+			logAwsError(d.log(), err)
+			d.statCache.invalidatePrefix(d.writeBucket(), prefix)
+			d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "RMDIR", "code": err.Code(), "error": err.Message()}).Errorf("Failed to delete directory %q, deleted %d of %d objects.", fqdn, deleted, len(keys))
+			return errors.Wrapf(err, "Deleted only %d of %d objects under %q", deleted, len(keys), fqdn)
+		}
+	}
+
+	d.statCache.invalidatePrefix(d.writeBucket(), prefix)
+	d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "RMDIR"}).Infof("Deleted %d objects under %q", deleted, fqdn)
+	return nil
 }
 
 // DeleteFile will delete the object with key `key`.
-func (d S3Driver) DeleteFile(key string) error {
-	if d.featureFlags&featureRemove == 0 {
-		logrus.Warn("Remove (RM) is not enabled.")
+func (d *S3Driver) DeleteFile(key string) error {
+	d.keepAlive()
+	if !d.enabled(featureRemove) {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(d.objectKey(key)), "action": "DELETE"}).Warn("Remove (RM) is not enabled.")
 		return notEnabled("RM")
 	}
 
-	fqdn := d.fqdn(key)
-	_, err := d.s3.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	timestamp := time.Now()
+	// s3 reports the deletion of missing objects as success
+	if d.strictDelete {
+		if _, err := d.objectSize(d.writeBucket(), objectKey); err != nil {
+			if intoAwsError(err).Code() == "NotFound" {
+				d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "DELETE"}).Warnf("Object %q does not exist", fqdn)
+				return fmt.Errorf("object %q %w", fqdn, ErrNotFound)
+			}
+			d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "DELETE", "error": err}).Errorf("Failed to delete object %q: %s", fqdn, err)
+			return ftpReply(err, fqdn)
+		}
+	}
+	if d.dryRun {
+		d.logDryRun(logrus.Fields{"time": timestamp, "bucket": d.writeBucket(), "key": fqdn, "action": "DELETE"}, "DeleteObject", "Would delete %q", fqdn)
+		return nil
+	}
+	_, err := d.s3Client().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(d.writeBucket()),
+		Key:    aws.String(objectKey),
 	})
+	d.statCache.invalidate(d.writeBucket(), objectKey)
 	if err != nil {
 		err := intoAwsError(err)
-		logAwsError(err)
-		logrus.WithFields(logrus.Fields{"time": time.Now(), "code": err.Code(), "error": err.Message()}).Errorf("Failed to delete object %q.", fqdn)
-		return err
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "DELETE", "code": err.Code(), "error": err.Message()}).Errorf("Failed to delete object %q.", fqdn)
+		return ftpReply(err, fqdn)
 	}
 
-	logrus.WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "DELETE"}).Infof("Deleted %q", fqdn)
+	d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "DELETE"}).Infof("Deleted %q", fqdn)
+
+	err = d.metrics.SendDelete(timestamp)
+	if err != nil {
+		d.log().WithFields(logrus.Fields{"action": "DELETE", "error": err}).Errorf("Sending DELETE metrics failed: %s", err)
+	}
 	return nil
 }
 
-// Rename will always return an error because there is no such operation for a cloud object storage.
-func (d S3Driver) Rename(oldKey string, newKey string) error {
-	// TODO: there is no direct method for s3, must be copied and removed
-	logrus.Warn("Rename (MV) is not supported.")
-	return notEnabled("MV")
+// Rename moves the object with key `oldKey` to `newKey`.
+// There is no such operation for a cloud object storage, thus the object is copied and the original is deleted afterwards.
+func (d *S3Driver) Rename(oldKey string, newKey string) error {
+	d.keepAlive()
+	if !d.enabled(featureMove) {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(d.objectKey(oldKey)), "action": "MV"}).Warn("Rename (MV) is not enabled.")
+		return notEnabled("MV")
+	}
+
+	sourceKey, targetKey := d.objectKey(oldKey), d.objectKey(newKey)
+	sourceFqdn, targetFqdn := d.fqdn(sourceKey), d.fqdn(targetKey)
+	timestamp := time.Now()
+	if d.dryRun {
+		d.logDryRun(logrus.Fields{"time": timestamp, "bucket": d.writeBucket(), "key": targetFqdn, "source": sourceFqdn, "action": "MV"}, "CopyObject,DeleteObject",
+			"Would move %q to %q", sourceFqdn, targetFqdn)
+		return nil
+	}
+	_, err := d.s3Client().CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(d.writeBucket()),
+		Key:        aws.String(targetKey),
+		CopySource: aws.String(copySource(d.writeBucket(), sourceKey)),
+	})
+	d.statCache.invalidate(d.writeBucket(), targetKey)
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": targetFqdn, "source": sourceFqdn, "action": "MV", "code": err.Code(), "error": err.Message()}).Errorf("Failed to copy object %q to %q.", sourceFqdn, targetFqdn)
+		return ftpReply(err, targetFqdn)
+	}
+
+	_, err = d.s3Client().DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(d.writeBucket()),
+		Key:    aws.String(sourceKey),
+	})
+	d.statCache.invalidate(d.writeBucket(), sourceKey)
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": targetFqdn, "source": sourceFqdn, "action": "MV", "code": err.Code(), "error": err.Message()}).Errorf("Copied %q to %q but failed to delete the original.", sourceFqdn, targetFqdn)
+		return errors.Wrapf(err, "Object %q was copied to %q but the original could not be deleted", sourceFqdn, targetFqdn)
+	}
+
+	d.log().WithFields(logrus.Fields{"time": timestamp, "key": targetFqdn, "source": sourceFqdn, "action": "MV"}).Infof("Moved %q to %q", sourceFqdn, targetFqdn)
+	return nil
 }
 
-// MakeDir will always return an error because there is no such operation for a cloud object storage.
-func (d S3Driver) MakeDir(key string) error {
-	// There is no s3 equivalent
-	logrus.Warn("MakeDir (MkDir) is not supported.")
-	return notEnabled("MKDIR")
+// MakeDir creates an empty object with key `key` and a trailing slash.
+// There is no such operation for a cloud object storage, but most clients and consoles treat such an object as a directory.
+func (d *S3Driver) MakeDir(key string) error {
+	d.keepAlive()
+	if !d.enabled(featureMakeDir) {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(d.objectKey(key)), "action": "MKDIR"}).Warn("MakeDir (MKDIR) is not enabled.")
+		return notEnabled("MKDIR")
+	}
+
+	if d.resolvePath(key) == "" {
+		return fmt.Errorf("can not create the root directory")
+	}
+	markerKey := d.objectKey(key) + "/"
+	fqdn := d.fqdn(markerKey)
+	if d.dryRun {
+		d.logDryRun(logrus.Fields{"time": time.Now(), "bucket": d.writeBucket(), "key": fqdn, "action": "MKDIR", "bytes": 0}, "PutObject", "Would create directory %q", fqdn)
+		return nil
+	}
+	_, err := d.s3Client().PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(d.writeBucket()),
+		Key:    aws.String(markerKey),
+		Body:   bytes.NewReader([]byte{}),
+	})
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "MKDIR", "code": err.Code(), "error": err.Message()}).Errorf("Failed to create directory %q.", fqdn)
+		return ftpReply(err, fqdn)
+	}
+
+	d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "MKDIR"}).Infof("Created directory %q", fqdn)
+	return nil
 }
 
-// GetFile returns the object with key `key`.
-func (d S3Driver) GetFile(key string, offset int64) (int64, io.ReadCloser, error) {
-	if d.featureFlags&featureGet == 0 {
+// GetFile returns the object with key `key` starting at byte `offset`.
+// The returned size is the number of remaining bytes after `offset`.
+// With the `versions` feature, the version selected by SelectVersion is returned.
+func (d *S3Driver) GetFile(key string, offset int64) (int64, io.ReadCloser, error) {
+	d.keepAlive()
+	if !d.enabled(featureGet) {
 		return -1, nil, notEnabled("GET")
 	}
 
-	fqdn := d.fqdn(key)
+	versionID := d.takeVersion()
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+
 	timestamp := time.Now()
-	resp, err := d.s3.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
-	})
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(d.readBucket()),
+		Key:    aws.String(objectKey),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	resp, err := d.getObject(input, offset)
 	if err != nil {
 		err := intoAwsError(err)
-		logAwsError(err)
+		logAwsError(d.log(), err)
 		if err.Code() == "NotFound" {
-			logrus.WithFields(logrus.Fields{"time": timestamp, "Object": fqdn}).Errorf("Failed to get object: %q", fqdn)
+			d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "GET", "code": err.Code(), "error": err.Message()}).Errorf("Failed to get object: %q", fqdn)
+		}
+		if err.Code() == "InvalidRange" {
+			d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "GET", "code": err.Code(), "error": err.Message()}).Errorf("Offset %d exceeds the size of object %q", offset, fqdn)
+			return 0, nil, errors.Wrapf(err, "Offset %d exceeds the size of object %q", offset, fqdn)
+		}
+		if err.Code() == "InvalidObjectState" {
+			archivedErr := d.archivedError(objectKey, versionID)
+			d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "GET", "code": err.Code(), "error": archivedErr}).Error(archivedErr)
+			return 0, nil, archivedErr
+		}
+		return 0, nil, ftpReply(err, fqdn)
+	}
+	size := aws.Int64Value(resp.ContentLength)
+	body := resp.Body
+	if aws.StringValue(resp.ContentEncoding) == gzipEncoding {
+		// the stored size is reported if the size of the decompressed data is unknown
+		if uncompressed, ok := uncompressedSize(resp.ContentEncoding, resp.Metadata); ok {
+			size = uncompressed - offset
+		}
+		body, err = gunzip(resp.Body, offset)
+		if err != nil {
+			d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "GET", "error": err}).Errorf("Failed to decompress object %q", fqdn)
+			return 0, nil, errors.Wrapf(err, "Failed to decompress object %q", fqdn)
 		}
-		return 0, nil, err
 	}
-	size := *resp.ContentLength
-	logrus.WithFields(logrus.Fields{"time": timestamp, "operation": "GET", "object": fqdn}).Infof("Serving object: %s", fqdn)
+	d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "GET", "bytes": size}).Infof("Serving object: %s", fqdn)
 
 	err = d.metrics.SendGet(size, timestamp)
 	if err != nil {
-		logrus.Errorf("Sending GET metrics failed: %s", err)
+		d.log().WithFields(logrus.Fields{"action": "GET", "error": err}).Errorf("Sending GET metrics failed: %s", err)
 	}
 
-	return size, resp.Body, nil
+	// the transfer lasts until the FTP server has read and closed the body
+	d.beginTransfer()
+	return size, &transferReader{ReadCloser: body, end: d.endTransfer}, nil
+}
+
+// getObject gets the object of `input` starting at byte `offset`.
+// Ranges apply to the stored data, thus compressed objects are got as a whole and the offset is skipped after decompressing them.
+func (d *S3Driver) getObject(input *s3.GetObjectInput, offset int64) (*s3.GetObjectOutput, error) {
+	if d.downloadConcurrency > 1 {
+		if resp, err := d.getObjectParallel(input, offset); resp != nil || err != nil {
+			return resp, err
+		}
+	}
+	if offset > 0 && !(d.compress && d.objectEncoding(aws.StringValue(input.Key), input.VersionId) == gzipEncoding) {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.s3Client().GetObjectWithContext(aws.BackgroundContext(), input, acceptIdentityEncoding)
+	if err == nil && input.Range != nil && aws.StringValue(resp.ContentEncoding) == gzipEncoding {
+		// compressed before compression was disabled or by another application
+		resp.Body.Close()
+		input.Range = nil
+		return d.s3Client().GetObjectWithContext(aws.BackgroundContext(), input, acceptIdentityEncoding)
+	}
+	return resp, err
+}
+
+// PresignedURL returns a URL to download the object with key `key` directly from s3 which is valid for the presign TTL, see SITE GETURL.
+// Only objects of at least the presign threshold are served, smaller ones have to be downloaded with RETR.
+func (d *S3Driver) PresignedURL(key string) (string, error) {
+	d.keepAlive()
+	if !d.enabled(featureGet) {
+		return "", notEnabled("GET")
+	}
+	if d.presignThreshold <= 0 {
+		return "", fmt.Errorf("Presigned URLs are disabled")
+	}
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	url, err := d.presignedURL(objectKey)
+	if err != nil {
+		d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "GETURL", "error": err}).Errorf("Failed to presign URL of object %q", fqdn)
+		return "", ftpReply(err, fqdn)
+	}
+	if url == "" {
+		return "", fmt.Errorf("Object %q is smaller than %d bytes, download it with RETR", fqdn, d.presignThreshold)
+	}
+	d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "GETURL"}).Infof("Serving presigned URL of object: %s", fqdn)
+	return url, nil
+}
+
+// presignedURL returns a presigned URL to download the object with key `key` if it is at least as large as the presign threshold.
+// Otherwise, it returns an empty string to serve the object itself.
+func (d *S3Driver) presignedURL(key string) (string, error) {
+	size, err := d.objectSize(d.readBucket(), key)
+	if err != nil {
+		return "", err
+	}
+	if size < d.presignThreshold {
+		return "", nil
+	}
+	req, _ := d.s3Client().GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(d.readBucket()),
+		Key:    aws.String(key),
+	})
+	url, err := req.Presign(d.presignTTL)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to presign URL of object %q", d.fqdn(key))
+	}
+	return url, nil
 }
 
 // PutFile stores the object with key `key`.
-// The method returns an error with no-overwrite was set and the object already exists or appendMode was specified.
-func (d S3Driver) PutFile(key string, data io.Reader, appendMode bool) (int64, error) {
-	if d.featureFlags&featurePut == 0 {
+// The method returns an error with no-overwrite was set and the object already exists
+// or appendMode was specified without enabling `append`.
+func (d *S3Driver) PutFile(key string, data io.Reader, appendMode bool) (int64, error) {
+	if !d.enabled(featurePut) {
 		return -1, notEnabled("PUT")
 	}
-	if data == nil || reflect.ValueOf(data).IsNil() {
-		logrus.Warn("PutFile was called with a nil valued io.Reader")
+	if isNil(data) {
+		d.log().WithFields(logrus.Fields{"key": d.fqdn(d.objectKey(key)), "action": "PUT"}).Warn("PutFile was called with a nil valued io.Reader")
 		return -1, fmt.Errorf("PUT with empty data")
 	}
 
-	fqdn := d.fqdn(key)
-	if appendMode {
-		err := fmt.Errorf("can not append to object %q because the backend does not support appending", fqdn)
-		logrus.Error(err)
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	if appendMode && !d.enabled(featureAppend) {
+		err := fmt.Errorf("can not append to object %q because %w", fqdn, ErrAppendUnsupported)
+		d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "APPE", "error": err}).Error(err)
 		return -1, err
 	}
+	if appendMode && d.compressed(objectKey) {
+		err := fmt.Errorf("can not append to object %q because it is compressed, %w", fqdn, ErrAppendUnsupported)
+		d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "APPE", "error": err}).Error(err)
+		return -1, err
+	}
+
+	d.beginTransfer()
+	defer d.endTransfer()
+	if d.idle != nil {
+		// unlike downloads, uploads keep the idle timer running while data is received to close the connection of stalled uploads
+		d.keepAlive()
+		data = &activityReader{Reader: data, active: d.keepAlive}
+	}
 
 	timestamp := time.Now()
-	if d.noOverwrite && d.objectExists(key) {
-		err := fmt.Errorf("object %q already exists and overwriting is forbidden", fqdn)
-		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "error": err}).Error(err)
+	exists := (d.noOverwrite || appendMode) && d.objectExists(objectKey)
+	if d.noOverwrite && exists {
+		err := fmt.Errorf("object %q already exists and %w", fqdn, ErrOverwriteForbidden)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Error(err)
 		return -1, err
 	}
 
-	_, err := d.uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
-		Body:   data,
-	})
+	data, err := d.checkContentType(objectKey, data, appendMode)
+	if err != nil {
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Error(err)
+		return -1, err
+	}
+
+	var limited *maxSizeReader
+	if d.maxUploadSize > 0 {
+		limited = &maxSizeReader{Reader: data, remaining: d.maxUploadSize}
+		data = limited
+	}
+
+	if d.dryRun {
+		return d.dryRunPut(objectKey, data, limited, appendMode && exists, timestamp)
+	}
+
+	ctx, cancel := d.uploadContext()
+	defer cancel()
+	var uncompressed *countingReader
+	if appendMode && exists {
+		err = d.appendObject(ctx, objectKey, data)
+	} else {
+		input := d.uploadInput(objectKey, data)
+		if d.compressed(objectKey) {
+			uncompressed = &countingReader{Reader: data}
+			compressed := gzipReader(uncompressed)
+			defer compressed.Close()
+			input.Body = compressed
+			input.ContentEncoding = aws.String(gzipEncoding)
+		}
+		if d.verifyMD5 {
+			err = setContentMD5(input, d.partSize)
+		}
+		options := []func(*s3manager.Uploader){}
+		if d.noOverwrite {
+			// the object might have been created since checking its existence
+			options = append(options, s3manager.WithUploaderRequestOptions(ifNoneMatch))
+		}
+		if err == nil {
+			_, err = d.s3Uploader().UploadWithContext(ctx, input, options...)
+		}
+		if failure, ok := err.(s3manager.MultiUploadFailure); ok && ctx.Err() != nil && !d.leavePartsOnError {
+			// s3manager fails to abort multipart uploads with the cancelled context itself
+			d.abortMultipartUpload(objectKey, aws.String(failure.UploadID()))
+		}
+	}
+	d.statCache.invalidate(d.writeBucket(), objectKey)
+	if limited != nil && limited.exceeded {
+		// s3manager aborts multipart uploads failing to read the data itself
+		err := fmt.Errorf("upload of %q %w of %d bytes", fqdn, ErrUploadTooLarge, d.maxUploadSize)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Error(err)
+		return -1, err
+	}
+	if err != nil && d.noOverwrite && isPreconditionFailed(err) {
+		err := fmt.Errorf("object %q already exists and %w", fqdn, ErrOverwriteForbidden)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Error(err)
+		return -1, err
+	}
+	if reply, ok := ftpReply(err, fqdn).(ftpError); ok {
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Errorf("Failed to put object %q", fqdn)
+		return -1, reply
+	}
 	if err != nil {
 		err := fmt.Errorf("Failed to put object %q because reading from source failed", fqdn)
-		logrus.WithFields(logrus.Fields{"time": timestamp, "object": fqdn, "action": "PUT", "error": err}).Error(err)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Error(err)
 		return -1, err
 	}
-	size, err := d.objectSize(key)
+	size, err := d.objectSize(d.writeBucket(), objectKey)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Errorf("Could not determine size of %q", fqdn)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Errorf("Could not determine size of %q", fqdn)
 		return size, err
 	}
-	logrus.WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT"}).Infof("Put %q", fqdn)
+	if uncompressed != nil {
+		// clients expect the size of the data they sent
+		size = uncompressed.count
+		d.storeUncompressedSize(objectKey, size)
+	}
+	d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "bytes": size}).Infof("Put %q", fqdn)
+	if d.webhook != nil {
+		notification := UploadNotification{
+			Bucket:      d.writeBucket(),
+			Key:         objectKey,
+			Size:        size,
+			ContentType: d.contentType(objectKey),
+			Time:        time.Now(),
+		}
+		if d.conn != nil {
+			notification.User = d.conn.LoginUser()
+		}
+		d.webhook.notify(notification)
+	}
 
 	err = d.metrics.SendPut(size, timestamp)
 	if err != nil {
-		logrus.Errorf("Sending PUT metrics failed: %s", err)
+		d.log().WithFields(logrus.Fields{"action": "PUT", "error": err}).Errorf("Sending PUT metrics failed: %s", err)
 	}
 
 	return size, nil
 }
 
+// dryRunPut reads `data` like an upload of the object with key `objectKey` and logs the requests of the upload instead of sending them.
+func (d *S3Driver) dryRunPut(objectKey string, data io.Reader, limited *maxSizeReader, appendMode bool, timestamp time.Time) (int64, error) {
+	fqdn := d.fqdn(objectKey)
+	size, err := io.Copy(ioutil.Discard, data)
+	if limited != nil && limited.exceeded {
+		err := fmt.Errorf("upload of %q %w of %d bytes", fqdn, ErrUploadTooLarge, d.maxUploadSize)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Error(err)
+		return -1, err
+	}
+	if err != nil {
+		err := fmt.Errorf("Failed to put object %q because reading from source failed", fqdn)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "PUT", "error": err}).Error(err)
+		return -1, err
+	}
+	requests := "PutObject"
+	switch {
+	case appendMode:
+		requests = "CreateMultipartUpload,UploadPartCopy,UploadPart,CompleteMultipartUpload"
+	case d.partSize > 0 && size > d.partSize:
+		requests = "CreateMultipartUpload,UploadPart,CompleteMultipartUpload"
+	}
+	d.logDryRun(logrus.Fields{"time": timestamp, "bucket": d.writeBucket(), "key": fqdn, "action": "PUT", "bytes": size}, requests, "Would put %q", fqdn)
+	return size, nil
+}
+
+// maxSizeReader reads at most `remaining` bytes, reading more fails with ErrUploadTooLarge.
+type maxSizeReader struct {
+	io.Reader
+	remaining int64
+	exceeded  bool
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.exceeded {
+		return 0, ErrUploadTooLarge
+	}
+	// a single byte more than allowed is read to tell data of exactly the maximum size from larger data
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.Reader.Read(p)
+	r.remaining -= int64(n)
+	if r.remaining < 0 {
+		r.exceeded = true
+		return n - 1, ErrUploadTooLarge
+	}
+	return n, err
+}
+
+// isNil returns true if `value` is nil or a typed nil, e.g. a nil pointer wrapped in an interface.
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Ptr, reflect.Slice:
+		return v.IsNil()
+	default:
+		return false
+	}
+}
+
+// ifNoneMatch makes uploads fail if the object already exists.
+// Only single part uploads and the completion of multipart uploads support the condition,
+// see https://docs.aws.amazon.com/AmazonS3/latest/userguide/conditional-requests.html
+func ifNoneMatch(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "CompleteMultipartUpload":
+		r.HTTPRequest.Header.Set("If-None-Match", "*")
+	}
+}
+
+// isPreconditionFailed returns true if `err` is caused by an unmet condition of a request, e.g. by ifNoneMatch.
+// Concurrent conditional requests of the same object are rejected with a conflict.
+func isPreconditionFailed(err error) bool {
+	switch intoAwsError(err).Code() {
+	case "PreconditionFailed", "ConditionalRequestConflict":
+		return true
+	default:
+		return false
+	}
+}
+
 // fqdn returns the fully qualified name for a object with key `key`.
-func (d S3Driver) fqdn(key string) string {
-	u := d.bucketURL
-	u.Path = filepath.Join(d.cwd, key)
-	return u.String()
+// The key is appended as is instead of percent-encoded, e.g. `https://my-bucket.s3.amazonaws.com/café/naïve.txt`,
+// because the name is displayed to users and in logs.
+// The bucket URL is shared by all drivers, thus it is copied instead of modified.
+func (d *S3Driver) fqdn(key string) string {
+	u := *d.bucketURL
+	u.Path, u.RawPath, u.RawQuery, u.Fragment = "", "", "", ""
+	return u.String() + "/" + key
+}
+
+// objectKey returns the s3 object key for the path `key`.
+// Keys are located under the key prefix of the server and the home prefix of the user.
+func (d *S3Driver) objectKey(key string) string {
+	return strings.TrimPrefix(path.Join("/", d.keyPrefix, d.home(), d.resolvePath(key)), "/")
+}
+
+// resolvePath returns the path `key` as seen by the user, without leading slash.
+// Relative paths are resolved against the current working directory, absolute paths are used as is.
+// A path can not escape the root directory, e.g. by `..` elements.
+func (d *S3Driver) resolvePath(key string) string {
+	if !path.IsAbs(key) {
+		key = path.Join(d.cwd, key)
+	}
+	return strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+// anonymous returns true if anonymous logins are allowed and the logged in user is anonymous.
+func (d *S3Driver) anonymous() bool {
+	return d.anonymousFeatures != 0 && d.conn != nil && IsAnonymous(d.conn.LoginUser())
+}
+
+// s3Client returns the s3 client of the logged in user.
+func (d *S3Driver) s3Client() s3iface.S3API {
+	if d.anonymousS3 != nil && d.anonymous() {
+		return d.anonymousS3
+	}
+	if api, ok := d.userS3API(); ok {
+		return api.client
+	}
+	return d.s3
+}
+
+// s3Uploader returns the s3 uploader of the logged in user.
+func (d *S3Driver) s3Uploader() s3manageriface.UploaderAPI {
+	if d.anonymousUploader != nil && d.anonymous() {
+		return d.anonymousUploader
+	}
+	if api, ok := d.userS3API(); ok {
+		return api.uploader
+	}
+	return d.uploader
+}
+
+// s3Identity returns who the s3 requests of the logged in user are made as, empty for the credentials of the factory.
+func (d *S3Driver) s3Identity() string {
+	if d.anonymousS3 != nil && d.anonymous() {
+		return "anonymous"
+	}
+	if _, ok := d.userS3API(); ok {
+		return "user:" + d.conn.LoginUser()
+	}
+	return ""
+}
+
+// userS3API returns the s3 client and uploader of the logged in user if the user has own s3 credentials
+// or a session policy applies.
+func (d *S3Driver) userS3API() (userS3API, bool) {
+	if d.conn == nil || d.conn.LoginUser() == "" {
+		return userS3API{}, false
+	}
+	if api, ok := d.userS3[d.conn.LoginUser()]; ok {
+		return api, true
+	}
+	if d.sessionPolicy != nil {
+		return d.sessionPolicy.s3API(d.conn.LoginUser(), d.home()), true
+	}
+	return userS3API{}, false
+}
+
+// readBucket returns the bucket objects are listed and downloaded from, the bucket of the bucket URL if none is configured.
+func (d *S3Driver) readBucket() string {
+	if d.readBucketName != "" {
+		return d.readBucketName
+	}
+	return d.bucketName
+}
+
+// writeBucket returns the bucket objects are uploaded to, renamed and deleted in, the bucket of the bucket URL if none is configured.
+func (d *S3Driver) writeBucket() string {
+	if d.writeBucketName != "" {
+		return d.writeBucketName
+	}
+	return d.bucketName
+}
+
+// home returns the home prefix of the logged in user, or an empty string if the user has none.
+func (d *S3Driver) home() string {
+	if d.users == nil || d.conn == nil {
+		return ""
+	}
+	return d.users.Home(d.conn.LoginUser())
+}
+
+// uploadInput returns the parameters to upload `body` as object with key `key`.
+func (d *S3Driver) uploadInput(key string, body io.Reader) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket:      aws.String(d.writeBucket()),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(d.contentType(key)),
+	}
+	if d.storageClass != "" {
+		input.StorageClass = aws.String(d.storageClass)
+	}
+	if d.sse != "" {
+		input.ServerSideEncryption = aws.String(d.sse)
+	}
+	if d.sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(d.sseKMSKeyID)
+	}
+	if d.acl != "" {
+		input.ACL = aws.String(d.acl)
+	}
+	if len(d.metadata) > 0 {
+		input.Metadata = aws.StringMap(d.metadata)
+	}
+	if d.tags != "" {
+		input.Tagging = aws.String(d.tags)
+	}
+	input.ObjectLockMode, input.ObjectLockRetainUntilDate, input.ObjectLockLegalHoldStatus = d.objectLock.headers(time.Now())
+	return input
+}
+
+// setContentMD5 sets the base64 encoded MD5 digest of the body of `input`, which lets s3 reject a corrupted body.
+// Only bodies which fit into a single part of `partSize` bytes are buffered to compute the digest,
+// larger bodies are uploaded in parts and s3manager sends a digest with every part instead.
+func setContentMD5(input *s3manager.UploadInput, partSize int64) error {
+	if partSize <= 0 {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(input.Body, buf)
+	switch err {
+	case io.EOF, io.ErrUnexpectedEOF:
+		sum := md5.Sum(buf[:n])
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		input.Body = bytes.NewReader(buf[:n])
+		return nil
+	case nil:
+		input.Body = io.MultiReader(bytes.NewReader(buf), input.Body)
+		return nil
+	default:
+		return errors.Wrapf(err, "Failed to read data of %q", aws.StringValue(input.Key))
+	}
+}
+
+// contentType returns the content type for the object with key `key` based on its extension.
+// Configured content types take precedence over the system's MIME types.
+func (d *S3Driver) contentType(key string) string {
+	ext := strings.ToLower(path.Ext(key))
+	if contentType, ok := d.contentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// copySource returns the URL encoded copy source of the object with key `key` in bucket `bucketName`.
+func copySource(bucketName, key string) string {
+	segments := strings.Split(bucketName+"/"+key, "/")
+	for idx, segment := range segments {
+		segments[idx] = strings.Replace(url.QueryEscape(segment), "+", "%20", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+// objectEncoding returns the content encoding of the object with key `key`, or an empty string if it has none or is missing.
+func (d *S3Driver) objectEncoding(key string, versionID *string) string {
+	resp, err := d.s3Client().HeadObject(&s3.HeadObjectInput{
+		Bucket:    aws.String(d.readBucket()),
+		Key:       aws.String(key),
+		VersionId: versionID,
+	})
+	if err != nil {
+		return ""
+	}
+	return aws.StringValue(resp.ContentEncoding)
 }
 
 // objectExists returns true if the object exists.
-func (d S3Driver) objectExists(key string) bool {
-	logrus.Debugf("Trying to check if object %q exists.", d.fqdn(key))
-	_, err := d.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(d.bucketName),
+func (d *S3Driver) objectExists(key string) bool {
+	d.log().Debugf("Trying to check if object %q exists.", d.fqdn(key))
+	_, err := d.s3Client().HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(d.writeBucket()),
 		Key:    aws.String(key),
 	})
 	if err != nil {
@@ -348,21 +1217,18 @@ func (d S3Driver) objectExists(key string) bool {
 		if err.Code() == "NotFound" {
 			return false
 		}
-		logrus.Debugf("Failed to check object %q", d.fqdn(key))
+		d.log().Debugf("Failed to check object %q", d.fqdn(key))
 		return false
 	}
 	return true
 }
 
-// objectSize returns the size of the object.
-func (d S3Driver) objectSize(key string) (int64, error) {
-	logrus.Debugf("Trying to get size of object %q.", d.fqdn(key))
-	resp, err := d.s3.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(key),
-	})
+// objectSize returns the size of the object with key `key` in bucket `bucket`.
+func (d *S3Driver) objectSize(bucket, key string) (int64, error) {
+	d.log().Debugf("Trying to get size of object %q.", d.fqdn(key))
+	resp, err := d.headObject(bucket, key)
 	if err != nil {
-		logrus.Debugf("Failed to check size of object %q", d.fqdn(key))
+		d.log().Debugf("Failed to check size of object %q", d.fqdn(key))
 		return -1, errors.Wrapf(err, "Failed to check size of object %q", d.fqdn(key))
 	}
 	return aws.Int64Value(resp.ContentLength), nil
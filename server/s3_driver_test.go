@@ -2,11 +2,17 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -14,11 +20,17 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
-	ftp "github.com/goftp/server"
+	goErrors "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
 )
 
 type bucketMock struct {
@@ -88,9 +100,18 @@ func (m metricsSenderMock) SendPut(size int64, timestamp time.Time) error {
 func (m metricsSenderMock) SendGet(size int64, timestamp time.Time) error {
 	return nil
 }
+func (m metricsSenderMock) SendDelete(timestamp time.Time) error {
+	return nil
+}
+func (m metricsSenderMock) SendList(count int, timestamp time.Time) error {
+	return nil
+}
 
 type s3UploaderMock struct {
-	bucket *bucketMock
+	bucket    *bucketMock
+	lastInput *s3manager.UploadInput
+	// beforeUpload is called before an object is uploaded, e.g. to simulate concurrent uploads
+	beforeUpload func()
 }
 
 func (s *s3UploaderMock) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
@@ -98,7 +119,22 @@ func (s *s3UploaderMock) Upload(input *s3manager.UploadInput, options ...func(*s
 	if bucketName != s.bucket.Name() {
 		return nil, fmt.Errorf("Wrong bucket, expected %q but was %q", bucketName, s.bucket.Name())
 	}
+	s.lastInput = input
 	key := aws.StringValue(input.Key)
+	if s.beforeUpload != nil {
+		s.beforeUpload()
+	}
+
+	// apply the request options to a PutObject request to check its conditions
+	uploader := s3manager.Uploader{}
+	for _, option := range options {
+		option(&uploader)
+	}
+	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: "PutObject"}, nil, nil)
+	req.ApplyOptions(uploader.RequestOptions...)
+	if _, err := s.bucket.Get(key); err == nil && req.HTTPRequest.Header.Get("If-None-Match") == "*" {
+		return nil, awserr.NewRequestFailure(awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil), 412, "")
+	}
 	data, err := ioutil.ReadAll(input.Body)
 	if err != nil {
 		return nil, awserr.New("FailedToReadBody", fmt.Sprintf("Could not read data for key: %s", key), nil)
@@ -112,13 +148,68 @@ func (s *s3UploaderMock) Upload(input *s3manager.UploadInput, options ...func(*s
 	return &s3manager.UploadOutput{}, nil
 }
 
-func (s *s3UploaderMock) UploadWithContext(aws.Context, *s3manager.UploadInput, ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
-	return nil, fmt.Errorf("Context upload is not mocked")
+func (s *s3UploaderMock) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "Upload was cancelled", err)
+	}
+	return s.Upload(input, options...)
+}
+
+// cancelledUploaderMock starts multipart uploads which are only finished by cancelling them.
+type cancelledUploaderMock struct {
+	s3      *s3Mock
+	started chan struct{}
+}
+
+func (u *cancelledUploaderMock) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return u.UploadWithContext(context.Background(), input, options...)
+}
+
+func (u *cancelledUploaderMock) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	upload, err := u.s3.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: input.Bucket, Key: input.Key})
+	if err != nil {
+		return nil, err
+	}
+	close(u.started)
+	<-ctx.Done()
+	return nil, multiUploadFailureMock{
+		err:      awserr.New(request.CanceledErrorCode, "Upload was cancelled", ctx.Err()),
+		uploadID: aws.StringValue(upload.UploadId),
+	}
+}
+
+// multiUploadFailureMock is the error of a failed multipart upload as returned by s3manager.
+type multiUploadFailureMock struct {
+	err      awserr.Error
+	uploadID string
+}
+
+func (e multiUploadFailureMock) Error() string   { return e.err.Error() }
+func (e multiUploadFailureMock) Code() string    { return e.err.Code() }
+func (e multiUploadFailureMock) Message() string { return e.err.Message() }
+func (e multiUploadFailureMock) OrigErr() error  { return e.err.OrigErr() }
+func (e multiUploadFailureMock) UploadID() string {
+	return e.uploadID
 }
 
 type s3Mock struct {
 	s3iface.S3API
-	bucket *bucketMock
+	bucket     *bucketMock
+	uploads    map[string]map[int64][]byte
+	pageSize   int
+	listCalls  int
+	listPrefix string
+	lastCopy   *s3.CopyObjectInput
+	lastDelete *s3.DeleteObjectInput
+	lastGet    *s3.GetObjectInput
+	// headBucketCalls is the number of HeadBucket requests
+	headBucketCalls int
+	// headObjectCalls is the number of HeadObject requests
+	headObjectCalls int
+	// deleteBatches contains the number of keys of each DeleteObjects request
+	deleteBatches []int
+	// failDeleteBatch is the (1-based) DeleteObjects request that fails
+	failDeleteBatch int
 }
 
 type objectMock struct {
@@ -131,10 +222,12 @@ func (mock *s3Mock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput,
 	if err := input.Validate(); err != nil {
 		return nil, err
 	}
+	mock.headObjectCalls++
 
 	object, err := mock.bucket.Get(aws.StringValue(input.Key))
 	if err != nil {
-		return nil, awserr.New("NoSuchObject", err.Error(), err)
+		// HEAD responses have no body, thus s3 only reports a generic "NotFound"
+		return nil, awserr.New("NotFound", err.Error(), err)
 	}
 	return &s3.HeadObjectOutput{
 		ContentLength: aws.Int64(int64(len(object.data))),
@@ -146,6 +239,7 @@ func (mock *s3Mock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput,
 	if err := input.Validate(); err != nil {
 		return nil, err
 	}
+	mock.headBucketCalls++
 
 	if aws.StringValue(input.Bucket) != mock.bucket.Name() {
 		return nil, awserr.New("NoSuchBucket", fmt.Sprintf("Bucket %q not found", aws.StringValue(input.Bucket)), nil)
@@ -174,27 +268,87 @@ func (mock *s3Mock) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutp
 	return &s3.ListObjectsOutput{Contents: contents}, nil
 }
 
-
-func (mock *s3Mock) ListObjectsPages(input *s3.ListObjectsInput, fn func(page *s3.ListObjectsOutput, lastPage bool) bool ) error {
+func (mock *s3Mock) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
 	if err := input.Validate(); err != nil {
-		return err
+		return nil, err
 	}
+	mock.listCalls++
+	mock.listPrefix = aws.StringValue(input.Prefix)
 
-	contents := []*s3.Object{}
+	// entries contains object keys and common prefixes in lexicographical order
+	entries := []string{}
+	commonPrefixes := map[string]struct{}{}
+	objects := mock.bucket.List()
 	prefix := aws.StringValue(input.Prefix)
-	for key, object := range mock.bucket.List() {
-		if strings.HasPrefix(key, prefix) {
-			contents = append(contents, &s3.Object{
-				ETag:         aws.String(object.etag),
-				Key:          aws.String(key),
-				LastModified: &object.lastMod,
-				Size:         aws.Int64(int64(len(object.data))),
-			})
+	delimiter := aws.StringValue(input.Delimiter)
+	for key := range objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
 		}
+		if idx := strings.Index(strings.TrimPrefix(key, prefix), delimiter); delimiter != "" && idx >= 0 {
+			commonPrefix := key[:len(prefix)+idx+len(delimiter)]
+			if _, ok := commonPrefixes[commonPrefix]; !ok {
+				commonPrefixes[commonPrefix] = struct{}{}
+				entries = append(entries, commonPrefix)
+			}
+			continue
+		}
+		entries = append(entries, key)
 	}
+	sort.Strings(entries)
 
-	fn(&s3.ListObjectsOutput{Contents: contents}, true)
-	return nil
+	start := 0
+	if token := aws.StringValue(input.ContinuationToken); token != "" {
+		idx, err := strconv.Atoi(token)
+		if err != nil {
+			return nil, awserr.New("InvalidArgument", fmt.Sprintf("Invalid continuation token %q", token), err)
+		}
+		start = idx
+	}
+	end := len(entries)
+	if mock.pageSize > 0 && start+mock.pageSize < end {
+		end = start + mock.pageSize
+	}
+	if maxKeys := int(aws.Int64Value(input.MaxKeys)); maxKeys > 0 && start+maxKeys < end {
+		end = start + maxKeys
+	}
+
+	output := &s3.ListObjectsV2Output{
+		Contents:    []*s3.Object{},
+		IsTruncated: aws.Bool(end < len(entries)),
+	}
+	for _, entry := range entries[start:end] {
+		if _, ok := commonPrefixes[entry]; ok {
+			output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(entry)})
+			continue
+		}
+		object := objects[entry]
+		output.Contents = append(output.Contents, &s3.Object{
+			ETag:         aws.String(object.etag),
+			Key:          aws.String(entry),
+			LastModified: aws.Time(object.lastMod),
+			Size:         aws.Int64(int64(len(object.data))),
+		})
+	}
+	if end < len(entries) {
+		output.NextContinuationToken = aws.String(strconv.Itoa(end))
+	}
+	return output, nil
+}
+
+func (mock *s3Mock) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(page *s3.ListObjectsV2Output, lastPage bool) bool) error {
+	params := *input
+	for {
+		page, err := mock.ListObjectsV2(&params)
+		if err != nil {
+			return err
+		}
+		lastPage := !aws.BoolValue(page.IsTruncated)
+		if !fn(page, lastPage) || lastPage {
+			return nil
+		}
+		params.ContinuationToken = page.NextContinuationToken
+	}
 }
 
 func (mock *s3Mock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
@@ -202,25 +356,245 @@ func (mock *s3Mock) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, er
 		return nil, err
 	}
 
+	mock.lastGet = input
+
 	object, err := mock.bucket.Get(aws.StringValue(input.Key))
 	if err != nil {
 		return nil, awserr.New("NoSuchObject", err.Error(), err)
 	}
+	data := object.data
+	if input.Range != nil {
+		var offset int
+		if _, err := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-", &offset); err != nil {
+			return nil, awserr.New("InvalidArgument", fmt.Sprintf("Unsupported range %q", aws.StringValue(input.Range)), err)
+		}
+		if offset >= len(data) {
+			return nil, awserr.New("InvalidRange", "The requested range is not satisfiable", nil)
+		}
+		data = data[offset:]
+	}
 	return &s3.GetObjectOutput{
-		Body:          ioutil.NopCloser(bytes.NewReader(object.data)),
-		ContentLength: aws.Int64(int64(len(object.data))),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
 		ETag:          aws.String(object.etag),
 		LastModified:  &object.lastMod,
 	}, nil
 }
 
+func (mock *s3Mock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	return mock.GetObject(input)
+}
+
+func (mock *s3Mock) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	client := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("access", "secret", ""),
+	})))
+	return client.GetObjectRequest(input)
+}
+
 func (mock *s3Mock) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
 	if err := input.Validate(); err != nil {
 		return nil, err
 	}
 
-	err := mock.bucket.Delete(aws.StringValue(input.Key))
-	return &s3.DeleteObjectOutput{}, err
+	mock.lastDelete = input
+	// like s3, deleting a missing object succeeds
+	mock.bucket.Delete(aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (mock *s3Mock) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	if len(input.Delete.Objects) > 1000 {
+		return nil, awserr.New("MalformedXML", "Too many keys", nil)
+	}
+	mock.deleteBatches = append(mock.deleteBatches, len(input.Delete.Objects))
+	if len(mock.deleteBatches) == mock.failDeleteBatch {
+		return nil, awserr.New("InternalError", "Batch failed", nil)
+	}
+
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		if err := mock.bucket.Delete(aws.StringValue(object.Key)); err != nil {
+			output.Errors = append(output.Errors, &s3.Error{
+				Key:     object.Key,
+				Code:    aws.String("NoSuchKey"),
+				Message: aws.String(err.Error()),
+			})
+			continue
+		}
+		output.Deleted = append(output.Deleted, &s3.DeletedObject{Key: object.Key})
+	}
+	return output, nil
+}
+
+func (mock *s3Mock) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	key := aws.StringValue(input.Key)
+	data := []byte{}
+	if input.Body != nil {
+		var err error
+		data, err = ioutil.ReadAll(input.Body)
+		if err != nil {
+			return nil, awserr.New("FailedToReadBody", fmt.Sprintf("Could not read data for key: %s", key), nil)
+		}
+	}
+	mock.bucket.Put(key, objectMock{
+		data,
+		time.Now(),
+		fmt.Sprintf("%x", sha256.Sum256(append([]byte(key), data...))),
+	})
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (mock *s3Mock) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	if mock.uploads == nil {
+		mock.uploads = map[string]map[int64][]byte{}
+	}
+	uploadID := fmt.Sprintf("upload-%d", len(mock.uploads))
+	mock.uploads[uploadID] = map[int64][]byte{}
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (mock *s3Mock) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	parts, ok := mock.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New("NoSuchUpload", "Upload not found", nil)
+	}
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, awserr.New("InvalidArgument", fmt.Sprintf("Invalid copy source %q", aws.StringValue(input.CopySource)), err)
+	}
+	object, err := mock.bucket.Get(strings.TrimPrefix(source, mock.bucket.Name()+"/"))
+	if err != nil {
+		return nil, awserr.New("NoSuchKey", err.Error(), err)
+	}
+	parts[aws.Int64Value(input.PartNumber)] = object.data
+	return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(object.etag)}}, nil
+}
+
+func (mock *s3Mock) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	parts, ok := mock.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New("NoSuchUpload", "Upload not found", nil)
+	}
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, awserr.New("FailedToReadBody", "Could not read part", err)
+	}
+	parts[aws.Int64Value(input.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("%x", sha256.Sum256(data)))}, nil
+}
+
+func (mock *s3Mock) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	parts, ok := mock.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New("NoSuchUpload", "Upload not found", nil)
+	}
+	data := []byte{}
+	for idx, part := range input.MultipartUpload.Parts {
+		partData, ok := parts[aws.Int64Value(part.PartNumber)]
+		if !ok {
+			return nil, awserr.New("InvalidPart", fmt.Sprintf("Part %d not found", aws.Int64Value(part.PartNumber)), nil)
+		}
+		if idx < len(input.MultipartUpload.Parts)-1 && int64(len(partData)) < s3manager.MinUploadPartSize {
+			return nil, awserr.New("EntityTooSmall", fmt.Sprintf("Part %d is too small", aws.Int64Value(part.PartNumber)), nil)
+		}
+		data = append(data, partData...)
+	}
+	delete(mock.uploads, aws.StringValue(input.UploadId))
+	mock.bucket.Put(aws.StringValue(input.Key), objectMock{data, time.Now(), "multipart"})
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (mock *s3Mock) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, options ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	return mock.CreateMultipartUpload(input)
+}
+
+func (mock *s3Mock) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, options ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	return mock.UploadPartCopy(input)
+}
+
+func (mock *s3Mock) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, options ...request.Option) (*s3.UploadPartOutput, error) {
+	return mock.UploadPart(input)
+}
+
+func (mock *s3Mock) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, options ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	return mock.CompleteMultipartUpload(input)
+}
+
+func (mock *s3Mock) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, options ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := mock.bucket.Get(aws.StringValue(input.Key)); err != nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, err.Error(), err)
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: []*s3.Tag{}}, nil
+}
+
+func (mock *s3Mock) GetObjectAcl(input *s3.GetObjectAclInput) (*s3.GetObjectAclOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	if _, err := mock.bucket.Get(aws.StringValue(input.Key)); err != nil {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, err.Error(), err)
+	}
+	return &s3.GetObjectAclOutput{
+		Owner: &s3.Owner{ID: aws.String("owner")},
+		Grants: []*s3.Grant{{
+			Grantee:    &s3.Grantee{Type: aws.String(s3.TypeCanonicalUser), ID: aws.String("owner")},
+			Permission: aws.String(s3.PermissionFullControl),
+		}},
+	}, nil
+}
+
+func (mock *s3Mock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	delete(mock.uploads, aws.StringValue(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (mock *s3Mock) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	mock.lastCopy = input
+
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, awserr.New("InvalidArgument", fmt.Sprintf("Invalid copy source %q", aws.StringValue(input.CopySource)), err)
+	}
+	prefix := mock.bucket.Name() + "/"
+	if !strings.HasPrefix(source, prefix) {
+		return nil, awserr.New("NoSuchBucket", fmt.Sprintf("Copy source %q is not in bucket %q", source, mock.bucket.Name()), nil)
+	}
+	object, err := mock.bucket.Get(strings.TrimPrefix(source, prefix))
+	if err != nil {
+		return nil, awserr.New("NoSuchKey", err.Error(), err)
+	}
+	mock.bucket.Put(aws.StringValue(input.Key), object)
+	return &s3.CopyObjectOutput{}, nil
 }
 
 func TestIfPutFileChecksForNilReader(t *testing.T) {
@@ -255,14 +629,94 @@ func TestIfPutFileChecksForNilReader(t *testing.T) {
 	if err == nil {
 		t.Error("nil valued io.Reader was not handled")
 	}
+	var nilBuffer *bytes.Buffer
+	_, err = d.PutFile("some-key", nilBuffer, false)
+	if err == nil {
+		t.Error("nil pointer io.Reader was not handled")
+	}
+	// readers which are no pointers can not be nil
+	_, err = d.PutFile("some-key", valueReader{strings.NewReader("data")}, false)
+	if err != nil {
+		t.Errorf("PutFile with a non-pointer io.Reader failed: %s", err)
+	}
+}
+
+// valueReader is an io.Reader implemented by a value receiver.
+type valueReader struct {
+	reader io.Reader
+}
+
+func (r valueReader) Read(p []byte) (int, error) {
+	return r.reader.Read(p)
 }
 
 func TestChangeDirectory(t *testing.T) {
-	// I can't test the value of the drivers 'cwd'
-	// because its methods need to be defined on a value receiver,
-	// i.e. that sideffect changes, like setting the cwd on a change-dir call,
-	// are not reflected in the test struct.
-	t.Log("ToDo")
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket: bucketMock,
+	}
+	uploader := s3UploaderMock{bucket: bucketMock}
+	var driver ftp.Driver = &S3Driver{
+		featureFlags: featureChangeDir | featureList | featureMakeDir | featureGet | featurePut | featureMove | featureRemove,
+		s3:           &mock,
+		uploader:     &uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("a/existing", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	// the working directory has to persist between calls through the ftp.Driver interface
+	if err := driver.ChangeDir("/a"); err != nil {
+		t.Fatalf("Changing into %q failed: %s", "/a", err)
+	}
+
+	if _, err := driver.PutFile("file", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	if key := aws.StringValue(uploader.lastInput.Key); key != "a/file" {
+		t.Errorf("Expected upload of key %q but was %q", "a/file", key)
+	}
+	if _, err := driver.Stat("file"); err != nil {
+		t.Errorf("Stat of uploaded file failed: %s", err)
+	}
+	if _, _, err := driver.GetFile("file", 0); err != nil {
+		t.Fatalf("GetFile failed: %s", err)
+	}
+	if key := aws.StringValue(mock.lastGet.Key); key != "a/file" {
+		t.Errorf("Expected download of key %q but was %q", "a/file", key)
+	}
+	if err := driver.ListDir("", func(ftp.FileInfo) error { return nil }); err != nil {
+		t.Fatalf("ListDir failed: %s", err)
+	}
+	if mock.listPrefix != "a/" {
+		t.Errorf("Expected listing of prefix %q but was %q", "a/", mock.listPrefix)
+	}
+	if err := driver.MakeDir("sub"); err != nil {
+		t.Fatalf("MakeDir failed: %s", err)
+	}
+	if _, err := bucketMock.Get("a/sub/"); err != nil {
+		t.Errorf("Directory marker was not created in the working directory: %s", err)
+	}
+	if err := driver.Rename("file", "moved"); err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+	if key := aws.StringValue(mock.lastCopy.Key); key != "a/moved" {
+		t.Errorf("Expected rename to key %q but was %q", "a/moved", key)
+	}
+	if err := driver.DeleteFile("moved"); err != nil {
+		t.Fatalf("DeleteFile failed: %s", err)
+	}
+	if key := aws.StringValue(mock.lastDelete.Key); key != "a/moved" {
+		t.Errorf("Expected deletion of key %q but was %q", "a/moved", key)
+	}
+
+	// absolute paths are not resolved against the working directory
+	if _, err := driver.Stat("/a/existing"); err != nil {
+		t.Errorf("Stat of absolute path failed: %s", err)
+	}
 }
 
 func TestS3Driver(t *testing.T) {
@@ -342,10 +796,2629 @@ func TestS3Driver(t *testing.T) {
 	}
 }
 
-func intoURL(s string) *url.URL {
-	u, err := url.Parse(s)
+func TestListDirPagination(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket:   bucketMock,
+		pageSize: 2,
+	}
+	d := S3Driver{
+		featureFlags: featureList,
+		s3:           &mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	keys := []string{"a", "b", "c", "d"}
+	for _, key := range keys {
+		bucketMock.Put(key, objectMock{[]byte(key), time.Now(), key})
+	}
+
+	listed := []string{}
+	err := d.ListDir("", func(info ftp.FileInfo) error {
+		listed = append(listed, info.Name())
+		return nil
+	})
 	if err != nil {
-		panic(err)
+		t.Fatalf("Object listing failed: %s", err)
+	}
+	if mock.listCalls != 2 {
+		t.Errorf("Expected 2 list requests but were %d", mock.listCalls)
+	}
+	if len(listed) != len(keys) {
+		t.Fatalf("Expected %d objects but listed %d: %v", len(keys), len(listed), listed)
+	}
+	for idx, key := range keys {
+		if listed[idx] != key {
+			t.Errorf("Expected object %q at position %d but was %q", key, idx, listed[idx])
+		}
+	}
+}
+
+func TestListDirWithPrefixes(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featureList,
+		s3:           &s3Mock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	for _, key := range []string{"baz", "foo/a", "foo/bar/b", "foo/bar/c", "foo/bar/deep/d"} {
+		bucketMock.Put(key, objectMock{[]byte(key), time.Now(), key})
+	}
+	// directory markers as created by MakeDir
+	for _, key := range []string{"uploads/", "uploads/file", "empty/"} {
+		bucketMock.Put(key, objectMock{[]byte{}, time.Now(), key})
+	}
+
+	testDataSet := []struct {
+		id      string
+		key     string
+		entries map[string]bool
+	}{
+		{"root", "/", map[string]bool{"baz": false, "foo": true, "uploads": true, "empty": true}},
+		{"empty", "", map[string]bool{"baz": false, "foo": true, "uploads": true, "empty": true}},
+		{"single-level", "/foo", map[string]bool{"a": false, "bar": true}},
+		{"nested", "/foo/bar/", map[string]bool{"b": false, "c": false, "deep": true}},
+		{"marker", "/uploads", map[string]bool{"file": false}},
+		{"marker-only", "/empty/", map[string]bool{}},
+	}
+	for _, testData := range testDataSet {
+		listed := map[string]bool{}
+		err := d.ListDir(testData.key, func(info ftp.FileInfo) error {
+			listed[info.Name()] = info.IsDir()
+			return nil
+		})
+		if err != nil {
+			t.Errorf("Test %s: listing failed: %s", testData.id, err)
+			continue
+		}
+		if len(listed) != len(testData.entries) {
+			t.Errorf("Test %s: expected %v but listed %v", testData.id, testData.entries, listed)
+			continue
+		}
+		for name, isDir := range testData.entries {
+			if listedIsDir, ok := listed[name]; !ok || listedIsDir != isDir {
+				t.Errorf("Test %s: expected %q (directory: %v) in %v", testData.id, name, isDir, listed)
+			}
+		}
+	}
+}
+
+func TestListDirInWorkingDirectory(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featureList | featureChangeDir,
+		s3:           &mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("a/some-key", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	if err := d.ChangeDir("/a"); err != nil {
+		t.Fatalf("Changing directory failed: %s", err)
+	}
+	err := d.ListDir("", func(info ftp.FileInfo) error {
+		if info.Name() != "some-key" {
+			return fmt.Errorf("Unexpected object: %s", info.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Object listing failed: %s", err)
+	}
+	if mock.listPrefix != "a/" {
+		t.Errorf("Expected prefix %q but was %q", "a/", mock.listPrefix)
+	}
+
+	info, err := d.Stat("some-key")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if info.Size() != int64(len("data")) {
+		t.Errorf("Stat returned size %d of wrong object", info.Size())
+	}
+}
+
+func TestStat(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		s3:         &s3Mock{bucket: bucketMock},
+		metrics:    metricsSenderMock{},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("some/object", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	testDataSet := []struct {
+		id    string
+		key   string
+		isDir bool
+		size  int64
+	}{
+		{"object", "/some/object", false, int64(len("data"))},
+		{"missing-prefix", "/some", true, 0},
+		{"root", "/", true, 0},
+	}
+	for _, testData := range testDataSet {
+		info, err := d.Stat(testData.key)
+		if err != nil {
+			t.Errorf("Test %s: stat failed: %s", testData.id, err)
+			continue
+		}
+		if info.IsDir() != testData.isDir {
+			t.Errorf("Test %s: expected directory: %v but was %v", testData.id, testData.isDir, info.IsDir())
+		}
+		if info.Size() != testData.size {
+			t.Errorf("Test %s: expected size %d but was %d", testData.id, testData.size, info.Size())
+		}
+	}
+}
+
+func TestBucketCheckCache(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := &s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featureList,
+		s3:           mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	for i := 0; i < 500; i++ {
+		bucketMock.Put(fmt.Sprintf("dir/object-%d", i), objectMock{[]byte("data"), time.Now(), "etag"})
+	}
+
+	// clients usually stat each listed entry
+	keys := []string{}
+	if err := d.ListDir("/dir", func(info ftp.FileInfo) error {
+		keys = append(keys, "/dir/"+info.Name())
+		return nil
+	}); err != nil {
+		t.Fatalf("Listing failed: %s", err)
+	}
+	for _, key := range keys {
+		if _, err := d.Stat(key); err != nil {
+			t.Fatalf("Stat of %q failed: %s", key, err)
+		}
+	}
+	if len(keys) != 500 {
+		t.Errorf("Expected 500 entries but were %d", len(keys))
+	}
+	if mock.headBucketCalls != 1 {
+		t.Errorf("Expected a single HeadBucket request for %d operations but were %d", len(keys)+1, mock.headBucketCalls)
+	}
+
+	// the check is repeated once the cached result expired
+	d.bucketChecked = time.Now().Add(-bucketCheckTTL)
+	if _, err := d.Stat("/dir/object-0"); err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if mock.headBucketCalls != 2 {
+		t.Errorf("Expected the expired bucket check to be repeated, HeadBucket requests: %d", mock.headBucketCalls)
+	}
+
+	// failed checks are not cached
+	d.bucketChecked = time.Time{}
+	d.bucketName = "missing-bucket"
+	for i := 0; i < 2; i++ {
+		if _, err := d.Stat("/dir/object-0"); err == nil {
+			t.Errorf("Stat of a missing bucket succeeded")
+		}
+	}
+	if mock.headBucketCalls != 4 {
+		t.Errorf("Expected failed bucket checks to be repeated, HeadBucket requests: %d", mock.headBucketCalls)
+	}
+}
+
+func TestFqdnConcurrently(t *testing.T) {
+	bucketURL := intoURL("https://test-bucket.my.s3.host.com")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// drivers of different connections share the bucket URL of the factory
+			d := S3Driver{bucketURL: bucketURL}
+			key := fmt.Sprintf("object-%d", i)
+			for j := 0; j < 100; j++ {
+				if fqdn := d.fqdn(key); fqdn != "https://test-bucket.my.s3.host.com/"+key {
+					t.Errorf("Wrong fqdn of %q: %q", key, fqdn)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if bucketURL.Path != "" {
+		t.Errorf("The bucket URL was modified: %q", bucketURL.String())
+	}
+}
+
+func TestStatSize(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		s3:         &s3Mock{bucket: bucketMock},
+		metrics:    metricsSenderMock{},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("large-object", objectMock{make([]byte, 12345), time.Now(), "etag"})
+
+	// FTP's SIZE command is answered with the size returned by Stat
+	info, err := d.Stat("/large-object")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	objectInfo, ok := info.(S3ObjectInfo)
+	if !ok {
+		t.Fatalf("Expected S3ObjectInfo but was %T", info)
+	}
+	if objectInfo.isPrefix {
+		t.Errorf("Object %q was reported as prefix", objectInfo.Name())
+	}
+	if objectInfo.Size() != 12345 {
+		t.Errorf("Expected size %d but was %d", 12345, objectInfo.Size())
+	}
+}
+
+func TestStrictDelete(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featureRemove,
+		s3:           &mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	// like s3, missing objects are deleted successfully by default
+	if err := d.DeleteFile("/missing"); err != nil {
+		t.Errorf("Deleting a missing object failed without strict deletes: %s", err)
+	}
+
+	d.strictDelete = true
+	mock.lastDelete = nil
+	if err := d.DeleteFile("/missing"); err == nil {
+		t.Error("Deleting a missing object succeeded with strict deletes")
+	}
+	if mock.lastDelete != nil {
+		t.Errorf("Missing object %q was deleted", aws.StringValue(mock.lastDelete.Key))
+	}
+	bucketMock.Put("existing", objectMock{[]byte("data"), time.Now(), "etag"})
+	if err := d.DeleteFile("/existing"); err != nil {
+		t.Errorf("Deleting an existing object failed with strict deletes: %s", err)
+	}
+	if _, err := bucketMock.Get("existing"); err == nil {
+		t.Error("Object was not deleted")
+	}
+}
+
+func TestRename(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featureMove,
+		s3:           &mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		cwd:          "/some dir",
+	}
+	bucketMock.Put("some dir/old+name.txt", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	err := d.Rename("old+name.txt", "new name.txt")
+	if err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+	if source := aws.StringValue(mock.lastCopy.CopySource); source != "test-bucket/some%20dir/old%2Bname.txt" {
+		t.Errorf("Unexpected copy source %q", source)
+	}
+	if key := aws.StringValue(mock.lastCopy.Key); key != "some dir/new name.txt" {
+		t.Errorf("Unexpected copy target %q", key)
+	}
+	if key := aws.StringValue(mock.lastDelete.Key); key != "some dir/old+name.txt" {
+		t.Errorf("Unexpected deleted key %q", key)
+	}
+	if _, err := bucketMock.Get("some dir/new name.txt"); err != nil {
+		t.Errorf("Renamed object is missing: %s", err)
+	}
+	if _, err := bucketMock.Get("some dir/old+name.txt"); err == nil {
+		t.Error("Original object was not deleted")
+	}
+
+	d.featureFlags = 0
+	if err := d.Rename("new name.txt", "other.txt"); err == nil {
+		t.Error("Rename succeeded although MV is not enabled")
+	}
+}
+
+func TestMakeDir(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featureMakeDir | featureList,
+		s3:           &s3Mock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	if err := d.MakeDir("/uploads"); err != nil {
+		t.Fatalf("MakeDir failed: %s", err)
+	}
+	if _, err := bucketMock.Get("uploads/"); err != nil {
+		t.Fatalf("Directory marker was not created: %s", err)
+	}
+
+	listed := map[string]bool{}
+	err := d.ListDir("/", func(info ftp.FileInfo) error {
+		listed[info.Name()] = info.IsDir()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Object listing failed: %s", err)
+	}
+	if isDir, ok := listed["uploads"]; len(listed) != 1 || !ok || !isDir {
+		t.Errorf("Expected directory %q but listed %v", "uploads", listed)
+	}
+
+	if err := d.MakeDir("/"); err == nil {
+		t.Error("Creating the root directory succeeded")
+	}
+	d.featureFlags = featureList
+	if err := d.MakeDir("/other"); err == nil {
+		t.Error("MakeDir succeeded although MKDIR is not enabled")
+	}
+}
+
+func TestDeleteDir(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featureRemoveDir,
+		s3:           &mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	for i := 0; i < 1500; i++ {
+		bucketMock.Put(fmt.Sprintf("staging/%04d", i), objectMock{[]byte("data"), time.Now(), "etag"})
+	}
+	bucketMock.Put("staging-other", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	if err := d.DeleteDir("/staging"); err != nil {
+		t.Fatalf("DeleteDir failed: %s", err)
+	}
+	if len(mock.deleteBatches) != 2 || mock.deleteBatches[0] != 1000 || mock.deleteBatches[1] != 500 {
+		t.Errorf("Unexpected delete batches: %v", mock.deleteBatches)
+	}
+	if objects := bucketMock.List(); len(objects) != 1 {
+		t.Errorf("Expected only %q to remain but found %d objects", "staging-other", len(objects))
+	}
+
+	// abort on a failing batch
+	for i := 0; i < 1500; i++ {
+		bucketMock.Put(fmt.Sprintf("staging/%04d", i), objectMock{[]byte("data"), time.Now(), "etag"})
+	}
+	mock.deleteBatches = nil
+	mock.failDeleteBatch = 2
+	err := d.DeleteDir("/staging")
+	if err == nil {
+		t.Fatal("DeleteDir succeeded although a batch failed")
+	}
+	if !strings.Contains(err.Error(), "1000 of 1500") {
+		t.Errorf("Error does not report the number of deleted objects: %s", err)
+	}
+
+	if err := d.DeleteDir("/"); err == nil {
+		t.Error("Deleting the root directory succeeded")
+	}
+	d.featureFlags = 0
+	if err := d.DeleteDir("/staging"); err == nil {
+		t.Error("DeleteDir succeeded although RMDIR is not enabled")
+	}
+}
+
+func TestChangeDirValidation(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featureChangeDir,
+		s3:           &s3Mock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("photos/2019/image.jpg", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	for _, path := range []string{"/", "/photos", "/photos/2019"} {
+		if err := d.ChangeDir(path); err != nil {
+			t.Errorf("Changing into existing directory %q failed: %s", path, err)
+		}
+		if d.cwd != path {
+			t.Errorf("Expected working directory %q but was %q", path, d.cwd)
+		}
+	}
+	if err := d.ChangeDir("/missing"); err == nil {
+		t.Error("Changing into a missing directory succeeded")
+	}
+	if d.cwd != "/photos/2019" {
+		t.Errorf("Working directory changed by failed call to %q", d.cwd)
+	}
+
+	d.featureFlags = 0
+	if err := d.ChangeDir("/photos"); err == nil {
+		t.Error("Changing directory succeeded although cd is not enabled")
+	}
+	if err := d.ChangeDir("/"); err != nil {
+		t.Errorf("Changing into the root directory failed: %s", err)
+	}
+}
+
+func TestDisabledFeatures(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: 0,
+		s3:           &mock,
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("some/object", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	testDataSet := []struct {
+		op string
+		fn func() error
+	}{
+		{"CD", func() error { return d.ChangeDir("/some") }},
+		{"LS", func() error { return d.ListDir("/", func(ftp.FileInfo) error { return nil }) }},
+		{"RMDIR", func() error { return d.DeleteDir("/some") }},
+		{"RM", func() error { return d.DeleteFile("/some/object") }},
+		{"MV", func() error { return d.Rename("/some/object", "/other/object") }},
+		{"MKDIR", func() error { return d.MakeDir("/other") }},
+		{"GET", func() error {
+			_, _, err := d.GetFile("/some/object", 0)
+			return err
+		}},
+		{"PUT", func() error {
+			_, err := d.PutFile("/new/object", bytes.NewBufferString("data"), false)
+			return err
+		}},
+	}
+	for _, testData := range testDataSet {
+		err := testData.fn()
+		if err == nil {
+			t.Errorf("Test %s: succeeded although the feature is not enabled", testData.op)
+			continue
+		}
+		if err.Error() != notEnabled(testData.op).Error() {
+			t.Errorf("Test %s: expected error %q but was %q", testData.op, notEnabled(testData.op), err)
+		}
+	}
+	if objects := bucketMock.List(); len(objects) != 1 {
+		t.Errorf("Expected the bucket to be unchanged but it contains %d objects", len(objects))
+	}
+	if d.cwd != "" {
+		t.Errorf("Working directory changed to %q", d.cwd)
+	}
+}
+
+type loginUserMock string
+
+func (user loginUserMock) LoginUser() string {
+	return string(user)
+}
+
+func TestUserFeatures(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	users, err := AuthenticatorFromString("reader:secret:ls,get\nadmin:secret")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	d := S3Driver{
+		featureFlags: featurePut,
+		users:        &users,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	d.conn = loginUserMock("reader")
+	if _, err := d.PutFile("some-key", bytes.NewBufferString("data"), false); err == nil {
+		t.Error("PUT succeeded although it is not enabled for the user")
+	}
+	if err := d.ListDir("/", func(ftp.FileInfo) error { return nil }); err != nil {
+		t.Errorf("LS failed although it is enabled for the user: %s", err)
+	}
+
+	d.conn = loginUserMock("admin")
+	if _, err := d.PutFile("some-key", bytes.NewBufferString("data"), false); err != nil {
+		t.Errorf("PUT with the global feature set failed: %s", err)
+	}
+	if err := d.ListDir("/", func(ftp.FileInfo) error { return nil }); err == nil {
+		t.Error("LS succeeded although it is not in the global feature set")
+	}
+}
+
+func TestUserHome(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	users, err := AuthenticatorFromString("alice:secret::alice")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	d := S3Driver{
+		featureFlags: featureChangeDir | featureList | featureGet | featurePut | featureRemove,
+		strictDelete: true,
+		users:        &users,
+		conn:         loginUserMock("alice"),
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("bob/secret", objectMock{[]byte("bob's data"), time.Now(), "etag"})
+
+	for _, key := range []string{"/docs/readme", "../../escaped"} {
+		if _, err := d.PutFile(key, bytes.NewBufferString("data"), false); err != nil {
+			t.Fatalf("PUT of %q failed: %s", key, err)
+		}
+	}
+	objects := bucketMock.List()
+	for _, key := range []string{"alice/docs/readme", "alice/escaped"} {
+		if _, ok := objects[key]; !ok {
+			t.Errorf("Object %q is not located in the home of the user", key)
+		}
+	}
+
+	names := []string{}
+	err = d.ListDir("/", func(info ftp.FileInfo) error {
+		names = append(names, info.Name())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("LS failed: %s", err)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "docs,escaped" {
+		t.Errorf("Expected listing of the home but was %v", names)
+	}
+
+	if err := d.ChangeDir("/docs"); err != nil {
+		t.Fatalf("CD failed: %s", err)
+	}
+	info, err := d.Stat("readme")
+	if err != nil || info.IsDir() {
+		t.Errorf("Stat of an object in the home failed: %v", err)
+	}
+	if _, _, err := d.GetFile("../../bob/secret", 0); err == nil {
+		t.Error("GET of an object outside of the home succeeded")
+	}
+	if err := d.DeleteFile("/../bob/secret"); err == nil {
+		t.Error("RM of an object outside of the home succeeded")
+	}
+	if err := d.DeleteFile("readme"); err != nil {
+		t.Errorf("RM of an object in the home failed: %s", err)
+	}
+	if _, err := bucketMock.Get("bob/secret"); err != nil {
+		t.Errorf("Object outside of the home was modified: %s", err)
+	}
+}
+
+func TestAnonymousUser(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	privateMock := &s3Mock{bucket: bucketMock}
+	publicMock := &s3Mock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags:      featureList | featureGet | featurePut,
+		anonymousFeatures: featureList | featureGet,
+		s3:                privateMock,
+		uploader:          &s3UploaderMock{bucket: bucketMock},
+		anonymousS3:       publicMock,
+		anonymousUploader: &s3UploaderMock{bucket: bucketMock},
+		metrics:           metricsSenderMock{},
+		bucketName:        bucketName,
+		bucketURL:         intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("public", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	d.conn = loginUserMock("anonymous")
+	if _, err := d.PutFile("some-key", bytes.NewBufferString("data"), false); err == nil {
+		t.Error("PUT of an anonymous user succeeded")
+	}
+	if _, _, err := d.GetFile("public", 0); err != nil {
+		t.Errorf("GET of an anonymous user failed: %s", err)
+	}
+	if publicMock.lastGet == nil || privateMock.lastGet != nil {
+		t.Error("The client of anonymous users was not used")
+	}
+
+	d.conn = loginUserMock("foo")
+	if _, err := d.PutFile("some-key", bytes.NewBufferString("data"), false); err != nil {
+		t.Errorf("PUT of an authenticated user failed: %s", err)
+	}
+	if _, _, err := d.GetFile("public", 0); err != nil {
+		t.Errorf("GET of an authenticated user failed: %s", err)
+	}
+	if privateMock.lastGet == nil {
+		t.Error("The client of anonymous users was used for an authenticated user")
+	}
+}
+
+func TestGetFileWithOffset(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featureGet,
+		s3:           &mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("some-key", objectMock{[]byte("0123456789"), time.Now(), "etag"})
+
+	size, reader, err := d.GetFile("some-key", 0)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	reader.Close()
+	if mock.lastGet.Range != nil {
+		t.Errorf("Range %q was set without an offset", aws.StringValue(mock.lastGet.Range))
+	}
+	if size != 10 {
+		t.Errorf("Expected size 10 but was %d", size)
+	}
+
+	size, reader, err = d.GetFile("some-key", 4)
+	if err != nil {
+		t.Fatalf("GET with offset failed: %s", err)
+	}
+	if r := aws.StringValue(mock.lastGet.Range); r != "bytes=4-" {
+		t.Errorf("Unexpected range %q", r)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatalf("Could not read response data: %s", err)
+	}
+	if size != 6 || string(data) != "456789" {
+		t.Errorf("Unexpected remaining content %q of size %d", data, size)
+	}
+
+	if _, _, err := d.GetFile("some-key", 10); err == nil {
+		t.Error("GET with an offset beyond the object size succeeded")
+	}
+}
+
+func TestPresignedURL(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags:     featureGet,
+		s3:               &s3Mock{bucket: bucketMock},
+		metrics:          metricsSenderMock{},
+		bucketName:       bucketName,
+		bucketURL:        intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		presignThreshold: 5,
+		presignTTL:       10 * time.Minute,
+	}
+	bucketMock.Put("small", objectMock{[]byte("012"), time.Now(), "etag"})
+	bucketMock.Put("large", objectMock{[]byte("0123456789"), time.Now(), "etag"})
+
+	testDataSet := []struct {
+		key       string
+		presigned bool
+	}{
+		{"small", false},
+		{"large", true},
+		{"missing", false},
+	}
+	for _, testData := range testDataSet {
+		url, err := d.PresignedURL(testData.key)
+		if (err == nil) != testData.presigned {
+			t.Errorf("Presigning the URL of %q returned %q: %v", testData.key, url, err)
+			continue
+		}
+		if testData.presigned && (!strings.Contains(url, "/large?") || !strings.Contains(url, "X-Amz-Expires=600") || !strings.Contains(url, "X-Amz-Signature=")) {
+			t.Errorf("Unexpected presigned URL %q", url)
+		}
+	}
+
+	// downloads always serve the content
+	_, reader, err := d.GetFile("large", 0)
+	if err != nil {
+		t.Fatalf("GET of a large object failed: %s", err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil || string(data) != "0123456789" {
+		t.Errorf("Expected GET of a large object to return its content but was %q: %v", data, err)
+	}
+
+	d.presignThreshold = 0
+	if url, err := d.PresignedURL("large"); err == nil {
+		t.Errorf("Expected presigned URLs to be disabled but got %q", url)
+	}
+}
+
+func TestDrainTransfers(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featureGet,
+		transfers:    newTransfers(),
+		s3:           &s3Mock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	factory := DriverFactory{transfers: d.transfers}
+	bucketMock.Put("some-key", objectMock{[]byte("0123456789"), time.Now(), "etag"})
+
+	if drained, aborted := factory.Drain(time.Second); drained != 0 || aborted != 0 {
+		t.Errorf("Drained %d and aborted %d transfers without any transfer", drained, aborted)
+	}
+
+	_, first, err := d.GetFile("some-key", 0)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	_, second, err := d.GetFile("some-key", 0)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	if _, _, err := d.GetFile("missing-key", 0); err == nil {
+		t.Fatal("GET of a missing object succeeded")
+	}
+
+	go func() {
+		first.Close()
+		// closing twice must not end the other transfer
+		first.Close()
+	}()
+	go func() {
+		// the aborted transfer finishes after the timeout
+		time.Sleep(100 * time.Millisecond)
+		second.Close()
+	}()
+	if drained, aborted := factory.Drain(50 * time.Millisecond); drained != 1 || aborted != 1 {
+		t.Errorf("Expected 1 drained and 1 aborted transfer but were %d and %d", drained, aborted)
+	}
+	if drained, aborted := factory.Drain(time.Second); drained != 0 || aborted != 0 {
+		t.Errorf("Expected no remaining transfers but drained %d and aborted %d", drained, aborted)
+	}
+}
+
+func TestAbortUploads(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	mock := &s3Mock{bucket: newBucketMock(bucketName)}
+	uploader := &cancelledUploaderMock{s3: mock, started: make(chan struct{})}
+	d := S3Driver{
+		featureFlags: featurePut,
+		transfers:    newTransfers(),
+		s3:           mock,
+		uploader:     uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	factory := DriverFactory{transfers: d.transfers}
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := d.PutFile("/some-key", strings.NewReader("data"), false)
+		errs <- err
+	}()
+	<-uploader.started
+
+	if drained, aborted := factory.Drain(50 * time.Millisecond); drained != 0 || aborted != 1 {
+		t.Errorf("Expected 1 aborted transfer but drained %d and aborted %d", drained, aborted)
+	}
+	if err := <-errs; err == nil {
+		t.Error("Aborted upload succeeded")
+	}
+	if len(mock.uploads) != 0 {
+		t.Errorf("Multipart uploads of aborted uploads were not aborted: %v", mock.uploads)
+	}
+}
+
+// abortedS3Mock reports the multipart uploads which are aborted.
+type abortedS3Mock struct {
+	*s3Mock
+	aborted chan string
+}
+
+func (mock abortedS3Mock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	output, err := mock.s3Mock.AbortMultipartUpload(input)
+	mock.aborted <- aws.StringValue(input.UploadId)
+	return output, err
+}
+
+func TestAbortStalledUploads(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	mock := abortedS3Mock{s3Mock: &s3Mock{bucket: newBucketMock(bucketName)}, aborted: make(chan string, 1)}
+	uploader := &cancelledUploaderMock{s3: mock.s3Mock, started: make(chan struct{})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				featureFlags: featurePut,
+				transfers:    newTransfers(),
+				idleTimeout:  100 * time.Millisecond,
+				s3:           mock,
+				uploader:     uploader,
+				metrics:      metricsSenderMock{},
+				bucketName:   bucketName,
+				bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+			}, nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	conn, replies := dialFTP(t, listener, "alice", "secret")
+	defer conn.Close()
+	fmt.Fprint(conn, "EPSV\r\n")
+	reply := expectReply(t, replies, "229")
+	var port int
+	if _, err := fmt.Sscanf(reply[strings.Index(reply, "(|||"):], "(|||%d|)", &port); err != nil {
+		t.Fatalf("Unexpected reply to EPSV %q: %s", reply, err)
+	}
+	dataConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("Opening the data connection failed: %s", err)
+	}
+	defer dataConn.Close()
+	fmt.Fprint(conn, "STOR some-key\r\n")
+	expectReply(t, replies, "150")
+	<-uploader.started
+
+	// the client sends no data, thus the connection is closed once it was idle and the upload is cancelled
+	if reply, err := replies.ReadString('\n'); err == nil {
+		t.Errorf("Expected the connection of the stalled upload to be closed but got %q", reply)
+	}
+	select {
+	case <-mock.aborted:
+	case <-time.After(time.Second):
+		t.Error("The multipart upload of the stalled upload was not aborted")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featureGet | featureList,
+		transfers:    newTransfers(),
+		idleTimeout:  100 * time.Millisecond,
+		s3:           &s3Mock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("some-key", objectMock{[]byte("0123456789"), time.Now(), "etag"})
+
+	closed := make(chan time.Time, 1)
+	start := time.Now()
+	d.startIdleTimer(func() { closed <- time.Now() })
+
+	// operations keep the connection alive
+	time.Sleep(60 * time.Millisecond)
+	if _, err := d.Stat("some-key"); err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if at := <-closed; at.Sub(start) < 150*time.Millisecond {
+		t.Errorf("Connection was closed after %s despite the operation", at.Sub(start))
+	}
+
+	// transfers pause the timer until they are finished
+	_, reader, err := d.GetFile("some-key", 0)
+	if err != nil {
+		t.Fatalf("GET failed: %s", err)
+	}
+	select {
+	case <-closed:
+		t.Error("Connection was closed during a transfer")
+	case <-time.After(200 * time.Millisecond):
+	}
+	reader.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Connection was not closed after the transfer")
+	}
+}
+
+func TestPutFileAppend(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featurePut | featureAppend,
+		s3:           &mock,
+		uploader: &s3UploaderMock{
+			bucket: bucketMock,
+		},
+		metrics:    metricsSenderMock{},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	small := []byte("some log line\n")
+	large := bytes.Repeat([]byte("x"), int(s3manager.MinUploadPartSize))
+	testDataSet := []struct {
+		id       string
+		existing []byte
+		appended []byte
+	}{
+		{"missing-object", nil, small},
+		{"small-object", small, small},
+		{"large-object", large, small},
+		{"large-object-large-data", large, append(large, small...)},
+	}
+	for _, testData := range testDataSet {
+		key := testData.id
+		if testData.existing != nil {
+			bucketMock.Put(key, objectMock{testData.existing, time.Now(), "etag"})
+		}
+
+		size, err := d.PutFile(key, bytes.NewReader(testData.appended), true)
+		if err != nil {
+			t.Errorf("Test %s: append failed: %s", testData.id, err)
+			continue
+		}
+		expected := append(append([]byte{}, testData.existing...), testData.appended...)
+		if size != int64(len(expected)) {
+			t.Errorf("Test %s: expected size %d but was %d", testData.id, len(expected), size)
+		}
+		object, err := bucketMock.Get(key)
+		if err != nil {
+			t.Errorf("Test %s: %s", testData.id, err)
+			continue
+		}
+		if !bytes.Equal(object.data, expected) {
+			t.Errorf("Test %s: unexpected object contents after append", testData.id)
+		}
+	}
+	if len(mock.uploads) != 0 {
+		t.Errorf("%d multipart uploads were not completed", len(mock.uploads))
+	}
+}
+
+// appendMock reports metadata, a content type and tags of all objects and records the parameters of multipart uploads.
+type appendMock struct {
+	*s3Mock
+	metadata        map[string]*string
+	contentType     string
+	tags            []*s3.Tag
+	lastMultipart   *s3.CreateMultipartUploadInput
+	uploadPartCalls int
+}
+
+func (mock *appendMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	head, err := mock.s3Mock.HeadObject(input)
+	if err != nil {
+		return nil, err
+	}
+	head.Metadata = mock.metadata
+	head.ContentType = aws.String(mock.contentType)
+	return head, nil
+}
+
+func (mock *appendMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	object, err := mock.s3Mock.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	object.TagCount = aws.Int64(int64(len(mock.tags)))
+	return object, nil
+}
+
+func (mock *appendMock) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, options ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	return &s3.GetObjectTaggingOutput{TagSet: mock.tags}, nil
+}
+
+func (mock *appendMock) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, options ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	mock.lastMultipart = input
+	return mock.s3Mock.CreateMultipartUpload(input)
+}
+
+func (mock *appendMock) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, options ...request.Option) (*s3.UploadPartOutput, error) {
+	mock.uploadPartCalls++
+	return mock.s3Mock.UploadPart(input)
+}
+
+func TestPutFileAppendKeepsProperties(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := &appendMock{
+		s3Mock:      &s3Mock{bucket: bucketMock},
+		metadata:    map[string]*string{mtimeMetadataKey: aws.String("981173106"), "Origin": aws.String("ftp")},
+		contentType: "text/x-log",
+		tags:        []*s3.Tag{{Key: aws.String("source"), Value: aws.String("ftp")}, {Key: aws.String("retention"), Value: aws.String("30d")}},
+	}
+	uploader := &s3UploaderMock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featurePut | featureAppend,
+		s3:           mock,
+		uploader:     uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		metadata:     map[string]string{"Origin": "f3", "Host": "some-host"},
+		tags:         "source=f3",
+		partSize:     s3manager.MinUploadPartSize,
+	}
+	expectedMetadata := map[string]string{mtimeMetadataKey: "981173106", "Origin": "ftp", "Host": "some-host"}
+
+	bucketMock.Put("small.log", objectMock{[]byte("some log line\n"), time.Now(), "etag"})
+	if _, err := d.PutFile("small.log", strings.NewReader("another log line\n"), true); err != nil {
+		t.Fatalf("Appending to a small object failed: %s", err)
+	}
+	input := uploader.lastInput
+	if metadata := aws.StringValueMap(input.Metadata); !reflect.DeepEqual(metadata, expectedMetadata) {
+		t.Errorf("Expected metadata %v of the re-uploaded object but was %v", expectedMetadata, metadata)
+	}
+	if aws.StringValue(input.ContentType) != "text/x-log" || aws.StringValue(input.Tagging) != "retention=30d&source=ftp" {
+		t.Errorf("Expected the content type and tags of the existing object but were %q and %q", aws.StringValue(input.ContentType), aws.StringValue(input.Tagging))
+	}
+
+	// the appended data is uploaded in parts of the configured size
+	bucketMock.Put("large.log", objectMock{bytes.Repeat([]byte("x"), int(s3manager.MinUploadPartSize)), time.Now(), "etag"})
+	appended := bytes.Repeat([]byte("y"), int(2*s3manager.MinUploadPartSize+1))
+	if _, err := d.PutFile("large.log", bytes.NewReader(appended), true); err != nil {
+		t.Fatalf("Appending to a large object failed: %s", err)
+	}
+	multipart := mock.lastMultipart
+	if metadata := aws.StringValueMap(multipart.Metadata); !reflect.DeepEqual(metadata, expectedMetadata) {
+		t.Errorf("Expected metadata %v of the multipart upload but was %v", expectedMetadata, metadata)
+	}
+	if aws.StringValue(multipart.ContentType) != "text/x-log" || aws.StringValue(multipart.Tagging) != "retention=30d&source=ftp" {
+		t.Errorf("Expected the content type and tags of the existing object but were %q and %q", aws.StringValue(multipart.ContentType), aws.StringValue(multipart.Tagging))
+	}
+	if mock.uploadPartCalls != 3 {
+		t.Errorf("Expected the appended data to be uploaded in 3 parts but were %d", mock.uploadPartCalls)
+	}
+}
+
+func TestPutFileNoOverwrite(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	uploader := s3UploaderMock{bucket: bucketMock}
+	d := S3Driver{
+		featureFlags: featurePut,
+		noOverwrite:  true,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	if _, err := d.PutFile("/new", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PUT of a new object failed: %s", err)
+	}
+	if _, err := d.PutFile("/new", strings.NewReader("other data"), false); err == nil {
+		t.Error("Existing object was overwritten")
+	}
+
+	// another upload creates the object after its existence was checked
+	uploader.beforeUpload = func() {
+		bucketMock.Put("concurrent", objectMock{[]byte("first"), time.Now(), "etag"})
+	}
+	if _, err := d.PutFile("/concurrent", strings.NewReader("second"), false); err == nil {
+		t.Error("Concurrently created object was overwritten")
+	}
+	if object, err := bucketMock.Get("concurrent"); err != nil || string(object.data) != "first" {
+		t.Errorf("Expected the concurrently uploaded data but was %q (%v)", object.data, err)
+	}
+
+	// parts of multipart uploads do not support conditions
+	for operation, condition := range map[string]string{"PutObject": "*", "CompleteMultipartUpload": "*", "UploadPart": ""} {
+		req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: operation}, nil, nil)
+		ifNoneMatch(req)
+		if header := req.HTTPRequest.Header.Get("If-None-Match"); header != condition {
+			t.Errorf("Expected If-None-Match %q of %s but was %q", condition, operation, header)
+		}
+	}
+
+	// overwriting is not conditional if it is allowed
+	d.noOverwrite = false
+	if _, err := d.PutFile("/concurrent", strings.NewReader("second"), false); err != nil {
+		t.Errorf("Overwriting failed: %s", err)
+	}
+	if object, _ := bucketMock.Get("concurrent"); string(object.data) != "second" {
+		t.Errorf("Expected overwritten data but was %q", object.data)
+	}
+}
+
+func TestPutFileContentType(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	uploader := s3UploaderMock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featurePut,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		contentTypes: map[string]string{".log": "text/plain"},
+	}
+
+	testDataSet := []struct {
+		key         string
+		contentType string
+	}{
+		{"x.json", "application/json"},
+		{"X.JSON", "application/json"},
+		{"some/app.log", "text/plain"},
+		{"unknown.extension-xyz", "application/octet-stream"},
+		{"no-extension", "application/octet-stream"},
+	}
+	for _, testData := range testDataSet {
+		_, err := d.PutFile(testData.key, bytes.NewBufferString("data"), false)
+		if err != nil {
+			t.Errorf("Test %s: PUT failed: %s", testData.key, err)
+			continue
+		}
+		if contentType := aws.StringValue(uploader.lastInput.ContentType); contentType != testData.contentType {
+			t.Errorf("Test %s: expected content type %q but was %q", testData.key, testData.contentType, contentType)
+		}
+	}
+}
+
+func TestPutFileUploadOptions(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	uploader := s3UploaderMock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featurePut,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	if _, err := d.PutFile("default", bytes.NewBufferString("data"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if uploader.lastInput.StorageClass != nil {
+		t.Errorf("Storage class %q was set although none was configured", aws.StringValue(uploader.lastInput.StorageClass))
+	}
+	if uploader.lastInput.ACL != nil {
+		t.Errorf("ACL %q was set although none was configured", aws.StringValue(uploader.lastInput.ACL))
+	}
+	if uploader.lastInput.Metadata != nil {
+		t.Errorf("Metadata %v was set although none was configured", aws.StringValueMap(uploader.lastInput.Metadata))
+	}
+
+	d.storageClass = s3.StorageClassStandardIa
+	if _, err := d.PutFile("infrequent", bytes.NewBufferString("data"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if storageClass := aws.StringValue(uploader.lastInput.StorageClass); storageClass != s3.StorageClassStandardIa {
+		t.Errorf("Expected storage class %q but was %q", s3.StorageClassStandardIa, storageClass)
+	}
+
+	d.sse = s3.ServerSideEncryptionAwsKms
+	d.sseKMSKeyID = "some-key-id"
+	if _, err := d.PutFile("encrypted", bytes.NewBufferString("data"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if sse := aws.StringValue(uploader.lastInput.ServerSideEncryption); sse != s3.ServerSideEncryptionAwsKms {
+		t.Errorf("Expected server-side encryption %q but was %q", s3.ServerSideEncryptionAwsKms, sse)
+	}
+	if keyID := aws.StringValue(uploader.lastInput.SSEKMSKeyId); keyID != "some-key-id" {
+		t.Errorf("Expected KMS key id %q but was %q", "some-key-id", keyID)
+	}
+
+	d.acl = s3.ObjectCannedACLPublicRead
+	if _, err := d.PutFile("public", bytes.NewBufferString("data"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if acl := aws.StringValue(uploader.lastInput.ACL); acl != s3.ObjectCannedACLPublicRead {
+		t.Errorf("Expected ACL %q but was %q", s3.ObjectCannedACLPublicRead, acl)
+	}
+
+	d.metadata = map[string]string{"origin": "ftp"}
+	if _, err := d.PutFile("meta", bytes.NewBufferString("data"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if origin := aws.StringValue(uploader.lastInput.Metadata["origin"]); origin != "ftp" {
+		t.Errorf("Expected metadata origin %q but was %q", "ftp", origin)
+	}
+
+	d.tags = "retention=30d&source=ftp"
+	if _, err := d.PutFile("tagged", bytes.NewBufferString("data"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if tags := aws.StringValue(uploader.lastInput.Tagging); tags != d.tags {
+		t.Errorf("Expected tags %q but were %q", d.tags, tags)
+	}
+	if tags := aws.StringValue(multipartUploadInput(d.uploadInput("tagged", nil)).Tagging); tags != d.tags {
+		t.Errorf("Expected tags %q of multipart uploads but were %q", d.tags, tags)
+	}
+
+	d.objectLock = &objectLock{mode: s3.ObjectLockModeCompliance, retainFor: time.Hour, legalHold: s3.ObjectLockLegalHoldStatusOn}
+	if _, err := d.PutFile("locked", bytes.NewBufferString("data"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if mode := aws.StringValue(uploader.lastInput.ObjectLockMode); mode != s3.ObjectLockModeCompliance {
+		t.Errorf("Expected object lock mode %q but was %q", s3.ObjectLockModeCompliance, mode)
+	}
+	if retainUntil := aws.TimeValue(uploader.lastInput.ObjectLockRetainUntilDate); time.Until(retainUntil) < 59*time.Minute || time.Until(retainUntil) > time.Hour {
+		t.Errorf("Expected objects to be retained for an hour but until %s", retainUntil)
+	}
+	if legalHold := aws.StringValue(uploader.lastInput.ObjectLockLegalHoldStatus); legalHold != s3.ObjectLockLegalHoldStatusOn {
+		t.Errorf("Expected legal hold %q but was %q", s3.ObjectLockLegalHoldStatusOn, legalHold)
+	}
+	if mode := aws.StringValue(multipartUploadInput(d.uploadInput("locked", nil)).ObjectLockMode); mode != s3.ObjectLockModeCompliance {
+		t.Errorf("Expected object lock mode %q of multipart uploads but was %q", s3.ObjectLockModeCompliance, mode)
+	}
+}
+
+func TestParseObjectLock(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tCases := []struct {
+		mode, retainUntil, legalHold string
+		expected                     *objectLock
+		shouldFail                   bool
+	}{
+		{"", "", "", nil, false},
+		{"governance", "720h", "", &objectLock{mode: s3.ObjectLockModeGovernance, retainFor: 720 * time.Hour}, false},
+		{"COMPLIANCE", "2030-12-31T00:00:00Z", "on", &objectLock{mode: s3.ObjectLockModeCompliance, retainUntil: time.Date(2030, 12, 31, 0, 0, 0, 0, time.UTC), legalHold: s3.ObjectLockLegalHoldStatusOn}, false},
+		{"", "", "OFF", &objectLock{legalHold: s3.ObjectLockLegalHoldStatusOff}, false},
+		{"GOVERNANCE", "", "", nil, true},
+		{"", "720h", "", nil, true},
+		{"WORM", "720h", "", nil, true},
+		{"GOVERNANCE", "2019-12-31T00:00:00Z", "", nil, true},
+		{"GOVERNANCE", "-1h", "", nil, true},
+		{"GOVERNANCE", "30 days", "", nil, true},
+		{"", "", "maybe", nil, true},
+	}
+	for _, tCase := range tCases {
+		lock, err := parseObjectLock(tCase.mode, tCase.retainUntil, tCase.legalHold, now)
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Expected %q, %q, %q to fail: %t but error was %v", tCase.mode, tCase.retainUntil, tCase.legalHold, tCase.shouldFail, err)
+			continue
+		}
+		if !reflect.DeepEqual(lock, tCase.expected) {
+			t.Errorf("Expected object lock %+v but was %+v", tCase.expected, lock)
+		}
+	}
+}
+
+// tagsMock returns the tags of a single object.
+type tagsMock struct {
+	s3iface.S3API
+	key  string
+	tags []*s3.Tag
+}
+
+func (mock *tagsMock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (mock *tagsMock) GetObjectTagging(input *s3.GetObjectTaggingInput) (*s3.GetObjectTaggingOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	if aws.StringValue(input.Key) != mock.key {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectTaggingOutput{TagSet: mock.tags}, nil
+}
+
+func TestObjectTags(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	d := &S3Driver{
+		featureFlags: featureGet | featureTags,
+		s3: &tagsMock{key: "dir/file", tags: []*s3.Tag{
+			{Key: aws.String("retention"), Value: aws.String("30d")},
+			{Key: aws.String("source"), Value: aws.String("ftp")},
+		}},
+		metrics:    metricsSenderMock{},
+		bucketName: bucketName,
+		bucketURL:  intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	tags, err := d.ObjectTags("/dir/file")
+	if err != nil {
+		t.Fatalf("Getting the tags failed: %s", err)
+	}
+	if strings.Join(tags, "&") != "retention=30d&source=ftp" {
+		t.Errorf("Expected the tags of %q but were %q", "dir/file", tags)
+	}
+	if _, err := d.ObjectTags("/missing"); err == nil || !strings.Contains(err.Error(), "No such file") {
+		t.Errorf("Expected the tags of a missing object to fail but was %v", err)
+	}
+	d.featureFlags = featureGet
+	if _, err := d.ObjectTags("/dir/file"); err == nil {
+		t.Errorf("Expected tags to be inaccessible without the tags feature")
+	}
+}
+
+func TestPutFileVerifyMD5(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	uploader := s3UploaderMock{
+		bucket: bucketMock,
+	}
+	d := S3Driver{
+		featureFlags: featurePut,
+		verifyMD5:    true,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	if _, err := d.PutFile("some-key", bytes.NewBufferString("hello world"), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	// echo -n "hello world" | openssl md5 -binary | base64
+	expected := "XrY7u+Ae7tCTyyK7j1rNww=="
+	if md5 := aws.StringValue(uploader.lastInput.ContentMD5); md5 != expected {
+		t.Errorf("Expected Content-MD5 %q but was %q", expected, md5)
+	}
+	object, err := bucketMock.Get("some-key")
+	if err != nil {
+		t.Fatalf("Uploaded object is missing: %s", err)
+	}
+	if string(object.data) != "hello world" {
+		t.Errorf("Expected object data %q but was %q", "hello world", object.data)
+	}
+
+	large := bytes.Repeat([]byte("a"), int(s3manager.DefaultUploadPartSize)+1)
+	if _, err := d.PutFile("large-key", bytes.NewReader(large), false); err != nil {
+		t.Fatalf("PUT failed: %s", err)
+	}
+	if uploader.lastInput.ContentMD5 != nil {
+		t.Errorf("Content-MD5 was set for a multipart upload")
+	}
+	object, err = bucketMock.Get("large-key")
+	if err != nil {
+		t.Fatalf("Uploaded object is missing: %s", err)
+	}
+	if !bytes.Equal(object.data, large) {
+		t.Errorf("Data of multipart upload was corrupted")
+	}
+}
+
+func intoURL(s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return u
+}
+
+// unreachableS3Mock fails all requests with a network error.
+type unreachableS3Mock struct {
+	s3iface.S3API
+	err error
+}
+
+func (mock unreachableS3Mock) HeadBucket(*s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return nil, mock.err
+}
+
+func (mock unreachableS3Mock) HeadObject(*s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return nil, mock.err
+}
+
+func (mock unreachableS3Mock) ListObjectsV2(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return nil, mock.err
+}
+
+func (mock unreachableS3Mock) ListObjectsV2Pages(*s3.ListObjectsV2Input, func(*s3.ListObjectsV2Output, bool) bool) error {
+	return mock.err
+}
+
+func (mock unreachableS3Mock) GetObject(*s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return nil, mock.err
+}
+
+func (mock unreachableS3Mock) GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error) {
+	return nil, mock.err
+}
+
+func (mock unreachableS3Mock) PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return nil, mock.err
+}
+
+func (mock unreachableS3Mock) DeleteObject(*s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	return nil, mock.err
+}
+
+func (mock unreachableS3Mock) CopyObject(*s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	return nil, mock.err
+}
+
+func TestNetworkErrors(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	networkErr := &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}
+	d := S3Driver{
+		featureFlags: featureChangeDir | featureList | featureRemove | featureMove | featureMakeDir | featureGet,
+		s3:           unreachableS3Mock{err: networkErr},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	testDataSet := []struct {
+		id string
+		op func() error
+	}{
+		{"bucket-check", func() error { _, err := d.Stat("/some-key"); return err }},
+		{"change-dir", func() error { return d.ChangeDir("/some-dir") }},
+		{"list-dir", func() error { return d.ListDir("/", func(ftp.FileInfo) error { return nil }) }},
+		{"delete-file", func() error { return d.DeleteFile("/some-key") }},
+		{"rename", func() error { return d.Rename("/some-key", "/other-key") }},
+		{"make-dir", func() error { return d.MakeDir("/some-dir") }},
+		{"get-file", func() error { _, _, err := d.GetFile("/some-key", 0); return err }},
+	}
+	for _, testData := range testDataSet {
+		// the bucket check is only failing once, afterwards the operations themselves fail
+		d.bucketChecked = time.Now()
+		if testData.id == "bucket-check" {
+			d.bucketChecked = time.Time{}
+		}
+		err := testData.op()
+		if err == nil {
+			t.Errorf("Test %s: network error was not returned", testData.id)
+			continue
+		}
+		if !strings.Contains(err.Error(), networkErr.Error()) {
+			t.Errorf("Test %s: expected the network error %q but was %q", testData.id, networkErr, err)
+		}
+	}
+
+	// errors of s3 are kept, even when they are wrapped
+	awsErr := awserr.New("NoSuchKey", "The specified key does not exist.", nil)
+	if err := intoAwsError(goErrors.Wrap(awsErr, "Failed to get object")); err != awsErr {
+		t.Errorf("Expected the wrapped s3 error but was %#v", err)
+	}
+	if err := intoAwsError(networkErr); err.Code() != errCodeUnknown || err.OrigErr() != networkErr {
+		t.Errorf("Expected the network error with code %q but was %#v", errCodeUnknown, err)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := s3Mock{
+		bucket: bucketMock,
+	}
+	uploader := s3UploaderMock{bucket: bucketMock}
+	users, err := AuthenticatorFromString("alice:secret::alice")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	var driver ftp.Driver = &S3Driver{
+		featureFlags: featureChangeDir | featureList | featureGet | featurePut | featureMove | featureRemove,
+		s3:           &mock,
+		uploader:     &uploader,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		keyPrefix:    "ftp/uploads",
+		users:        &users,
+		conn:         loginUserMock("alice"),
+	}
+	bucketMock.Put("ftp/uploads/alice/existing", objectMock{[]byte("data"), time.Now(), "etag"})
+	bucketMock.Put("other/application", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	var names []string
+	if err := driver.ListDir("/", func(info ftp.FileInfo) error {
+		names = append(names, info.Name())
+		return nil
+	}); err != nil {
+		t.Fatalf("ListDir failed: %s", err)
+	}
+	if strings.Join(names, ",") != "existing" {
+		t.Errorf("Expected only %q in the root directory but was %v", "existing", names)
+	}
+
+	if err := driver.ChangeDir("/sub/.."); err != nil {
+		t.Fatalf("ChangeDir failed: %s", err)
+	}
+	if _, err := driver.PutFile("../../file", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	if key := aws.StringValue(uploader.lastInput.Key); key != "ftp/uploads/alice/file" {
+		t.Errorf("Expected upload of key %q but was %q", "ftp/uploads/alice/file", key)
+	}
+	if err := driver.Rename("file", "moved"); err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+	if key := aws.StringValue(mock.lastCopy.Key); key != "ftp/uploads/alice/moved" {
+		t.Errorf("Expected rename to key %q but was %q", "ftp/uploads/alice/moved", key)
+	}
+	if _, _, err := driver.GetFile("/../other/application", 0); err == nil {
+		t.Errorf("Expected keys outside of the prefix to be inaccessible")
+	}
+}
+
+// versionsMock serves the versions of objects, the latest version is the last one.
+type versionsMock struct {
+	s3iface.S3API
+	versions map[string][]string
+	lastGet  *s3.GetObjectInput
+}
+
+func (mock *versionsMock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (mock *versionsMock) ListObjectVersionsPages(input *s3.ListObjectVersionsInput, fn func(*s3.ListObjectVersionsOutput, bool) bool) error {
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	var keys []string
+	for key := range mock.versions {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	page := &s3.ListObjectVersionsOutput{}
+	for _, key := range keys {
+		// s3 lists the latest version first
+		versions := mock.versions[key]
+		for i := len(versions) - 1; i >= 0; i-- {
+			page.Versions = append(page.Versions, &s3.ObjectVersion{
+				Key:          aws.String(key),
+				VersionId:    aws.String(fmt.Sprintf("v%d", i)),
+				Size:         aws.Int64(int64(len(versions[i]))),
+				LastModified: aws.Time(time.Unix(int64(i), 0)),
+				IsLatest:     aws.Bool(i == len(versions)-1),
+			})
+		}
+	}
+	fn(page, true)
+	return nil
+}
+
+func (mock *versionsMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	mock.lastGet = input
+	versions := mock.versions[aws.StringValue(input.Key)]
+	if len(versions) == 0 {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	data := versions[len(versions)-1]
+	if input.VersionId != nil {
+		var i int
+		if _, err := fmt.Sscanf(aws.StringValue(input.VersionId), "v%d", &i); err != nil || i >= len(versions) {
+			return nil, awserr.New("NoSuchVersion", "The specified version does not exist.", nil)
+		}
+		data = versions[i]
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(strings.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+	}, nil
+}
+
+func TestVersions(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	mock := &versionsMock{versions: map[string][]string{
+		"dir/file":     {"first", "second", "third"},
+		"dir/file.bak": {"backup"},
+	}}
+	var driver ftp.Driver = &S3Driver{
+		featureFlags: featureList | featureGet | featureVersions,
+		s3:           mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	versions, err := driver.(*S3Driver).ListVersions("/dir/file")
+	if err != nil {
+		t.Fatalf("Listing the versions failed: %s", err)
+	}
+	var ids []string
+	for _, version := range versions {
+		ids = append(ids, version.ID)
+	}
+	if strings.Join(ids, ",") != "v2,v1,v0" || !versions[0].IsLatest || versions[1].IsLatest || versions[2].Size != 5 {
+		t.Errorf("Expected the three versions of %q, latest first, but were %+v", "dir/file", versions)
+	}
+
+	for versionID, expected := range map[string]string{"": "third", "v0": "first", "v1": "second"} {
+		if err := driver.(*S3Driver).SelectVersion(versionID); err != nil {
+			t.Fatalf("Selecting version %q failed: %s", versionID, err)
+		}
+		_, reader, err := driver.GetFile("/dir/file", 0)
+		if err != nil {
+			t.Fatalf("Getting version %q failed: %s", versionID, err)
+		}
+		data, _ := ioutil.ReadAll(reader)
+		reader.Close()
+		if string(data) != expected {
+			t.Errorf("Expected version %q to contain %q but was %q", versionID, expected, data)
+		}
+		if key := aws.StringValue(mock.lastGet.Key); key != "dir/file" {
+			t.Errorf("Expected download of key %q but was %q", "dir/file", key)
+		}
+		// the selection only applies to the next download
+		_, reader, err = driver.GetFile("/dir/file", 0)
+		if err != nil {
+			t.Fatalf("Getting the current version failed: %s", err)
+		}
+		data, _ = ioutil.ReadAll(reader)
+		reader.Close()
+		if string(data) != "third" {
+			t.Errorf("Expected the current version after downloading version %q but was %q", versionID, data)
+		}
+	}
+
+	// a key with a query is an ordinary key
+	if _, _, err := driver.GetFile("/dir/file?versionId=v0", 0); err == nil {
+		t.Errorf("Expected the version query to be part of the key")
+	}
+	if key := aws.StringValue(mock.lastGet.Key); key != "dir/file?versionId=v0" {
+		t.Errorf("Expected download of key %q but was %q", "dir/file?versionId=v0", key)
+	}
+
+	driver.(*S3Driver).featureFlags = featureList | featureGet
+	if _, err := driver.(*S3Driver).ListVersions("/dir/file"); err == nil {
+		t.Errorf("Expected versions to be inaccessible without the versions feature")
+	}
+	if err := driver.(*S3Driver).SelectVersion("v0"); err == nil {
+		t.Errorf("Expected versions to be inaccessible without the versions feature")
+	}
+}
+
+// archiveMock serves a single archived object which becomes available once its restore has been initiated.
+type archiveMock struct {
+	s3iface.S3API
+	restoring bool
+	restored  bool
+	days      int64
+}
+
+func (mock *archiveMock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (mock *archiveMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	output := &s3.HeadObjectOutput{StorageClass: aws.String(s3.StorageClassGlacier)}
+	if mock.restoring {
+		output.Restore = aws.String(`ongoing-request="true"`)
+	}
+	return output, nil
+}
+
+func (mock *archiveMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	if !mock.restored {
+		return nil, awserr.New("InvalidObjectState", "The operation is not valid for the object's storage class", nil)
+	}
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(strings.NewReader("data")), ContentLength: aws.Int64(4)}, nil
+}
+
+func (mock *archiveMock) RestoreObject(input *s3.RestoreObjectInput) (*s3.RestoreObjectOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	if mock.restoring {
+		return nil, awserr.New("RestoreAlreadyInProgress", "Object restore is already in progress", nil)
+	}
+	mock.restoring = true
+	mock.days = aws.Int64Value(input.RestoreRequest.Days)
+	return &s3.RestoreObjectOutput{}, nil
+}
+
+func TestRestore(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	mock := &archiveMock{}
+	driver := &S3Driver{
+		featureFlags: featureGet | featureRestore,
+		s3:           mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	download := func(key string) (string, error) {
+		_, reader, err := driver.GetFile(key, 0)
+		if err != nil {
+			return "", err
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		return string(data), err
+	}
+
+	_, err := download("archived")
+	if !errors.Is(err, ErrArchived) || !strings.Contains(err.Error(), "SITE RESTORE") {
+		t.Errorf("Expected an archived error describing how to restore the object but was %v", err)
+	}
+	if _, err := driver.RestoreObject("archived", 0); err == nil || mock.restoring {
+		t.Errorf("Expected an invalid number of days to fail")
+	}
+
+	state, err := driver.RestoreObject("archived", 7)
+	if err != nil {
+		t.Fatalf("Restoring the object failed: %s", err)
+	}
+	if !strings.Contains(state, "initiated") || mock.days != 7 {
+		t.Errorf("Expected a restore for 7 days to be initiated but was %q for %d days", state, mock.days)
+	}
+	if state, _ := driver.RestoreObject("archived", 7); !strings.Contains(state, "in progress") {
+		t.Errorf("Expected the restore to be in progress but was %q", state)
+	}
+	if _, err := download("archived"); !errors.Is(err, ErrArchived) || !strings.Contains(err.Error(), "restore in progress") {
+		t.Errorf("Expected an archived error reporting the restore in progress but was %v", err)
+	}
+
+	mock.restored = true
+	if data, err := download("archived"); err != nil || data != "data" {
+		t.Errorf("Expected the restored object to be downloadable but was %q, %v", data, err)
+	}
+
+	driver.featureFlags = featureGet
+	if _, err := driver.RestoreObject("archived", 7); err == nil {
+		t.Errorf("Expected restores to fail without the restore feature")
+	}
+}
+
+// encodingMock keeps the content encodings of uploaded objects.
+type encodingMock struct {
+	*s3Mock
+	uploader  *s3UploaderMock
+	encodings map[string]string
+	metadata  map[string]map[string]*string
+}
+
+func (mock *encodingMock) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	output, err := mock.uploader.UploadWithContext(ctx, input, options...)
+	if err == nil {
+		mock.encodings[aws.StringValue(input.Key)] = aws.StringValue(input.ContentEncoding)
+	}
+	return output, err
+}
+
+func (mock *encodingMock) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return mock.UploadWithContext(context.Background(), input, options...)
+}
+
+func (mock *encodingMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	output, err := mock.s3Mock.HeadObject(input)
+	if err == nil && mock.encodings[aws.StringValue(input.Key)] != "" {
+		output.ContentEncoding = aws.String(mock.encodings[aws.StringValue(input.Key)])
+	}
+	if err == nil {
+		output.Metadata = mock.metadata[aws.StringValue(input.Key)]
+	}
+	return output, err
+}
+
+func (mock *encodingMock) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	output, err := mock.s3Mock.CopyObject(input)
+	if err == nil && aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		mock.encodings[aws.StringValue(input.Key)] = aws.StringValue(input.ContentEncoding)
+		mock.metadata[aws.StringValue(input.Key)] = input.Metadata
+	}
+	return output, err
+}
+
+func (mock *encodingMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	// the HTTP client must not decompress the objects itself
+	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil, &request.Operation{Name: "GetObject"}, nil, nil)
+	req.ApplyOptions(options...)
+	if encoding := req.HTTPRequest.Header.Get("Accept-Encoding"); encoding != "identity" {
+		return nil, fmt.Errorf("Expected to accept the identity encoding only but was %q", encoding)
+	}
+	output, err := mock.s3Mock.GetObject(input)
+	if err == nil && mock.encodings[aws.StringValue(input.Key)] != "" {
+		output.ContentEncoding = aws.String(mock.encodings[aws.StringValue(input.Key)])
+	}
+	if err == nil {
+		output.Metadata = mock.metadata[aws.StringValue(input.Key)]
+	}
+	return output, err
+}
+
+func TestCompression(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := &encodingMock{
+		s3Mock:    &s3Mock{bucket: bucketMock},
+		uploader:  &s3UploaderMock{bucket: bucketMock},
+		encodings: map[string]string{},
+		metadata:  map[string]map[string]*string{},
+	}
+	d := &S3Driver{
+		featureFlags:       featureList | featureGet | featurePut | featureAppend,
+		s3:                 mock,
+		uploader:           mock,
+		metrics:            metricsSenderMock{},
+		bucketName:         bucketName,
+		bucketURL:          intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		compress:           true,
+		compressExtensions: map[string]bool{".txt": true},
+	}
+	download := func(key string, offset int64) string {
+		size, reader, err := d.GetFile(key, offset)
+		if err != nil {
+			t.Fatalf("GetFile of %q failed: %s", key, err)
+		}
+		if info, err := d.Stat(key); err != nil || info.Size()-offset != size {
+			t.Errorf("Expected the size %d of %q from offset %d but was %d: %v", info.Size()-offset, key, offset, size, err)
+		}
+		defer reader.Close()
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("Reading %q failed: %s", key, err)
+		}
+		return string(data)
+	}
+
+	text := strings.Repeat("some compressible text\n", 1000)
+	if size, err := d.PutFile("file.txt", strings.NewReader(text), false); err != nil || size != int64(len(text)) {
+		t.Fatalf("Expected the upload of %d bytes but was %d: %v", len(text), size, err)
+	}
+	object, err := bucketMock.Get("file.txt")
+	if err != nil {
+		t.Fatalf("Compressed object was not uploaded: %s", err)
+	}
+	if mock.encodings["file.txt"] != gzipEncoding || len(object.data) >= len(text) {
+		t.Errorf("Expected a gzip encoded object smaller than %d bytes but was %q with %d bytes", len(text), mock.encodings["file.txt"], len(object.data))
+	}
+	if data := download("file.txt", 0); data != text {
+		t.Errorf("Expected the decompressed text but was %d bytes", len(data))
+	}
+	// the size of the decompressed data is reported
+	if info, err := d.Stat("file.txt"); err != nil || info.Size() != int64(len(text)) {
+		t.Errorf("Expected the size %d but was %v: %v", len(text), info, err)
+	}
+	err = d.ListDir("/", func(info ftp.FileInfo) error {
+		if info.Name() == "file.txt" && info.Size() != int64(len(text)) {
+			t.Errorf("Expected the size %d in listings but was %d", len(text), info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ListDir failed: %s", err)
+	}
+	// the offset applies to the decompressed data
+	if data := download("file.txt", 23); data != text[23:] {
+		t.Errorf("Expected the decompressed text from offset 23 but was %q", data[:23])
+	}
+	if _, err := d.PutFile("file.txt", strings.NewReader("more"), true); !errors.Is(err, ErrAppendUnsupported) {
+		t.Errorf("Expected appending to a compressed object to fail but was %v", err)
+	}
+
+	// files with other extensions are stored as is
+	if _, err := d.PutFile("image.png", strings.NewReader("png"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	if object, _ := bucketMock.Get("image.png"); string(object.data) != "png" || mock.encodings["image.png"] != "" {
+		t.Errorf("Expected an uncompressed object but was %q encoded with %q", object.data, mock.encodings["image.png"])
+	}
+	if data := download("image.png", 1); data != "ng" {
+		t.Errorf("Expected %q but was %q", "ng", data)
+	}
+
+	// objects compressed before compression was disabled are still decompressed
+	d.compress = false
+	if data := download("file.txt", 23); data != text[23:] {
+		t.Errorf("Expected the decompressed text from offset 23 but was %q", data[:23])
+	}
+}
+
+func TestMaxUploadSize(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := &S3Driver{
+		featureFlags:  featurePut,
+		s3:            &s3Mock{bucket: bucketMock},
+		uploader:      &s3UploaderMock{bucket: bucketMock},
+		metrics:       metricsSenderMock{},
+		bucketName:    bucketName,
+		bucketURL:     intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		maxUploadSize: 10,
+	}
+
+	if size, err := d.PutFile("exact", strings.NewReader("0123456789"), false); err != nil || size != 10 {
+		t.Errorf("Expected an upload of exactly the maximum size to succeed but was %d bytes, %v", size, err)
+	}
+	_, err := d.PutFile("larger", strings.NewReader("0123456789a"), false)
+	if !errors.Is(err, ErrUploadTooLarge) {
+		t.Errorf("Expected an upload larger than the maximum size to fail but was %v", err)
+	}
+	if _, err := bucketMock.Get("larger"); err == nil {
+		t.Errorf("Expected the upload larger than the maximum size not to be stored")
+	}
+}
+
+// metadataMock stores objects with their user-defined metadata and content type.
+type metadataMock struct {
+	s3iface.S3API
+	objects map[string]*s3.HeadObjectOutput
+	heads   int
+	// grants are the grants of the access control lists of all objects besides the one of their owner
+	grants   []*s3.Grant
+	lastCopy *s3.CopyObjectInput
+}
+
+func (mock *metadataMock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (mock *metadataMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	mock.heads++
+	object, ok := mock.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return object, nil
+}
+
+func (mock *metadataMock) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	source := strings.SplitN(aws.StringValue(input.CopySource), "/", 2)[1]
+	object, ok := mock.objects[source]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	mock.lastCopy = input
+	copied := *object
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		copied.Metadata = input.Metadata
+		copied.ContentType = input.ContentType
+	}
+	mock.objects[aws.StringValue(input.Key)] = &copied
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (mock *metadataMock) GetObjectAcl(input *s3.GetObjectAclInput) (*s3.GetObjectAclOutput, error) {
+	if _, ok := mock.objects[aws.StringValue(input.Key)]; !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	owner := &s3.Grant{
+		Grantee:    &s3.Grantee{Type: aws.String(s3.TypeCanonicalUser), ID: aws.String("owner")},
+		Permission: aws.String(s3.PermissionFullControl),
+	}
+	return &s3.GetObjectAclOutput{Owner: &s3.Owner{ID: aws.String("owner")}, Grants: append([]*s3.Grant{owner}, mock.grants...)}, nil
+}
+
+func (mock *metadataMock) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	page := &s3.ListObjectsV2Output{}
+	for key, object := range mock.objects {
+		page.Contents = append(page.Contents, &s3.Object{Key: aws.String(key), Size: object.ContentLength, LastModified: object.LastModified})
+	}
+	fn(page, true)
+	return nil
+}
+
+func TestModTime(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	lastModified := time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC)
+	mock := &metadataMock{objects: map[string]*s3.HeadObjectOutput{
+		"file": {
+			ContentLength: aws.Int64(4),
+			ContentType:   aws.String("text/plain"),
+			LastModified:  aws.Time(lastModified),
+			Metadata:      map[string]*string{"Origin": aws.String("ftp")},
+		},
+	}}
+	d := &S3Driver{
+		featureFlags: featureList | featurePut,
+		s3:           mock,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+
+	info, err := d.Stat("file")
+	if err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	if !info.ModTime().Equal(lastModified) {
+		t.Errorf("Expected the last modification of s3 %s without mtime metadata but was %s", lastModified, info.ModTime())
+	}
+
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 700000000, time.UTC)
+	if err := d.SetModTime("file", mtime); err != nil {
+		t.Fatalf("SetModTime failed: %s", err)
+	}
+	object := mock.objects["file"]
+	if aws.StringValue(object.Metadata["Origin"]) != "ftp" || aws.StringValue(object.ContentType) != "text/plain" {
+		t.Errorf("Expected the metadata and content type to be kept but were %v and %q", object.Metadata, aws.StringValue(object.ContentType))
+	}
+	if info, err := d.Stat("file"); err != nil || !info.ModTime().Equal(mtime) {
+		t.Errorf("Expected the modification time %s but was %v, %v", mtime, info, err)
+	}
+
+	if copied := mock.lastCopy; copied.GrantRead != nil || copied.GrantFullControl != nil || copied.ObjectLockMode != nil {
+		t.Errorf("Expected no grants and object lock of a private object but were %v", copied)
+	}
+
+	// the copy keeps the access control list and the object lock of the object
+	retainUntil := time.Now().Add(time.Hour)
+	mock.objects["file"].ObjectLockMode = aws.String(s3.ObjectLockModeGovernance)
+	mock.objects["file"].ObjectLockRetainUntilDate = aws.Time(retainUntil)
+	mock.objects["file"].ObjectLockLegalHoldStatus = aws.String(s3.ObjectLockLegalHoldStatusOn)
+	mock.grants = []*s3.Grant{{
+		Grantee:    &s3.Grantee{Type: aws.String(s3.TypeGroup), URI: aws.String("http://acs.amazonaws.com/groups/global/AllUsers")},
+		Permission: aws.String(s3.PermissionRead),
+	}}
+	if err := d.SetModTime("file", mtime); err != nil {
+		t.Fatalf("SetModTime failed: %s", err)
+	}
+	copied := mock.lastCopy
+	if aws.StringValue(copied.GrantRead) != `uri="http://acs.amazonaws.com/groups/global/AllUsers"` || aws.StringValue(copied.GrantFullControl) != `id="owner"` {
+		t.Errorf("Expected the grants of the object but were %q and %q", aws.StringValue(copied.GrantRead), aws.StringValue(copied.GrantFullControl))
+	}
+	if aws.StringValue(copied.ObjectLockMode) != s3.ObjectLockModeGovernance || !aws.TimeValue(copied.ObjectLockRetainUntilDate).Equal(retainUntil) || aws.StringValue(copied.ObjectLockLegalHoldStatus) != s3.ObjectLockLegalHoldStatusOn {
+		t.Errorf("Expected the object lock of the object but was %q until %v with legal hold %q", aws.StringValue(copied.ObjectLockMode), copied.ObjectLockRetainUntilDate, aws.StringValue(copied.ObjectLockLegalHoldStatus))
+	}
+	d.acl = s3.ObjectCannedACLBucketOwnerFullControl
+	if err := d.SetModTime("file", mtime); err != nil {
+		t.Fatalf("SetModTime failed: %s", err)
+	}
+	if copied := mock.lastCopy; aws.StringValue(copied.ACL) != d.acl || copied.GrantRead != nil {
+		t.Errorf("Expected the configured ACL %q instead of the grants of the object but were %q and %q", d.acl, aws.StringValue(copied.ACL), aws.StringValue(copied.GrantRead))
+	}
+
+	// listings only report the mtime metadata if enabled because it costs a HEAD request per object
+	for _, listModTimes := range []bool{false, true} {
+		d.listModTimes = listModTimes
+		expected := lastModified
+		if listModTimes {
+			expected = mtime
+		}
+		err := d.ListDir("/", func(info ftp.FileInfo) error {
+			if !info.ModTime().Equal(expected) {
+				t.Errorf("Expected the modification time %s in listings but was %s", expected, info.ModTime())
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("ListDir failed: %s", err)
+		}
+	}
+
+	for value, expected := range map[string]time.Time{
+		"1577836799":           time.Unix(1577836799, 0),
+		"1577836799.5":         time.Unix(1577836799, 500000000),
+		"1577836799.123456789": time.Unix(1577836799, 123456789),
+		"yesterday":            lastModified,
+		"1577836799.-5":        lastModified,
+	} {
+		if actual := modTime(map[string]*string{mtimeMetadataKey: aws.String(value)}, lastModified); !actual.Equal(expected) {
+			t.Errorf("Expected mtime %q to be %s but was %s", value, expected, actual)
+		}
+	}
+}
+
+// bucketsMock routes requests to the mock of the requested bucket.
+type bucketsMock struct {
+	s3iface.S3API
+	buckets map[string]*s3Mock
+}
+
+func (mock *bucketsMock) bucket(name *string) (*s3Mock, error) {
+	if bucket, ok := mock.buckets[aws.StringValue(name)]; ok {
+		return bucket, nil
+	}
+	return nil, awserr.New("NoSuchBucket", fmt.Sprintf("Bucket %q not found", aws.StringValue(name)), nil)
+}
+
+func (mock *bucketsMock) HeadBucket(input *s3.HeadBucketInput) (*s3.HeadBucketOutput, error) {
+	bucket, err := mock.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.HeadBucket(input)
+}
+
+func (mock *bucketsMock) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	bucket, err := mock.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.HeadObject(input)
+}
+
+func (mock *bucketsMock) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	bucket, err := mock.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.GetObject(input)
+}
+
+func (mock *bucketsMock) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	bucket, err := mock.bucket(input.Bucket)
+	if err != nil {
+		return err
+	}
+	return bucket.ListObjectsV2Pages(input, fn)
+}
+
+func (mock *bucketsMock) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	bucket, err := mock.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.CopyObject(input)
+}
+
+func (mock *bucketsMock) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	bucket, err := mock.bucket(input.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	return bucket.DeleteObject(input)
+}
+
+func TestReadWriteBuckets(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	mainBucket, readBucket, writeBucket := newBucketMock("main"), newBucketMock("read"), newBucketMock("write")
+	mock := &bucketsMock{buckets: map[string]*s3Mock{
+		"main":  {bucket: mainBucket},
+		"read":  {bucket: readBucket},
+		"write": {bucket: writeBucket},
+	}}
+	var driver ftp.Driver = &S3Driver{
+		featureFlags:    featureList | featureGet | featurePut | featureMove | featureRemove,
+		s3:              mock,
+		uploader:        &s3UploaderMock{bucket: writeBucket},
+		metrics:         metricsSenderMock{},
+		bucketName:      "main",
+		readBucketName:  "read",
+		writeBucketName: "write",
+		bucketURL:       intoURL("https://main.my.s3.host.com"),
+		noOverwrite:     true,
+	}
+	mainBucket.Put("main", objectMock{[]byte("main"), time.Now(), "etag"})
+	readBucket.Put("file", objectMock{[]byte("read"), time.Now(), "etag"})
+
+	if _, err := driver.PutFile("/file", strings.NewReader("write"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	if object, err := writeBucket.Get("file"); err != nil || string(object.data) != "write" {
+		t.Errorf("Expected the upload in the write bucket but was %q: %v", object.data, err)
+	}
+	if _, err := mainBucket.Get("file"); err == nil {
+		t.Errorf("Expected no upload in the main bucket")
+	}
+
+	_, reader, err := driver.GetFile("/file", 0)
+	if err != nil {
+		t.Fatalf("GetFile failed: %s", err)
+	}
+	defer reader.Close()
+	if data, _ := ioutil.ReadAll(reader); string(data) != "read" {
+		t.Errorf("Expected the object of the read bucket but was %q", data)
+	}
+
+	var names []string
+	if err := driver.ListDir("/", func(info ftp.FileInfo) error {
+		names = append(names, info.Name())
+		return nil
+	}); err != nil {
+		t.Fatalf("ListDir failed: %s", err)
+	}
+	if strings.Join(names, ",") != "file" {
+		t.Errorf("Expected the listing of the read bucket but was %v", names)
+	}
+	if info, err := driver.Stat("/main"); err == nil && !info.IsDir() {
+		t.Errorf("Expected no information about objects of the main bucket but was %v", info)
+	}
+
+	if err := driver.Rename("/file", "/renamed"); err != nil {
+		t.Fatalf("Rename failed: %s", err)
+	}
+	if object, err := writeBucket.Get("renamed"); err != nil || string(object.data) != "write" {
+		t.Errorf("Expected the object to be renamed in the write bucket but was %q: %v", object.data, err)
+	}
+	if err := driver.DeleteFile("/renamed"); err != nil {
+		t.Fatalf("DeleteFile failed: %s", err)
+	}
+	if len(writeBucket.List()) != 0 || len(readBucket.List()) != 1 || len(mainBucket.List()) != 1 {
+		t.Errorf("Expected the object to be deleted in the write bucket only but were %v, %v and %v", writeBucket.List(), readBucket.List(), mainBucket.List())
+	}
+}
+
+func TestMatchContentType(t *testing.T) {
+	patterns, err := parseContentTypePatterns([]string{"Image/*", " application/pdf", ""})
+	if err != nil {
+		t.Fatalf("Parsing patterns failed: %s", err)
+	}
+	tCases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"image/png", true},
+		{"IMAGE/JPEG", true},
+		{"application/pdf", true},
+		{"application/pdf; charset=binary", true},
+		{"application/pdfx", false},
+		{"application/octet-stream", false},
+		{"imagex/png", false},
+		{"invalid", false},
+	}
+	for _, tCase := range tCases {
+		if actual := matchContentType(patterns, tCase.contentType); actual != tCase.expected {
+			t.Errorf("Expected %q to match %v but was %v", tCase.contentType, tCase.expected, actual)
+		}
+	}
+	if !matchContentType([]string{"*/*"}, "application/x-executable") {
+		t.Errorf("Expected */* to match all types")
+	}
+	for _, invalid := range []string{"image", "image/", "*/png", "a/b/c"} {
+		if _, err := parseContentTypePatterns([]string{invalid}); err == nil {
+			t.Errorf("Expected pattern %q to be invalid", invalid)
+		}
+	}
+}
+
+func TestAllowContentTypes(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	driver := &S3Driver{
+		featureFlags:      featurePut,
+		s3:                &s3Mock{bucket: bucketMock},
+		uploader:          &s3UploaderMock{bucket: bucketMock},
+		metrics:           metricsSenderMock{},
+		bucketName:        bucketName,
+		bucketURL:         intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		allowContentTypes: []string{"image/*", "application/pdf"},
+	}
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 600)
+	tCases := []struct {
+		key        string
+		data       string
+		shouldFail bool
+	}{
+		{"image.png", png, false},
+		{"document.pdf", "%PDF-1.4\n", false},
+		{"program.exe", "MZ\x90\x00", true},
+		{"disguised.png", "\x7fELF\x02\x01\x01", true},
+		{"script.png", "#!/bin/sh\nrm -rf /\n", true},
+		{"image", png, true},
+	}
+	for _, tCase := range tCases {
+		t.Run(tCase.key, func(t *testing.T) {
+			size, err := driver.PutFile(tCase.key, strings.NewReader(tCase.data), false)
+			if tCase.shouldFail {
+				if !errors.Is(err, ErrContentTypeForbidden) {
+					t.Fatalf("Expected the upload to be forbidden but was: %v", err)
+				}
+				if _, err := bucketMock.Get(tCase.key); err == nil {
+					t.Errorf("Expected %q not to be uploaded", tCase.key)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Upload failed: %s", err)
+			}
+			// the bytes read to detect the type are uploaded as well
+			if object, _ := bucketMock.Get(tCase.key); size != int64(len(tCase.data)) || string(object.data) != tCase.data {
+				t.Errorf("Expected all %d bytes to be uploaded but were %d", len(tCase.data), len(object.data))
+			}
+		})
+	}
+}
+
+// multipartUploadsMock lists multipart uploads in pages of two uploads.
+type multipartUploadsMock struct {
+	s3iface.S3API
+	uploads []*s3.MultipartUpload
+	aborted []string
+	prefix  string
+}
+
+func (mock *multipartUploadsMock) ListMultipartUploadsPages(input *s3.ListMultipartUploadsInput, fn func(*s3.ListMultipartUploadsOutput, bool) bool) error {
+	if err := input.Validate(); err != nil {
+		return err
+	}
+	mock.prefix = aws.StringValue(input.Prefix)
+	for start := 0; start < len(mock.uploads); start += 2 {
+		end := start + 2
+		if end > len(mock.uploads) {
+			end = len(mock.uploads)
+		}
+		if !fn(&s3.ListMultipartUploadsOutput{Uploads: mock.uploads[start:end]}, end == len(mock.uploads)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (mock *multipartUploadsMock) AbortMultipartUpload(input *s3.AbortMultipartUploadInput) (*s3.AbortMultipartUploadOutput, error) {
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+	uploadID := aws.StringValue(input.UploadId)
+	if uploadID == "completed" {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist", nil)
+	}
+	mock.aborted = append(mock.aborted, uploadID)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func TestAbortMultipartUploads(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	now := time.Now()
+	upload := func(id string, age time.Duration) *s3.MultipartUpload {
+		return &s3.MultipartUpload{Key: aws.String("key-" + id), UploadId: aws.String(id), Initiated: aws.Time(now.Add(-age))}
+	}
+	mock := &multipartUploadsMock{uploads: []*s3.MultipartUpload{
+		upload("old", 48*time.Hour),
+		upload("recent", time.Hour),
+		upload("completed", 48*time.Hour),
+		upload("older", 72*time.Hour),
+		upload("active", time.Minute),
+	}}
+
+	aborted, err := abortMultipartUploads(mock, "test-bucket", "", now.Add(-24*time.Hour), logrus.StandardLogger())
+	if err != nil {
+		t.Fatalf("Aborting multipart uploads failed: %s", err)
+	}
+	// uploads which were completed in the meantime are skipped
+	if aborted != 2 {
+		t.Errorf("Expected 2 aborted uploads but were %d", aborted)
+	}
+	if strings.Join(mock.aborted, ",") != "old,older" {
+		t.Errorf("Expected uploads old and older to be aborted but were %v", mock.aborted)
+	}
+
+	// only uploads below the key prefix are aborted
+	prefixed := &multipartUploadsMock{}
+	if _, err := abortMultipartUploads(prefixed, "test-bucket", "ftp", now, logrus.StandardLogger()); err != nil {
+		t.Fatalf("Aborting multipart uploads failed: %s", err)
+	}
+	if prefixed.prefix != "ftp/" {
+		t.Errorf("Expected uploads of prefix %q to be listed but was %q", "ftp/", prefixed.prefix)
+	}
+}
+
+func TestFtpReply(t *testing.T) {
+	testDataSet := []struct {
+		id      string
+		err     error
+		code    int
+		message string
+	}{
+		{"access-denied", awserr.New("AccessDenied", "Access Denied", nil), 550, `Permission denied: "some-key": Access Denied`},
+		{"no-such-key", awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil), 550, `No such file or directory: "some-key": The specified key does not exist.`},
+		{"not-found", awserr.NewRequestFailure(awserr.New("NotFound", "Not Found", nil), 404, ""), 550, `No such file or directory: "some-key": Not Found`},
+		{"slow-down", awserr.New("SlowDown", "Please reduce your request rate.", nil), 450, `Service busy, try again later: "some-key": Please reduce your request rate.`},
+		{"unavailable", awserr.New("ServiceUnavailable", "Service is unable to handle request.", nil), 450, `Service busy, try again later: "some-key": Service is unable to handle request.`},
+		{"too-large", awserr.New("EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", nil), 552, `Exceeded storage allocation: "some-key": Your proposed upload exceeds the maximum allowed object size.`},
+		{"cancelled", awserr.New(request.CanceledErrorCode, "request context canceled", nil), 426, `Connection closed, transfer aborted: "some-key": request context canceled`},
+		{"wrapped", goErrors.Wrap(awserr.New("AccessDenied", "Access Denied", nil), "Bucket check failed"), 550, `Permission denied: "some-key": Access Denied`},
+		{"unmapped", awserr.New("InvalidRange", "The requested range is not satisfiable", nil), 0, "InvalidRange: The requested range is not satisfiable"},
+		{"network", fmt.Errorf("connection refused"), 0, "connection refused"},
+	}
+	for _, testData := range testDataSet {
+		err := ftpReply(testData.err, "some-key")
+		if err.Error() != testData.message {
+			t.Errorf("Test %s: expected message %q but was %q", testData.id, testData.message, err.Error())
+		}
+		reply, ok := err.(ftpError)
+		if testData.code == 0 {
+			if ok {
+				t.Errorf("Test %s: unmapped error was turned into reply %d", testData.id, reply.Code())
+			}
+			continue
+		}
+		if !ok || reply.Code() != testData.code || ftp.ReplyCode(fmt.Errorf("wrapped: %w", err), 500) != testData.code {
+			t.Errorf("Test %s: expected reply %d but was %#v", testData.id, testData.code, err)
+			continue
+		}
+		if goErrors.Cause(reply) != goErrors.Cause(testData.err) {
+			t.Errorf("Test %s: original error was not kept", testData.id)
+		}
+	}
+	if ftpReply(nil, "some-key") != nil {
+		t.Error("nil error was turned into a reply")
+	}
+
+	// driver operations reply with the mapped errors
+	d := S3Driver{
+		featureFlags: featureRemove,
+		s3:           unreachableS3Mock{err: awserr.New("AccessDenied", "Access Denied", nil)},
+		metrics:      metricsSenderMock{},
+		bucketName:   "test-bucket",
+		bucketURL:    intoURL("https://test-bucket.my.s3.host.com"),
+	}
+	expected := `Permission denied: "https://test-bucket.my.s3.host.com/some-key": Access Denied`
+	if err := d.DeleteFile("/some-key"); err == nil || err.Error() != expected {
+		t.Errorf("Expected %q but was %v", expected, err)
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := S3Driver{
+		featureFlags: featureChangeDir | featurePut,
+		noOverwrite:  true,
+		strictDelete: true,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("existing", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	testDataSet := []struct {
+		id       string
+		op       func() error
+		sentinel error
+	}{
+		{"not-enabled", func() error { return d.DeleteFile("/existing") }, ErrFeatureNotEnabled},
+		{"append", func() error { _, err := d.PutFile("/existing", strings.NewReader("data"), true); return err }, ErrAppendUnsupported},
+		{"overwrite", func() error { _, err := d.PutFile("/existing", strings.NewReader("data"), false); return err }, ErrOverwriteForbidden},
+		{"missing-dir", func() error { return d.ChangeDir("/missing") }, ErrNotFound},
+		{"missing-object", func() error { d.featureFlags |= featureRemove; return d.DeleteFile("/missing") }, ErrNotFound},
+	}
+	for _, testData := range testDataSet {
+		err := testData.op()
+		if !errors.Is(err, testData.sentinel) {
+			t.Errorf("Test %s: expected %q but was %v", testData.id, testData.sentinel, err)
+		}
+	}
+	if err := notEnabled("RM"); err.Error() != `"RM" is not enabled` {
+		t.Errorf("Unexpected message %q", err)
+	}
+
+	// the errors of s3 are kept by FTP replies
+	awsErr := awserr.New("AccessDenied", "Access Denied", nil)
+	var reply awserr.Error
+	if !errors.As(ftpReply(awsErr, "some-key"), &reply) || reply != awsErr {
+		t.Errorf("The s3 error of the FTP reply was not kept")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(logrus.PanicLevel)
+	hook := logrustest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	d := &S3Driver{
+		featureFlags: featurePut | featureRemove | featureMove | featureMakeDir | featureRemoveDir | featureGet,
+		dryRun:       true,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}
+	bucketMock.Put("existing", objectMock{[]byte("data"), time.Now(), "etag"})
+	bucketMock.Put("dir/file", objectMock{[]byte("data"), time.Now(), "etag"})
+
+	if size, err := d.PutFile("new", strings.NewReader("0123456789"), false); err != nil || size != 10 {
+		t.Errorf("Expected the dry run of PUT to report 10 bytes but was %d bytes, %v", size, err)
+	}
+	if err := d.DeleteFile("existing"); err != nil {
+		t.Errorf("Dry run of DELETE failed: %s", err)
+	}
+	if err := d.Rename("existing", "renamed"); err != nil {
+		t.Errorf("Dry run of MV failed: %s", err)
+	}
+	if err := d.MakeDir("new-dir"); err != nil {
+		t.Errorf("Dry run of MKDIR failed: %s", err)
+	}
+	if err := d.DeleteDir("dir"); err != nil {
+		t.Errorf("Dry run of RMDIR failed: %s", err)
+	}
+	if objects := bucketMock.List(); len(objects) != 2 || objects["existing"].data == nil || objects["dir/file"].data == nil {
+		t.Errorf("Expected the bucket not to be modified but contained %v", objects)
+	}
+	// reads are not affected
+	if size, _, err := d.GetFile("existing", 0); err != nil || size != 4 {
+		t.Errorf("Expected GET to read the object but was %d bytes, %v", size, err)
+	}
+
+	dryRuns := map[string]logrus.Fields{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Data[dryRunField] == true {
+			dryRuns[fmt.Sprint(entry.Data["action"])] = entry.Data
+		}
+	}
+	if len(dryRuns) != 5 {
+		t.Fatalf("Expected the dry runs of 5 operations to be logged but were %v", dryRuns)
+	}
+	if put := dryRuns["PUT"]; put["bytes"] != int64(10) || put["bucket"] != bucketName || put["requests"] != "PutObject" {
+		t.Errorf("Unexpected log fields of PUT: %v", put)
+	}
+	if rmdir := dryRuns["RMDIR"]; rmdir["files"] != 1 || rmdir["requests"] != "DeleteObjects" {
+		t.Errorf("Unexpected log fields of RMDIR: %v", rmdir)
 	}
-	return u
 }
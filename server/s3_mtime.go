@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// mtimeMetadataKey is the user-defined metadata (`x-amz-meta-mtime`) with the modification time set by clients.
+// The value is the time in seconds since the Unix epoch with optional fractional seconds, e.g. `1577836799.5`, like rclone stores it.
+const mtimeMetadataKey = "Mtime"
+
+// formatModTime returns `modTime` formatted as value of the mtime metadata.
+func formatModTime(modTime time.Time) string {
+	return fmt.Sprintf("%d.%09d", modTime.Unix(), modTime.Nanosecond())
+}
+
+// modTime returns the modification time of the mtime metadata in `metadata`, or `lastModified` if it is missing or invalid.
+func modTime(metadata map[string]*string, lastModified time.Time) time.Time {
+	value, ok := metadata[mtimeMetadataKey]
+	if !ok {
+		return lastModified
+	}
+	parts := strings.SplitN(aws.StringValue(value), ".", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return lastModified
+	}
+	nanoseconds := int64(0)
+	if len(parts) == 2 {
+		fraction := (parts[1] + "000000000")[:9]
+		if nanoseconds, err = strconv.ParseInt(fraction, 10, 64); err != nil || nanoseconds < 0 {
+			return lastModified
+		}
+	}
+	return time.Unix(seconds, nanoseconds)
+}
+
+// SetModTime sets the modification time of the object with key `key` reported by Stat and ListDir, see commandMfmt.
+// s3 does not allow modifying objects, thus the object is copied in place with the mtime metadata, which is limited to objects of up to 5GB.
+func (d *S3Driver) SetModTime(key string, mtime time.Time) error {
+	d.keepAlive()
+	if !d.enabled(featurePut) {
+		return notEnabled("MFMT")
+	}
+
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	if d.dryRun {
+		d.logDryRun(logrus.Fields{"time": time.Now(), "bucket": d.writeBucket(), "key": fqdn, "action": "MFMT"}, "CopyObject", "Would set modification time of %q to %s", fqdn, mtime)
+		return nil
+	}
+	if err := d.replaceMetadata(objectKey, mtimeMetadataKey, formatModTime(mtime)); err != nil {
+		return ftpReply(errors.Wrapf(err, "Failed to set modification time of %q", fqdn), fqdn)
+	}
+
+	d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "MFMT"}).Infof("Set modification time of %q to %s", fqdn, mtime)
+	return nil
+}
+
+// modTimeDriver is a driver which sets the modification time of objects, see S3Driver.SetModTime.
+type modTimeDriver interface {
+	SetModTime(key string, mtime time.Time) error
+}
+
+// commandMfmt sets the modification time of a file like `MFMT 20191231235959 some/file`, see draft-somers-ftp-mfxx.
+// The time is in UTC like the one of MDTM, fractional seconds are allowed.
+type commandMfmt struct{}
+
+func (cmd commandMfmt) IsExtend() bool     { return false }
+func (cmd commandMfmt) RequireParam() bool { return true }
+func (cmd commandMfmt) RequireAuth() bool  { return true }
+
+func (cmd commandMfmt) Execute(conn *ftp.Conn, param string) {
+	fields := strings.SplitN(param, " ", 2)
+	if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+		conn.WriteMessage(501, "Syntax: MFMT <YYYYMMDDHHMMSS[.sss]> <path>")
+		return
+	}
+	mtime, err := time.ParseInLocation("20060102150405", fields[0], time.UTC)
+	if err != nil {
+		conn.WriteMessage(501, "Syntax: MFMT <YYYYMMDDHHMMSS[.sss]> <path>")
+		return
+	}
+	driver, ok := conn.Driver().(modTimeDriver)
+	if !ok {
+		conn.WriteMessage(502, "MFMT is not supported")
+		return
+	}
+	path := conn.BuildPath(strings.TrimSpace(fields[1]))
+	if err := driver.SetModTime(path, mtime); err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	conn.WriteMessage(213, fmt.Sprintf("Modify=%s; %s", fields[0], path))
+}
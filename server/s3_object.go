@@ -6,6 +6,7 @@ import (
 )
 
 // S3ObjectInfo metadata about an s3 object.
+// Implements https://godoc.org/github.com/goftp/server#FileInfo
 type S3ObjectInfo struct {
 	name     string
 	size     int64
@@ -14,7 +15,24 @@ type S3ObjectInfo struct {
 	isPrefix bool
 }
 
-// Name returns an s3 objects fully qualified identifier, e.g. `https://my-bucket.s3.amazonaws.com/some/prefix/objectKey`.
+// NewS3ObjectInfo returns the metadata of the object or, if `isPrefix` is true, the common prefix `name`.
+// Prefixes are listed as directories.
+func NewS3ObjectInfo(name string, size int64, modTime time.Time, isPrefix bool) S3ObjectInfo {
+	return S3ObjectInfo{
+		name:     name,
+		size:     size,
+		modTime:  modTime,
+		isPrefix: isPrefix,
+	}
+}
+
+// WithOwner returns a copy of the metadata with the owner name `owner`.
+func (s S3ObjectInfo) WithOwner(owner string) S3ObjectInfo {
+	s.owner = owner
+	return s
+}
+
+// Name returns the name of the object as listed, e.g. `objectKey` in the directory `some/prefix`, or the path given to Stat.
 func (s S3ObjectInfo) Name() string {
 	return s.name
 }
@@ -38,6 +56,11 @@ func (s S3ObjectInfo) IsDir() bool {
 	return s.isPrefix
 }
 
+// IsPrefix returns true if the metadata is of a common prefix of object keys instead of an object.
+func (s S3ObjectInfo) IsPrefix() bool {
+	return s.isPrefix
+}
+
 // ModTime returns the object's date of last modification.
 func (s S3ObjectInfo) ModTime() time.Time {
 	return s.modTime
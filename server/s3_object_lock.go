@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// objectLock are the object lock settings of uploaded objects, e.g. for WORM buckets.
+type objectLock struct {
+	mode string
+	// retainUntil is the fixed date until which objects are retained, retainFor is used instead if it is zero
+	retainUntil time.Time
+	// retainFor is the period objects are retained after their upload
+	retainFor time.Duration
+	legalHold string
+}
+
+// parseObjectLock validates the object lock mode `mode`, either GOVERNANCE or COMPLIANCE, the retention `retainUntil`
+// and the legal hold status `legalHold`, either ON or OFF, of uploaded objects.
+// The retention is either a date like `2030-12-31T00:00:00Z` or a period after the upload like `720h`, a mode requires it and vice versa.
+// It returns nil if no settings are given.
+func parseObjectLock(mode, retainUntil, legalHold string, now time.Time) (*objectLock, error) {
+	if mode == "" && retainUntil == "" && legalHold == "" {
+		return nil, nil
+	}
+	lock := &objectLock{mode: strings.ToUpper(mode), legalHold: strings.ToUpper(legalHold)}
+	switch lock.mode {
+	case "":
+		if retainUntil != "" {
+			return nil, fmt.Errorf("An object lock retention requires an object lock mode")
+		}
+	case s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance:
+		if retainUntil == "" {
+			return nil, fmt.Errorf("Object lock mode %q requires a retention", lock.mode)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown object lock mode %q, must be one of: %s, %s", mode, s3.ObjectLockModeGovernance, s3.ObjectLockModeCompliance)
+	}
+	if retainUntil != "" {
+		if date, err := time.Parse(time.RFC3339, retainUntil); err == nil {
+			if !date.After(now) {
+				return nil, fmt.Errorf("Object lock retention date %s is in the past", retainUntil)
+			}
+			lock.retainUntil = date
+		} else if period, err := time.ParseDuration(retainUntil); err == nil && period > 0 {
+			lock.retainFor = period
+		} else {
+			return nil, fmt.Errorf("Invalid object lock retention %q, must be a date like 2030-12-31T00:00:00Z or a positive period like 720h", retainUntil)
+		}
+	}
+	switch lock.legalHold {
+	case "", s3.ObjectLockLegalHoldStatusOn, s3.ObjectLockLegalHoldStatusOff:
+	default:
+		return nil, fmt.Errorf("Unknown object lock legal hold status %q, must be one of: %s, %s", legalHold, s3.ObjectLockLegalHoldStatusOn, s3.ObjectLockLegalHoldStatusOff)
+	}
+	return lock, nil
+}
+
+// headers returns the mode, retention date and legal hold status of objects uploaded at `now`, nil if they are not set.
+func (l *objectLock) headers(now time.Time) (*string, *time.Time, *string) {
+	if l == nil {
+		return nil, nil, nil
+	}
+	var mode, legalHold *string
+	var retainUntil *time.Time
+	if l.mode != "" {
+		mode = aws.String(l.mode)
+		retainUntil = aws.Time(l.retainUntil)
+		if l.retainUntil.IsZero() {
+			retainUntil = aws.Time(now.Add(l.retainFor).UTC())
+		}
+	}
+	if l.legalHold != "" {
+		legalHold = aws.String(l.legalHold)
+	}
+	return mode, retainUntil, legalHold
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+func TestNewS3ObjectInfo(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	var info ftp.FileInfo = NewS3ObjectInfo("naïve.txt", 42, modTime, false)
+	if info.Name() != "naïve.txt" || info.Size() != 42 || !info.ModTime().Equal(modTime) || info.IsDir() || info.Mode() != 0644 {
+		t.Errorf("Unexpected metadata of an object %+v", info)
+	}
+	if info.Owner() != "Unknown" {
+		t.Errorf("Expected an unknown owner but was %q", info.Owner())
+	}
+	if owner := NewS3ObjectInfo("naïve.txt", 42, modTime, false).WithOwner("alice").Owner(); owner != "alice" {
+		t.Errorf("Expected the owner alice but was %q", owner)
+	}
+
+	prefix := NewS3ObjectInfo("café", 0, modTime, true)
+	if !prefix.IsPrefix() || !prefix.IsDir() || prefix.Mode() != os.ModeDir {
+		t.Errorf("Expected the prefix to be a directory %+v", prefix)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RestoreObject restores the archived object with key `key` for `days` days, see SITE RESTORE.
+// The version selected by SelectVersion is restored, the current version if none is selected.
+// It returns the state of the restore.
+func (d *S3Driver) RestoreObject(key string, days int64) (string, error) {
+	d.keepAlive()
+	versionID := d.takeVersion()
+	if !d.enabled(featureRestore) {
+		return "", notEnabled("RESTORE")
+	}
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	if days <= 0 {
+		return "", fmt.Errorf("Invalid number of days to restore %q for: %d", fqdn, days)
+	}
+
+	input := &s3.RestoreObjectInput{
+		Bucket:         aws.String(d.readBucket()),
+		Key:            aws.String(objectKey),
+		RestoreRequest: &s3.RestoreRequest{Days: aws.Int64(days)},
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	var state string
+	_, err := d.s3Client().RestoreObject(input)
+	switch {
+	case err == nil:
+		state = fmt.Sprintf("Restore of %s for %d days initiated", fqdn, days)
+	case intoAwsError(err).Code() == "RestoreAlreadyInProgress":
+		state = fmt.Sprintf("Restore of %s in progress", fqdn)
+	case intoAwsError(err).Code() == s3.ErrCodeObjectAlreadyInActiveTierError:
+		state = fmt.Sprintf("%s is not archived", fqdn)
+	default:
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "RESTORE", "code": err.Code(), "error": err.Message()}).Errorf("Failed to restore %q", fqdn)
+		return "", ftpReply(errors.Wrapf(err, "Failed to restore %q", fqdn), fqdn)
+	}
+
+	d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "RESTORE"}).Info(state)
+	return state, nil
+}
+
+// archivedError returns an error describing the restore state of the archived object with key `key`.
+func (d *S3Driver) archivedError(key, versionID string) error {
+	fqdn := d.fqdn(key)
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(d.readBucket()),
+		Key:    aws.String(key),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	resp, err := d.s3Client().HeadObject(input)
+	if err == nil && strings.Contains(aws.StringValue(resp.Restore), `ongoing-request="true"`) {
+		return fmt.Errorf("%q %w, restore in progress", fqdn, ErrArchived)
+	}
+	if d.enabled(featureRestore) {
+		return fmt.Errorf("%q %w, restore it with %q", fqdn, ErrArchived, "SITE RESTORE <path> <days>")
+	}
+	return fmt.Errorf("%q %w", fqdn, ErrArchived)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionPolicyData are the values of the placeholders of session policy templates.
+type sessionPolicyData struct {
+	// Bucket is the name of the bucket.
+	Bucket string
+	// Prefix is the key prefix of the objects of the user with trailing slash, empty if the user accesses the whole bucket.
+	Prefix string
+	// User is the name of the user.
+	User string
+}
+
+// invalidSessionNameChars are the characters which are not allowed in role session names.
+var invalidSessionNameChars = regexp.MustCompile(`[^\w+=,.@-]`)
+
+// sessionPolicy assumes a role for each user with a session policy which restricts the credentials to the objects of the user,
+// e.g. to the home prefix, in addition to the restrictions of the driver.
+// The clients of a user are shared by the connections of the user.
+type sessionPolicy struct {
+	template   *template.Template
+	client     stscreds.AssumeRoler
+	roleARN    string
+	externalID string
+	bucketName string
+	keyPrefix  string
+	// newS3API returns the s3 client and uploader which use the credentials `creds`
+	newS3API func(creds *credentials.Credentials) userS3API
+	lock     sync.Mutex
+	apis     map[string]userS3API
+	logger   logrus.FieldLogger
+}
+
+// parseSessionPolicy parses the session policy template `policy`, a JSON IAM policy with the placeholders
+// `{{.Bucket}}`, `{{.Prefix}}` and `{{.User}}`.
+func parseSessionPolicy(policy string) (*template.Template, error) {
+	tmpl, err := template.New("session-policy").Option("missingkey=error").Parse(policy)
+	if err != nil {
+		return nil, err
+	}
+	var expanded bytes.Buffer
+	if err := tmpl.Execute(&expanded, sessionPolicyData{Bucket: "bucket", Prefix: "user/", User: "user"}); err != nil {
+		return nil, err
+	}
+	if !json.Valid(expanded.Bytes()) {
+		return nil, fmt.Errorf("session policy is not a JSON document")
+	}
+	return tmpl, nil
+}
+
+// s3API returns the s3 client and uploader of `user` whose objects are located under the home prefix `home`.
+func (p *sessionPolicy) s3API(user, home string) userS3API {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if api, ok := p.apis[user]; ok {
+		return api
+	}
+	api := p.newS3API(p.credentials(user, home))
+	if p.apis == nil {
+		p.apis = make(map[string]userS3API)
+	}
+	p.apis[user] = api
+	return api
+}
+
+// credentials returns the credentials of the role assumed with the session policy of `user`.
+func (p *sessionPolicy) credentials(user, home string) *credentials.Credentials {
+	prefix := strings.TrimPrefix(path.Join("/", p.keyPrefix, home), "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	var policy bytes.Buffer
+	if err := p.template.Execute(&policy, sessionPolicyData{Bucket: p.bucketName, Prefix: prefix, User: user}); err != nil {
+		// requests fail instead of using credentials without session policy
+		p.logger.WithFields(logrus.Fields{"user": user, "error": err}).Error("Failed to expand session policy")
+		return credentials.NewCredentials(&credentials.ErrorProvider{Err: err, ProviderName: "SessionPolicy"})
+	}
+	sessionName := invalidSessionNameChars.ReplaceAllString("f3-"+user, "-")
+	if len(sessionName) > 64 {
+		sessionName = sessionName[:64]
+	}
+	p.logger.WithFields(logrus.Fields{"user": user, "session": sessionName, "prefix": prefix}).Infof("Assuming role %q with session policy", p.roleARN)
+	return stscreds.NewCredentialsWithClient(p.client, p.roleARN, func(provider *stscreds.AssumeRoleProvider) {
+		provider.RoleSessionName = sessionName
+		provider.Policy = aws.String(policy.String())
+		if p.externalID != "" {
+			provider.ExternalID = aws.String(p.externalID)
+		}
+	})
+}
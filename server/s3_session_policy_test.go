@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/sirupsen/logrus"
+)
+
+const testSessionPolicy = `{
+  "Version": "2012-10-17",
+  "Statement": [{
+    "Effect": "Allow",
+    "Action": "s3:*",
+    "Resource": "arn:aws:s3:::{{.Bucket}}/{{.Prefix}}*"
+  }]
+}`
+
+func TestParseSessionPolicy(t *testing.T) {
+	tCases := []struct {
+		policy     string
+		shouldFail bool
+	}{
+		{testSessionPolicy, false},
+		{`{"Statement": [{"Condition": {"StringLike": {"s3:prefix": "{{.Prefix}}*"}}, "Sid": "{{.User}}"}]}`, false},
+		{`{"Resource": "{{.Bucket}"}`, true},
+		{`{"Resource": "{{.Home}}"}`, true},
+		{`"Resource": "{{.Bucket}}"`, true},
+	}
+	for _, tCase := range tCases {
+		_, err := parseSessionPolicy(tCase.policy)
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Parsing session policy %s: expected failure %v but was %v", tCase.policy, tCase.shouldFail, err)
+		}
+	}
+}
+
+func TestSessionPolicy(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	tmpl, err := parseSessionPolicy(testSessionPolicy)
+	if err != nil {
+		t.Fatalf("Parsing session policy failed: %s", err)
+	}
+	mock := &assumeRolerMock{}
+	created := 0
+	policy := &sessionPolicy{
+		template:   tmpl,
+		client:     mock,
+		roleARN:    "arn:aws:iam::123456789012:role/ftp",
+		bucketName: "some-bucket",
+		keyPrefix:  "ftp",
+		logger:     logrus.StandardLogger(),
+		newS3API: func(creds *credentials.Credentials) userS3API {
+			created++
+			if _, err := creds.Get(); err != nil {
+				t.Errorf("Assuming the role failed: %s", err)
+			}
+			return userS3API{}
+		},
+	}
+	users, err := AuthenticatorFromString("alice:secret::alice\nbob@example.com/x:secret")
+	if err != nil {
+		t.Fatalf("Parsing credentials failed: %s", err)
+	}
+	driver := &S3Driver{users: &users, keyPrefix: "ftp", sessionPolicy: policy}
+
+	tCases := []struct {
+		user        string
+		resource    string
+		sessionName string
+	}{
+		{"alice", "arn:aws:s3:::some-bucket/ftp/alice/*", "f3-alice"},
+		{"bob@example.com/x", "arn:aws:s3:::some-bucket/ftp/*", "f3-bob@example.com-x"},
+	}
+	for _, tCase := range tCases {
+		driver.conn = loginUserMock(tCase.user)
+		if _, ok := driver.userS3API(); !ok {
+			t.Fatalf("Expected the session policy to apply to %s", tCase.user)
+		}
+		if !strings.Contains(aws.StringValue(mock.lastInput.Policy), fmt.Sprintf("%q", tCase.resource)) {
+			t.Errorf("Expected the session policy of %s to permit %s but was %s", tCase.user, tCase.resource, aws.StringValue(mock.lastInput.Policy))
+		}
+		if name := aws.StringValue(mock.lastInput.RoleSessionName); name != tCase.sessionName {
+			t.Errorf("Expected session name %q of %s but was %q", tCase.sessionName, tCase.user, name)
+		}
+	}
+	// the clients are shared by the connections of a user
+	driver.conn = loginUserMock("alice")
+	driver.userS3API()
+	if created != 2 {
+		t.Errorf("Expected clients of 2 users but were %d", created)
+	}
+	driver.conn = loginUserMock("")
+	if _, ok := driver.userS3API(); ok {
+		t.Error("Expected no session policy to apply before the login")
+	}
+}
+
+func TestSessionPolicyDriver(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	policyFile, err := ioutil.TempFile("", "f3-session-policy")
+	if err != nil {
+		t.Fatalf("Failed to create session policy file: %s", err)
+	}
+	defer os.Remove(policyFile.Name())
+	policyFile.WriteString(testSessionPolicy)
+	policyFile.Close()
+
+	factory, err := NewDriverFactory(&FactoryConfig{
+		FtpFeatures:       DefaultFeatureSet,
+		S3Credentials:     "access:secret",
+		S3AssumeRoleARN:   "arn:aws:iam::123456789012:role/some-role",
+		S3SessionPolicy:   policyFile.Name(),
+		S3BucketURL:       "https://some-bucket.somewhere.com",
+		S3KeyPrefix:       "ftp",
+		S3Region:          DefaultRegion,
+		DisableCloudWatch: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver factory: %s", err)
+	}
+	if factory.sessionPolicy.bucketName != "some-bucket" || factory.sessionPolicy.keyPrefix != "ftp" {
+		t.Errorf("Expected the session policy to apply to some-bucket/ftp but was %s/%s", factory.sessionPolicy.bucketName, factory.sessionPolicy.keyPrefix)
+	}
+	driver, err := factory.newDriver()
+	if err != nil {
+		t.Fatalf("Failed to create driver: %s", err)
+	}
+	if driver.s3Client() != driver.s3 {
+		t.Error("Expected the global client to be used before the login")
+	}
+	driver.conn = loginUserMock("alice")
+	if client := driver.s3Client(); client == driver.s3 || client != driver.s3Client() {
+		t.Error("Expected the client of alice to be used after the login")
+	}
+}
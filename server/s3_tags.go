@@ -0,0 +1,42 @@
+package server
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ObjectTags returns the tags of the object with key `key` as `key=value` pairs, see SITE TAGS.
+// The tags of the version selected by SelectVersion are returned, those of the current version if none is selected.
+func (d *S3Driver) ObjectTags(key string) ([]string, error) {
+	d.keepAlive()
+	versionID := d.takeVersion()
+	if !d.enabled(featureTags) {
+		return nil, notEnabled("TAGS")
+	}
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	input := &s3.GetObjectTaggingInput{
+		Bucket: aws.String(d.readBucket()),
+		Key:    aws.String(objectKey),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	resp, err := d.s3Client().GetObjectTagging(input)
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		return nil, ftpReply(errors.Wrapf(err, "Failed to get tags of %q", fqdn), fqdn)
+	}
+
+	tags := []string{}
+	for _, tag := range resp.TagSet {
+		tags = append(tags, aws.StringValue(tag.Key)+"="+aws.StringValue(tag.Value))
+	}
+	d.log().WithFields(logrus.Fields{"time": time.Now(), "key": fqdn, "action": "TAGS"}).Infof("Serving %d tags of object: %s", len(tags), fqdn)
+	return tags, nil
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// commandStou stores the upload of the data connection as a new object in the working directory under a generated name,
+// see RFC 959 section 4.1.3. The name is sent before the upload like RFC 1123 section 4.1.2.9 requires.
+// The name consists of the time of the upload and random bytes, e.g. `20191231T235959Z-0123456789abcdef`,
+// the key prefix and the working directory apply like for STOR.
+type commandStou struct{}
+
+func (cmd commandStou) IsExtend() bool     { return false }
+func (cmd commandStou) RequireParam() bool { return false }
+func (cmd commandStou) RequireAuth() bool  { return true }
+
+func (cmd commandStou) Execute(conn *ftp.Conn, param string) {
+	dataConn := conn.DataConn()
+	if dataConn == nil {
+		conn.WriteMessage(425, "No data connection, send PASV or PORT first")
+		return
+	}
+	name, err := uniqueName(time.Now())
+	if err != nil {
+		conn.WriteMessage(450, err.Error())
+		return
+	}
+	conn.WriteMessage(150, "FILE: "+name)
+	bytes, err := conn.Driver().PutFile(path.Join(conn.BuildPath(""), name), dataConn, false)
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 450), fmt.Sprint("error during transfer: ", err))
+		return
+	}
+	conn.WriteMessage(226, fmt.Sprintf("OK, received %d bytes, stored as %s", bytes, name))
+}
+
+// uniqueName returns a name starting with `now` which is unique due to 64 random bits.
+func uniqueName(now time.Time) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrap(err, "Failed to generate a unique name")
+	}
+	return now.UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(random), nil
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
+)
+
+// userS3API is the s3 client and uploader of a user with own s3 credentials.
+type userS3API struct {
+	client   s3iface.S3API
+	uploader s3manageriface.UploaderAPI
+}
+
+// parseStaticCredentials parses credentials in the format `access_key:secret_key[:session_token]`.
+func parseStaticCredentials(creds string) (*credentials.Credentials, error) {
+	parts := strings.SplitN(creds, ":", 3)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Malformed credentials, not in format: 'access_key:secret_key[:session_token]'")
+	}
+	sessionToken := ""
+	if len(parts) == 3 {
+		sessionToken = parts[2]
+	}
+	return credentials.NewStaticCredentials(parts[0], parts[1], sessionToken), nil
+}
+
+// parseUserCredentials parses the s3 credentials of FTP users from `contents`, which contains one user per line
+// followed by a `:` and either static credentials in the format `access_key:secret_key[:session_token]`
+// or the ARN of a role which is assumed by `assumeRole`, e.g. `alice:arn:aws:iam::123456789012:role/alice`.
+// Empty lines and lines starting with `#` are ignored.
+func parseUserCredentials(contents string, assumeRole func(roleARN string) *credentials.Credentials) (map[string]*credentials.Credentials, error) {
+	userCredentials := make(map[string]*credentials.Credentials)
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Malformed s3 credentials in line %d, not in format: 'user:access_key:secret_key[:session_token]' or 'user:role_arn'", i+1)
+		}
+		user := parts[0]
+		if _, ok := userCredentials[user]; ok {
+			return nil, fmt.Errorf("Duplicate s3 credentials of user %q", user)
+		}
+		if strings.HasPrefix(parts[1], "arn:") {
+			userCredentials[user] = assumeRole(parts[1])
+			continue
+		}
+		creds, err := parseStaticCredentials(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Malformed s3 credentials of user %q, not in format: 'user:access_key:secret_key[:session_token]' or 'user:role_arn'", user)
+		}
+		userCredentials[user] = creds
+	}
+	if len(userCredentials) == 0 {
+		return nil, fmt.Errorf("No s3 credentials of users found")
+	}
+	return userCredentials, nil
+}
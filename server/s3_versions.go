@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ObjectVersion is a version of an object of a versioned bucket.
+type ObjectVersion struct {
+	// ID is the version ID of s3
+	ID           string
+	Size         int64
+	LastModified time.Time
+	// IsLatest is true for the current version of the object
+	IsLatest bool
+}
+
+// ListVersions returns the versions of the object with key `key`, latest first, see SITE VERSIONS.
+// Delete markers are skipped because they can not be downloaded.
+func (d *S3Driver) ListVersions(key string) ([]ObjectVersion, error) {
+	d.keepAlive()
+	if !d.enabled(featureVersions) || !d.enabled(featureList) {
+		return nil, notEnabled("VERSIONS")
+	}
+	objectKey := d.objectKey(key)
+	fqdn := d.fqdn(objectKey)
+	timestamp := time.Now()
+
+	versions := []ObjectVersion{}
+	err := d.s3Client().ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(d.readBucket()),
+		Prefix: aws.String(objectKey),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			// the prefix also matches objects whose keys start with the key, e.g. `file.bak` of `file`
+			if aws.StringValue(version.Key) != objectKey {
+				continue
+			}
+			versions = append(versions, ObjectVersion{
+				ID:           aws.StringValue(version.VersionId),
+				Size:         aws.Int64Value(version.Size),
+				LastModified: aws.TimeValue(version.LastModified),
+				IsLatest:     aws.BoolValue(version.IsLatest),
+			})
+		}
+		// return if we should continue with the next page
+		return !lastPage
+	})
+	if err != nil {
+		err := intoAwsError(err)
+		logAwsError(d.log(), err)
+		d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "VERSIONS", "code": err.Code(), "error": err.Message()}).Errorf("Could not list versions of %q.", fqdn)
+		return nil, ftpReply(errors.Wrapf(err, "Failed to list versions of %q", fqdn), fqdn)
+	}
+
+	d.log().WithFields(logrus.Fields{"time": timestamp, "key": fqdn, "action": "VERSIONS", "files": len(versions)}).Infof("Version listing for %q", key)
+	if err := d.metrics.SendList(len(versions), timestamp); err != nil {
+		d.log().WithFields(logrus.Fields{"action": "VERSIONS", "error": err}).Errorf("Sending LIST metrics failed: %s", err)
+	}
+	return versions, nil
+}
+
+// SelectVersion selects the version `versionID` of the object of the next download, restore or tags, see SITE VERSION.
+// Like the offset of REST, the selection only applies to the next operation, an empty version ID selects the current version.
+func (d *S3Driver) SelectVersion(versionID string) error {
+	d.keepAlive()
+	if !d.enabled(featureVersions) {
+		return notEnabled("VERSIONS")
+	}
+	if strings.ContainsAny(versionID, " \t") {
+		return fmt.Errorf("Invalid version ID %q", versionID)
+	}
+	d.versionID = versionID
+	return nil
+}
+
+// takeVersion returns the selected version ID of the next download, restore or tags and resets it, empty for the current version.
+func (d *S3Driver) takeVersion() string {
+	versionID := d.versionID
+	d.versionID = ""
+	return versionID
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// weekdays are the abbreviations of days in access schedules.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessWindow is a daily period on some days of the week during which a user may log in.
+type accessWindow struct {
+	days [7]bool
+	// start and end are minutes of the day, the window ends on the next day if end is not after start
+	start    int
+	end      int
+	location *time.Location
+}
+
+// accessSchedule are the windows during which a user may log in, any time if empty.
+type accessSchedule []accessWindow
+
+// parseAccessSchedule parses windows separated by `;` like `Mon-Fri 08:00-18:00 Europe/Berlin`.
+// Days are ranges or lists like `Mon,Wed`, the end of a window is exclusive, e.g. `24:00`, and windows like `22:00-06:00`
+// end on the next day. The timezone is UTC if none is given.
+func parseAccessSchedule(schedule string) (accessSchedule, error) {
+	var windows accessSchedule
+	for _, rule := range strings.Split(schedule, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+		window, err := parseAccessWindow(rule)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid access window %q", strings.TrimSpace(rule))
+		}
+		windows = append(windows, window)
+	}
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("Access schedule %q contains no windows", schedule)
+	}
+	return windows, nil
+}
+
+// parseAccessWindow parses a window like `Mon-Fri 08:00-18:00 Europe/Berlin`.
+func parseAccessWindow(rule string) (accessWindow, error) {
+	window := accessWindow{location: time.UTC}
+	fields := strings.Fields(rule)
+	if len(fields) != 2 && len(fields) != 3 {
+		return window, fmt.Errorf("must be like Mon-Fri 08:00-18:00 Europe/Berlin")
+	}
+	for _, days := range strings.Split(fields[0], ",") {
+		bounds := strings.SplitN(days, "-", 2)
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return window, fmt.Errorf("unknown day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[strings.ToLower(bounds[1])]; !ok {
+				return window, fmt.Errorf("unknown day %q", bounds[1])
+			}
+		}
+		// ranges like Fri-Mon wrap around the weekend
+		for day := first; ; day = (day + 1) % 7 {
+			window.days[day] = true
+			if day == last {
+				break
+			}
+		}
+	}
+	times := strings.SplitN(fields[1], "-", 2)
+	if len(times) != 2 {
+		return window, fmt.Errorf("times %q must be like 08:00-18:00", fields[1])
+	}
+	var err error
+	if window.start, err = parseMinuteOfDay(times[0]); err != nil {
+		return window, err
+	}
+	if window.end, err = parseMinuteOfDay(times[1]); err != nil {
+		return window, err
+	}
+	if len(fields) == 3 {
+		if window.location, err = time.LoadLocation(fields[2]); err != nil {
+			return window, errors.Wrapf(err, "unknown timezone %q", fields[2])
+		}
+	}
+	return window, nil
+}
+
+// parseMinuteOfDay returns the minute of the day of the time `value` like `08:30`, `24:00` is the end of the day.
+func parseMinuteOfDay(value string) (int, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(value, "%2d:%2d", &hours, &minutes); err != nil || n != 2 || len(value) != 5 {
+		return 0, fmt.Errorf("time %q must be like 08:00", value)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || hours == 24 && minutes != 0 {
+		return 0, fmt.Errorf("time %q is not a time of the day", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+// allows returns true if `t` is within one of the windows of the schedule.
+func (s accessSchedule) allows(t time.Time) bool {
+	for _, window := range s {
+		if window.allows(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows returns true if `t` is within the window.
+func (w accessWindow) allows(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[t.Weekday()] && minute >= w.start && minute < w.end
+	}
+	// the window started on the previous day
+	return w.days[t.Weekday()] && minute >= w.start || w.days[(t.Weekday()+6)%7] && minute < w.end
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessSchedule(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("Timezone database is not available: %s", err)
+	}
+	// 2019-07-01 is a Monday
+	at := func(day int, clock string, location *time.Location) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", "2019-07-01 "+clock, location)
+		if err != nil {
+			t.Fatalf("Invalid time %q: %s", clock, err)
+		}
+		return parsed.AddDate(0, 0, day)
+	}
+
+	tCases := []struct {
+		schedule string
+		time     time.Time
+		allowed  bool
+	}{
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", at(0, "08:00", berlin), true},
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", at(4, "17:59", berlin), true},
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", at(0, "18:00", berlin), false},
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", at(5, "12:00", berlin), false},
+		// 06:30 UTC is 08:30 in Berlin in summer
+		{"Mon-Fri 08:00-18:00 Europe/Berlin", at(0, "06:30", time.UTC), true},
+		{"Mon-Fri 08:00-18:00", at(0, "06:30", time.UTC), false},
+		{"mon,wed 00:00-24:00", at(2, "23:59", time.UTC), true},
+		{"Mon,Wed 00:00-24:00", at(1, "12:00", time.UTC), false},
+		{"Fri-Mon 10:00-12:00", at(6, "11:00", time.UTC), true},
+		{"Fri-Mon 10:00-12:00", at(1, "11:00", time.UTC), false},
+		// windows ending on the next day belong to the day they start
+		{"Fri 22:00-06:00", at(4, "23:00", time.UTC), true},
+		{"Fri 22:00-06:00", at(5, "05:59", time.UTC), true},
+		{"Fri 22:00-06:00", at(0, "05:00", time.UTC), false},
+		{"Sat 09:00-12:00; Mon-Fri 08:00-18:00", at(5, "10:00", time.UTC), true},
+		{"Sat 09:00-12:00; Mon-Fri 08:00-18:00", at(6, "10:00", time.UTC), false},
+	}
+	for _, tCase := range tCases {
+		schedule, err := parseAccessSchedule(tCase.schedule)
+		if err != nil {
+			t.Errorf("Parsing access schedule %q failed: %s", tCase.schedule, err)
+			continue
+		}
+		if allowed := schedule.allows(tCase.time); allowed != tCase.allowed {
+			t.Errorf("Access schedule %q at %s: expected %v but was %v", tCase.schedule, tCase.time, tCase.allowed, allowed)
+		}
+	}
+
+	for _, schedule := range []string{"", ";", "Mon-Fri", "Mo 08:00-18:00", "Mon-Fry 08:00-18:00", "Mon 8:00-18:00", "Mon 08:00", "Mon 08:00-24:30", "Mon 08:60-18:00", "Mon 08:00-18:00 Mars/Olympus", "Mon 08:00-18:00 UTC extra"} {
+		if _, err := parseAccessSchedule(schedule); err == nil {
+			t.Errorf("Parsing access schedule %q succeeded", schedule)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/pkg/errors"
+)
+
+// SecretsManagerScheme prefixes the names or ARNs of secrets of AWS Secrets Manager which are given instead of credentials,
+// e.g. `secretsmanager://f3/s3-credentials`.
+const SecretsManagerScheme = "secretsmanager://"
+
+// secretGetter reads the values of secrets.
+// Implemented by *secretsmanager.SecretsManager.
+type secretGetter interface {
+	GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// IsSecretsManagerURI returns true if `value` refers to a secret of AWS Secrets Manager.
+func IsSecretsManagerURI(value string) bool {
+	return strings.HasPrefix(value, SecretsManagerScheme)
+}
+
+// newSecretsManagerClient returns a client of AWS Secrets Manager which uses the default credential chain.
+// Secrets given by ARN are read in the region of the ARN, secrets given by name in `region`.
+func newSecretsManagerClient(uri, region string, httpClient *http.Client) (secretGetter, error) {
+	if secretARN, err := arn.Parse(strings.TrimPrefix(uri, SecretsManagerScheme)); err == nil {
+		region = secretARN.Region
+	}
+	if region == "" {
+		region = DefaultRegion
+	}
+	secretsSession, err := session.NewSession(&aws.Config{
+		Region:     aws.String(region),
+		HTTPClient: httpClient,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create secrets manager session to read %q", uri)
+	}
+	return secretsmanager.New(secretsSession), nil
+}
+
+// readSecretJSON reads the secret `uri` which must be a JSON object of strings, e.g. the key/value pairs of the AWS console.
+func readSecretJSON(client secretGetter, uri string) (map[string]string, error) {
+	name := strings.TrimPrefix(uri, SecretsManagerScheme)
+	if name == "" {
+		return nil, fmt.Errorf("Secret %q has no name", uri)
+	}
+	output, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(name)})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+			return nil, fmt.Errorf("Secret %q does not exist", uri)
+		}
+		return nil, errors.Wrapf(err, "Failed to read secret %q", uri)
+	}
+	if output.SecretString == nil {
+		return nil, fmt.Errorf("Secret %q is binary, expected a JSON object", uri)
+	}
+	values := map[string]string{}
+	if err := json.Unmarshal([]byte(aws.StringValue(output.SecretString)), &values); err != nil {
+		return nil, fmt.Errorf("Secret %q is malformed, expected a JSON object of strings: %s", uri, err)
+	}
+	return values, nil
+}
+
+// secretsManagerProvider provides s3 credentials from a secret with the keys `access_key`, `secret_key` and optionally `session_token`.
+// The secret is read again when the credentials are expired, e.g. after the secret was rotated.
+// Implements credentials.Provider.
+type secretsManagerProvider struct {
+	client    secretGetter
+	uri       string
+	retrieved bool
+}
+
+// Retrieve reads the credentials from the secret.
+func (p *secretsManagerProvider) Retrieve() (credentials.Value, error) {
+	value, err := p.read()
+	if err != nil {
+		return value, err
+	}
+	p.retrieved = true
+	return value, nil
+}
+
+// IsExpired returns true if the credentials were not read yet, they are read again after they were expired explicitly.
+func (p *secretsManagerProvider) IsExpired() bool {
+	return !p.retrieved
+}
+
+// read reads and validates the credentials of the secret.
+func (p *secretsManagerProvider) read() (credentials.Value, error) {
+	values, err := readSecretJSON(p.client, p.uri)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	if values["access_key"] == "" || values["secret_key"] == "" {
+		return credentials.Value{}, fmt.Errorf("Secret %q is malformed, expected the keys access_key, secret_key and optionally session_token", p.uri)
+	}
+	return credentials.Value{
+		AccessKeyID:     values["access_key"],
+		SecretAccessKey: values["secret_key"],
+		SessionToken:    values["session_token"],
+		ProviderName:    "SecretsManagerProvider",
+	}, nil
+}
+
+// AuthenticatorFromSecretsManager returns an Authenticator with the credentials of the secret `uri` read with the default credential chain,
+// secrets given by name are read in `region`.
+// The secret is a JSON object whose keys are the users and whose values are the rest of the lines of credentials files,
+// e.g. `{"alice": "password:ls,get:alice/"}`.
+func AuthenticatorFromSecretsManager(uri, region string) (Authenticator, error) {
+	client, err := newSecretsManagerClient(uri, region, nil)
+	if err != nil {
+		return Authenticator{}, err
+	}
+	return authenticatorFromSecret(client, uri)
+}
+
+// authenticatorFromSecret returns an Authenticator with the credentials of the secret `uri`.
+func authenticatorFromSecret(client secretGetter, uri string) (Authenticator, error) {
+	values, err := readSecretJSON(client, uri)
+	if err != nil {
+		return Authenticator{}, err
+	}
+	lines := make([]string, 0, len(values))
+	for user, credentials := range values {
+		if user == "" || strings.ContainsAny(user, ":\n") || strings.Contains(credentials, "\n") {
+			return Authenticator{}, fmt.Errorf("Secret %q is malformed, user %q has invalid credentials", uri, user)
+		}
+		lines = append(lines, user+":"+credentials)
+	}
+	sort.Strings(lines)
+	auth, err := AuthenticatorFromString(strings.Join(lines, "\n"))
+	if err != nil {
+		return auth, errors.Wrapf(err, "Secret %q is malformed", uri)
+	}
+	return auth, nil
+}
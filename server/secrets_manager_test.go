@@ -0,0 +1,116 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/sirupsen/logrus"
+)
+
+// secretGetterMock serves the string secrets `secrets` by name, other secrets do not exist.
+type secretGetterMock struct {
+	secrets map[string]string
+	reads   int
+}
+
+func (mock *secretGetterMock) GetSecretValue(input *secretsmanager.GetSecretValueInput) (*secretsmanager.GetSecretValueOutput, error) {
+	mock.reads++
+	secret, ok := mock.secrets[aws.StringValue(input.SecretId)]
+	if !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "Secrets Manager can't find the specified secret.", nil)
+	}
+	if secret == "" {
+		return &secretsmanager.GetSecretValueOutput{SecretBinary: []byte{0}}, nil
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(secret)}, nil
+}
+
+func TestSecretsManagerCredentials(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	mock := &secretGetterMock{secrets: map[string]string{
+		"f3/s3":         `{"access_key": "access", "secret_key": "secret"}`,
+		"f3/token":      `{"access_key": "access", "secret_key": "secret", "session_token": "token"}`,
+		"f3/incomplete": `{"access_key": "access"}`,
+		"f3/text":       "access:secret",
+		"f3/binary":     "",
+	}}
+	tCases := []struct {
+		uri          string
+		sessionToken string
+		shouldFail   bool
+	}{
+		{"secretsmanager://f3/s3", "", false},
+		{"secretsmanager://f3/token", "token", false},
+		{"secretsmanager://f3/incomplete", "", true},
+		{"secretsmanager://f3/text", "", true},
+		{"secretsmanager://f3/binary", "", true},
+		{"secretsmanager://f3/missing", "", true},
+		{"secretsmanager://", "", true},
+	}
+	for _, tCase := range tCases {
+		value, err := credentials.NewCredentials(&secretsManagerProvider{client: mock, uri: tCase.uri}).Get()
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Test %s: expected failure %v but was %v", tCase.uri, tCase.shouldFail, err)
+			continue
+		}
+		if err == nil && (value.AccessKeyID != "access" || value.SecretAccessKey != "secret" || value.SessionToken != tCase.sessionToken) {
+			t.Errorf("Test %s: unexpected credentials %#v", tCase.uri, value)
+		}
+	}
+
+	// the secret is read again after it was rotated
+	provider := &secretsManagerProvider{client: mock, uri: "secretsmanager://f3/s3"}
+	factory := DriverFactory{secretProvider: provider, secretCredentials: credentials.NewCredentials(provider)}
+	factory.secretCredentials.Get()
+	mock.secrets["f3/s3"] = `{"access_key": "rotated", "secret_key": "secret"}`
+	if value, _ := factory.secretCredentials.Get(); value.AccessKeyID != "access" {
+		t.Errorf("Expected the credentials to be cached but were %#v", value)
+	}
+	if err := factory.ReloadCredentials(); err != nil {
+		t.Fatalf("Reloading credentials failed: %s", err)
+	}
+	if value, _ := factory.secretCredentials.Get(); value.AccessKeyID != "rotated" {
+		t.Errorf("Expected the rotated credentials but were %#v", value)
+	}
+	mock.secrets["f3/s3"] = "{}"
+	if err := factory.ReloadCredentials(); err == nil {
+		t.Error("Reloading malformed credentials succeeded")
+	}
+	if value, err := factory.secretCredentials.Get(); err != nil || value.AccessKeyID != "rotated" {
+		t.Errorf("Expected the current credentials to be kept but were %#v: %v", value, err)
+	}
+	if err := (DriverFactory{}).ReloadCredentials(); err != nil {
+		t.Errorf("Reloading credentials without secret failed: %s", err)
+	}
+}
+
+func TestAuthenticatorFromSecret(t *testing.T) {
+	mock := &secretGetterMock{secrets: map[string]string{
+		"f3/users":   `{"alice": "secret:ls,get:alice", "bob": "secret"}`,
+		"f3/invalid": `{"alice": "secret:fly"}`,
+		"f3/colon":   `{"al:ice": "secret"}`,
+		"f3/nested":  `{"alice": {"password": "secret"}}`,
+		"f3/empty":   `{}`,
+	}}
+	auth, err := authenticatorFromSecret(mock, "secretsmanager://f3/users")
+	if err != nil {
+		t.Fatalf("Reading users from secret failed: %s", err)
+	}
+	if valid, _ := auth.CheckPasswd("bob", "secret"); !valid {
+		t.Error("Login of bob failed")
+	}
+	if featureFlags, ok := auth.Features("alice"); !ok || featureFlags != featureList|featureGet {
+		t.Errorf("Expected the features ls,get of alice but were %d", featureFlags)
+	}
+	if auth.Home("alice") != "alice" {
+		t.Errorf("Expected home alice but was %q", auth.Home("alice"))
+	}
+	for _, uri := range []string{"secretsmanager://f3/invalid", "secretsmanager://f3/colon", "secretsmanager://f3/nested", "secretsmanager://f3/empty", "secretsmanager://f3/missing"} {
+		if _, err := authenticatorFromSecret(mock, uri); err == nil {
+			t.Errorf("Reading users from secret %s succeeded", uri)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// siteCommand runs a subcommand of SITE with the parameter `param` following its name.
+type siteCommand func(conn *ftp.Conn, param string)
+
+// siteCommands returns the subcommands of SITE by their upper case names.
+func siteCommands() map[string]siteCommand {
+	return map[string]siteCommand{
+		"GETURL":   siteGetURL,
+		"VERSIONS": siteVersions,
+		"VERSION":  siteVersion,
+		"RESTORE":  siteRestore,
+		"TAGS":     siteTags,
+	}
+}
+
+// commandSite runs the subcommands of f3 which are not part of FTP, like `SITE GETURL <path>`, see RFC 959.
+type commandSite struct{}
+
+func (cmd commandSite) IsExtend() bool     { return false }
+func (cmd commandSite) RequireParam() bool { return true }
+func (cmd commandSite) RequireAuth() bool  { return true }
+
+func (cmd commandSite) Execute(conn *ftp.Conn, param string) {
+	name, param := splitSiteParam(param)
+	if strings.EqualFold(name, "HELP") {
+		names := []string{}
+		for name := range siteCommands() {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		conn.WriteMessage(214, "SITE commands: "+strings.Join(append(names, "HELP"), " "))
+		return
+	}
+	command, ok := siteCommands()[strings.ToUpper(name)]
+	if !ok {
+		conn.WriteMessage(504, "Unknown SITE command "+name+", see SITE HELP")
+		return
+	}
+	command(conn, param)
+}
+
+// splitSiteParam splits the parameter of SITE into the name of the subcommand and its parameter.
+func splitSiteParam(param string) (string, string) {
+	fields := strings.SplitN(param, " ", 2)
+	if len(fields) == 1 {
+		return fields[0], ""
+	}
+	return fields[0], strings.TrimSpace(fields[1])
+}
+
+// urlDriver is a driver which serves presigned URLs of objects, see S3Driver.PresignedURL.
+type urlDriver interface {
+	PresignedURL(key string) (string, error)
+}
+
+// siteGetURL replies a presigned URL to download the object of path `param` directly from s3.
+func siteGetURL(conn *ftp.Conn, param string) {
+	if param == "" {
+		conn.WriteMessage(501, "Syntax: SITE GETURL <path>")
+		return
+	}
+	driver, ok := conn.Driver().(urlDriver)
+	if !ok {
+		conn.WriteMessage(502, "SITE GETURL is not supported")
+		return
+	}
+	url, err := driver.PresignedURL(conn.BuildPath(param))
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	conn.WriteMessage(200, url)
+}
+
+// versionDriver is a driver which serves the versions of objects, see S3Driver.ListVersions.
+type versionDriver interface {
+	ListVersions(key string) ([]ObjectVersion, error)
+	SelectVersion(versionID string) error
+}
+
+// siteVersions replies the versions of the object of path `param`, latest first, with their size and modification time.
+func siteVersions(conn *ftp.Conn, param string) {
+	if param == "" {
+		conn.WriteMessage(501, "Syntax: SITE VERSIONS <path>")
+		return
+	}
+	driver, ok := conn.Driver().(versionDriver)
+	if !ok {
+		conn.WriteMessage(502, "SITE VERSIONS is not supported")
+		return
+	}
+	path := conn.BuildPath(param)
+	versions, err := driver.ListVersions(path)
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	lines := []string{"Versions of " + path}
+	for _, version := range versions {
+		line := fmt.Sprintf(" %s %d %s", version.ID, version.Size, version.LastModified.UTC().Format("20060102150405"))
+		if version.IsLatest {
+			line += " latest"
+		}
+		lines = append(lines, line)
+	}
+	conn.WriteMessageLines(213, append(lines, "End")...)
+}
+
+// siteVersion selects the version `param` of the object of the next download like REST selects its offset.
+func siteVersion(conn *ftp.Conn, param string) {
+	if param == "" {
+		conn.WriteMessage(501, "Syntax: SITE VERSION <version id>")
+		return
+	}
+	driver, ok := conn.Driver().(versionDriver)
+	if !ok {
+		conn.WriteMessage(502, "SITE VERSION is not supported")
+		return
+	}
+	if err := driver.SelectVersion(param); err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	conn.WriteMessage(200, fmt.Sprintf("Version %s selected for the next download, restore or tags", param))
+}
+
+// restoreDriver is a driver which restores archived objects, see S3Driver.RestoreObject.
+type restoreDriver interface {
+	RestoreObject(key string, days int64) (string, error)
+}
+
+// siteRestore restores the archived object of the path and number of days of `param`, e.g. `some/file 7`.
+func siteRestore(conn *ftp.Conn, param string) {
+	i := strings.LastIndex(param, " ")
+	days, err := strconv.ParseInt(param[i+1:], 10, 64)
+	if i <= 0 || err != nil || days <= 0 {
+		conn.WriteMessage(501, "Syntax: SITE RESTORE <path> <days>")
+		return
+	}
+	driver, ok := conn.Driver().(restoreDriver)
+	if !ok {
+		conn.WriteMessage(502, "SITE RESTORE is not supported")
+		return
+	}
+	state, err := driver.RestoreObject(conn.BuildPath(strings.TrimSpace(param[:i])), days)
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	conn.WriteMessage(200, state)
+}
+
+// tagsDriver is a driver which serves the tags of objects, see S3Driver.ObjectTags.
+type tagsDriver interface {
+	ObjectTags(key string) ([]string, error)
+}
+
+// siteTags replies the tags of the object of path `param`, one `key=value` pair per line.
+func siteTags(conn *ftp.Conn, param string) {
+	if param == "" {
+		conn.WriteMessage(501, "Syntax: SITE TAGS <path>")
+		return
+	}
+	driver, ok := conn.Driver().(tagsDriver)
+	if !ok {
+		conn.WriteMessage(502, "SITE TAGS is not supported")
+		return
+	}
+	path := conn.BuildPath(param)
+	tags, err := driver.ObjectTags(path)
+	if err != nil {
+		conn.WriteMessage(ftp.ReplyCode(err, 550), err.Error())
+		return
+	}
+	lines := []string{"Tags of " + path}
+	for _, tag := range tags {
+		lines = append(lines, " "+tag)
+	}
+	conn.WriteMessageLines(213, append(lines, "End")...)
+}
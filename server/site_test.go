@@ -0,0 +1,68 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+func TestSite(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	bucketMock.Put("small", objectMock{[]byte("012"), time.Now(), "etag"})
+	bucketMock.Put("large", objectMock{[]byte("0123456789"), time.Now(), "etag"})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listening failed: %s", err)
+	}
+	ftpServer := ftp.NewServer(&ftp.ServerOpts{
+		Factory: driverFactoryFunc(func() (ftp.Driver, error) {
+			return &S3Driver{
+				featureFlags:     featureList | featureGet,
+				s3:               &s3Mock{bucket: bucketMock},
+				metrics:          metricsSenderMock{},
+				bucketName:       bucketName,
+				bucketURL:        intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+				presignThreshold: 5,
+				presignTTL:       10 * time.Minute,
+			}, nil
+		}),
+		Auth:   &ftp.SimpleAuth{Name: "alice", Password: "secret"},
+		Logger: &FTPLogger{},
+	})
+	go Serve(ftpServer, listener, nil)
+	defer ftpServer.Shutdown()
+
+	conn, replies := dialFTP(t, listener, "alice", "secret")
+	defer conn.Close()
+
+	tCases := []struct {
+		param string
+		reply string
+	}{
+		{"GETURL large", "200 https://"},
+		{"geturl /large", "200 https://"},
+		{"GETURL small", "550 "},
+		{"GETURL missing", "550 "},
+		{"GETURL", "501 "},
+		{"RESTORE large", "501 "},
+		{"RESTORE large never", "501 "},
+		{"HELP", "214 SITE commands: GETURL RESTORE TAGS VERSION VERSIONS HELP"},
+		{"UNKNOWN", "504 "},
+	}
+	for _, tCase := range tCases {
+		fmt.Fprintf(conn, "SITE %s\r\n", tCase.param)
+		if reply, err := replies.ReadString('\n'); err != nil || !strings.HasPrefix(reply, tCase.reply) {
+			t.Errorf("Test %q: expected reply %q but was %q: %v", tCase.param, tCase.reply, reply, err)
+		}
+	}
+	if data := transferData(t, conn, replies, "RETR large", nil); data != "0123456789" {
+		t.Errorf("Expected RETR to return the content of a large object but was %q", data)
+	}
+}
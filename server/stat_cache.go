@@ -0,0 +1,152 @@
+package server
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// DefaultStatCacheSize is the default number of objects whose metadata is cached.
+const DefaultStatCacheSize = 10000
+
+// statCache caches the HeadObject responses of Stat and objectSize for a short time,
+// e.g. for GUI clients calling Stat repeatedly while browsing.
+// It is shared by all drivers and evicts the least recently used responses once it is full.
+// Responses are cached per s3 identity, since users with own s3 credentials or a session policy may not read the same objects.
+type statCache struct {
+	lock sync.Mutex
+	ttl  time.Duration
+	size int
+	// entries are the cached responses of objects by the s3 identity they were requested as
+	entries map[statCacheKey]map[string]*list.Element
+	// lru orders the entries from the most to the least recently used
+	lru *list.List
+	now func() time.Time
+}
+
+type statCacheKey struct {
+	bucket string
+	key    string
+}
+
+type statCacheEntry struct {
+	key      statCacheKey
+	identity string
+	head     *s3.HeadObjectOutput
+	expires  time.Time
+}
+
+// newStatCache returns a cache of up to `size` responses which are valid for `ttl`, or nil if `ttl` is 0.
+func newStatCache(size int, ttl time.Duration) *statCache {
+	if ttl == 0 {
+		return nil
+	}
+	if size == 0 {
+		size = DefaultStatCacheSize
+	}
+	return &statCache{ttl: ttl, size: size, entries: map[statCacheKey]map[string]*list.Element{}, lru: list.New(), now: time.Now}
+}
+
+// get returns the cached response of the object with key `key` in bucket `bucket` requested as `identity` unless it expired.
+func (c *statCache) get(identity, bucket, key string) (*s3.HeadObjectOutput, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[statCacheKey{bucket, key}][identity]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*statCacheEntry)
+	if c.now().After(entry.expires) {
+		c.remove(element)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.head, true
+}
+
+// put caches the response `head` of the object with key `key` in bucket `bucket` requested as `identity`.
+func (c *statCache) put(identity, bucket, key string, head *s3.HeadObjectOutput) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cacheKey := statCacheKey{bucket, key}
+	entry := &statCacheEntry{key: cacheKey, identity: identity, head: head, expires: c.now().Add(c.ttl)}
+	if element, ok := c.entries[cacheKey][identity]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	if c.entries[cacheKey] == nil {
+		c.entries[cacheKey] = map[string]*list.Element{}
+	}
+	c.entries[cacheKey][identity] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove removes the cached response `element`, the lock must be held.
+func (c *statCache) remove(element *list.Element) {
+	entry := element.Value.(*statCacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries[entry.key], entry.identity)
+	if len(c.entries[entry.key]) == 0 {
+		delete(c.entries, entry.key)
+	}
+}
+
+// invalidate removes the cached responses of the object with key `key` in bucket `bucket` of all identities, e.g. after it was modified.
+func (c *statCache) invalidate(bucket, key string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, element := range c.entries[statCacheKey{bucket, key}] {
+		c.lru.Remove(element)
+	}
+	delete(c.entries, statCacheKey{bucket, key})
+}
+
+// invalidatePrefix removes the cached responses of all objects below `prefix` in bucket `bucket`, e.g. after deleting a directory.
+func (c *statCache) invalidatePrefix(bucket, prefix string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for cacheKey, elements := range c.entries {
+		if cacheKey.bucket == bucket && strings.HasPrefix(cacheKey.key, prefix) {
+			for _, element := range elements {
+				c.lru.Remove(element)
+			}
+			delete(c.entries, cacheKey)
+		}
+	}
+}
+
+// headObject returns the metadata of the object with key `key` in bucket `bucket`, from the stat cache if it is enabled.
+func (d *S3Driver) headObject(bucket, key string) (*s3.HeadObjectOutput, error) {
+	identity := d.s3Identity()
+	if head, ok := d.statCache.get(identity, bucket, key); ok {
+		return head, nil
+	}
+	head, err := d.s3Client().HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.statCache.put(identity, bucket, key, head)
+	return head, nil
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+)
+
+func TestStatCache(t *testing.T) {
+	now := time.Now()
+	cache := newStatCache(2, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	for _, key := range []string{"a", "b"} {
+		cache.put("", "bucket", key, &s3.HeadObjectOutput{ContentLength: aws.Int64(1)})
+	}
+	if _, ok := cache.get("", "other-bucket", "a"); ok {
+		t.Errorf("Expected objects of other buckets not to be cached")
+	}
+	// a is used more recently than b which is evicted
+	if _, ok := cache.get("", "bucket", "a"); !ok {
+		t.Errorf("Expected a to be cached")
+	}
+	cache.put("", "bucket", "c", &s3.HeadObjectOutput{})
+	if _, ok := cache.get("", "bucket", "b"); ok {
+		t.Errorf("Expected the least recently used entry b to be evicted")
+	}
+
+	cache.invalidate("bucket", "c")
+	if _, ok := cache.get("", "bucket", "c"); ok {
+		t.Errorf("Expected c to be invalidated")
+	}
+	cache.put("", "bucket", "dir/c", &s3.HeadObjectOutput{})
+	cache.invalidatePrefix("bucket", "dir/")
+	if _, ok := cache.get("", "bucket", "dir/c"); ok {
+		t.Errorf("Expected dir/c to be invalidated with its directory")
+	}
+
+	now = now.Add(time.Minute + time.Second)
+	if _, ok := cache.get("", "bucket", "a"); ok {
+		t.Errorf("Expected a to expire")
+	}
+	if len(cache.entries) != 0 || cache.lru.Len() != 0 {
+		t.Errorf("Expected no entries to be left but were %d", len(cache.entries))
+	}
+
+	// users with own s3 credentials may not read the objects others can
+	cache = newStatCache(DefaultStatCacheSize, time.Minute)
+	cache.put("user:alice", "bucket", "a", &s3.HeadObjectOutput{})
+	if _, ok := cache.get("user:bob", "bucket", "a"); ok {
+		t.Errorf("Expected the responses of other identities not to be cached")
+	}
+	if _, ok := cache.get("user:alice", "bucket", "a"); !ok {
+		t.Errorf("Expected a to be cached for alice")
+	}
+	cache.put("", "bucket", "a", &s3.HeadObjectOutput{})
+	cache.invalidate("bucket", "a")
+	if len(cache.entries) != 0 || cache.lru.Len() != 0 {
+		t.Errorf("Expected a to be invalidated for all identities but %d entries were left", cache.lru.Len())
+	}
+	if newStatCache(DefaultStatCacheSize, 0) != nil {
+		t.Errorf("Expected no cache without TTL")
+	}
+}
+
+func TestStatCacheDriver(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	mock := &s3Mock{bucket: bucketMock}
+	driver := &S3Driver{
+		featureFlags: featurePut | featureRemove,
+		s3:           mock,
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		statCache:    newStatCache(DefaultStatCacheSize, time.Minute),
+	}
+
+	if _, err := driver.PutFile("/file", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		info, err := driver.Stat("/file")
+		if err != nil || info.Size() != 4 {
+			t.Fatalf("Expected the size of the uploaded file but was %v: %v", info, err)
+		}
+	}
+	// the metadata is cached by the size check of the upload
+	if mock.headObjectCalls != 1 {
+		t.Errorf("Expected a single HeadObject request but were %d", mock.headObjectCalls)
+	}
+
+	if _, err := driver.PutFile("/file", strings.NewReader("more data"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	if info, err := driver.Stat("/file"); err != nil || info.Size() != 9 {
+		t.Errorf("Expected the size of the overwritten file but was %v: %v", info, err)
+	}
+	if err := driver.DeleteFile("/file"); err != nil {
+		t.Fatalf("DeleteFile failed: %s", err)
+	}
+	if info, err := driver.Stat("/file"); err != nil || !info.IsDir() {
+		t.Errorf("Expected the deleted file not to be found but was %v: %v", info, err)
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// totpDigits is the number of digits of TOTP codes.
+	totpDigits = 6
+	// totpPeriod is the time a TOTP code is valid.
+	totpPeriod = 30
+	// totpSkew is the number of periods before and after the current one whose codes are accepted, e.g. for clock drift.
+	totpSkew = 1
+)
+
+// parseTOTPSecret decodes the base32 encoded TOTP secret `secret` as shown by authenticator apps,
+// spaces, lower case letters and missing padding are accepted.
+func parseTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("Invalid TOTP secret, must be base32 encoded")
+	}
+	return key, nil
+}
+
+// totpCode returns the code of `key` for the time step `counter` (RFC 6238 with HMAC-SHA1, the default of authenticator apps).
+func totpCode(key []byte, counter uint64) string {
+	message := make([]byte, 8)
+	binary.BigEndian.PutUint64(message, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(message)
+	sum := mac.Sum(nil)
+	// dynamic truncation of RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// verifyTOTP returns the time step of `code` and true if it is the code of `key` at `now` or at most totpSkew periods before or after it.
+func verifyTOTP(key []byte, code string, now time.Time) (int64, bool) {
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	counter := now.Unix() / totpPeriod
+	matched, valid := int64(0), false
+	for step := counter - totpSkew; step <= counter+totpSkew; step++ {
+		if step >= 0 && subtle.ConstantTimeCompare([]byte(totpCode(key, uint64(step))), []byte(code)) == 1 {
+			matched, valid = step, true
+		}
+	}
+	return matched, valid
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"io"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+)
+
+// Tracer starts the spans of traces, e.g. OTelTracer which exports them to OpenTelemetry or LogTracer which logs them.
+type Tracer interface {
+	// StartSpan starts a span named `name` as child of `parent`, or a root span if `parent` is nil.
+	StartSpan(name string, parent Span) Span
+}
+
+// Span is a single operation of a trace.
+type Span interface {
+	// SetAttribute sets the attribute `key`, e.g. `s3.key`, to `value`.
+	SetAttribute(key string, value interface{})
+	// SetError marks the operation as failed with `err`.
+	SetError(err error)
+	// End ends the operation.
+	End()
+}
+
+// Attributes of the spans of driver operations.
+const (
+	spanAttributeBucket = "s3.bucket"
+	spanAttributeKey    = "s3.key"
+	spanAttributeBytes  = "ftp.bytes"
+	spanAttributeFiles  = "ftp.files"
+)
+
+// Attributes of the spans of s3 requests.
+const (
+	spanAttributeRequestID = "s3.request_id"
+	spanAttributeRetries   = "s3.retries"
+	// spanAttributeRequestBytes are the bytes of the request body of uploads or of the response body of downloads
+	spanAttributeRequestBytes = "s3.bytes"
+)
+
+// tracingDriver traces the operations of an S3Driver, the s3 requests of an operation are traced as its child spans.
+// Drivers are only wrapped if a tracer is configured, so tracing has no overhead otherwise.
+type tracingDriver struct {
+	*S3Driver
+	tracer Tracer
+	// span is the span of the current operation, goftp calls the driver of a connection sequentially.
+	span Span
+}
+
+// newTracingDriver returns `driver` traced by `tracer`, the requests of `client` become child spans of the operations.
+func newTracingDriver(driver *S3Driver, tracer Tracer, client *s3.S3) *tracingDriver {
+	d := &tracingDriver{S3Driver: driver, tracer: tracer}
+	if client != nil {
+		// the validation runs once per request, unlike sending, which is repeated by retries
+		client.Handlers.Validate.PushFront(func(r *request.Request) {
+			span := tracer.StartSpan("s3."+r.Operation.Name, d.span)
+			span.SetAttribute(spanAttributeBucket, d.bucketName)
+			r.Handlers.Complete.PushBack(func(r *request.Request) {
+				span.SetAttribute(spanAttributeRequestID, r.RequestID)
+				span.SetAttribute(spanAttributeRetries, r.RetryCount)
+				if bytes := requestBytes(r); bytes >= 0 {
+					span.SetAttribute(spanAttributeRequestBytes, bytes)
+				}
+				if r.Error != nil {
+					span.SetError(r.Error)
+				}
+				span.End()
+			})
+		})
+	}
+	return d
+}
+
+// requestBytes returns the size of the body of the upload or download `r`, -1 if unknown or if it has no body like HEAD requests.
+func requestBytes(r *request.Request) int64 {
+	switch {
+	case r.HTTPRequest == nil:
+		return -1
+	case r.HTTPRequest.Method == "PUT" || r.HTTPRequest.Method == "POST":
+		return r.HTTPRequest.ContentLength
+	case r.HTTPRequest.Method == "GET" && r.HTTPResponse != nil:
+		return r.HTTPResponse.ContentLength
+	default:
+		return -1
+	}
+}
+
+// start starts the span of operation `name` of the object with key `key`.
+func (d *tracingDriver) start(name, key string) Span {
+	d.span = d.tracer.StartSpan(name, nil)
+	d.span.SetAttribute(spanAttributeBucket, d.bucketName)
+	d.span.SetAttribute(spanAttributeKey, d.objectKey(key))
+	return d.span
+}
+
+// end ends `span` which failed if `err` is not nil.
+func (d *tracingDriver) end(span Span, err error) {
+	if err != nil {
+		span.SetError(err)
+	}
+	span.End()
+	d.span = nil
+}
+
+func (d *tracingDriver) Stat(key string) (ftp.FileInfo, error) {
+	span := d.start("Stat", key)
+	info, err := d.S3Driver.Stat(key)
+	d.end(span, err)
+	return info, err
+}
+
+func (d *tracingDriver) ChangeDir(key string) error {
+	span := d.start("ChangeDir", key)
+	err := d.S3Driver.ChangeDir(key)
+	d.end(span, err)
+	return err
+}
+
+func (d *tracingDriver) ListDir(key string, cb func(ftp.FileInfo) error) error {
+	span := d.start("ListDir", key)
+	files := 0
+	err := d.S3Driver.ListDir(key, func(info ftp.FileInfo) error {
+		files++
+		return cb(info)
+	})
+	span.SetAttribute(spanAttributeFiles, files)
+	d.end(span, err)
+	return err
+}
+
+func (d *tracingDriver) DeleteDir(key string) error {
+	span := d.start("DeleteDir", key)
+	err := d.S3Driver.DeleteDir(key)
+	d.end(span, err)
+	return err
+}
+
+func (d *tracingDriver) DeleteFile(key string) error {
+	span := d.start("DeleteFile", key)
+	err := d.S3Driver.DeleteFile(key)
+	d.end(span, err)
+	return err
+}
+
+func (d *tracingDriver) Rename(oldKey string, newKey string) error {
+	span := d.start("Rename", oldKey)
+	span.SetAttribute("s3.target_key", d.objectKey(newKey))
+	err := d.S3Driver.Rename(oldKey, newKey)
+	d.end(span, err)
+	return err
+}
+
+func (d *tracingDriver) MakeDir(key string) error {
+	span := d.start("MakeDir", key)
+	err := d.S3Driver.MakeDir(key)
+	d.end(span, err)
+	return err
+}
+
+// GetFile traces requesting the object, the transfer of its content to the client is not part of the span.
+func (d *tracingDriver) GetFile(key string, offset int64) (int64, io.ReadCloser, error) {
+	span := d.start("GetFile", key)
+	size, reader, err := d.S3Driver.GetFile(key, offset)
+	span.SetAttribute(spanAttributeBytes, size)
+	d.end(span, err)
+	return size, reader, err
+}
+
+func (d *tracingDriver) PutFile(key string, data io.Reader, appendMode bool) (int64, error) {
+	span := d.start("PutFile", key)
+	size, err := d.S3Driver.PutFile(key, data, appendMode)
+	span.SetAttribute(spanAttributeBytes, size)
+	d.end(span, err)
+	return size, err
+}
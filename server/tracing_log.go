@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logFields are the log fields of span attributes, other attributes are logged with their key.
+var logFields = map[string]string{
+	spanAttributeBucket:       "bucket",
+	spanAttributeKey:          "key",
+	spanAttributeBytes:        "bytes",
+	spanAttributeFiles:        "files",
+	spanAttributeRequestID:    "request_id",
+	spanAttributeRetries:      "retries",
+	spanAttributeRequestBytes: "bytes",
+}
+
+// LogTracer logs the operations of drivers and their s3 requests with their duration at debug level,
+// e.g. to find slow or throttled requests without a tracing backend.
+// Implements Tracer.
+type LogTracer struct {
+	// Logger receives the logs of the spans instead of the global logger of logrus if not nil.
+	Logger logrus.FieldLogger
+}
+
+// StartSpan starts a span which is logged when it ends.
+func (t LogTracer) StartSpan(name string, parent Span) Span {
+	span := &logSpan{name: name, start: time.Now(), fields: logrus.Fields{"operation": name}, logger: orStandardLogger(t.Logger)}
+	if parent, ok := parent.(*logSpan); ok {
+		// requests are logged with the key of their operation
+		parent.lock.Lock()
+		span.fields["parent"] = parent.name
+		if key, ok := parent.fields["key"]; ok {
+			span.fields["key"] = key
+		}
+		parent.lock.Unlock()
+	}
+	span.logger.WithFields(span.fields).Debugf("Starting %s", name)
+	return span
+}
+
+// logSpan is a span of LogTracer, the requests of parallel transfers may be started while the operation sets attributes.
+type logSpan struct {
+	name   string
+	start  time.Time
+	lock   sync.Mutex
+	fields logrus.Fields
+	logger logrus.FieldLogger
+}
+
+// SetAttribute sets the log field of attribute `key` to `value`.
+func (s *logSpan) SetAttribute(key string, value interface{}) {
+	field, ok := logFields[key]
+	if !ok {
+		field = strings.Replace(key, ".", "_", -1)
+	}
+	s.lock.Lock()
+	s.fields[field] = value
+	s.lock.Unlock()
+}
+
+// SetError sets the log field `error`.
+func (s *logSpan) SetError(err error) {
+	s.lock.Lock()
+	s.fields["error"] = err
+	s.lock.Unlock()
+}
+
+// End logs the span with its duration in milliseconds.
+func (s *logSpan) End() {
+	duration := time.Since(s.start)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fields["duration_ms"] = float64(duration) / float64(time.Millisecond)
+	s.logger.WithFields(s.fields).Debugf("Finished %s after %s", s.name, duration)
+}
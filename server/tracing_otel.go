@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	goErrors "github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// otelServiceName is the service name of the exported spans.
+	otelServiceName = "f3"
+	// otelTracesPath is the default path of the traces of OTLP/HTTP collectors.
+	otelTracesPath = "/v1/traces"
+	// otelCloseTimeout is the time the pending spans get to be exported on shutdown.
+	otelCloseTimeout = 10 * time.Second
+)
+
+// OTelTracer exports the operations of drivers and their s3 requests as OpenTelemetry spans.
+// Implements Tracer.
+type OTelTracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// NewOTelTracer returns an OTelTracer which exports spans in batches to the OTLP/HTTP collector at `endpoint`,
+// e.g. `http://localhost:4318`, spans are sent to the path `/v1/traces` of the endpoint if it has no path.
+func NewOTelTracer(endpoint string) (*OTelTracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid OpenTelemetry endpoint %q, expected an URL like http://localhost:4318", endpoint)
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host), otlptracehttp.WithURLPath(otelTracesPath)}
+	if strings.Trim(u.Path, "/") != "" {
+		options = append(options, otlptracehttp.WithURLPath(u.Path))
+	}
+	if u.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, goErrors.Wrapf(err, "Failed to create the OpenTelemetry exporter of %q", endpoint)
+	}
+	return newOTelTracer(sdktrace.NewBatchSpanProcessor(exporter)), nil
+}
+
+// newOTelTracer returns an OTelTracer whose spans are processed by `processor`, e.g. to record them in tests.
+func newOTelTracer(processor sdktrace.SpanProcessor) *OTelTracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(otelServiceName))),
+	)
+	return &OTelTracer{provider: provider, tracer: provider.Tracer("github.com/spreadshirt/f3/server")}
+}
+
+// StartSpan starts a span which is exported when it ends, child spans belong to the trace of their parent.
+func (t *OTelTracer) StartSpan(name string, parent Span) Span {
+	ctx := context.Background()
+	if parent, ok := parent.(otelSpan); ok {
+		ctx = trace.ContextWithSpan(ctx, parent.span)
+	}
+	_, span := t.tracer.Start(ctx, name)
+	return otelSpan{span: span}
+}
+
+// Close exports the pending spans and stops exporting, e.g. on shutdown.
+func (t *OTelTracer) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), otelCloseTimeout)
+	defer cancel()
+	return t.provider.Shutdown(ctx)
+}
+
+// otelSpan is a span of OTelTracer.
+type otelSpan struct {
+	span trace.Span
+}
+
+// SetAttribute sets the attribute `key` to `value`, values of other types than strings, integers, floats and booleans are formatted as strings.
+func (s otelSpan) SetAttribute(key string, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case float64:
+		s.span.SetAttributes(attribute.Float64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+// SetError records `err` and sets the status of the span to error.
+func (s otelSpan) SetError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+// End ends the span.
+func (s otelSpan) End() {
+	s.span.End()
+}
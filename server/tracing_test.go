@@ -0,0 +1,293 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/sirupsen/logrus"
+	logrustest "github.com/sirupsen/logrus/hooks/test"
+	ftp "github.com/spreadshirt/f3/third_party/goftp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanMock records a span for the assertions of tests.
+type spanMock struct {
+	name       string
+	parent     *spanMock
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *spanMock) SetAttribute(key string, value interface{}) {
+	s.attributes[key] = value
+}
+
+func (s *spanMock) SetError(err error) {
+	s.err = err
+}
+
+func (s *spanMock) End() {
+	s.ended = true
+}
+
+// tracerMock records all started spans.
+type tracerMock struct {
+	lock  sync.Mutex
+	spans []*spanMock
+}
+
+func (t *tracerMock) StartSpan(name string, parent Span) Span {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	span := &spanMock{name: name, attributes: map[string]interface{}{}}
+	if parent != nil {
+		span.parent = parent.(*spanMock)
+	}
+	t.spans = append(t.spans, span)
+	return span
+}
+
+func (t *tracerMock) span(name string) *spanMock {
+	for _, span := range t.spans {
+		if span.name == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func TestTracingDriver(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	tracer := &tracerMock{}
+	var driver ftp.Driver = newTracingDriver(&S3Driver{
+		featureFlags: featureList | featureGet | featurePut,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		keyPrefix:    "ftp",
+	}, tracer, nil)
+
+	if _, err := driver.PutFile("/dir/file", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	if err := driver.ListDir("/dir", func(ftp.FileInfo) error { return nil }); err != nil {
+		t.Fatalf("ListDir failed: %s", err)
+	}
+	if err := driver.DeleteFile("/dir/file"); err == nil {
+		t.Fatalf("Expected DeleteFile to fail because it is not enabled")
+	}
+
+	put := tracer.span("PutFile")
+	if put == nil || !put.ended || put.err != nil {
+		t.Fatalf("Expected an ended span of PutFile but was %+v", put)
+	}
+	if put.attributes[spanAttributeBucket] != bucketName || put.attributes[spanAttributeKey] != "ftp/dir/file" || put.attributes[spanAttributeBytes] != int64(4) {
+		t.Errorf("Expected the bucket, key and size of the upload as attributes but were %v", put.attributes)
+	}
+	if list := tracer.span("ListDir"); list == nil || list.attributes[spanAttributeFiles] != 1 {
+		t.Errorf("Expected the number of listed files as attribute but was %+v", list)
+	}
+	if deletion := tracer.span("DeleteFile"); deletion == nil || deletion.err == nil || !deletion.ended {
+		t.Errorf("Expected an ended span of the failed deletion but was %+v", deletion)
+	}
+}
+
+func TestTracingDriverRequests(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s3Server.Close()
+
+	client := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("eu-central-1"),
+		Endpoint:         aws.String(s3Server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("access", "secret", ""),
+	})))
+	bucketName := "test-bucket"
+	tracer := &tracerMock{}
+	driver := newTracingDriver(&S3Driver{
+		featureFlags: featureList,
+		s3:           client,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}, tracer, client)
+
+	if _, err := driver.Stat("file"); err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	stat := tracer.span("Stat")
+	for _, name := range []string{"s3.HeadBucket", "s3.HeadObject"} {
+		request := tracer.span(name)
+		if request == nil || request.parent != stat || !request.ended {
+			t.Errorf("Expected an ended child span %q of Stat but was %+v", name, request)
+		}
+	}
+
+	// requests outside of operations are root spans
+	if _, err := client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(bucketName), Key: aws.String("file")}); err != nil {
+		t.Fatalf("HeadObject failed: %s", err)
+	}
+	if last := tracer.spans[len(tracer.spans)-1]; last.name != "s3.HeadObject" || last.parent != nil {
+		t.Errorf("Expected a root span of the request but was %+v", last)
+	}
+}
+
+func TestOTelTracer(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Request-Id", "request-1")
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s3Server.Close()
+
+	client := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("eu-central-1"),
+		Endpoint:         aws.String(s3Server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("access", "secret", ""),
+	})))
+	bucketName := "test-bucket"
+	recorder := tracetest.NewSpanRecorder()
+	driver := newTracingDriver(&S3Driver{
+		featureFlags: featureList,
+		s3:           client,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}, newOTelTracer(recorder), client)
+
+	if _, err := driver.Stat("file"); err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	head, stat := spans["s3.HeadObject"], spans["Stat"]
+	if head == nil || stat == nil {
+		t.Fatalf("Expected spans of Stat and its HeadObject request but were %v", spans)
+	}
+	if head.Parent().SpanID() != stat.SpanContext().SpanID() || head.SpanContext().TraceID() != stat.SpanContext().TraceID() {
+		t.Errorf("Expected HeadObject to be a child span of Stat")
+	}
+	attributes := map[attribute.Key]attribute.Value{}
+	for _, kv := range head.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	if attributes[spanAttributeRequestID].AsString() != "request-1" || attributes[spanAttributeBucket].AsString() != bucketName || attributes[spanAttributeRetries].AsInt64() != 0 {
+		t.Errorf("Unexpected attributes of HeadObject: %v", attributes)
+	}
+
+	span := newOTelTracer(recorder).StartSpan("DeleteFile", nil)
+	span.SetError(fmt.Errorf("not enabled"))
+	span.End()
+	if failed := recorder.Ended()[len(recorder.Ended())-1]; failed.Status().Code != codes.Error || failed.Status().Description != "not enabled" {
+		t.Errorf("Expected the status of the failed span to be an error but was %+v", failed.Status())
+	}
+}
+
+func TestNewOTelTracer(t *testing.T) {
+	if _, err := NewOTelTracer("localhost:4318"); err == nil {
+		t.Errorf("Expected an endpoint without scheme to be rejected")
+	}
+
+	paths := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	tracer, err := NewOTelTracer(collector.URL)
+	if err != nil {
+		t.Fatalf("NewOTelTracer failed: %s", err)
+	}
+	tracer.StartSpan("Stat", nil).End()
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("Close failed: %s", err)
+	}
+	select {
+	case path := <-paths:
+		if path != otelTracesPath {
+			t.Errorf("Expected the spans to be exported to %q but were exported to %q", otelTracesPath, path)
+		}
+	default:
+		t.Errorf("Expected the pending spans to be exported on Close")
+	}
+}
+
+func TestLogTracer(t *testing.T) {
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(logrus.PanicLevel)
+	hook := logrustest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+	s3Server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Amz-Request-Id", "request-1")
+		w.Header().Set("Content-Length", "4")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s3Server.Close()
+
+	client := s3.New(session.Must(session.NewSession(&aws.Config{
+		Region:           aws.String("eu-central-1"),
+		Endpoint:         aws.String(s3Server.URL),
+		S3ForcePathStyle: aws.Bool(true),
+		Credentials:      credentials.NewStaticCredentials("access", "secret", ""),
+	})))
+	bucketName := "test-bucket"
+	driver := newTracingDriver(&S3Driver{
+		featureFlags: featureList,
+		s3:           client,
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+	}, LogTracer{}, client)
+
+	if _, err := driver.Stat("file"); err != nil {
+		t.Fatalf("Stat failed: %s", err)
+	}
+	finished := map[string]logrus.Fields{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.DebugLevel && strings.HasPrefix(entry.Message, "Finished ") {
+			finished[fmt.Sprint(entry.Data["operation"])] = entry.Data
+		}
+	}
+	head, stat := finished["s3.HeadObject"], finished["Stat"]
+	if head == nil || stat == nil {
+		t.Fatalf("Expected Stat and its HeadObject request to be logged but were %v", finished)
+	}
+	if head["request_id"] != "request-1" || head["parent"] != "Stat" || head["key"] != "file" || head["retries"] != 0 {
+		t.Errorf("Unexpected log fields of HeadObject: %v", head)
+	}
+	if _, ok := head["bytes"]; ok {
+		t.Errorf("Expected no bytes of HEAD requests but were %v", head["bytes"])
+	}
+	if duration, ok := stat["duration_ms"].(float64); !ok || duration < 0 || stat["bucket"] != bucketName {
+		t.Errorf("Unexpected log fields of Stat: %v", stat)
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// transfers counts the active transfers of all FTP connections.
+type transfers struct {
+	lock   sync.Mutex
+	active int
+	done   chan struct{}
+	// ctx is the context of all uploads, cancelled by abort
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newTransfers() *transfers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &transfers{done: make(chan struct{}), ctx: ctx, cancel: cancel}
+}
+
+// context returns the context of uploads which is cancelled by abort.
+func (t *transfers) context() context.Context {
+	if t == nil {
+		return context.Background()
+	}
+	return t.ctx
+}
+
+// abort cancels all active uploads.
+func (t *transfers) abort() {
+	if t == nil {
+		return
+	}
+	t.cancel()
+}
+
+// begin registers a new active transfer.
+func (t *transfers) begin() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.active++
+	t.lock.Unlock()
+}
+
+// end unregisters a finished transfer.
+func (t *transfers) end() {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	t.active--
+	if t.active == 0 {
+		// wake up all waiting calls
+		close(t.done)
+		t.done = make(chan struct{})
+	}
+	t.lock.Unlock()
+}
+
+// wait waits up to `timeout` for all active transfers to finish.
+// It returns the number of transfers which finished and which are still active.
+func (t *transfers) wait(timeout time.Duration) (int, int) {
+	t.lock.Lock()
+	active, done := t.active, t.done
+	t.lock.Unlock()
+	if active == 0 {
+		return 0, 0
+	}
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.active > active {
+		// transfers which started in the meantime are not counted
+		return 0, t.active
+	}
+	return active - t.active, t.active
+}
+
+// transferReader calls `end` when it is closed to finish its transfer.
+type transferReader struct {
+	io.ReadCloser
+	end  func()
+	once sync.Once
+}
+
+// Close closes the underlying reader and finishes the transfer.
+func (r *transferReader) Close() error {
+	r.once.Do(r.end)
+	return r.ReadCloser.Close()
+}
+
+// activityReader calls `active` for every read, e.g. to keep a connection alive while data is received.
+type activityReader struct {
+	io.Reader
+	active func()
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	r.active()
+	return r.Reader.Read(p)
+}
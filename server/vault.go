@@ -0,0 +1,269 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// VaultScheme prefixes references to fields of secrets of HashiCorp Vault which are given instead of credentials,
+	// e.g. `vault://secret/data/f3/s3/credentials` for the field `credentials` of the secret `secret/data/f3/s3`.
+	VaultScheme = "vault://"
+	// DefaultVaultCacheTTL is the default time values read from Vault are cached.
+	DefaultVaultCacheTTL = 5 * time.Minute
+	// DefaultVaultKubernetesMount is the default path of the Kubernetes auth method of Vault.
+	DefaultVaultKubernetesMount = "kubernetes"
+	// DefaultVaultKubernetesTokenFile is the default path of the service account token used to log in to Vault.
+	DefaultVaultKubernetesTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// VaultConfig configures the access to HashiCorp Vault.
+type VaultConfig struct {
+	// Addr is the URL of Vault, e.g. `https://vault.example.com:8200`.
+	Addr string
+	// Token is used to authenticate, the Kubernetes auth method is used instead if empty.
+	Token string
+	// KubernetesRole is the role of the Kubernetes auth method.
+	KubernetesRole string
+	// KubernetesMount is the path of the Kubernetes auth method, DefaultVaultKubernetesMount if empty.
+	KubernetesMount string
+	// KubernetesTokenFile is the service account token of the Kubernetes auth method, DefaultVaultKubernetesTokenFile if empty.
+	KubernetesTokenFile string
+	// CacheTTL is the time values are cached, DefaultVaultCacheTTL if 0. Values with shorter leases are read again before they expire.
+	CacheTTL time.Duration
+	// Logger is used for all log messages of the client, the global logger of logrus if nil.
+	Logger logrus.FieldLogger
+}
+
+// VaultClient reads fields of secrets of HashiCorp Vault with its HTTP API, both of KV version 1 and 2.
+type VaultClient struct {
+	config     VaultConfig
+	httpClient *http.Client
+	now        func() time.Time
+	lock       sync.Mutex
+	token      string
+	// tokenRenewal is the time the Kubernetes auth method is used again, before the token expires, never if zero
+	tokenRenewal time.Time
+	cache        map[string]vaultValue
+}
+
+// vaultValue is a cached field of a secret.
+type vaultValue struct {
+	value   string
+	refresh time.Time
+}
+
+// IsVaultURI returns true if `value` refers to a field of a secret of HashiCorp Vault.
+func IsVaultURI(value string) bool {
+	return strings.HasPrefix(value, VaultScheme)
+}
+
+// NewVaultClient returns a VaultClient which authenticates either with the token or the Kubernetes role of `config`.
+func NewVaultClient(config VaultConfig) (*VaultClient, error) {
+	addr, err := url.Parse(config.Addr)
+	if err != nil || (addr.Scheme != "http" && addr.Scheme != "https") || addr.Host == "" {
+		return nil, fmt.Errorf("Invalid Vault address %q, expected e.g. https://vault.example.com:8200", config.Addr)
+	}
+	config.Addr = strings.TrimSuffix(config.Addr, "/")
+	switch {
+	case config.Token != "" && config.KubernetesRole != "":
+		return nil, fmt.Errorf("Either a Vault token or a Kubernetes role can be given, but not both")
+	case config.Token == "" && config.KubernetesRole == "":
+		return nil, fmt.Errorf("Vault requires a token or a Kubernetes role")
+	}
+	if config.KubernetesMount == "" {
+		config.KubernetesMount = DefaultVaultKubernetesMount
+	}
+	if config.KubernetesTokenFile == "" {
+		config.KubernetesTokenFile = DefaultVaultKubernetesTokenFile
+	}
+	if config.CacheTTL < 0 {
+		return nil, fmt.Errorf("Invalid Vault cache TTL %s, must not be negative", config.CacheTTL)
+	}
+	if config.CacheTTL == 0 {
+		config.CacheTTL = DefaultVaultCacheTTL
+	}
+	return &VaultClient{
+		config:     config,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		now:        time.Now,
+		token:      config.Token,
+		cache:      make(map[string]vaultValue),
+	}, nil
+}
+
+// log returns the logger of the client, the global logger of logrus if none is configured.
+func (c *VaultClient) log() logrus.FieldLogger {
+	return orStandardLogger(c.config.Logger)
+}
+
+// CacheTTL returns the time values are cached.
+func (c *VaultClient) CacheTTL() time.Duration {
+	return c.config.CacheTTL
+}
+
+// Read returns the field of the secret `uri` like `vault://secret/data/f3/s3/credentials` and the time it is read again.
+// The field of secrets of KV version 2 is read from the latest version.
+func (c *VaultClient) Read(uri string) (string, time.Time, error) {
+	secretPath, field := path.Split(strings.Trim(strings.TrimPrefix(uri, VaultScheme), "/"))
+	secretPath = strings.Trim(secretPath, "/")
+	if secretPath == "" || field == "" {
+		return "", time.Time{}, fmt.Errorf("Invalid Vault reference %q, expected e.g. vault://secret/data/f3/credentials", uri)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	if cached, ok := c.cache[uri]; ok && now.Before(cached.refresh) {
+		return cached.value, cached.refresh, nil
+	}
+
+	var secret struct {
+		LeaseDuration int                    `json:"lease_duration"`
+		Data          map[string]interface{} `json:"data"`
+	}
+	if err := c.request(http.MethodGet, secretPath, nil, &secret); err != nil {
+		return "", time.Time{}, errors.Wrapf(err, "Failed to read Vault secret %q", secretPath)
+	}
+	data := secret.Data
+	// KV version 2 nests the fields with the metadata of the version
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", time.Time{}, fmt.Errorf("Vault secret %q has no string field %q", secretPath, field)
+	}
+	refresh := now.Add(c.config.CacheTTL)
+	if lease := time.Duration(secret.LeaseDuration) * time.Second; lease > 0 && lease*2/3 < c.config.CacheTTL {
+		refresh = now.Add(lease * 2 / 3)
+	}
+	c.cache[uri] = vaultValue{value: value, refresh: refresh}
+	return value, refresh, nil
+}
+
+// request sends a request to the API path `apiPath` with the JSON body `body` and decodes the JSON response into `result`.
+// A token of the Kubernetes auth method is requested before the first request and renewed before it expires, c.lock must be held.
+func (c *VaultClient) request(method, apiPath string, body interface{}, result interface{}) error {
+	if c.config.KubernetesRole != "" && (c.token == "" || (!c.tokenRenewal.IsZero() && !c.now().Before(c.tokenRenewal))) {
+		if err := c.login(); err != nil {
+			return err
+		}
+	}
+	return c.send(method, apiPath, body, result)
+}
+
+// login requests a token with the Kubernetes auth method, c.lock must be held.
+func (c *VaultClient) login() error {
+	jwt, err := ioutil.ReadFile(c.config.KubernetesTokenFile)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to read Kubernetes service account token %q", c.config.KubernetesTokenFile)
+	}
+	var response struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	loginPath := path.Join("auth", c.config.KubernetesMount, "login")
+	body := map[string]string{"role": c.config.KubernetesRole, "jwt": strings.TrimSpace(string(jwt))}
+	if err := c.send(http.MethodPost, loginPath, body, &response); err != nil {
+		return errors.Wrapf(err, "Failed to log in to Vault as Kubernetes role %q", c.config.KubernetesRole)
+	}
+	if response.Auth.ClientToken == "" {
+		return fmt.Errorf("Vault login as Kubernetes role %q returned no token", c.config.KubernetesRole)
+	}
+	c.token = response.Auth.ClientToken
+	c.tokenRenewal = time.Time{}
+	if lease := time.Duration(response.Auth.LeaseDuration) * time.Second; lease > 0 {
+		c.tokenRenewal = c.now().Add(lease * 2 / 3)
+	}
+	c.log().Debugf("Logged in to Vault as Kubernetes role %q, token lease %ds", c.config.KubernetesRole, response.Auth.LeaseDuration)
+	return nil
+}
+
+// send sends a request to the API path `apiPath` with the current token.
+func (c *VaultClient) send(method, apiPath string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, c.config.Addr+"/v1/"+apiPath, reader)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(resp.Body).Decode(&vaultErr)
+		return fmt.Errorf("Vault responded with %s: %s", resp.Status, strings.Join(vaultErr.Errors, ", "))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// vaultProvider provides s3 credentials in the format `access_key:secret_key[:session_token]` from a field of a secret of Vault,
+// they expire when the field is read again.
+// Implements credentials.Provider.
+type vaultProvider struct {
+	credentials.Expiry
+	client *VaultClient
+	uri    string
+}
+
+// Retrieve reads the credentials from Vault.
+func (p *vaultProvider) Retrieve() (credentials.Value, error) {
+	value, refresh, err := p.client.Read(p.uri)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	creds, err := parseStaticCredentials(value)
+	if err != nil {
+		return credentials.Value{}, errors.Wrapf(err, "Vault secret %q is malformed", p.uri)
+	}
+	p.SetExpiration(refresh, 0)
+	credsValue, err := creds.Get()
+	credsValue.ProviderName = "VaultProvider"
+	return credsValue, err
+}
+
+// AuthenticatorFromVault returns an Authenticator with the credentials of the field of a secret of Vault `uri`,
+// whose value is formatted like credentials files.
+func AuthenticatorFromVault(client *VaultClient, uri string) (Authenticator, error) {
+	value, _, err := client.Read(uri)
+	if err != nil {
+		return Authenticator{}, err
+	}
+	auth, err := AuthenticatorFromString(value)
+	if err != nil {
+		return auth, errors.Wrapf(err, "Vault secret %q is malformed", uri)
+	}
+	return auth, nil
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// newVaultMock returns a Vault server with the KV version 1 secret `kv/f3` and the KV version 2 secret `secret/data/f3`,
+// which accepts the token `root` and issues the token `k8s` to the Kubernetes role `f3` with the service account token `jwt`.
+func newVaultMock(reads, logins *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/auth/kubernetes/login" {
+			var login map[string]string
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["role"] != "f3" || login["jwt"] != "jwt" {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"errors": ["permission denied"]}`))
+				return
+			}
+			atomic.AddInt32(logins, 1)
+			w.Write([]byte(`{"auth": {"client_token": "k8s", "lease_duration": 3600}}`))
+			return
+		}
+		if token := r.Header.Get("X-Vault-Token"); token != "root" && token != "k8s" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors": ["permission denied"]}`))
+			return
+		}
+		atomic.AddInt32(reads, 1)
+		switch r.URL.Path {
+		case "/v1/kv/f3":
+			w.Write([]byte(`{"lease_duration": 60, "data": {"s3": "access:secret", "users": "alice:secret:ls,get\nbob:secret", "invalid": "access-only"}}`))
+		case "/v1/secret/data/f3":
+			w.Write([]byte(`{"lease_duration": 0, "data": {"data": {"s3": "access:secret:token", "count": 1}, "metadata": {"version": 3}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors": []}`))
+		}
+	}))
+}
+
+func TestVaultClient(t *testing.T) {
+	var reads, logins int32
+	vault := newVaultMock(&reads, &logins)
+	defer vault.Close()
+
+	client, err := NewVaultClient(VaultConfig{Addr: vault.URL, Token: "root", CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatalf("Creating the Vault client failed: %s", err)
+	}
+	now := time.Now()
+	client.now = func() time.Time { return now }
+
+	tCases := []struct {
+		uri        string
+		value      string
+		refresh    time.Duration
+		shouldFail bool
+	}{
+		{"vault://kv/f3/s3", "access:secret", 40 * time.Second, false},
+		{"vault://secret/data/f3/s3", "access:secret:token", time.Minute, false},
+		{"vault://secret/data/f3/count", "", 0, true},
+		{"vault://secret/data/f3/missing", "", 0, true},
+		{"vault://secret/data/other/s3", "", 0, true},
+		{"vault://s3", "", 0, true},
+	}
+	for _, tCase := range tCases {
+		value, refresh, err := client.Read(tCase.uri)
+		if (err != nil) != tCase.shouldFail {
+			t.Errorf("Test %s: expected failure %v but was %v", tCase.uri, tCase.shouldFail, err)
+			continue
+		}
+		if err == nil && (value != tCase.value || !refresh.Equal(now.Add(tCase.refresh))) {
+			t.Errorf("Test %s: expected %q refreshed after %s but was %q refreshed at %s", tCase.uri, tCase.value, tCase.refresh, value, refresh)
+		}
+	}
+
+	// values are cached until they are refreshed before their lease expires
+	reads = 0
+	client.Read("vault://kv/f3/s3")
+	client.Read("vault://secret/data/f3/s3")
+	now = now.Add(45 * time.Second)
+	client.Read("vault://kv/f3/s3")
+	client.Read("vault://secret/data/f3/s3")
+	if reads != 1 {
+		t.Errorf("Expected the value with the shorter lease to be read again but were %d reads", reads)
+	}
+
+	auth, err := AuthenticatorFromVault(client, "vault://kv/f3/users")
+	if err != nil {
+		t.Fatalf("Reading users from Vault failed: %s", err)
+	}
+	if valid, _ := auth.CheckPasswd("alice", "secret"); !valid {
+		t.Error("Login of alice failed")
+	}
+	if _, err := AuthenticatorFromVault(client, "vault://kv/f3/missing"); err == nil {
+		t.Error("Reading users from a missing field succeeded")
+	}
+
+	// the credentials expire when the value is read again
+	creds := credentials.NewCredentials(&vaultProvider{client: client, uri: "vault://kv/f3/s3"})
+	if value, err := creds.Get(); err != nil || value.AccessKeyID != "access" || value.SecretAccessKey != "secret" {
+		t.Errorf("Expected the credentials of Vault but were %#v: %v", value, err)
+	}
+	if expiresAt, err := creds.ExpiresAt(); err != nil || !expiresAt.Equal(now.Add(40*time.Second)) {
+		t.Errorf("Expected the credentials to expire after 40s but was %s: %v", expiresAt, err)
+	}
+	if _, err := credentials.NewCredentials(&vaultProvider{client: client, uri: "vault://kv/f3/invalid"}).Get(); err == nil {
+		t.Error("Reading malformed credentials from Vault succeeded")
+	}
+}
+
+func TestVaultKubernetesAuth(t *testing.T) {
+	var reads, logins int32
+	vault := newVaultMock(&reads, &logins)
+	defer vault.Close()
+	tokenFile, err := ioutil.TempFile("", "f3-vault-jwt")
+	if err != nil {
+		t.Fatalf("Failed to create token file: %s", err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("jwt\n")
+	tokenFile.Close()
+
+	client, err := NewVaultClient(VaultConfig{Addr: vault.URL + "/", KubernetesRole: "f3", KubernetesTokenFile: tokenFile.Name(), CacheTTL: time.Second})
+	if err != nil {
+		t.Fatalf("Creating the Vault client failed: %s", err)
+	}
+	now := time.Now()
+	client.now = func() time.Time { return now }
+	for i := 0; i < 3; i++ {
+		if value, _, err := client.Read("vault://kv/f3/s3"); err != nil || value != "access:secret" {
+			t.Fatalf("Expected the value of the secret but was %q: %v", value, err)
+		}
+		now = now.Add(30 * time.Minute)
+	}
+	// the token with a lease of an hour is renewed after 40 minutes
+	if logins != 2 || reads != 3 {
+		t.Errorf("Expected 2 logins and 3 reads but were %d and %d", logins, reads)
+	}
+
+	client, _ = NewVaultClient(VaultConfig{Addr: vault.URL, KubernetesRole: "other", KubernetesTokenFile: tokenFile.Name()})
+	if _, _, err := client.Read("vault://kv/f3/s3"); err == nil {
+		t.Error("Reading with a rejected Kubernetes role succeeded")
+	}
+
+	for _, config := range []VaultConfig{
+		{Addr: "", Token: "root"},
+		{Addr: "vault.example.com:8200", Token: "root"},
+		{Addr: vault.URL},
+		{Addr: vault.URL, Token: "root", KubernetesRole: "f3"},
+		{Addr: vault.URL, Token: "root", CacheTTL: -time.Second},
+	} {
+		if _, err := NewVaultClient(config); err == nil {
+			t.Errorf("Creating a Vault client with %#v succeeded", config)
+		}
+	}
+}
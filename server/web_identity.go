@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+)
+
+// webIdentityExpiryWindow is the time before their expiration at which credentials are renewed.
+const webIdentityExpiryWindow = time.Minute
+
+// webIdentityRoleAssumer exchanges web identity tokens for role credentials.
+// Implemented by *sts.STS.
+type webIdentityRoleAssumer interface {
+	AssumeRoleWithWebIdentity(input *sts.AssumeRoleWithWebIdentityInput) (*sts.AssumeRoleWithWebIdentityOutput, error)
+}
+
+// webIdentityProvider retrieves credentials of a role by exchanging the web identity token stored in a file,
+// e.g. the service account token of a pod on EKS.
+// The token file is read again on every renewal because it is rotated by the platform.
+type webIdentityProvider struct {
+	credentials.Expiry
+	client      webIdentityRoleAssumer
+	roleARN     string
+	sessionName string
+	tokenFile   string
+}
+
+// newWebIdentityCredentials returns credentials of the role `roleARN` which are renewed before they expire.
+func newWebIdentityCredentials(client webIdentityRoleAssumer, roleARN, sessionName, tokenFile string) *credentials.Credentials {
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("f3-%d", time.Now().UnixNano())
+	}
+	return credentials.NewCredentials(&webIdentityProvider{
+		client:      client,
+		roleARN:     roleARN,
+		sessionName: sessionName,
+		tokenFile:   tokenFile,
+	})
+}
+
+// Retrieve assumes the role with the current web identity token.
+// Implements https://godoc.org/github.com/aws/aws-sdk-go/aws/credentials#Provider
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, errors.Wrapf(err, "Failed to read web identity token file %q", p.tokenFile)
+	}
+
+	resp, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return credentials.Value{}, errors.Wrapf(err, "Failed to assume role %q with web identity", p.roleARN)
+	}
+
+	p.SetExpiration(aws.TimeValue(resp.Credentials.Expiration), webIdentityExpiryWindow)
+	return credentials.Value{
+		AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+		SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+		SessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// webhookWorkers is the number of notifications which are sent in parallel.
+	webhookWorkers = 4
+	// webhookQueueSize is the number of pending notifications, further notifications are dropped.
+	webhookQueueSize = 1000
+	// webhookAttempts is the number of attempts to send a notification.
+	webhookAttempts = 3
+	// webhookTimeout limits each attempt to send a notification.
+	webhookTimeout = 10 * time.Second
+	// webhookCloseTimeout is the time pending notifications get to be sent on shutdown.
+	webhookCloseTimeout = 30 * time.Second
+)
+
+// UploadNotification is the JSON payload POSTed to the upload webhook after a file was uploaded.
+type UploadNotification struct {
+	Bucket      string    `json:"bucket"`
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	User        string    `json:"user"`
+	Time        time.Time `json:"time"`
+}
+
+// webhook sends upload notifications in the background, so that FTP replies are not delayed by the receiver.
+type webhook struct {
+	url     string
+	client  *http.Client
+	backoff time.Duration
+	queue   chan UploadNotification
+	workers sync.WaitGroup
+	// lock guards closing the queue against concurrent notifications
+	lock   sync.RWMutex
+	closed bool
+	logger logrus.FieldLogger
+}
+
+// newWebhook returns a webhook POSTing notifications to `webhookURL`, or nil if the URL is empty.
+func newWebhook(webhookURL string, client *http.Client, logger logrus.FieldLogger) (*webhook, error) {
+	if webhookURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid webhook URL %q, must be an http or https URL", webhookURL)
+	}
+	httpClient := *client
+	httpClient.Timeout = webhookTimeout
+	w := &webhook{
+		url:     webhookURL,
+		client:  &httpClient,
+		backoff: time.Second,
+		queue:   make(chan UploadNotification, webhookQueueSize),
+		logger:  logger,
+	}
+	for i := 0; i < webhookWorkers; i++ {
+		w.workers.Add(1)
+		go func() {
+			defer w.workers.Done()
+			for notification := range w.queue {
+				if err := w.send(notification); err != nil {
+					w.logger.WithFields(logrus.Fields{"key": notification.Key, "action": "PUT", "error": err}).Errorf("Failed to notify webhook about %q: %s", notification.Key, err)
+				}
+			}
+		}()
+	}
+	return w, nil
+}
+
+// notify queues `notification` to be sent, it is dropped if too many notifications are pending.
+func (w *webhook) notify(notification UploadNotification) {
+	if w == nil {
+		return
+	}
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		w.logger.WithFields(logrus.Fields{"key": notification.Key, "action": "PUT"}).Warnf("Dropped webhook notification about %q after shutdown", notification.Key)
+		return
+	}
+	select {
+	case w.queue <- notification:
+	default:
+		w.logger.WithFields(logrus.Fields{"key": notification.Key, "action": "PUT"}).Warnf("Dropped webhook notification about %q, %d notifications are pending", notification.Key, webhookQueueSize)
+	}
+}
+
+// send POSTs `notification`, failed attempts are retried with exponential backoff unless the receiver rejected it.
+func (w *webhook) send(notification UploadNotification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	backoff := w.backoff
+	for attempt := 1; ; attempt++ {
+		retry := false
+		resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(payload))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("webhook replied with %s", resp.Status)
+			retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		} else {
+			retry = true
+		}
+		if !retry || attempt == webhookAttempts {
+			return errors.Wrapf(err, "Failed to send notification after %d attempts", attempt)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// close waits up to `timeout` for the pending notifications to be sent.
+func (w *webhook) close(timeout time.Duration) error {
+	if w == nil {
+		return nil
+	}
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("%d webhook notifications were not sent within %s", len(w.queue), timeout)
+	}
+}
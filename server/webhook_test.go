@@ -0,0 +1,121 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// webhookReceiverMock replies to notifications with the given status codes, the last one is repeated.
+type webhookReceiverMock struct {
+	lock          sync.Mutex
+	statusCodes   []int
+	notifications []UploadNotification
+}
+
+func (m *webhookReceiverMock) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	notification := UploadNotification{}
+	if err := json.NewDecoder(r.Body).Decode(&notification); err != nil || r.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	m.notifications = append(m.notifications, notification)
+	statusCode := m.statusCodes[0]
+	if len(m.statusCodes) > 1 {
+		m.statusCodes = m.statusCodes[1:]
+	}
+	w.WriteHeader(statusCode)
+}
+
+func (m *webhookReceiverMock) received() []UploadNotification {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]UploadNotification{}, m.notifications...)
+}
+
+func TestUploadWebhook(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	receiver := &webhookReceiverMock{statusCodes: []int{http.StatusServiceUnavailable, http.StatusNoContent}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	hook, err := newWebhook(server.URL, http.DefaultClient, logrus.StandardLogger())
+	if err != nil {
+		t.Fatalf("Creating the webhook failed: %s", err)
+	}
+	hook.backoff = time.Millisecond
+
+	bucketName := "test-bucket"
+	bucketMock := newBucketMock(bucketName)
+	driver := &S3Driver{
+		featureFlags: featurePut,
+		s3:           &s3Mock{bucket: bucketMock},
+		uploader:     &s3UploaderMock{bucket: bucketMock},
+		metrics:      metricsSenderMock{},
+		bucketName:   bucketName,
+		bucketURL:    intoURL(fmt.Sprintf("https://%s.my.s3.host.com", bucketName)),
+		keyPrefix:    "ftp",
+		conn:         loginUserMock("alice"),
+		webhook:      hook,
+	}
+	if _, err := driver.PutFile("/report.pdf", strings.NewReader("data"), false); err != nil {
+		t.Fatalf("PutFile failed: %s", err)
+	}
+	if err := hook.close(5 * time.Second); err != nil {
+		t.Fatalf("Closing the webhook failed: %s", err)
+	}
+	// notifications after shutdown are dropped
+	hook.notify(UploadNotification{Key: "late"})
+
+	notifications := receiver.received()
+	if len(notifications) != 2 {
+		t.Fatalf("Expected the notification to be retried once but was sent %d times", len(notifications))
+	}
+	notification := notifications[1]
+	if notification.Time.IsZero() {
+		t.Errorf("Expected the time of the upload")
+	}
+	notification.Time = time.Time{}
+	expected := UploadNotification{Bucket: bucketName, Key: "ftp/report.pdf", Size: 4, ContentType: "application/pdf", User: "alice"}
+	if notification != expected {
+		t.Errorf("Expected notification %+v but was %+v", expected, notification)
+	}
+}
+
+func TestUploadWebhookRejected(t *testing.T) {
+	receiver := &webhookReceiverMock{statusCodes: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	hook, err := newWebhook(server.URL, http.DefaultClient, logrus.StandardLogger())
+	if err != nil {
+		t.Fatalf("Creating the webhook failed: %s", err)
+	}
+	hook.backoff = time.Millisecond
+
+	if err := hook.send(UploadNotification{Key: "file"}); err == nil {
+		t.Errorf("Expected the rejected notification to fail")
+	}
+	if sent := len(receiver.received()); sent != 1 {
+		t.Errorf("Expected rejected notifications not to be retried but was sent %d times", sent)
+	}
+	hook.close(time.Second)
+}
+
+func TestNewWebhook(t *testing.T) {
+	if hook, err := newWebhook("", http.DefaultClient, logrus.StandardLogger()); hook != nil || err != nil {
+		t.Errorf("Expected no webhook without URL but was %v: %v", hook, err)
+	}
+	for _, invalid := range []string{"ftp://example.com/hook", "/hook", "http://"} {
+		if _, err := newWebhook(invalid, http.DefaultClient, logrus.StandardLogger()); err == nil {
+			t.Errorf("Expected %q to be invalid", invalid)
+		}
+	}
+}
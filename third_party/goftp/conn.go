@@ -0,0 +1,394 @@
+// Copyright 2018 The goftp Authors. All rights reserved.
+// Use of this source code is governed by a MIT-style
+// license that can be found in the LICENSE file.
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultWelcomeMessage = "Welcome to the Go FTP Server"
+)
+
+type Conn struct {
+	conn          net.Conn
+	controlReader *bufio.Reader
+	controlWriter *bufio.Writer
+	dataConn      DataSocket
+	driver        Driver
+	auth          Auth
+	logger        Logger
+	server        *Server
+	tlsConfig     *tls.Config
+	sessionID     string
+	namePrefix    string
+	reqUser       string
+	user          string
+	renameFrom    string
+	lastFilePos   int64
+	appendData    bool
+	closed        bool
+	tls           bool
+	ctx           context.Context
+	cancel        context.CancelFunc
+	// lock guards closed and dataConn, Close may be called concurrently with
+	// the commands, e.g. by an idle timer of the driver
+	lock sync.Mutex
+}
+
+func (conn *Conn) LoginUser() string {
+	return conn.user
+}
+
+// Context returns a context which is cancelled when this connection is
+// closed, e.g. to cancel the operations of its driver after the client
+// disconnected.
+func (conn *Conn) Context() context.Context {
+	if conn.ctx == nil {
+		return context.Background()
+	}
+	return conn.ctx
+}
+
+// SessionID returns the unique id of this connection, e.g. for logging.
+func (conn *Conn) SessionID() string {
+	return conn.sessionID
+}
+
+// RemoteAddr returns the address of the client of this connection, nil if
+// it is not connected.
+func (conn *Conn) RemoteAddr() net.Addr {
+	if conn.conn == nil {
+		return nil
+	}
+	return conn.conn.RemoteAddr()
+}
+
+// Driver returns the driver of this connection.
+func (conn *Conn) Driver() Driver {
+	return conn.driver
+}
+
+func (conn *Conn) IsLogin() bool {
+	return len(conn.user) > 0
+}
+
+// TLSConnectionState returns the state of the TLS control connection, false
+// if the control connection does not use TLS.
+func (conn *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := conn.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+func (conn *Conn) PublicIp() string {
+	return conn.server.PublicIp
+}
+
+func (conn *Conn) passiveListenIP() string {
+	var listenIP string
+	if len(conn.PublicIp()) > 0 {
+		listenIP = conn.PublicIp()
+	} else {
+		listenIP = conn.conn.LocalAddr().(*net.TCPAddr).IP.String()
+	}
+
+	lastIdx := strings.LastIndex(listenIP, ":")
+	if lastIdx <= 0 {
+		return listenIP
+	}
+	return listenIP[:lastIdx]
+}
+
+func (conn *Conn) PassivePort() int {
+	if len(conn.server.PassivePorts) > 0 {
+		portRange := strings.Split(conn.server.PassivePorts, "-")
+
+		if len(portRange) != 2 {
+			log.Println("empty port")
+			return 0
+		}
+
+		minPort, _ := strconv.Atoi(strings.TrimSpace(portRange[0]))
+		maxPort, _ := strconv.Atoi(strings.TrimSpace(portRange[1]))
+
+		return minPort + mrand.Intn(maxPort-minPort)
+	}
+	// let system automatically chose one port
+	return 0
+}
+
+// returns a random 20 char string that can be used as a unique session ID
+func newSessionID() string {
+	hash := sha256.New()
+	_, err := io.CopyN(hash, rand.Reader, 50)
+	if err != nil {
+		return "????????????????????"
+	}
+	md := hash.Sum(nil)
+	mdStr := hex.EncodeToString(md)
+	return mdStr[0:20]
+}
+
+// Serve starts an endless loop that reads FTP commands from the client and
+// responds appropriately. terminated is a channel that will receive a true
+// message when the connection closes. This loop will be running inside a
+// goroutine, so use this channel to be notified when the connection can be
+// cleaned up.
+func (conn *Conn) Serve() {
+	conn.logger.Print(conn.sessionID, "Connection Established")
+	// send welcome
+	conn.writeMessage(220, conn.server.WelcomeMessage)
+	// read commands
+	for {
+		line, err := conn.controlReader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				conn.logger.Print(conn.sessionID, fmt.Sprint("read error:", err))
+			}
+
+			break
+		}
+		conn.receiveLine(line)
+		// QUIT command closes connection, break to avoid error on reading from
+		// closed socket
+		if conn.isClosed() {
+			break
+		}
+	}
+	conn.Close()
+	conn.logger.Print(conn.sessionID, "Connection Terminated")
+}
+
+// Close will manually close this connection, even if the client isn't ready.
+// It is safe to call it concurrently with the commands of the connection.
+func (conn *Conn) Close() {
+	conn.conn.Close()
+	conn.lock.Lock()
+	conn.closed = true
+	conn.lock.Unlock()
+	if conn.cancel != nil {
+		conn.cancel()
+	}
+	conn.closeDataSocket()
+}
+
+// isClosed returns true if the connection was closed.
+func (conn *Conn) isClosed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.closed
+}
+
+// dataSocket returns the currently open data socket, nil if there is none.
+func (conn *Conn) dataSocket() DataSocket {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.dataConn
+}
+
+// setDataSocket sets the currently open data socket, it is closed right away
+// if the connection was closed.
+func (conn *Conn) setDataSocket(socket DataSocket) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.closed {
+		socket.Close()
+		return
+	}
+	conn.dataConn = socket
+}
+
+// closeDataSocket closes the currently open data socket if there is one.
+func (conn *Conn) closeDataSocket() {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.dataConn != nil {
+		conn.dataConn.Close()
+		conn.dataConn = nil
+	}
+}
+
+func (conn *Conn) upgradeToTLS() error {
+	conn.logger.Print(conn.sessionID, "Upgrading connectiion to TLS")
+	tlsConn := tls.Server(conn.conn, conn.tlsConfig)
+	err := tlsConn.Handshake()
+	if err == nil {
+		conn.conn = tlsConn
+		conn.controlReader = bufio.NewReader(tlsConn)
+		conn.controlWriter = bufio.NewWriter(tlsConn)
+		conn.tls = true
+	}
+	return err
+}
+
+// receiveLine accepts a single line FTP command and co-ordinates an
+// appropriate response.
+func (conn *Conn) receiveLine(line string) {
+	command, param := conn.parseLine(line)
+	conn.logger.PrintCommand(conn.sessionID, command, param)
+	cmdObj := conn.server.command(strings.ToUpper(command))
+	if cmdObj == nil {
+		conn.writeMessage(500, "Command not found")
+		return
+	}
+	if cmdObj.RequireParam() && param == "" {
+		conn.writeMessage(553, "action aborted, required param missing")
+	} else if cmdObj.RequireAuth() && conn.user == "" {
+		conn.writeMessage(530, "not logged in")
+	} else {
+		cmdObj.Execute(conn, param)
+	}
+}
+
+func (conn *Conn) parseLine(line string) (string, string) {
+	params := strings.SplitN(strings.Trim(line, "\r\n"), " ", 2)
+	if len(params) == 1 {
+		return params[0], ""
+	}
+	return params[0], strings.TrimSpace(params[1])
+}
+
+// writeMessage will send a standard FTP response back to the client.
+func (conn *Conn) writeMessage(code int, message string) (wrote int, err error) {
+	conn.logger.PrintResponse(conn.sessionID, code, message)
+	line := fmt.Sprintf("%d %s\r\n", code, message)
+	wrote, err = conn.controlWriter.WriteString(line)
+	conn.controlWriter.Flush()
+	return
+}
+
+// WriteMessage sends a standard FTP response back to the client, e.g. from
+// the commands of ServerOpts.
+func (conn *Conn) WriteMessage(code int, message string) (wrote int, err error) {
+	return conn.writeMessage(code, message)
+}
+
+// WriteMessageLines sends a multiline FTP response of RFC 959 back to the
+// client, the lines between the first and the last are written as they are.
+// A single line is sent as standard response.
+func (conn *Conn) WriteMessageLines(code int, lines ...string) (wrote int, err error) {
+	last := lines[len(lines)-1]
+	conn.logger.PrintResponse(conn.sessionID, code, last)
+	var message strings.Builder
+	if len(lines) > 1 {
+		fmt.Fprintf(&message, "%d-%s\r\n", code, lines[0])
+		for _, line := range lines[1 : len(lines)-1] {
+			message.WriteString(line + "\r\n")
+		}
+	}
+	fmt.Fprintf(&message, "%d %s\r\n", code, last)
+	wrote, err = conn.controlWriter.WriteString(message.String())
+	conn.controlWriter.Flush()
+	return
+}
+
+// writeMessage will send a standard FTP response back to the client.
+func (conn *Conn) writeMessageMultiline(code int, message string) (wrote int, err error) {
+	conn.logger.PrintResponse(conn.sessionID, code, message)
+	line := fmt.Sprintf("%d-%s\r\n%d END\r\n", code, message, code)
+	wrote, err = conn.controlWriter.WriteString(line)
+	conn.controlWriter.Flush()
+	return
+}
+
+// buildPath takes a client supplied path or filename and generates a safe
+// absolute path within their account sandbox.
+//
+//	buildpath("/")
+//	=> "/"
+//	buildpath("one.txt")
+//	=> "/one.txt"
+//	buildpath("/files/two.txt")
+//	=> "/files/two.txt"
+//	buildpath("files/two.txt")
+//	=> "/files/two.txt"
+//	buildpath("/../../../../etc/passwd")
+//	=> "/etc/passwd"
+//
+// The driver implementation is responsible for deciding how to treat this path.
+// Obviously they MUST NOT just read the path off disk. The probably want to
+// prefix the path with something to scope the users access to a sandbox.
+func (conn *Conn) buildPath(filename string) (fullPath string) {
+	if len(filename) > 0 && filename[0:1] == "/" {
+		fullPath = filepath.Clean(filename)
+	} else if len(filename) > 0 && filename != "-a" {
+		fullPath = filepath.Clean(conn.namePrefix + "/" + filename)
+	} else {
+		fullPath = filepath.Clean(conn.namePrefix)
+	}
+	fullPath = strings.Replace(fullPath, "//", "/", -1)
+	fullPath = strings.Replace(fullPath, string(filepath.Separator), "/", -1)
+	return
+}
+
+// BuildPath returns the safe absolute path of a client supplied path or
+// filename like buildPath.
+func (conn *Conn) BuildPath(filename string) string {
+	return conn.buildPath(filename)
+}
+
+// DataConn returns the currently open data socket, e.g. to receive uploads
+// in the commands of ServerOpts. It is nil if the client opened none.
+func (conn *Conn) DataConn() DataSocket {
+	return conn.dataSocket()
+}
+
+// SendOutofbandData sends data to the client via the currently open data
+// socket and replies 226 like sendOutofbandData. It returns false and replies
+// nothing if the client opened no data socket.
+func (conn *Conn) SendOutofbandData(data []byte) bool {
+	if conn.dataSocket() == nil {
+		return false
+	}
+	conn.sendOutofbandData(data)
+	return true
+}
+
+// sendOutofbandData will send a string to the client via the currently open
+// data socket. Assumes the socket is open and ready to be used.
+func (conn *Conn) sendOutofbandData(data []byte) {
+	bytes := len(data)
+	if socket := conn.dataSocket(); socket != nil {
+		socket.Write(data)
+		conn.closeDataSocket()
+	}
+	message := "Closing data connection, sent " + strconv.Itoa(bytes) + " bytes"
+	conn.writeMessage(226, message)
+}
+
+func (conn *Conn) sendOutofBandDataWriter(data io.ReadCloser) error {
+	conn.lastFilePos = 0
+	socket := conn.dataSocket()
+	if socket == nil {
+		return fmt.Errorf("no data connection")
+	}
+	bytes, err := io.Copy(socket, data)
+	if err != nil {
+		conn.closeDataSocket()
+		return err
+	}
+	message := "Closing data connection, sent " + strconv.Itoa(int(bytes)) + " bytes"
+	conn.writeMessage(226, message)
+	conn.closeDataSocket()
+
+	return nil
+}